@@ -0,0 +1,111 @@
+package echo
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// accessTokenBody is the body of the access token requests
+// expires_in is in seconds, zero never expires
+type accessTokenBody struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+// GetAccessTokens responds with the access tokens of the user, without the secrets
+func (api *API) GetAccessTokens(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.AccessTokens()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"tokens": list,
+	})
+}
+
+// NoAccessToken refuses access tokens on the endpoints that manage
+// the credentials of the user, it goes after Middleware, which loads the token
+func (api *API) NoAccessToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if auth.GetAccessToken(c) != nil {
+			return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+		}
+
+		return next(c)
+	}
+}
+
+// PostAccessToken handles post requests to create a access token
+// the secret is only sent in this response
+// the required fields are: [name], optional: [scopes, expires_in]
+func (api *API) PostAccessToken(c echo.Context) error {
+	body := new(accessTokenBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	// a token can't create more tokens
+	if auth.GetAccessToken(c) != nil {
+		return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if body.ExpiresIn < 0 {
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	t, secret, err := u.CreateAccessToken(body.Name, body.Scopes, time.Duration(body.ExpiresIn)*time.Second, auth.HasMFAClaim(c))
+	if err != nil {
+		switch err.Code {
+		case errors.ErrorNotEnoughInfo, errors.ErrorInvalidScope:
+			return ErrorWithStatus(c, http.StatusBadRequest, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"token":  t,
+		"secret": secret,
+	})
+}
+
+// DeleteAccessToken handles delete requests to revoke a access token
+func (api *API) DeleteAccessToken(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	id, gErr := strconv.ParseInt(c.Param("token"), 10, 64)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	if err = u.RevokeAccessToken(id); err != nil {
+		if err.Code == errors.ErrorAccessTokenNotFound {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
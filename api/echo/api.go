@@ -103,6 +103,16 @@ func (api *API) Post(c echo.Context) error {
 
 	Logger.WithField("user", u).Debug("USER")
 
+	// the same answer is given for new and existing users,
+	// the result is sent to the user's email
+	if auth.Config.HideAccountExistence {
+		if err := u.Register(); err != nil {
+			return Error(c, err)
+		}
+
+		return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+	}
+
 	// tries to create the user
 	// it does all the work of validation
 	// and checking for existing username and email...
@@ -133,9 +143,92 @@ func (api *API) PostAuth(c echo.Context) error {
 	// and checking for invalid info...
 	token, err := u.Auth(u.Password)
 	if err != nil {
+		return authError(c, err)
+	}
+
+	return authResponse(c, u, token)
+}
+
+// authResponse responds to a login with the token or
+// the challenge of the second factor the user needs
+func authResponse(c echo.Context, u *auth.User, token string) error {
+	// a trusted device replaces the second factor
+	if u.MFAPending {
+		if cookie, cErr := c.Cookie(deviceCookie); cErr == nil {
+			full, err := auth.NewUser().AuthDevice(token, cookie.Value)
+			if err == nil {
+				u.MFAPending = false
+				return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
+					"user":  u,
+					"token": full,
+				})
+			}
+
+			// revoked or expired
+			Logger.WithError(err).Debug("[API.authResponse]: device not trusted")
+			setDeviceCookie(c, "", -1)
+		}
+	}
+
+	// the token is a challenge for PostAuthMFA
+	if u.MFAPending {
+		return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"challenge":    token,
+		})
+	}
+
+	// the power of the user needs a second factor before logging in
+	if u.MFAEnrollmentRequired {
+		return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
+			"mfa_enrollment_required": true,
+			"challenge":               token,
+		})
+	}
+
+	// returns OK with the jwt token and user's data
+	return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
+		"user":  u,
+		"token": token,
+	})
+}
+
+// PostAuthMFA handles post requests with the challenge from PostAuth
+// the required fields are: [challenge, code]
+func (api *API) PostAuthMFA(c echo.Context) error {
+	body := struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+
+		// trusts this browser so its next logins skip the second factor
+		Remember   bool   `json:"remember"`
+		DeviceName string `json:"device_name"`
+	}{}
+
+	if err := c.Bind(&body); err != nil {
 		return Error(c, err)
 	}
 
+	// checks the code from the authenticator app or a recovery code
+	u := auth.NewUser()
+	token, err := u.AuthMFA(body.Challenge, body.Code)
+	if err != nil {
+		return authError(c, err)
+	}
+
+	if body.Remember {
+		if body.DeviceName == "" {
+			body.DeviceName = c.Request().UserAgent()
+		}
+
+		device, err := u.TrustDevice(body.DeviceName)
+		if err != nil {
+			return Error(c, err)
+		}
+
+		setDeviceCookie(c, device, int(auth.Config.TrustedDeviceTime.Seconds()))
+	}
+
 	// returns OK with the jwt token and user's data
 	return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
 		"user":  u,
@@ -143,6 +236,83 @@ func (api *API) PostAuth(c echo.Context) error {
 	})
 }
 
+// authError responds with the status that fits a login error
+func authError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorAccountLocked, errors.ErrorCodeThrottled:
+		return ErrorWithStatus(c, http.StatusTooManyRequests, err)
+
+	case errors.ErrorInvalidCode, errors.ErrorInvalidChallenge:
+		return ErrorWithStatus(c, http.StatusUnauthorized, err)
+	}
+
+	return Error(c, err)
+}
+
+// findOwner finds the user of the id param
+// it must be the same user of the token
+func findOwner(c echo.Context) (*auth.User, int, *errors.Error) {
+	return findOwnerOr(c, -1)
+}
+
+// findOwnerOr finds the user of the id param like findOwner
+// but tokens with the given power can find any user
+// a negative power only allows the owner
+func findOwnerOr(c echo.Context, power auth.UserPower) (*auth.User, int, *errors.Error) {
+	id := c.Param("id")
+	if id == "" {
+		return nil, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam)
+	}
+
+	u := auth.NewUser()
+	if err := u.SetIDFromString(id); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	tid, err := auth.GetID(c)
+	if err != nil {
+		return nil, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	if tid != u.ID {
+		up, pErr := auth.GetPower(c)
+		if pErr != nil || power < 0 || up < power {
+			return nil, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized)
+		}
+	}
+
+	found, fErr := u.Find()
+	if fErr != nil {
+		return nil, http.StatusInternalServerError, fErr
+	}
+
+	if !found {
+		return nil, http.StatusNotFound, errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	return u, http.StatusOK, nil
+}
+
+// findLesserOr finds the user of the id param like findOwnerOr
+// but other users must have less power than the token too
+// the same rule of impersonation, admins can't act on other admins
+func findLesserOr(c echo.Context, power auth.UserPower) (*auth.User, int, *errors.Error) {
+	u, status, err := findOwnerOr(c, power)
+	if err != nil {
+		return nil, status, err
+	}
+
+	tid, _ := auth.GetID(c)
+	if tid != u.ID {
+		up, pErr := auth.GetPower(c)
+		if pErr != nil || auth.UserPower(u.Power) >= up {
+			return nil, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized)
+		}
+	}
+
+	return u, status, nil
+}
+
 // GetID handles get requests with a id in it
 // to return the user of the given id
 func (api *API) GetID(c echo.Context) error {
@@ -194,6 +364,12 @@ func (api *API) PutID(c echo.Context) error {
 		return Error(c, err)
 	}
 
+	// the password has its own endpoint that checks the current one
+	if u.Password != "" {
+		Logger.Debug("[API.PutID]: password in the body")
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorUseChangePassword))
+	}
+
 	// insert the id from the url into the user variable
 	err := u.SetIDFromString(id)
 	if err != nil {
@@ -201,6 +377,48 @@ func (api *API) PutID(c echo.Context) error {
 		return Error(c, err)
 	}
 
+	// users change their own account, admins any account
+	// service clients any account within their scope
+	current := auth.NewUser()
+	profileOnly := true
+
+	if auth.GetServiceClient(c) != nil {
+		current.ID = u.ID
+
+		found, err := current.Find()
+		if err != nil {
+			return Error(c, err)
+		}
+
+		if !found {
+			return ErrorWithStatus(c, http.StatusNotFound, errors.FromCode(errors.ErrorUserDoesntExists))
+		}
+
+		if auth.UserPower(current.Power) >= auth.Config.ServiceClientPower {
+			Logger.WithField("ID", current.ID).Warn("[API.PutID]: service client refused")
+			return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+		}
+	} else {
+		var status int
+		current, status, err = findOwnerOr(c, auth.UserPowerAdmin)
+		if err != nil {
+			Logger.WithError(err).Debug("[API.PutID]: not the owner")
+			return ErrorWithStatus(c, status, err)
+		}
+
+		up, pErr := auth.GetPower(c)
+		profileOnly = pErr != nil || up < auth.UserPowerAdmin
+	}
+
+	// only admins change the power or the state
+	if profileOnly {
+		current.Username = u.Username
+		current.Email = u.Email
+		current.Name = u.Name
+		current.LastName = u.LastName
+		u = current
+	}
+
 	// save the changes
 	err = u.Save()
 	if err != nil {
@@ -215,6 +433,57 @@ func (api *API) PutID(c echo.Context) error {
 	})
 }
 
+// PostPassword handles post requests to change the password of the given id
+// the required fields are: [current_password, password]
+func (api *API) PostPassword(c echo.Context) error {
+	Logger.WithField("ID", c.Param("id")).Debug("[API.PostPassword]")
+
+	body := struct {
+		Current  string `json:"current_password"`
+		Password string `json:"password"`
+	}{}
+
+	if err := c.Bind(&body); err != nil {
+		return Error(c, err)
+	}
+
+	// only the owner of the account can change its password
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	// checks the current password, the policy and revokes the old tokens
+	if err = u.ChangePassword(body.Current, body.Password); err != nil {
+		if err.Code == errors.ErrorUserInvalidPassword {
+			return ErrorWithStatus(c, http.StatusForbidden, err)
+		}
+
+		if err.Code == errors.ErrorTryAgain {
+			return Error(c, err)
+		}
+
+		return ErrorWithStatus(c, http.StatusBadRequest, err)
+	}
+
+	// a new token replaces the revoked ones
+	// keeping the second factor of the current one
+	issue := u.IssueToken
+	if auth.HasMFAClaim(c) {
+		issue = u.IssueMFAToken
+	}
+
+	token, err := issue()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"user":  u,
+		"token": token,
+	})
+}
+
 // DeleteID handles delete requests with a id in it
 // to soft delete the user of the given id
 func (api *API) DeleteID(c echo.Context) error {
@@ -234,6 +503,26 @@ func (api *API) DeleteID(c echo.Context) error {
 		return Error(c, err)
 	}
 
+	// service clients only remove users with less power than ServiceClientPower
+	if auth.GetServiceClient(c) != nil {
+		found, err := u.Find()
+		if err != nil {
+			return Error(c, err)
+		}
+
+		if !found {
+			return ErrorWithStatus(c, http.StatusNotFound, errors.FromCode(errors.ErrorUserDoesntExists))
+		}
+
+		if auth.UserPower(u.Power) >= auth.Config.ServiceClientPower {
+			Logger.WithField("ID", u.ID).Warn("[API.DeleteID]: service client refused")
+			return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+		}
+	} else if _, status, err := findOwnerOr(c, auth.UserPowerAdmin); err != nil {
+		// users remove their own account, admins any account
+		return ErrorWithStatus(c, status, err)
+	}
+
 	// apply deleted state to the user
 	if err := u.SoftDelete(); err != nil {
 		Logger.WithError(err).Error("[API.PutID]: error while deleting user")
@@ -244,28 +533,146 @@ func (api *API) DeleteID(c echo.Context) error {
 	return Success(c, nil)
 }
 
+// GetLocks handles get requests to respond with the accounts
+// locked by failed logins, it's used by moderators
+func (api *API) GetLocks(c echo.Context) error {
+	list, err := auth.FindLocked()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"locks": list,
+	})
+}
+
+// DeleteLock handles delete requests with a id in it
+// to remove the failed logins lock of the user
+func (api *API) DeleteLock(c echo.Context) error {
+	id := c.Param("id")
+	Logger.WithField("ID", id).Debug("[API.DeleteLock]")
+
+	if id == "" {
+		return Error(c, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	u := auth.NewUser()
+	if err := u.SetIDFromString(id); err != nil {
+		return Error(c, err)
+	}
+
+	if err := u.Unlock(); err != nil {
+		Logger.WithError(err).Error("[API.DeleteLock]: error while unlocking user")
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// GetHashStats responds with the state of the bcrypt worker pool
+// it's used to monitor the queue depth
+func (api *API) GetHashStats(c echo.Context) error {
+	return Success(c, map[string]interface{}{
+		"hash": auth.GetHashStats(),
+	})
+}
+
+// GetMigrationStats responds with how many users were moved from
+// the legacy auth service and how many remain there
+func (api *API) GetMigrationStats(c echo.Context) error {
+	stats, err := auth.GetMigrationStats()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"migration": stats,
+	})
+}
+
 // Middleware is a function that returns a function that returns a function that runs the function given in the first given function so the next function runs at the end of the last function
 func (api *API) Middleware(power auth.UserPower) func(echo.HandlerFunc) echo.HandlerFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			// access tokens are accepted alongside jwts
+			if err := auth.LoadAccessToken(c); err != nil {
+				Logger.WithError(err).Debug("[API.Middleware]: invalid access token")
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+			}
+
+			// parse the jwt token from the request
+			if err := auth.LoadToken(c); err != nil {
+				Logger.WithError(err).Debug("[API.Middleware]: no valid token")
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+			}
+
+			// refuse tokens issued before a password change
+			if err := auth.CheckTokenVersion(c); err != nil {
+				if e, ok := err.(*errors.Error); ok && e.Code != errors.ErrorTokenRevoked {
+					Logger.WithError(err).Error("[API.Middleware]: error while checking the token version")
+					return Error(c, e)
+				}
+
+				Logger.WithError(err).Debug("[API.Middleware]: token revoked")
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorTokenRevoked))
+			}
+
+			// admins acting as the user leave a trail of everything they do
+			if err := auth.RecordImpersonation(c); err != nil {
+				return Error(c, err)
+			}
+
 			// get user's power from the jwt token
 			up, err := auth.GetPower(c)
 			if err != nil {
-				c.Error(err)
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
 			}
 
 			// checks if the current user's power is lower than the required
 			if up < power {
-				c.Error(errors.FromCode(errors.ErrorUnauthorized))
+				return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+			}
 
-				// continue when power is equal or greater
-			} else if up >= power {
-				if err := next(c); err != nil {
-					c.Error(err)
-				}
+			// elevated powers need a token issued after a second factor
+			// access tokens carry the one of the session that created them
+			if auth.MFARequiredFor(up) && !auth.HasMFAClaim(c) {
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorMFARequired))
+			}
+
+			// read only access tokens can't change anything
+			if !auth.AccessTokenAllows(c) {
+				return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorInsufficientScope))
+			}
+
+			// continue when power is equal or greater
+			return next(c)
+		}
+	}
+}
+
+// MiddlewareScope is CertMiddleware for routes service clients can call too
+// their tokens need the scope instead of the power
+func (api *API) MiddlewareScope(power auth.UserPower, scope string) func(echo.HandlerFunc) echo.HandlerFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		users := api.CertMiddleware(power)(next)
+
+		return func(c echo.Context) error {
+			ok, err := auth.LoadServiceToken(c)
+			if err != nil {
+				Logger.WithError(err).Debug("[API.MiddlewareScope]: invalid service token")
+				return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+			}
+
+			// tokens and certificates of users
+			if !ok {
+				return users(c)
+			}
+
+			if !auth.ServiceTokenAllows(c, scope) {
+				return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorInsufficientScope))
 			}
 
-			return nil
+			return next(c)
 		}
 	}
 }
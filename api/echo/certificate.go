@@ -0,0 +1,103 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// certificateBody is the body of the certificate binding requests
+type certificateBody struct {
+	Identity string `json:"identity"`
+}
+
+// CertMiddleware is the same as Middleware but authenticates the request
+// by its client certificate first, requests without one use the jwt
+func (api *API) CertMiddleware(power auth.UserPower) func(echo.HandlerFunc) echo.HandlerFunc {
+	tokens := api.Middleware(power)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		check := tokens(next)
+
+		return func(c echo.Context) error {
+			if err := auth.LoadCertificate(c); err != nil {
+				Logger.WithError(err).Debug("[API.CertMiddleware]: no valid certificate")
+			}
+
+			return check(c)
+		}
+	}
+}
+
+// GetCertificates responds with the certificate identities bound to the user
+func (api *API) GetCertificates(c echo.Context) error {
+	u, status, err := findOwnerOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.CertificateBindings()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"certificates": list,
+	})
+}
+
+// PostCertificate handles post requests of admins binding a certificate identity to the user
+// the required fields are: [identity]
+func (api *API) PostCertificate(c echo.Context) error {
+	body := new(certificateBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findLesserOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.BindCertificate(body.Identity); err != nil {
+		switch err.Code {
+		case errors.ErrorNotEnoughInfo:
+			return ErrorWithStatus(c, http.StatusBadRequest, err)
+
+		case errors.ErrorCertificateExists:
+			return ErrorWithStatus(c, http.StatusConflict, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{})
+}
+
+// DeleteCertificate handles delete requests to unbind a certificate identity
+// the identity is given in the query: ?identity=dns:service.local
+func (api *API) DeleteCertificate(c echo.Context) error {
+	identity := c.QueryParam("identity")
+	if identity == "" {
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	u, status, err := findLesserOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.UnbindCertificate(identity); err != nil {
+		if err.Code == errors.ErrorCertificateNotFound {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
@@ -0,0 +1,82 @@
+package echo
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// deviceCookie keeps the token of a trusted device
+const deviceCookie = "trusted_device"
+
+// setDeviceCookie sets or removes, with a negative maxAge, the trusted device cookie
+func setDeviceCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     deviceCookie,
+		Value:    value,
+		Path:     "/api/v1/users/auth",
+		MaxAge:   maxAge,
+		Secure:   c.IsTLS(),
+		HttpOnly: true,
+	})
+}
+
+// GetDevices responds with the trusted devices of the user
+// admins can see the devices of any user
+func (api *API) GetDevices(c echo.Context) error {
+	u, status, err := findOwnerOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.Devices()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"devices": list,
+	})
+}
+
+// DeleteDevice handles delete requests to stop trusting a device
+// admins can revoke the devices of any user
+func (api *API) DeleteDevice(c echo.Context) error {
+	u, status, err := findOwnerOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	id, gErr := strconv.ParseInt(c.Param("device"), 10, 64)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	if err = u.RevokeDevice(id); err != nil {
+		if err.Code == errors.ErrorDeviceNotFound {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// DeleteDevices handles delete requests to stop trusting every device of the user
+func (api *API) DeleteDevices(c echo.Context) error {
+	u, status, err := findOwnerOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.RevokeDevices(); err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
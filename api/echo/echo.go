@@ -44,16 +44,133 @@ func SetAPI(ee **echo.Echo) error {
 	_users := e.Group("/api/v1/users")
 	{
 		// many
-		_users.GET("", api.Get, api.Middleware(auth.UserPowerAdmin)) // gets user list
+		_users.GET("", api.Get, api.MiddlewareScope(auth.UserPowerAdmin, auth.ServiceScopeUsersRead)) // gets user list
 
 		// single
-		_users.POST("", api.Post)          // create user
-		_users.POST("/auth", api.PostAuth) // auth user
+		_users.POST("", api.Post)                                          // create user
+		_users.POST("/auth", api.PostAuth)                                 // auth user
+		_users.POST("/auth/mfa", api.PostAuthMFA)                          // second login step
+		_users.POST("/auth/mfa/enroll", api.PostAuthEnroll)                // adds a required second factor on login
+		_users.POST("/auth/mfa/enroll/confirm", api.PostAuthEnrollConfirm) // confirms it and logs in
+		_users.POST("/auth/webauthn", api.PostAuthWebAuthn)                // starts a passkey login
+		_users.POST("/auth/webauthn/finish", api.PostAuthWebAuthnFinish)   // logs in with a passkey
+		_users.POST("/auth/link", api.PostAuthLink)                        // emails a login link
+		_users.POST("/auth/link/consume", api.PostAuthLinkConsume)         // logs in with the link
+		_users.POST("/auth/code", api.PostAuthCode)                        // emails a login code
+		_users.POST("/auth/code/verify", api.PostAuthCodeVerify)           // logs in with the code
+		_users.POST("/auth/mfa/email", api.PostAuthMFAEmail)               // emails a code for the second step
+		_users.POST("/auth/sms", api.PostAuthSMS)                          // texts a login code
+		_users.POST("/auth/sms/verify", api.PostAuthSMSVerify)             // logs in with the code
+		_users.POST("/auth/mfa/sms", api.PostAuthMFASMS)                   // texts a code for the second step
+
+		// social login
+		_users.GET("/auth/oidc/:provider", api.GetAuthOIDC)                  // redirects to the provider
+		_users.GET("/auth/oidc/:provider/callback", api.GetAuthOIDCCallback) // logs in or links the account
+
+		// saml login
+		_users.GET("/auth/saml/:provider", api.GetAuthSAML)              // sends the browser to the identity provider
+		_users.GET("/auth/saml/:provider/metadata", api.GetSAMLMetadata) // service provider metadata
+		_users.POST("/auth/saml/:provider/acs", api.PostSAMLACS)         // logs in with the response
+
+		// failed logins
+		_users.GET("/locks", api.GetLocks, api.MiddlewareScope(auth.UserPowerMod, auth.ServiceScopeUsersRead))          // locked accounts
+		_users.DELETE("/:id/lock", api.DeleteLock, api.MiddlewareScope(auth.UserPowerMod, auth.ServiceScopeUsersWrite)) // unlocks a account
+
+		// monitoring
+		_users.GET("/hash/stats", api.GetHashStats, api.MiddlewareScope(auth.UserPowerProgrammer, auth.ServiceScopeStats))           // bcrypt queue depth
+		_users.GET("/migration/stats", api.GetMigrationStats, api.MiddlewareScope(auth.UserPowerProgrammer, auth.ServiceScopeStats)) // users left in the legacy auth
 
 		// specific id
-		_users.GET("/:id", api.GetID)                                             // gets specific user
-		_users.PUT("/:id", api.PutID, api.Middleware(auth.UserPowerNormal))       // updates specific user
-		_users.DELETE("/:id", api.DeleteID, api.Middleware(auth.UserPowerNormal)) // soft deletes specific user
+		_users.GET("/:id", api.GetID)                                                                                                    // gets specific user
+		_users.PUT("/:id", api.PutID, api.MiddlewareScope(auth.UserPowerNormal, auth.ServiceScopeUsersWrite), api.NoImpersonation)       // updates specific user
+		_users.DELETE("/:id", api.DeleteID, api.MiddlewareScope(auth.UserPowerNormal, auth.ServiceScopeUsersWrite), api.NoImpersonation) // soft deletes specific user
+		_users.POST("/:id/password", api.PostPassword, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)       // changes the password
+
+		// second factor
+		_users.POST("/:id/mfa/totp", api.PostTOTP, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)                // starts adding a authenticator app
+		_users.POST("/:id/mfa/totp/confirm", api.PostTOTPConfirm, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken) // enables it with the first code
+		_users.DELETE("/:id/mfa/totp", api.DeleteTOTP, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)            // removes it
+		_users.POST("/:id/mfa/recovery", api.PostRecoveryCodes, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)   // new recovery codes
+
+		// device logins
+		_users.POST("/device", api.PostDevice, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken) // approves or denies a user code
+
+		// trusted devices
+		_users.GET("/:id/devices", api.GetDevices, api.Middleware(auth.UserPowerNone))                                   // lists them
+		_users.DELETE("/:id/devices", api.DeleteDevices, api.Middleware(auth.UserPowerNone), api.NoImpersonation)        // forgets all
+		_users.DELETE("/:id/devices/:device", api.DeleteDevice, api.Middleware(auth.UserPowerNone), api.NoImpersonation) // forgets one
+
+		// social logins
+		_users.GET("/:id/identities", api.GetIdentities, api.Middleware(auth.UserPowerNone))                                                       // lists them
+		_users.POST("/:id/identities", api.PostIdentity, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)               // starts linking one
+		_users.DELETE("/:id/identities/:identity", api.DeleteIdentity, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken) // unlinks one
+		_users.POST("/:id/identities/trusted", api.PostTrustedSubject, api.Middleware(auth.UserPowerAdmin))                                        // links a subject of a trusted issuer
+
+		// personal access tokens
+		_users.GET("/:id/tokens", api.GetAccessTokens, api.Middleware(auth.UserPowerNone))                                  // lists them
+		_users.POST("/:id/tokens", api.PostAccessToken, api.Middleware(auth.UserPowerNone), api.NoImpersonation)            // creates one
+		_users.DELETE("/:id/tokens/:token", api.DeleteAccessToken, api.Middleware(auth.UserPowerNone), api.NoImpersonation) // revokes one
+
+		// client certificates, bound by admins
+		_users.GET("/:id/certificates", api.GetCertificates, api.Middleware(auth.UserPowerAdmin))      // lists them
+		_users.POST("/:id/certificates", api.PostCertificate, api.Middleware(auth.UserPowerAdmin))     // binds one
+		_users.DELETE("/:id/certificates", api.DeleteCertificate, api.Middleware(auth.UserPowerAdmin)) // unbinds one
+
+		// phone
+		_users.POST("/:id/phone", api.PostPhone, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)              // texts a code to the new number
+		_users.POST("/:id/phone/verify", api.PostPhoneVerify, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken) // saves it with the code
+		_users.DELETE("/:id/phone", api.DeletePhone, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)          // removes it
+
+		// passkeys
+		_users.GET("/:id/webauthn", api.GetWebAuthn, api.Middleware(auth.UserPowerNone))                                                                         // lists them
+		_users.POST("/:id/webauthn/register", api.PostWebAuthnRegister, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)              // starts adding one
+		_users.POST("/:id/webauthn/register/finish", api.PostWebAuthnRegisterFinish, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken) // adds it
+		_users.DELETE("/:id/webauthn/:credential", api.DeleteWebAuthn, api.Middleware(auth.UserPowerNone), api.NoImpersonation, api.NoAccessToken)               // removes one
+
+		// impersonation, every request of its token is recorded in the events of the user
+		_users.POST("/:id/impersonate", api.PostImpersonate, api.Middleware(auth.UserPowerAdmin), api.NoImpersonation, api.NoAccessToken) // gets a token of the user
+	}
+
+	_oauth := e.Group("/api/v1/oauth")
+	{
+		_oauth.POST("/device_authorization", api.PostDeviceAuthorization) // starts a device login
+		_oauth.POST("/token", api.PostToken)                              // exchanges a grant for a token
+	}
+
+	// openid connect provider
+	{
+		_oauth.GET("/authorize", api.GetAuthorize)                                                            // sends the browser to the consent page
+		_oauth.POST("/authorize", api.PostAuthorize, api.Middleware(auth.UserPowerNone), api.NoImpersonation) // consents and issues the code
+		_oauth.GET("/userinfo", api.UserInfo)                                                                 // claims of the access token
+		_oauth.POST("/userinfo", api.UserInfo)                                                                // same, with a form
+		_oauth.GET("/jwks", api.GetJWKS)                                                                      // keys of the id tokens
+		_oauth.GET("/clients", api.GetOAuthClients, api.Middleware(auth.UserPowerAdmin))                      // lists them
+		_oauth.POST("/clients", api.PostOAuthClient, api.Middleware(auth.UserPowerAdmin))                     // registers one
+		_oauth.DELETE("/clients/:client", api.DeleteOAuthClient, api.Middleware(auth.UserPowerAdmin))         // removes one
+		e.GET("/.well-known/openid-configuration", api.GetOIDCDiscovery)                                      // provider metadata
+	}
+
+	// clients the user allowed
+	{
+		_users.GET("/:id/consents", api.GetConsents, api.Middleware(auth.UserPowerNone))                                   // lists them
+		_users.DELETE("/:id/consents/:client", api.DeleteConsent, api.Middleware(auth.UserPowerNone), api.NoImpersonation) // revokes one
+	}
+
+	// forward auth for nginx's auth_request and traefik's forwardAuth
+	{
+		e.GET("/api/v1/auth/verify", api.GetVerify) // checks the token of the proxied request
+	}
+
+	// scim 2.0 provisioning, there are no groups yet
+	_scim := e.Group("/scim/v2", api.SCIMMiddleware)
+	{
+		_scim.GET("/ServiceProviderConfig", api.GetSCIMServiceProviderConfig) // supported features
+		_scim.GET("/Users", api.GetSCIMUsers)                                 // lists and filters them
+		_scim.POST("/Users", api.PostSCIMUser)                                // provisions one
+		_scim.GET("/Users/:id", api.GetSCIMUser)                              // gets one
+		_scim.PUT("/Users/:id", api.PutSCIMUser)                              // replaces it
+		_scim.PATCH("/Users/:id", api.PatchSCIMUser)                          // changes some attributes
+		_scim.DELETE("/Users/:id", api.DeleteSCIMUser)                        // deprovisions it
 	}
 
 	return nil
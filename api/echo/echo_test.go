@@ -23,8 +23,11 @@ package echo
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	auth "github.com/UnnoTed/authenticaTed"
+
 	"github.com/gavv/httpexpect"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
@@ -36,6 +39,7 @@ const (
 
 var (
 	id     string
+	token  string
 	server *httptest.Server
 	ex     *httpexpect.Expect
 )
@@ -44,6 +48,13 @@ func insert(t *testing.T) {
 	// create httpexpect instance
 	ex = httpexpect.New(t, server.URL)
 	httpexpect.NewDebugPrinter(t, true)
+
+	// requests carry the token once logged in
+	if token != "" {
+		ex = ex.Builder(func(r *httpexpect.Request) {
+			r.WithHeader("Authorization", "Bearer "+token)
+		})
+	}
 }
 
 func TestSetup(t *testing.T) {
@@ -108,6 +119,36 @@ func TestPost(t *testing.T) {
 	id = idn.Raw()
 }
 
+func TestPostAuth(t *testing.T) {
+	insert(t)
+
+	// activate the user so it can use PUT
+	u := auth.NewUser()
+	u.Username = "gopher"
+	_, err := u.Find()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.Power = int(auth.UserPowerNormal)
+	if err = u.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := ex.POST(URL + "/auth").
+		WithJSON(map[string]interface{}{
+			"username": "gopher",
+			"password": "wood",
+		}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object()
+
+	obj.Keys().ContainsOnly("success", "user", "token")
+	token = obj.Value("token").String().Raw()
+}
+
 func TestGetMany(t *testing.T) {
 	insert(t)
 
@@ -145,6 +186,101 @@ func TestPut(t *testing.T) {
 	uobj.Value("id").String().Equal(id)      // user.id == id
 }
 
+func TestPutPassword(t *testing.T) {
+	insert(t)
+
+	// expect error: no token
+	httpexpect.New(t, server.URL).PUT(URL + "/" + id).
+		WithJSON(map[string]interface{}{
+			"username": "gophersour",
+		}).
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	// expect error: password can't be changed here
+	ex.PUT(URL + "/" + id).
+		WithJSON(map[string]interface{}{
+			"password": "plaintext",
+		}).
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func TestPutOwner(t *testing.T) {
+	u := auth.NewUser()
+	u.Username = "Put_Owner"
+	u.Email = "put_owner@mail.com"
+	u.Password = "password"
+	if _, err := u.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := auth.NewUser()
+	other.Username = "Put_Other"
+	other.Email = "put_other@mail.com"
+	other.Password = "password"
+	if _, err := other.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	bearer, err := u.IssueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := httpexpect.New(t, server.URL).Builder(func(r *httpexpect.Request) {
+		r.WithHeader("Authorization", "Bearer "+bearer)
+	})
+
+	// expect error: the account of someone else
+	owner.PUT(URL + "/" + strconv.FormatInt(int64(other.ID), 10)).
+		WithJSON(map[string]interface{}{
+			"username": "Put_Other",
+			"email":    "taken_over@mail.com",
+		}).
+		Expect().
+		Status(http.StatusForbidden)
+
+	owner.DELETE(URL + "/" + strconv.FormatInt(int64(other.ID), 10)).
+		Expect().
+		Status(http.StatusForbidden)
+
+	// ok: the profile changes, the power and state don't
+	owner.PUT(URL + "/" + strconv.FormatInt(int64(u.ID), 10)).
+		WithJSON(map[string]interface{}{
+			"username":  "Put_Owner_Changed",
+			"email":     "put_owner@mail.com",
+			"power":     int(auth.UserPowerProgrammer),
+			"deleted":   true,
+			"activated": true,
+		}).
+		Expect().
+		Status(http.StatusOK)
+
+	found := auth.NewUser()
+	found.ID = other.ID
+	if ok, err := found.Find(); err != nil || !ok || found.Deleted || found.Email != "put_other@mail.com" {
+		t.Error("the other user was changed")
+	}
+
+	found = auth.NewUser()
+	found.ID = u.ID
+	if ok, err := found.Find(); err != nil || !ok {
+		t.Fatal("the user is gone")
+	}
+
+	if found.Username != "Put_Owner_Changed" {
+		t.Error("the username wasn't changed")
+	}
+
+	if found.Power != u.Power || found.Deleted || found.Activated != u.Activated {
+		t.Error("the user changed its own power or state")
+	}
+
+	u.HardDelete()
+	other.HardDelete()
+}
+
 func TestGetSingle(t *testing.T) {
 	insert(t)
 
@@ -162,6 +298,398 @@ func TestGetSingle(t *testing.T) {
 	uobj.Value("id").String().Equal(id)       // user.id == id
 }
 
+func TestPostPassword(t *testing.T) {
+	insert(t)
+
+	path := URL + "/" + id + "/password"
+
+	// expect error: wrong current password
+	ex.POST(path).
+		WithJSON(map[string]interface{}{
+			"current_password": "wrong",
+			"password":         "woodchuck",
+		}).
+		Expect().
+		Status(http.StatusForbidden)
+
+	// expect error: too short
+	ex.POST(path).
+		WithJSON(map[string]interface{}{
+			"current_password": "wood",
+			"password":         "pass",
+		}).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// ok
+	obj := ex.POST(path).
+		WithJSON(map[string]interface{}{
+			"current_password": "wood",
+			"password":         "woodchuck",
+		}).
+		Expect().
+		Status(http.StatusOK).
+		JSON().
+		Object()
+
+	obj.Keys().ContainsOnly("success", "user", "token")
+	obj.Value("user").Object().NotContainsKey("password")
+
+	// expect error: the old token was revoked
+	ex.PUT(URL + "/" + id).
+		WithJSON(map[string]interface{}{
+			"username": "gophersour",
+		}).
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	// the new password works
+	ex.POST(URL + "/auth").
+		WithJSON(map[string]interface{}{
+			"username": "gophersour",
+			"password": "woodchuck",
+		}).
+		Expect().
+		Status(http.StatusOK)
+
+	token = obj.Value("token").String().Raw()
+}
+
+func TestHideAccountExistence(t *testing.T) {
+	insert(t)
+
+	auth.Config.HideAccountExistence = true
+	defer func() {
+		auth.Config.HideAccountExistence = false
+	}()
+
+	// wrong password and missing user give the same answer
+	wrong := ex.POST(URL + "/auth").
+		WithJSON(map[string]interface{}{
+			"username": "gophersour",
+			"password": "wrong password",
+		}).
+		Expect()
+
+	missing := ex.POST(URL + "/auth").
+		WithJSON(map[string]interface{}{
+			"username": "gophermissing",
+			"password": "wrong password",
+		}).
+		Expect()
+
+	wrong.Status(missing.Raw().StatusCode)
+	wrong.Body().Equal(missing.Body().Raw())
+
+	// new and existing users give the same answer
+	created := ex.POST(URL).
+		WithJSON(map[string]interface{}{
+			"username": "gopherstealth",
+			"password": "woodpecker",
+			"email":    "gopherstealth@ufo.gov",
+		}).
+		Expect().
+		Status(http.StatusAccepted)
+
+	existing := ex.POST(URL).
+		WithJSON(map[string]interface{}{
+			"username": "gopherstealth",
+			"password": "woodpecker",
+			"email":    "gopherstealth@ufo.gov",
+		}).
+		Expect().
+		Status(http.StatusAccepted)
+
+	created.Body().Equal(existing.Body().Raw())
+}
+
+func TestVerify(t *testing.T) {
+	insert(t)
+
+	// ok: the user goes in the headers
+	res := ex.GET("/api/v1/auth/verify").
+		Expect().
+		Status(http.StatusOK)
+
+	res.Header(HeaderUserID).Equal(id)
+	res.Header(HeaderUserName).Equal("gophersour")
+	res.Header(HeaderUserPower).Equal(strconv.Itoa(int(auth.UserPowerNormal)))
+
+	// ok: browsers send it in a cookie
+	anonymous := httpexpect.New(t, server.URL)
+	anonymous.GET("/api/v1/auth/verify").
+		WithCookie(auth.Config.VerifyCookie, token).
+		Expect().
+		Status(http.StatusOK)
+
+	// expect error: not enough power
+	ex.GET("/api/v1/auth/verify").
+		WithQuery("power", int(auth.UserPowerAdmin)).
+		Expect().
+		Status(http.StatusForbidden)
+
+	// expect error: no token, browsers are sent to the login page
+	anonymous.GET("/api/v1/auth/verify").
+		WithHeader("X-Forwarded-Host", "app.example.com").
+		WithHeader("X-Forwarded-Uri", "/private").
+		Expect().
+		Status(http.StatusUnauthorized).
+		Header(HeaderAuthRedirect).Contains("rd=https%3A%2F%2Fapp.example.com%2Fprivate")
+
+	anonymous.GET("/api/v1/auth/verify").
+		WithHeader("Accept", "text/html").
+		Expect().
+		Status(http.StatusUnauthorized).
+		Header("Location").Equal(auth.Config.VerifyLoginURL)
+}
+
+func TestSCIMPower(t *testing.T) {
+	admin := auth.NewUser()
+	admin.Username = "SCIM_Power_Admin"
+	admin.Email = "scim_power_admin@mail.com"
+	admin.Password = "password"
+	if _, err := admin.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	admin.Power = int(auth.UserPowerAdmin)
+	if err := admin.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := auth.NewUser()
+	owner.Username = "SCIM_Power_Owner"
+	owner.Email = "scim_power_owner@mail.com"
+	owner.Password = "password"
+	if _, err := owner.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	owner.Power = int(auth.UserPowerOwner)
+	if err := owner.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, secret, err := admin.CreateAccessToken("idp", []string{auth.ScopeSCIM}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scim := httpexpect.New(t, server.URL).Builder(func(r *httpexpect.Request) {
+		r.WithHeader("Authorization", "Bearer "+secret)
+	})
+
+	// expect error: a user with more power than the token
+	path := "/scim/v2/Users/" + owner.SCIM().ID
+	scim.GET(path).Expect().Status(http.StatusForbidden)
+	scim.PUT(path).WithBytes([]byte(`{"userName":"taken_over","emails":[{"value":"taken_over@mail.com","primary":true}],"password":"taken over"}`)).
+		Expect().
+		Status(http.StatusForbidden)
+	scim.DELETE(path).Expect().Status(http.StatusForbidden)
+
+	// expect error: nor one with the same power
+	scim.DELETE("/scim/v2/Users/" + admin.SCIM().ID).Expect().Status(http.StatusForbidden)
+
+	// ok: they aren't listed
+	scim.GET("/scim/v2/Users").
+		WithQuery("filter", `emails co "scim_power_"`).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().Value("totalResults").Equal(0)
+
+	// ok: still there
+	found := auth.NewUser()
+	found.ID = owner.ID
+	if ok, err := found.Find(); err != nil || !ok {
+		t.Fatal("the owner was deleted")
+	}
+
+	if err := found.ComparePassword("password"); err != nil {
+		t.Fatal("the password of the owner was changed")
+	}
+
+	admin.HardDelete()
+	owner.HardDelete()
+}
+
+func TestPutService(t *testing.T) {
+	u := auth.NewUser()
+	u.Username = "Service_Target"
+	u.Email = "service_target@mail.com"
+	u.Password = "password"
+	if _, err := u.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _, err := auth.CreateServiceClient("crm", []string{auth.ServiceScopeUsersWrite}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer, _, err := auth.IssueServiceToken(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := httpexpect.New(t, server.URL).Builder(func(r *httpexpect.Request) {
+		r.WithHeader("Authorization", "Bearer "+bearer)
+	})
+
+	// ok: the profile changes, the power and state don't
+	service.PUT(URL + "/" + strconv.FormatInt(int64(u.ID), 10)).
+		WithJSON(map[string]interface{}{
+			"username":  "Service_Changed",
+			"email":     "service_target@mail.com",
+			"power":     int(auth.UserPowerProgrammer),
+			"deleted":   true,
+			"activated": true,
+		}).
+		Expect().
+		Status(http.StatusOK)
+
+	found := auth.NewUser()
+	found.ID = u.ID
+	if ok, err := found.Find(); err != nil || !ok {
+		t.Fatal("the user is gone")
+	}
+
+	if found.Username != "Service_Changed" {
+		t.Error("the username wasn't changed")
+	}
+
+	if found.Power != u.Power || found.Deleted || found.Activated != u.Activated {
+		t.Error("the service changed the power or state of the user")
+	}
+
+	mod := auth.NewUser()
+	mod.Username = "Service_Mod"
+	mod.Email = "service_mod@mail.com"
+	mod.Password = "password"
+	if _, err := mod.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	mod.Power = int(auth.Config.ServiceClientPower)
+	if err := mod.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// expect error: a user with ServiceClientPower
+	path := URL + "/" + strconv.FormatInt(int64(mod.ID), 10)
+	service.PUT(path).
+		WithJSON(map[string]interface{}{
+			"username": "Service_Mod",
+			"email":    "taken_over@mail.com",
+		}).
+		Expect().
+		Status(http.StatusForbidden)
+
+	service.DELETE(path).Expect().Status(http.StatusForbidden)
+
+	found = auth.NewUser()
+	found.ID = mod.ID
+	if ok, err := found.Find(); err != nil || !ok || found.Deleted || found.Email != "service_mod@mail.com" {
+		t.Error("the service changed a user with ServiceClientPower")
+	}
+
+	// ok: a user with less power
+	service.DELETE(URL + "/" + strconv.FormatInt(int64(u.ID), 10)).
+		Expect().
+		Status(http.StatusOK)
+
+	auth.DeleteOAuthClient(client.ClientID)
+	mod.HardDelete()
+	u.HardDelete()
+}
+
+func TestCertificatePower(t *testing.T) {
+	admin := auth.NewUser()
+	admin.Username = "Certificate_Admin"
+	admin.Email = "certificate_admin@mail.com"
+	admin.Password = "password"
+	if _, err := admin.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	admin.Power = int(auth.UserPowerAdmin)
+	if err := admin.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := auth.NewUser()
+	other.Username = "Certificate_Other"
+	other.Email = "certificate_other@mail.com"
+	other.Password = "password"
+	if _, err := other.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	other.Power = int(auth.UserPowerAdmin)
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	u := auth.NewUser()
+	u.Username = "Certificate_User"
+	u.Email = "certificate_user@mail.com"
+	u.Password = "password"
+	if _, err := u.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.BindCertificate("dns:other.local"); err != nil {
+		t.Fatal(err)
+	}
+
+	bearer, err := admin.IssueMFAToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ea := httpexpect.New(t, server.URL).Builder(func(r *httpexpect.Request) {
+		r.WithHeader("Authorization", "Bearer "+bearer)
+	})
+
+	// expect error: a user with the same power
+	path := URL + "/" + strconv.FormatInt(int64(other.ID), 10) + "/certificates"
+	ea.POST(path).
+		WithJSON(map[string]interface{}{
+			"identity": "dns:attacker.local",
+		}).
+		Expect().
+		Status(http.StatusForbidden)
+
+	ea.DELETE(path).
+		WithQuery("identity", "dns:other.local").
+		Expect().
+		Status(http.StatusForbidden)
+
+	// ok: a user with less power
+	path = URL + "/" + strconv.FormatInt(int64(u.ID), 10) + "/certificates"
+	ea.POST(path).
+		WithJSON(map[string]interface{}{
+			"identity": "dns:user.local",
+		}).
+		Expect().
+		Status(http.StatusCreated)
+
+	ea.DELETE(path).
+		WithQuery("identity", "dns:user.local").
+		Expect().
+		Status(http.StatusOK)
+
+	// ok: the binding of the other admin is still there
+	list, lErr := other.CertificateBindings()
+	if lErr != nil || len(list) != 1 {
+		t.Error("the certificate of the other admin was changed")
+	}
+
+	other.UnbindCertificate("dns:other.local")
+	admin.HardDelete()
+	other.HardDelete()
+	u.HardDelete()
+}
+
 func TestEnd(t *testing.T) {
 	server.Close()
 }
@@ -0,0 +1,69 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// PostAuthCode handles post requests to email a login code
+// the required fields are: [email] or [username]
+func (api *API) PostAuthCode(c echo.Context) error {
+	u := auth.NewUser()
+	if err := c.Bind(u); err != nil {
+		return Error(c, err)
+	}
+
+	if err := u.RequestLoginCode(); err != nil {
+		Logger.WithError(err).Debug("[API.PostAuthCode]: error while sending code")
+		return authError(c, err)
+	}
+
+	// the same answer whether the user exists or not
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
+
+// PostAuthCodeVerify handles post requests with the emailed code
+// it responds like PostAuth
+// the required fields are: [email] or [username], [code]
+func (api *API) PostAuthCodeVerify(c echo.Context) error {
+	body := struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Code     string `json:"code"`
+	}{}
+
+	if err := c.Bind(&body); err != nil {
+		return Error(c, err)
+	}
+
+	u := auth.NewUser()
+	u.Username = body.Username
+	u.Email = body.Email
+
+	token, err := u.AuthEmailCode(body.Code)
+	if err != nil {
+		return authError(c, err)
+	}
+
+	return authResponse(c, u, token)
+}
+
+// PostAuthMFAEmail handles post requests with the challenge from PostAuth
+// to email a code that can be used on PostAuthMFA
+// the required fields are: [challenge]
+func (api *API) PostAuthMFAEmail(c echo.Context) error {
+	body := new(challengeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	if err := auth.NewUser().SendMFAEmailCode(body.Challenge); err != nil {
+		return authError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
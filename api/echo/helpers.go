@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"strconv"
 
+	auth "github.com/UnnoTed/authenticaTed"
 	"github.com/UnnoTed/authenticaTed/auth/errors"
 	"github.com/labstack/echo"
 )
@@ -53,13 +54,32 @@ func SuccessWithStatus(c echo.Context, status int, data map[string]interface{})
 }
 
 // Error returns a json error with the Internal Server Error status
+// busy errors are sent as Service Unavailable with a Retry-After header
 func Error(c echo.Context, err interface{}) error {
+	if e, ok := err.(*errors.Error); ok && e != nil && e.Code == errors.ErrorTryAgain {
+		return TryAgain(c, e)
+	}
+
 	return ErrorWithStatus(c, http.StatusInternalServerError, err)
 }
 
+// TryAgain returns a json error with the Service Unavailable status
+// and tells the client to retry after the hash queue timeout
+func TryAgain(c echo.Context, err interface{}) error {
+	retry := int(auth.Config.HashTimeout.Seconds())
+	if retry < 1 {
+		retry = 1
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retry))
+	return ErrorWithStatus(c, http.StatusServiceUnavailable, err)
+}
+
 // ErrorWithStatus returns a json error with the given status
 func ErrorWithStatus(c echo.Context, status int, err interface{}) error {
 	switch err.(type) {
+	case *errors.Error:
+		// keeps the error code
 	case error:
 		err = errors.FromErr(err.(error))
 	}
@@ -0,0 +1,64 @@
+package echo
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// NoImpersonation refuses the requests of admins impersonating the user
+// on sensitive endpoints, it goes after Middleware, which loads the token
+func (api *API) NoImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if auth.GetActor(c) != nil {
+			return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorImpersonating))
+		}
+
+		return next(c)
+	}
+}
+
+// PostImpersonate handles post requests of admins for a token of the user
+// the token lasts ImpersonationTime and its requests are recorded
+func (api *API) PostImpersonate(c echo.Context) error {
+	u, status, err := findOwnerOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	id, gErr := auth.GetID(c)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	admin := auth.NewUser()
+	admin.ID = id
+
+	found, err := admin.Find()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	if !found {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	token, err := u.Impersonate(admin, auth.HasMFAClaim(c), c.RealIP())
+	if err != nil {
+		if err.Code == errors.ErrorCannotImpersonate {
+			return ErrorWithStatus(c, http.StatusForbidden, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"user":    u,
+		"token":   token,
+		"expires": time.Now().Add(auth.Config.ImpersonationTime),
+	})
+}
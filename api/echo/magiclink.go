@@ -0,0 +1,83 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// magicLinkCookie keeps the browser secret of a login link
+const magicLinkCookie = "magic_link"
+
+// PostAuthLink handles post requests to email a login link
+// when auth.Config.MagicLinkBindBrowser is on, the link only
+// works on this browser through a cookie
+// the required fields are: [email] or [username]
+func (api *API) PostAuthLink(c echo.Context) error {
+	u := auth.NewUser()
+	if err := c.Bind(u); err != nil {
+		return Error(c, err)
+	}
+
+	var browser string
+	if auth.Config.MagicLinkBindBrowser {
+		var gErr error
+		if browser, gErr = util.RandomToken(32); gErr != nil {
+			return Error(c, gErr)
+		}
+	}
+
+	if err := u.RequestMagicLink(browser); err != nil {
+		Logger.WithError(err).Debug("[API.PostAuthLink]: error while requesting link")
+		return Error(c, err)
+	}
+
+	if browser != "" {
+		c.SetCookie(&http.Cookie{
+			Name:     magicLinkCookie,
+			Value:    browser,
+			Path:     "/api/v1/users/auth/link",
+			MaxAge:   int(auth.Config.MagicLinkTime.Seconds()),
+			Secure:   c.IsTLS(),
+			HttpOnly: true,
+		})
+	}
+
+	// the same answer whether the user exists or not
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
+
+// PostAuthLinkConsume handles post requests with the token from the link
+// it responds like PostAuth
+// the required fields are: [token]
+func (api *API) PostAuthLinkConsume(c echo.Context) error {
+	body := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := c.Bind(&body); err != nil {
+		return Error(c, err)
+	}
+
+	var browser string
+	if cookie, err := c.Cookie(magicLinkCookie); err == nil {
+		browser = cookie.Value
+	}
+
+	u := auth.NewUser()
+	token, err := u.ConsumeMagicLink(body.Token, browser)
+	if err != nil {
+		if err.Code == errors.ErrorInvalidMagicLink {
+			return ErrorWithStatus(c, http.StatusUnauthorized, err)
+		}
+
+		return authError(c, err)
+	}
+
+	return authResponse(c, u, token)
+}
@@ -0,0 +1,178 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// codeBody is the body of the requests that need a second factor code
+type codeBody struct {
+	Code string `json:"code"`
+}
+
+// mfaError responds with the status that fits a second factor error
+func mfaError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorInvalidCode:
+		return ErrorWithStatus(c, http.StatusForbidden, err)
+
+	case errors.ErrorMFAAlreadyEnabled, errors.ErrorMFANotEnabled:
+		return ErrorWithStatus(c, http.StatusConflict, err)
+
+	case errors.ErrorAccountLocked:
+		return ErrorWithStatus(c, http.StatusTooManyRequests, err)
+	}
+
+	return Error(c, err)
+}
+
+// challengeBody is the body of the forced enrollment requests
+type challengeBody struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// PostAuthEnroll handles post requests with the enrollment challenge from PostAuth
+// it responds with the secret, the otpauth uri and a qr code
+// the required fields are: [challenge]
+func (api *API) PostAuthEnroll(c echo.Context) error {
+	body := new(challengeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u := auth.NewUser()
+	e, err := u.EnrollTOTPWithChallenge(body.Challenge)
+	if err != nil {
+		if err.Code == errors.ErrorInvalidChallenge {
+			return authError(c, err)
+		}
+
+		return mfaError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"totp": e,
+	})
+}
+
+// PostAuthEnrollConfirm handles post requests with the first code of the app
+// it finishes the login, responding with the token and the recovery codes
+// the required fields are: [challenge, code]
+func (api *API) PostAuthEnrollConfirm(c echo.Context) error {
+	body := new(challengeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u := auth.NewUser()
+	token, codes, err := u.ConfirmTOTPWithChallenge(body.Challenge, body.Code)
+	if err != nil {
+		if err.Code == errors.ErrorInvalidChallenge {
+			return authError(c, err)
+		}
+
+		return mfaError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"user":           u,
+		"token":          token,
+		"recovery_codes": codes,
+	})
+}
+
+// PostTOTP handles post requests to start adding a authenticator app
+// it responds with the secret, the otpauth uri and a qr code
+func (api *API) PostTOTP(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	e, err := u.EnrollTOTP()
+	if err != nil {
+		Logger.WithError(err).Debug("[API.PostTOTP]: error while enrolling")
+		return mfaError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"totp": e,
+	})
+}
+
+// PostTOTPConfirm handles post requests with the first code of the app
+// it responds with the recovery codes, they are only shown once
+// the required fields are: [code]
+func (api *API) PostTOTPConfirm(c echo.Context) error {
+	body := new(codeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	codes, err := u.ConfirmTOTP(body.Code)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// DeleteTOTP handles delete requests to remove the authenticator app
+// the required fields are: [code]
+func (api *API) DeleteTOTP(c echo.Context) error {
+	body := new(codeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.DisableTOTP(body.Code); err != nil {
+		return mfaError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// PostRecoveryCodes handles post requests to replace the recovery codes
+// the required fields are: [code]
+func (api *API) PostRecoveryCodes(c echo.Context) error {
+	body := new(codeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.CheckSecondFactor(body.Code); err != nil {
+		return mfaError(c, err)
+	}
+
+	codes, err := u.GenerateRecoveryCodes()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
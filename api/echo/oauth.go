@@ -0,0 +1,155 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// oauth error codes of rfc 6749 section 5.2 and rfc 8628 section 3.5
+var oauthErrors = map[errors.ErrorCode]string{
+	errors.ErrorAuthorizationPending: "authorization_pending",
+	errors.ErrorSlowDown:             "slow_down",
+	errors.ErrorAccessDenied:         "access_denied",
+	errors.ErrorExpiredToken:         "expired_token",
+	errors.ErrorInvalidGrant:         "invalid_grant",
+	errors.ErrorInvalidClient:        "invalid_client",
+	errors.ErrorInvalidRequest:       "invalid_request",
+	errors.ErrorInvalidScope:         "invalid_scope",
+	errors.ErrorUnauthorizedClient:   "unauthorized_client",
+}
+
+// deviceBody is the body of the device verification requests
+type deviceBody struct {
+	UserCode string `json:"user_code"`
+	Approve  bool   `json:"approve"`
+}
+
+// oauthJSON responds without letting anything cache the answer
+func oauthJSON(c echo.Context, status int, data map[string]interface{}) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+	return c.JSON(status, data)
+}
+
+// oauthError responds with a error in the oauth format
+// errors without a oauth code are sent like the rest of the api
+func oauthError(c echo.Context, err *errors.Error) error {
+	code, ok := oauthErrors[err.Code]
+	if !ok {
+		return Error(c, err)
+	}
+
+	status := http.StatusBadRequest
+	if err.Code == errors.ErrorInvalidClient {
+		status = http.StatusUnauthorized
+	}
+
+	return oauthJSON(c, status, map[string]interface{}{
+		"error":             code,
+		"error_description": err.Error(),
+	})
+}
+
+// PostDeviceAuthorization handles the device authorization requests
+// of rfc 8628, the fields are form encoded: [client_id, scope]
+func (api *API) PostDeviceAuthorization(c echo.Context) error {
+	clientID := c.FormValue("client_id")
+	if clientID == "" {
+		return oauthJSON(c, http.StatusBadRequest, map[string]interface{}{
+			"error": "invalid_request",
+		})
+	}
+
+	d, err := auth.NewDeviceAuthorization(clientID, c.FormValue("scope"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	return oauthJSON(c, http.StatusOK, map[string]interface{}{
+		"device_code":               d.DeviceCode,
+		"user_code":                 d.UserCode,
+		"verification_uri":          d.VerificationURI,
+		"verification_uri_complete": d.VerificationURIComplete,
+		"expires_in":                d.ExpiresIn,
+		"interval":                  d.Interval,
+	})
+}
+
+// PostToken handles the oauth token requests, the fields are form encoded
+// the grant_type picks the other required fields
+// device code: [device_code, client_id]
+// authorization code: [code, redirect_uri, code_verifier, client_id]
+// client credentials: [scope] and the client secret or client_assertion
+func (api *API) PostToken(c echo.Context) error {
+	var (
+		u     = auth.NewUser()
+		token string
+		err   *errors.Error
+	)
+
+	switch c.FormValue("grant_type") {
+	case auth.DeviceCodeGrantType:
+		token, err = u.PollDeviceCode(c.FormValue("client_id"), c.FormValue("device_code"))
+
+	case auth.AuthorizationCodeGrantType:
+		return api.postAuthorizationCode(c)
+
+	case auth.ClientCredentialsGrantType:
+		return api.postClientCredentials(c)
+
+	default:
+		return oauthJSON(c, http.StatusBadRequest, map[string]interface{}{
+			"error": "unsupported_grant_type",
+		})
+	}
+
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	return oauthJSON(c, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.Config.TokenExpirationTime.Seconds()),
+	})
+}
+
+// PostDevice handles post requests of a logged in user
+// approving or denying the device of the user code
+// the required fields are: [user_code, approve]
+func (api *API) PostDevice(c echo.Context) error {
+	body := new(deviceBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	id, gErr := auth.GetID(c)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	u := auth.NewUser()
+	u.ID = id
+
+	var err *errors.Error
+	if body.Approve {
+		// the device only gets a second factor token if this session had one
+		err = u.ApproveDeviceCode(body.UserCode, auth.HasMFAClaim(c))
+	} else {
+		err = u.DenyDeviceCode(body.UserCode)
+	}
+
+	if err != nil {
+		if err.Code == errors.ErrorInvalidUserCode {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
@@ -0,0 +1,367 @@
+package echo
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// authorizeBody is the body of the consent page posting back to the authorize endpoint
+// consent is "approve", "deny" or empty to only check a consent given before
+type authorizeBody struct {
+	auth.AuthorizeRequest
+	Consent string `json:"consent"`
+}
+
+// oauthClientBody is the body of the client registration requests
+// service clients have scopes instead of redirect uris
+type oauthClientBody struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+	Scopes       []string `json:"scopes"`
+	PublicKey    string   `json:"public_key"`
+}
+
+// authorizeRequest reads the authorize parameters of the query
+func authorizeRequest(c echo.Context) *auth.AuthorizeRequest {
+	return &auth.AuthorizeRequest{
+		ResponseType:        c.QueryParam("response_type"),
+		ClientID:            c.QueryParam("client_id"),
+		RedirectURI:         c.QueryParam("redirect_uri"),
+		Scope:               c.QueryParam("scope"),
+		State:               c.QueryParam("state"),
+		Nonce:               c.QueryParam("nonce"),
+		CodeChallenge:       c.QueryParam("code_challenge"),
+		CodeChallengeMethod: c.QueryParam("code_challenge_method"),
+	}
+}
+
+// authorizeError builds the redirect uri sending the error back to the client
+func authorizeError(r *auth.AuthorizeRequest, err *errors.Error) string {
+	code, ok := oauthErrors[err.Code]
+	if !ok {
+		code = "server_error"
+	}
+
+	return r.Redirect(url.Values{"error": []string{code}})
+}
+
+// clientError tells if the error is about the client or redirect uri,
+// those can't be sent to the redirect uri
+func clientError(err *errors.Error) bool {
+	return err.Code == errors.ErrorInvalidClient || err.Code == errors.ErrorInvalidRedirectURI
+}
+
+// GetAuthorize handles the authorization requests of the openid connect clients
+// the browser is sent to the consent page with the same query
+func (api *API) GetAuthorize(c echo.Context) error {
+	r := authorizeRequest(c)
+
+	if _, err := r.Validate(); err != nil {
+		if clientError(err) {
+			return ErrorWithStatus(c, http.StatusBadRequest, err)
+		}
+
+		if err.Code == errors.ErrorInvalidScope || err.Code == errors.ErrorInvalidRequest {
+			return c.Redirect(http.StatusFound, authorizeError(r, err))
+		}
+
+		return Error(c, err)
+	}
+
+	return c.Redirect(http.StatusFound, auth.Config.OIDCConsentURL+"?"+c.Request().URL.RawQuery)
+}
+
+// PostAuthorize handles the consent page of a logged in user, it responds
+// with the uri to send the browser back to the client or with the client
+// and scope when the user must consent first
+// the required fields are the authorize parameters, optional: [consent]
+func (api *API) PostAuthorize(c echo.Context) error {
+	body := new(authorizeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	// only a session can log into other apps
+	if auth.GetAccessToken(c) != nil {
+		return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	r := &body.AuthorizeRequest
+	client, err := r.Validate()
+	if err != nil {
+		if clientError(err) {
+			return ErrorWithStatus(c, http.StatusBadRequest, err)
+		}
+
+		if err.Code == errors.ErrorInvalidScope || err.Code == errors.ErrorInvalidRequest {
+			return Success(c, map[string]interface{}{
+				"redirect": authorizeError(r, err),
+			})
+		}
+
+		return Error(c, err)
+	}
+
+	id, gErr := auth.GetID(c)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	u := auth.NewUser()
+	u.ID = id
+
+	found, err := u.Find()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	if !found {
+		return ErrorWithStatus(c, http.StatusNotFound, errors.FromCode(errors.ErrorUserDoesntExists))
+	}
+
+	switch body.Consent {
+	case "deny":
+		return Success(c, map[string]interface{}{
+			"redirect": authorizeError(r, errors.FromCode(errors.ErrorAccessDenied)),
+		})
+
+	case "approve":
+		if err = u.GrantConsent(r.ClientID, r.Scope); err != nil {
+			return Error(c, err)
+		}
+
+	default:
+		consent, err := u.HasConsent(r.ClientID, r.Scope)
+		if err != nil {
+			return Error(c, err)
+		}
+
+		if !consent {
+			return Success(c, map[string]interface{}{
+				"consent_required": true,
+				"client":           client,
+				"scope":            r.Scope,
+			})
+		}
+	}
+
+	code, err := u.IssueAuthorizationCode(r, auth.GetAMR(c))
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"redirect": r.Redirect(url.Values{"code": []string{code}}),
+	})
+}
+
+// clientCredentials reads the client credentials of a token request
+// from the basic authorization header or from the form
+func clientCredentials(c echo.Context) (string, string) {
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		// rfc 6749 section 2.3.1 form encodes them first
+		uid, iErr := url.QueryUnescape(id)
+		usecret, sErr := url.QueryUnescape(secret)
+		if iErr == nil && sErr == nil {
+			return uid, usecret
+		}
+
+		return id, secret
+	}
+
+	return c.FormValue("client_id"), c.FormValue("client_secret")
+}
+
+// postClientCredentials gives a service client a token for itself
+// the fields are: [scope] and the secret, or the client_assertion
+// and client_assertion_type of private_key_jwt
+func (api *API) postClientCredentials(c echo.Context) error {
+	var (
+		client *auth.OAuthClient
+		err    *errors.Error
+	)
+
+	if c.FormValue("client_assertion_type") == auth.ClientAssertionType {
+		client, err = auth.AuthenticateClientAssertion(c.FormValue("client_assertion"))
+	} else {
+		client, err = auth.AuthenticateOAuthClient(clientCredentials(c))
+	}
+
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	// public clients act for users
+	if client.Public() {
+		return oauthError(c, errors.FromCode(errors.ErrorUnauthorizedClient))
+	}
+
+	token, scope, err := auth.IssueServiceToken(client, c.FormValue("scope"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	return oauthJSON(c, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.Config.OIDCTokenTime.Seconds()),
+		"scope":        scope,
+	})
+}
+
+// postAuthorizationCode exchanges a authorization code for the tokens
+// the fields are: [code, redirect_uri, code_verifier, client_id]
+func (api *API) postAuthorizationCode(c echo.Context) error {
+	client, err := auth.AuthenticateOAuthClient(clientCredentials(c))
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	tokens, err := auth.ExchangeAuthorizationCode(client, c.FormValue("code"), c.FormValue("redirect_uri"), c.FormValue("code_verifier"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	return oauthJSON(c, http.StatusOK, map[string]interface{}{
+		"access_token": tokens.AccessToken,
+		"token_type":   tokens.TokenType,
+		"expires_in":   tokens.ExpiresIn,
+		"id_token":     tokens.IDToken,
+		"scope":        tokens.Scope,
+	})
+}
+
+// UserInfo responds with the claims of the user allowed to the client
+// the access token is sent as a bearer or as the access_token form field
+func (api *API) UserInfo(c echo.Context) error {
+	token := c.FormValue("access_token")
+	if h := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+
+	claims, err := auth.UserInfo(token)
+	if err != nil {
+		if err.Code == errors.ErrorUnauthorized {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return ErrorWithStatus(c, http.StatusUnauthorized, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return c.JSON(http.StatusOK, claims)
+}
+
+// GetJWKS responds with the keys verifying the id tokens
+func (api *API) GetJWKS(c echo.Context) error {
+	return c.JSON(http.StatusOK, auth.JWKS())
+}
+
+// GetOIDCDiscovery responds with the openid connect provider metadata
+func (api *API) GetOIDCDiscovery(c echo.Context) error {
+	return c.JSON(http.StatusOK, auth.OIDCDiscovery())
+}
+
+// GetOAuthClients responds with the registered clients, without the secrets
+func (api *API) GetOAuthClients(c echo.Context) error {
+	list, err := auth.OAuthClients()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"clients": list,
+	})
+}
+
+// PostOAuthClient handles post requests registering a client
+// the secret is only sent in this response
+// the required fields are: [name, redirect_uris], optional: [public]
+// or, for service clients: [name, scopes], optional: [public_key]
+func (api *API) PostOAuthClient(c echo.Context) error {
+	body := new(oauthClientBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	var (
+		client *auth.OAuthClient
+		secret string
+		err    *errors.Error
+	)
+
+	if len(body.Scopes) > 0 {
+		client, secret, err = auth.CreateServiceClient(body.Name, body.Scopes, body.PublicKey)
+	} else {
+		client, secret, err = auth.CreateOAuthClient(body.Name, body.RedirectURIs, body.Public)
+	}
+
+	if err != nil {
+		switch err.Code {
+		case errors.ErrorNotEnoughInfo, errors.ErrorInvalidRedirectURI, errors.ErrorInvalidScope, errors.ErrorInvalidRequest:
+			return ErrorWithStatus(c, http.StatusBadRequest, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"client": client,
+		"secret": secret,
+	})
+}
+
+// DeleteOAuthClient handles delete requests removing a client
+func (api *API) DeleteOAuthClient(c echo.Context) error {
+	if err := auth.DeleteOAuthClient(c.Param("client")); err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// GetConsents responds with the clients the user allowed
+func (api *API) GetConsents(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.Consents()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"consents": list,
+	})
+}
+
+// DeleteConsent handles delete requests revoking the consent given to a client
+func (api *API) DeleteConsent(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.RevokeConsent(c.Param("client")); err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return ErrorWithStatus(c, http.StatusNotFound, err)
+		}
+
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
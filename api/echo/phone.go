@@ -0,0 +1,146 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// phoneBody is the body of the phone requests
+type phoneBody struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+}
+
+// phoneError responds with the status that fits a phone error
+func phoneError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorPhoneInvalid:
+		return ErrorWithStatus(c, http.StatusBadRequest, err)
+
+	case errors.ErrorPhoneExists:
+		return ErrorWithStatus(c, http.StatusConflict, err)
+
+	case errors.ErrorInvalidCode:
+		return ErrorWithStatus(c, http.StatusForbidden, err)
+
+	case errors.ErrorCodeThrottled:
+		return ErrorWithStatus(c, http.StatusTooManyRequests, err)
+	}
+
+	return Error(c, err)
+}
+
+// PostPhone handles post requests to change the phone of the user
+// a code is texted to the number to verify it
+// the required fields are: [phone]
+func (api *API) PostPhone(c echo.Context) error {
+	body := new(phoneBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.SetPhone(body.Phone); err != nil {
+		return phoneError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
+
+// PostPhoneVerify handles post requests with the code texted by PostPhone
+// the required fields are: [code]
+func (api *API) PostPhoneVerify(c echo.Context) error {
+	body := new(phoneBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.VerifyPhone(body.Code); err != nil {
+		return phoneError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"user": u,
+	})
+}
+
+// DeletePhone handles delete requests to remove the phone of the user
+func (api *API) DeletePhone(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.RemovePhone(); err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// PostAuthSMS handles post requests to text a login code
+// the required fields are: [phone]
+func (api *API) PostAuthSMS(c echo.Context) error {
+	body := new(phoneBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	if err := auth.NewUser().RequestSMSLoginCode(body.Phone); err != nil {
+		return phoneError(c, err)
+	}
+
+	// the same answer whether the user exists or not
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
+
+// PostAuthSMSVerify handles post requests with the texted code
+// it responds like PostAuth
+// the required fields are: [phone, code]
+func (api *API) PostAuthSMSVerify(c echo.Context) error {
+	body := new(phoneBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u := auth.NewUser()
+	token, err := u.AuthSMSCode(body.Phone, body.Code)
+	if err != nil {
+		if err.Code == errors.ErrorPhoneInvalid {
+			return phoneError(c, err)
+		}
+
+		return authError(c, err)
+	}
+
+	return authResponse(c, u, token)
+}
+
+// PostAuthMFASMS handles post requests with the challenge from PostAuth
+// to text a code that can be used on PostAuthMFA
+// the required fields are: [challenge]
+func (api *API) PostAuthMFASMS(c echo.Context) error {
+	body := new(challengeBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	if err := auth.NewUser().SendMFASMSCode(body.Challenge); err != nil {
+		return authError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusAccepted, map[string]interface{}{})
+}
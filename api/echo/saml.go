@@ -0,0 +1,57 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// samlError responds with the status that fits a saml login error
+func samlError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorSAMLFailed:
+		return ErrorWithStatus(c, http.StatusUnauthorized, err)
+	}
+
+	return socialError(c, err)
+}
+
+// GetSAMLMetadata responds with the service provider metadata of the provider
+func (api *API) GetSAMLMetadata(c echo.Context) error {
+	metadata, err := auth.SAMLMetadata(c.Param("provider"))
+	if err != nil {
+		return samlError(c, err)
+	}
+
+	return c.Blob(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// GetAuthSAML sends the browser to the identity provider to log in
+// with a redirect or with a page posting the request
+func (api *API) GetAuthSAML(c echo.Context) error {
+	start, err := auth.BeginSAML(c.Param("provider"))
+	if err != nil {
+		return samlError(c, err)
+	}
+
+	if start.Form != nil {
+		return c.HTML(http.StatusOK, string(start.Form))
+	}
+
+	return c.Redirect(http.StatusFound, start.URL)
+}
+
+// PostSAMLACS handles the response the identity provider posts back
+// it responds like PostAuth
+func (api *API) PostSAMLACS(c echo.Context) error {
+	u := auth.NewUser()
+	token, err := u.CompleteSAML(c.Param("provider"), c.Request())
+	if err != nil {
+		return samlError(c, err)
+	}
+
+	return authResponse(c, u, token)
+}
@@ -0,0 +1,262 @@
+package echo
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// content type of the scim messages
+const scimContentType = "application/scim+json"
+
+// SCIMMiddleware only allows access tokens with the scim scope
+// created by an admin, jwts of a session are refused
+func (api *API) SCIMMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := auth.LoadAccessToken(c); err != nil {
+			Logger.WithError(err).Debug("[API.SCIMMiddleware]: invalid access token")
+			return scimError(c, http.StatusUnauthorized, "", err)
+		}
+
+		t := auth.GetAccessToken(c)
+		if t == nil || !t.HasScope(auth.ScopeSCIM) {
+			return scimError(c, http.StatusUnauthorized, "", errors.FromCode(errors.ErrorInsufficientScope))
+		}
+
+		// the admin may have lost the power after creating it
+		up, err := auth.GetPower(c)
+		if err != nil || up < auth.UserPowerAdmin {
+			return scimError(c, http.StatusForbidden, "", errors.FromCode(errors.ErrorUnauthorized))
+		}
+
+		// the same rule of API.Middleware
+		if auth.MFARequiredFor(up) && !auth.HasMFAClaim(c) {
+			return scimError(c, http.StatusUnauthorized, "", errors.FromCode(errors.ErrorMFARequired))
+		}
+
+		return next(c)
+	}
+}
+
+// scimResponse sends the resource as scim json
+func scimResponse(c echo.Context, status int, body interface{}) error {
+	if s, ok := body.(*auth.SCIMUser); ok && s.Meta != nil {
+		c.Response().Header().Set("ETag", s.Meta.Version)
+		c.Response().Header().Set(echo.HeaderLocation, s.Meta.Location)
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return c.Blob(status, scimContentType, buf)
+}
+
+// scimError sends the error in the scim format, rfc 7644 3.12
+func scimError(c echo.Context, status int, scimType string, err *errors.Error) error {
+	body := map[string]interface{}{
+		"schemas": []string{auth.SCIMErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  err.String(),
+	}
+
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+
+	return scimResponse(c, status, body)
+}
+
+// scimUserError sends the errors of the users with their scim status
+func scimUserError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorUserDoesntExists:
+		return scimError(c, http.StatusNotFound, "", err)
+	case errors.ErrorUnauthorized:
+		return scimError(c, http.StatusForbidden, "", err)
+	case errors.ErrorUsernameExists, errors.ErrorEmailExists:
+		return scimError(c, http.StatusConflict, "uniqueness", err)
+	case errors.ErrorInvalidFilter:
+		return scimError(c, http.StatusBadRequest, "invalidFilter", err)
+	case errors.ErrorInvalidPatch:
+		return scimError(c, http.StatusBadRequest, "invalidValue", err)
+	case errors.ErrorNotEnoughInfo, errors.ErrorUserInvalid, errors.ErrorPasswordTooShort, errors.ErrorPasswordTooLong:
+		return scimError(c, http.StatusBadRequest, "invalidValue", err)
+	}
+
+	Logger.WithError(err).Error("[API.SCIM]: error")
+	return scimError(c, http.StatusInternalServerError, "", err)
+}
+
+// scimBind decodes the body, c.Bind doesn't know the scim content type
+func scimBind(c echo.Context, body interface{}) *errors.Error {
+	if err := json.NewDecoder(c.Request().Body).Decode(body); err != nil {
+		return errors.FromCode(errors.ErrorUserInvalid)
+	}
+
+	return nil
+}
+
+// scimPower is the power of the owner of the token, checked by SCIMMiddleware
+func scimPower(c echo.Context) auth.UserPower {
+	up, _ := auth.GetPower(c)
+	return up
+}
+
+// scimUser finds the user of the id param and checks the If-Match header
+func scimUser(c echo.Context) (*auth.User, error) {
+	u, err := auth.FindSCIMUser(c.Param("id"), scimPower(c))
+	if err != nil {
+		return nil, scimUserError(c, err)
+	}
+
+	match := c.Request().Header.Get("If-Match")
+	if match != "" && match != "*" && match != u.SCIM().Meta.Version {
+		return nil, scimError(c, http.StatusPreconditionFailed, "", errors.FromCode(errors.ErrorUserInvalid))
+	}
+
+	return u, nil
+}
+
+// GetSCIMServiceProviderConfig responds with the supported scim features
+func (api *API) GetSCIMServiceProviderConfig(c echo.Context) error {
+	return scimResponse(c, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{auth.SCIMConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": auth.SCIMMaxResults},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": true},
+		"authenticationSchemes": []map[string]interface{}{
+			map[string]interface{}{
+				"type":        "oauthbearertoken",
+				"name":        "Access token",
+				"description": "An access token with the scim scope",
+				"primary":     true,
+			},
+		},
+	})
+}
+
+// GetSCIMUsers responds with a page of the users matching the filter
+// the query params are: [filter, startIndex, count]
+func (api *API) GetSCIMUsers(c echo.Context) error {
+	startIndex, count := 1, -1
+	if s := c.QueryParam("startIndex"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return scimError(c, http.StatusBadRequest, "invalidValue", errors.FromCode(errors.ErrorMissingParam))
+		}
+
+		startIndex = i
+	}
+
+	if s := c.QueryParam("count"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return scimError(c, http.StatusBadRequest, "invalidValue", errors.FromCode(errors.ErrorMissingParam))
+		}
+
+		count = i
+	}
+
+	list, err := auth.SCIMUsers(c.QueryParam("filter"), startIndex, count, scimPower(c))
+	if err != nil {
+		return scimUserError(c, err)
+	}
+
+	return scimResponse(c, http.StatusOK, list)
+}
+
+// GetSCIMUser responds with the user of the id
+// it's not modified when the If-None-Match header has its version
+func (api *API) GetSCIMUser(c echo.Context) error {
+	u, err := auth.FindSCIMUser(c.Param("id"), scimPower(c))
+	if err != nil {
+		return scimUserError(c, err)
+	}
+
+	s := u.SCIM()
+	if c.Request().Header.Get("If-None-Match") == s.Meta.Version {
+		c.Response().Header().Set("ETag", s.Meta.Version)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return scimResponse(c, http.StatusOK, s)
+}
+
+// PostSCIMUser provisions a user
+func (api *API) PostSCIMUser(c echo.Context) error {
+	body := new(auth.SCIMUser)
+	if err := scimBind(c, body); err != nil {
+		return scimError(c, http.StatusBadRequest, "invalidSyntax", err)
+	}
+
+	u, err := auth.CreateSCIMUser(body)
+	if err != nil {
+		return scimUserError(c, err)
+	}
+
+	return scimResponse(c, http.StatusCreated, u.SCIM())
+}
+
+// PutSCIMUser replaces the attributes of the user
+func (api *API) PutSCIMUser(c echo.Context) error {
+	u, rErr := scimUser(c)
+	if u == nil {
+		return rErr
+	}
+
+	body := new(auth.SCIMUser)
+	if err := scimBind(c, body); err != nil {
+		return scimError(c, http.StatusBadRequest, "invalidSyntax", err)
+	}
+
+	if err := u.ReplaceSCIM(body); err != nil {
+		return scimUserError(c, err)
+	}
+
+	return scimResponse(c, http.StatusOK, u.SCIM())
+}
+
+// PatchSCIMUser changes some attributes of the user
+func (api *API) PatchSCIMUser(c echo.Context) error {
+	u, rErr := scimUser(c)
+	if u == nil {
+		return rErr
+	}
+
+	body := new(auth.SCIMPatch)
+	if err := scimBind(c, body); err != nil {
+		return scimError(c, http.StatusBadRequest, "invalidSyntax", err)
+	}
+
+	if err := u.PatchSCIM(body.Operations); err != nil {
+		return scimUserError(c, err)
+	}
+
+	return scimResponse(c, http.StatusOK, u.SCIM())
+}
+
+// DeleteSCIMUser deletes the user for good, deprovisioned users
+// that may come back are only made inactive
+func (api *API) DeleteSCIMUser(c echo.Context) error {
+	u, rErr := scimUser(c)
+	if u == nil {
+		return rErr
+	}
+
+	if err := u.HardDelete(); err != nil {
+		return scimUserError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package echo
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// oidcCookie keeps the state of a social login so
+// the callback only works in the browser that started it
+const oidcCookie = "oidc_state"
+
+// setOIDCCookie sets or removes, with a negative maxAge, the state cookie
+func setOIDCCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/api/v1/users/auth/oidc",
+		MaxAge:   maxAge,
+		Secure:   c.IsTLS(),
+		HttpOnly: true,
+	})
+}
+
+// socialError responds with the status that fits a social login error
+func socialError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorUnknownProvider, errors.ErrorIdentityNotFound:
+		return ErrorWithStatus(c, http.StatusNotFound, err)
+
+	case errors.ErrorInvalidState:
+		return ErrorWithStatus(c, http.StatusForbidden, err)
+
+	case errors.ErrorOIDCFailed:
+		return ErrorWithStatus(c, http.StatusUnauthorized, err)
+
+	case errors.ErrorNotEnoughInfo:
+		return ErrorWithStatus(c, http.StatusBadRequest, err)
+
+	case errors.ErrorIdentityExists, errors.ErrorEmailExists, errors.ErrorUsernameExists, errors.ErrorLastLoginMethod:
+		return ErrorWithStatus(c, http.StatusConflict, err)
+	}
+
+	return authError(c, err)
+}
+
+// GetAuthOIDC redirects the browser to the provider to log in
+func (api *API) GetAuthOIDC(c echo.Context) error {
+	state, url, err := auth.NewUser().BeginOIDC(c.Param("provider"))
+	if err != nil {
+		return socialError(c, err)
+	}
+
+	setOIDCCookie(c, state, int(auth.Config.OIDCStateTime.Seconds()))
+	return c.Redirect(http.StatusFound, url)
+}
+
+// GetAuthOIDCCallback handles the redirect back from the provider
+// a login responds like PostAuth, a link with the identities of the user
+func (api *API) GetAuthOIDCCallback(c echo.Context) error {
+	// refused or canceled at the provider
+	if e := c.QueryParam("error"); e != "" {
+		Logger.WithField("error", e).Debug("[API.GetAuthOIDCCallback]: provider error")
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorOIDCFailed))
+	}
+
+	state := c.QueryParam("state")
+	cookie, cErr := c.Cookie(oidcCookie)
+	if cErr != nil || state == "" || cookie.Value != state {
+		return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorInvalidState))
+	}
+
+	setOIDCCookie(c, "", -1)
+
+	u := auth.NewUser()
+	token, err := u.CompleteOIDC(c.Param("provider"), state, c.QueryParam("code"))
+	if err != nil {
+		return socialError(c, err)
+	}
+
+	// linked to the user that started it
+	if token == "" {
+		list, err := u.Identities()
+		if err != nil {
+			return Error(c, err)
+		}
+
+		return Success(c, map[string]interface{}{
+			"identities": list,
+		})
+	}
+
+	return authResponse(c, u, token)
+}
+
+// GetIdentities responds with the external identities linked to the user
+func (api *API) GetIdentities(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.Identities()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"identities": list,
+	})
+}
+
+// PostIdentity handles post requests to link a account of the provider
+// it responds with the url the browser must open, the callback finishes it
+// the required fields are: [provider]
+func (api *API) PostIdentity(c echo.Context) error {
+	body := struct {
+		Provider string `json:"provider"`
+	}{}
+
+	if err := c.Bind(&body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	state, url, err := u.BeginOIDC(body.Provider)
+	if err != nil {
+		return socialError(c, err)
+	}
+
+	setOIDCCookie(c, state, int(auth.Config.OIDCStateTime.Seconds()))
+	return Success(c, map[string]interface{}{
+		"url": url,
+	})
+}
+
+// DeleteIdentity handles delete requests to unlink a external identity
+func (api *API) DeleteIdentity(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	id, gErr := strconv.ParseInt(c.Param("identity"), 10, 64)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+	}
+
+	if err = u.UnlinkIdentity(id); err != nil {
+		return socialError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
@@ -0,0 +1,58 @@
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+)
+
+// trustedSubjectBody is the body of the trusted subject linking requests
+type trustedSubjectBody struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// PostTrustedSubject handles post requests of admins linking the subject
+// of a trusted issuer to the user, its tokens then authenticate as the user
+// the required fields are: [issuer, subject]
+func (api *API) PostTrustedSubject(c echo.Context) error {
+	body := new(trustedSubjectBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findLesserOr(c, auth.UserPowerAdmin)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	id, gErr := auth.GetID(c)
+	if gErr != nil {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	admin := auth.NewUser()
+	admin.ID = id
+
+	found, err := admin.Find()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	if !found {
+		return ErrorWithStatus(c, http.StatusUnauthorized, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	if err = u.LinkTrustedSubject(admin, body.Issuer, body.Subject); err != nil {
+		if err.Code == errors.ErrorUnauthorized {
+			return ErrorWithStatus(c, http.StatusForbidden, err)
+		}
+
+		return socialError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{})
+}
@@ -0,0 +1,183 @@
+package echo
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// headers of the forward auth responses, the proxy copies them to the app
+const (
+	HeaderUserID    = "X-User-Id"
+	HeaderUserName  = "X-User-Name"
+	HeaderUserPower = "X-User-Power"
+
+	// HeaderAuthRedirect is the login page with the original url
+	// nginx can send browsers there with auth_request_set
+	HeaderAuthRedirect = "X-Auth-Redirect"
+)
+
+// GetVerify handles the subrequests of nginx's auth_request and traefik's forwardAuth
+// the token comes from the authorization header or the VerifyCookie
+// and the query param [power] is the minimum power, UserPowerNone by default
+// it responds 200 with the user in the headers, 401 or 403 otherwise
+func (api *API) GetVerify(c echo.Context) error {
+	power := auth.UserPowerNone
+	if p := c.QueryParam("power"); p != "" {
+		i, gErr := strconv.Atoi(p)
+		if gErr != nil {
+			return ErrorWithStatus(c, http.StatusBadRequest, errors.FromCode(errors.ErrorMissingParam))
+		}
+
+		power = auth.UserPower(i)
+	}
+
+	req := c.Request()
+	if req.Header.Get(echo.HeaderAuthorization) == "" && auth.Config.VerifyCookie != "" {
+		if cookie, cErr := c.Cookie(auth.Config.VerifyCookie); cErr == nil && cookie.Value != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+cookie.Value)
+		}
+	}
+
+	if err := auth.LoadAccessToken(c); err != nil {
+		Logger.WithError(err).Debug("[API.GetVerify]: invalid access token")
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	if err := auth.LoadToken(c); err != nil {
+		Logger.WithError(err).Debug("[API.GetVerify]: no valid token")
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	if err := auth.CheckTokenVersion(c); err != nil {
+		if e, ok := err.(*errors.Error); ok && e.Code != errors.ErrorTokenRevoked {
+			return Error(c, e)
+		}
+
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorTokenRevoked))
+	}
+
+	if err := auth.RecordImpersonation(c); err != nil {
+		return Error(c, err)
+	}
+
+	id, gErr := auth.GetID(c)
+	if gErr != nil {
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	up, gErr := auth.GetPower(c)
+	if gErr != nil {
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	if up < power {
+		return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	// the same rule of API.Middleware
+	if auth.MFARequiredFor(up) && !auth.HasMFAClaim(c) {
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorMFARequired))
+	}
+
+	// read only access tokens are checked against the method of the original request
+	if method := forwardedMethod(req); method != "" {
+		req.Method = method
+	}
+
+	if !auth.AccessTokenAllows(c) {
+		return ErrorWithStatus(c, http.StatusForbidden, errors.FromCode(errors.ErrorInsufficientScope))
+	}
+
+	u := auth.NewUser()
+	u.ID = id
+
+	found, err := u.Find()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	if !found || u.Deleted {
+		return verifyUnauthorized(c, errors.FromCode(errors.ErrorUnauthorized))
+	}
+
+	h := c.Response().Header()
+	h.Set(HeaderUserID, strconv.FormatInt(util.Obfuscate(u.ID), 10))
+	h.Set(HeaderUserName, u.Username)
+	h.Set(HeaderUserPower, strconv.Itoa(int(up)))
+
+	return c.NoContent(http.StatusOK)
+}
+
+// verifyUnauthorized responds 401 with the login page of VerifyLoginURL
+// browsers also get it as the location, traefik sends them there
+func verifyUnauthorized(c echo.Context, err *errors.Error) error {
+	if login := loginRedirect(c.Request()); login != "" {
+		h := c.Response().Header()
+		h.Set(HeaderAuthRedirect, login)
+
+		if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+			h.Set(echo.HeaderLocation, login)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return ErrorWithStatus(c, http.StatusUnauthorized, err)
+}
+
+// loginRedirect is the login page with the original url in the rd param
+func loginRedirect(r *http.Request) string {
+	if auth.Config.VerifyLoginURL == "" {
+		return ""
+	}
+
+	login, gErr := url.Parse(auth.Config.VerifyLoginURL)
+	if gErr != nil {
+		return ""
+	}
+
+	if original := forwardedURL(r); original != "" {
+		q := login.Query()
+		q.Set("rd", original)
+		login.RawQuery = q.Encode()
+	}
+
+	return login.String()
+}
+
+// forwardedURL is the url the proxy is protecting
+// nginx sends it in X-Original-URL, traefik in the X-Forwarded headers
+func forwardedURL(r *http.Request) string {
+	if original := r.Header.Get("X-Original-URL"); original != "" {
+		return original
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+
+	proto := r.Header.Get(echo.HeaderXForwardedProto)
+	if proto == "" {
+		proto = "https"
+	}
+
+	return proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+}
+
+// forwardedMethod is the method of the request the proxy is protecting
+func forwardedMethod(r *http.Request) string {
+	if method := r.Header.Get("X-Original-Method"); method != "" {
+		return strings.ToUpper(method)
+	}
+
+	return strings.ToUpper(r.Header.Get("X-Forwarded-Method"))
+}
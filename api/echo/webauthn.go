@@ -0,0 +1,149 @@
+package echo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	auth "github.com/UnnoTed/authenticaTed"
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// webAuthnBody is the answer of the browser to a ceremony
+// credential is the json of the PublicKeyCredential
+type webAuthnBody struct {
+	Session    string          `json:"session"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// webAuthnError responds with the status that fits a passkey error
+func webAuthnError(c echo.Context, err *errors.Error) error {
+	switch err.Code {
+	case errors.ErrorWebAuthnFailed, errors.ErrorInvalidChallenge:
+		return ErrorWithStatus(c, http.StatusUnauthorized, err)
+
+	case errors.ErrorCredentialNotFound:
+		return ErrorWithStatus(c, http.StatusNotFound, err)
+
+	case errors.ErrorAccountLocked:
+		return ErrorWithStatus(c, http.StatusTooManyRequests, err)
+	}
+
+	return Error(c, err)
+}
+
+// PostWebAuthnRegister handles post requests to start adding a passkey
+// it responds with the options for navigator.credentials.create
+// and the session that must be sent back with the answer
+func (api *API) PostWebAuthnRegister(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	options, session, err := u.BeginWebAuthnRegistration()
+	if err != nil {
+		Logger.WithError(err).Debug("[API.PostWebAuthnRegister]: error while starting")
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"options": options,
+		"session": session,
+	})
+}
+
+// PostWebAuthnRegisterFinish handles post requests with the new passkey
+// the required fields are: [session, credential]
+func (api *API) PostWebAuthnRegisterFinish(c echo.Context) error {
+	body := new(webAuthnBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	cred, err := u.FinishWebAuthnRegistration(body.Session, body.Name, bytes.NewReader(body.Credential))
+	if err != nil {
+		return webAuthnError(c, err)
+	}
+
+	return SuccessWithStatus(c, http.StatusCreated, map[string]interface{}{
+		"credential": cred,
+	})
+}
+
+// GetWebAuthn responds with the passkeys of the user
+func (api *API) GetWebAuthn(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	list, err := u.WebAuthnCredentials()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"credentials": list,
+	})
+}
+
+// DeleteWebAuthn handles delete requests to remove a passkey of the user
+func (api *API) DeleteWebAuthn(c echo.Context) error {
+	u, status, err := findOwner(c)
+	if err != nil {
+		return ErrorWithStatus(c, status, err)
+	}
+
+	if err = u.DeleteWebAuthnCredential(c.Param("credential")); err != nil {
+		return webAuthnError(c, err)
+	}
+
+	return Success(c, map[string]interface{}{})
+}
+
+// PostAuthWebAuthn handles post requests to start a passkey login
+// it responds with the options for navigator.credentials.get
+// and the session that must be sent back with the answer
+func (api *API) PostAuthWebAuthn(c echo.Context) error {
+	options, session, err := auth.BeginWebAuthnLogin()
+	if err != nil {
+		return Error(c, err)
+	}
+
+	return Success(c, map[string]interface{}{
+		"options": options,
+		"session": session,
+	})
+}
+
+// PostAuthWebAuthnFinish handles post requests with the answer of the passkey
+// it responds like PostAuth
+// the required fields are: [session, credential]
+func (api *API) PostAuthWebAuthnFinish(c echo.Context) error {
+	body := new(webAuthnBody)
+	if err := c.Bind(body); err != nil {
+		return Error(c, err)
+	}
+
+	u := auth.NewUser()
+	token, err := u.FinishWebAuthnLogin(body.Session, bytes.NewReader(body.Credential))
+	if err != nil {
+		return webAuthnError(c, err)
+	}
+
+	// returns OK with the jwt token and user's data
+	return SuccessWithStatus(c, http.StatusOK, map[string]interface{}{
+		"user":  u,
+		"token": token,
+	})
+}
@@ -0,0 +1,318 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// scopes of the access tokens
+const (
+	// ScopeRead only allows safe methods: GET, HEAD and OPTIONS
+	ScopeRead = "read"
+	// ScopeWrite allows every method
+	ScopeWrite = "write"
+	// ScopeSCIM allows provisioning users with the scim api, admins only
+	ScopeSCIM = "scim"
+)
+
+// context key of the access token that authenticated the request
+const accessTokenKey = "access_token"
+
+// how often the last use of a token is saved
+const accessTokenTouch = time.Minute
+
+// AccessToken is a personal access token or api key of a user
+// only the hash of its secret is stored, the hint are
+// the first characters so the owner can tell them apart
+type AccessToken struct {
+	ID     int64      `db:"id,omitempty" json:"id,string"`
+	UserID hide.Int64 `db:"user_id"      json:"user_id,string"`
+	Name   string     `db:"name"         json:"name"`
+	Hint   string     `db:"hint"         json:"hint"`
+	Secret string     `db:"secret"       json:"-"`
+
+	// comma separated
+	Scopes string `db:"scopes"           json:"scopes"`
+
+	// the session that created it, the token never gets more than it had
+	MFA   bool `db:"mfa"                  json:"mfa"`
+	Power int  `db:"power"                json:"power"`
+
+	// a zero Expires never expires, a zero LastUsed was never used
+	Created  time.Time `db:"created"      json:"created"`
+	Expires  time.Time `db:"expires"      json:"expires"`
+	LastUsed time.Time `db:"last_used"    json:"last_used"`
+}
+
+// HasScope checks if the token was given the scope
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeScopes checks the scopes and joins them
+// write includes read, no scopes means read, scim alone is only scim
+func normalizeScopes(scopes []string) (string, *errors.Error) {
+	read, write, scim := false, false, false
+	for _, s := range scopes {
+		switch strings.TrimSpace(s) {
+		case "":
+		case ScopeRead:
+			read = true
+		case ScopeWrite:
+			write = true
+		case ScopeSCIM:
+			scim = true
+		default:
+			return "", errors.FromCode(errors.ErrorInvalidScope)
+		}
+	}
+
+	var list []string
+	if read || write || !scim {
+		list = append(list, ScopeRead)
+	}
+
+	if write {
+		list = append(list, ScopeWrite)
+	}
+
+	if scim {
+		list = append(list, ScopeSCIM)
+	}
+
+	return strings.Join(list, ","), nil
+}
+
+// CreateAccessToken creates a token that works like a jwt of the user
+// limited to the scopes, a zero expiration never expires
+// mfa is whether the session creating it passed a second factor
+// the secret is only returned here
+func (u *User) CreateAccessToken(name string, scopes []string, expiration time.Duration, mfa bool) (*AccessToken, string, *errors.Error) {
+	l := Logger.WithField("ID", u.ID)
+
+	if u.ID == 0 || name == "" {
+		return nil, "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	if len(name) > 255 {
+		name = name[:255]
+	}
+
+	scope, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// provisioning manages other users
+	if strings.HasSuffix(scope, ScopeSCIM) && UserPower(u.Power) < UserPowerAdmin {
+		return nil, "", errors.FromCode(errors.ErrorInvalidScope)
+	}
+
+	random, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	secret := Config.AccessTokenPrefix + random
+	now := time.Now()
+
+	t := &AccessToken{
+		UserID:  u.ID,
+		Name:    name,
+		Hint:    secret[:len(Config.AccessTokenPrefix)+4],
+		Secret:  util.HashToken(secret),
+		Scopes:  scope,
+		MFA:     mfa,
+		Power:   u.Power,
+		Created: now,
+	}
+
+	if expiration > 0 {
+		t.Expires = now.Add(expiration)
+	}
+
+	id, gErr := pc.Insert(t)
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.CreateAccessToken]: Error while inserting")
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	t.ID = id.(int64)
+
+	l.WithFields(log.Fields{
+		"token":  t.ID,
+		"scopes": scope,
+	}).Info("[User.CreateAccessToken]: Token created")
+	return t, secret, nil
+}
+
+// AccessTokens lists the tokens of the user
+func (u *User) AccessTokens() ([]*AccessToken, *errors.Error) {
+	var list []*AccessToken
+
+	err := pc.Find(db.Cond{"user_id": u.ID}).OrderBy("-created").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// RevokeAccessToken deletes a token of the user
+func (u *User) RevokeAccessToken(id int64) *errors.Error {
+	r := pc.Find(db.Cond{"id": id, "user_id": u.ID})
+
+	count, err := r.Count()
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if count == 0 {
+		return errors.FromCode(errors.ErrorAccessTokenNotFound)
+	}
+
+	if err = r.Delete(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":    u.ID,
+		"token": id,
+	}).Info("[User.RevokeAccessToken]: Token revoked")
+	return nil
+}
+
+// FindAccessToken finds the user of the token secret
+func (u *User) FindAccessToken(secret string) (*AccessToken, *errors.Error) {
+	if !IsAccessTokenSecret(secret) {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	var t *AccessToken
+	err := pc.Find(db.Cond{"secret": util.HashToken(secret)}).One(&t)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	now := time.Now()
+	if !t.Expires.IsZero() && now.After(t.Expires) {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	*u = User{ID: t.UserID}
+	found, fErr := u.Find()
+	if fErr != nil {
+		return nil, fErr
+	}
+
+	if !found || u.Deleted {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	if now.Sub(t.LastUsed) > accessTokenTouch {
+		t.LastUsed = now
+
+		gErr := pc.Find(db.Cond{"id": t.ID}).Update(map[string]interface{}{
+			"last_used": now,
+		})
+		if gErr != nil {
+			return nil, errors.FromErr(gErr)
+		}
+	}
+
+	return t, nil
+}
+
+// IsAccessTokenSecret checks if the bearer is an access token instead of a jwt
+func IsAccessTokenSecret(bearer string) bool {
+	return Config.AccessTokenPrefix != "" && strings.HasPrefix(bearer, Config.AccessTokenPrefix)
+}
+
+// LoadAccessToken authenticates the request by an access token in the
+// authorization header and stores the user in the context like LoadToken
+// it does nothing when the header has a jwt or there is a token in the context already
+func LoadAccessToken(c echo.Context) *errors.Error {
+	if c.Get(middleware.DefaultJWTConfig.ContextKey) != nil {
+		return nil
+	}
+
+	bearer, gErr := jwtFromHeader(echo.HeaderAuthorization)(c)
+	if gErr != nil || !IsAccessTokenSecret(bearer) {
+		return nil
+	}
+
+	u := NewUser()
+	t, err := u.FindAccessToken(bearer)
+	if err != nil {
+		return err
+	}
+
+	// a promoted user doesn't promote the tokens created before
+	owner := *u
+	if owner.Power > t.Power {
+		owner.Power = t.Power
+	}
+
+	claims, err := owner.tokenClaims(t.MFA)
+	if err != nil {
+		return err
+	}
+
+	// never signed nor sent, it only carries the claims
+	c.Set(middleware.DefaultJWTConfig.ContextKey, &jwt.Token{
+		Method: jwt.SigningMethodHS256,
+		Claims: claims,
+		Valid:  true,
+	})
+	c.Set(accessTokenKey, t)
+
+	Logger.WithFields(log.Fields{
+		"ID":    u.ID,
+		"token": t.ID,
+	}).Debug("[LoadAccessToken]: Authenticated by access token")
+	return nil
+}
+
+// GetAccessToken gets the access token that authenticated the request
+// it returns nil for jwts
+func GetAccessToken(c echo.Context) *AccessToken {
+	t, _ := c.Get(accessTokenKey).(*AccessToken)
+	return t
+}
+
+// AccessTokenAllows checks if the access token of the request
+// has the scope needed by its method, jwts are always allowed
+func AccessTokenAllows(c echo.Context) bool {
+	t := GetAccessToken(c)
+	if t == nil {
+		return true
+	}
+
+	switch c.Request().Method {
+	case echo.GET, echo.HEAD, echo.OPTIONS:
+		return t.HasScope(ScopeRead)
+	}
+
+	return t.HasScope(ScopeWrite)
+}
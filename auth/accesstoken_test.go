@@ -0,0 +1,121 @@
+package users
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// bearerContext creates a echo context of a request with the bearer
+func bearerContext(method, bearer string) echo.Context {
+	r := httptest.NewRequest(method, "/", nil)
+	r.Header.Set(echo.HeaderAuthorization, "Bearer "+bearer)
+	return echo.New().NewContext(r, httptest.NewRecorder())
+}
+
+func TestAccessToken(t *testing.T) {
+	u := NewUser()
+	u.Username = "Token_User"
+	u.Email = "token_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: unknown scope
+	_, _, err = u.CreateAccessToken("ci", []string{"admin"}, 0, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidScope, err.Code)
+
+	// ok: read only
+	at, secret, err := u.CreateAccessToken("ci", nil, 0, false)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(secret, Config.AccessTokenPrefix))
+	assert.True(t, strings.HasPrefix(secret, at.Hint))
+	assert.Equal(t, ScopeRead, at.Scopes)
+
+	c := bearerContext(echo.GET, secret)
+	assert.Nil(t, LoadAccessToken(c))
+
+	id, gErr := GetID(c)
+	assert.Nil(t, gErr)
+	assert.Equal(t, u.ID, id)
+	assert.True(t, AccessTokenAllows(c))
+
+	// expect error: read only
+	c = bearerContext(echo.PUT, secret)
+	assert.Nil(t, LoadAccessToken(c))
+	assert.False(t, AccessTokenAllows(c))
+
+	// ok: jwts are left to LoadToken
+	token, err := u.IssueToken()
+	assert.Nil(t, err)
+
+	c = bearerContext(echo.PUT, token)
+	assert.Nil(t, LoadAccessToken(c))
+	assert.Nil(t, GetAccessToken(c))
+	assert.True(t, AccessTokenAllows(c))
+
+	// ok: write
+	_, writer, err := u.CreateAccessToken("deploy", []string{ScopeWrite}, time.Hour, false)
+	assert.Nil(t, err)
+
+	c = bearerContext(echo.PUT, writer)
+	assert.Nil(t, LoadAccessToken(c))
+	assert.True(t, AccessTokenAllows(c))
+
+	list, err := u.AccessTokens()
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+	assert.False(t, list[1].LastUsed.IsZero())
+
+	// expect error: expired
+	_, short, err := u.CreateAccessToken("short", nil, time.Millisecond, false)
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	err = LoadAccessToken(bearerContext(echo.GET, short))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	// expect error: revoked
+	assert.Nil(t, u.RevokeAccessToken(at.ID))
+
+	err = LoadAccessToken(bearerContext(echo.GET, secret))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	err = u.RevokeAccessToken(at.ID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorAccessTokenNotFound, err.Code)
+
+	// ok: the token keeps the power and second factor of its session
+	_, mfa, err := u.CreateAccessToken("mfa", nil, 0, true)
+	assert.Nil(t, err)
+
+	c = bearerContext(echo.GET, mfa)
+	assert.Nil(t, LoadAccessToken(c))
+	assert.True(t, HasMFAClaim(c))
+
+	c = bearerContext(echo.GET, writer)
+	assert.Nil(t, LoadAccessToken(c))
+	assert.False(t, HasMFAClaim(c))
+
+	// ok: promoting the user doesn't promote its tokens
+	u.Power = int(UserPowerAdmin)
+	assert.Nil(t, u.Save())
+
+	c = bearerContext(echo.GET, writer)
+	assert.Nil(t, LoadAccessToken(c))
+
+	up, gErr := GetPower(c)
+	assert.Nil(t, gErr)
+	assert.True(t, up < UserPowerAdmin)
+
+	assert.Nil(t, u.HardDelete())
+}
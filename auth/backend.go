@@ -0,0 +1,163 @@
+package users
+
+import (
+	goerrors "errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// ErrBackendInvalidPassword is returned by a AuthBackend
+// when the user exists there but the password is wrong
+var ErrBackendInvalidPassword = goerrors.New("invalid password")
+
+// AuthBackend checks passwords against a external user store, like a directory
+// User.Auth consults the ones in Config.AuthBackends, in order, for logins
+// that aren't local users with a password
+type AuthBackend interface {
+	// Name identifies the backend in the identities of its users
+	Name() string
+
+	// Authenticate checks the login, a username or email, and the password
+	// a user that isn't in the backend returns nil and no error
+	Authenticate(login, password string) (*BackendUser, error)
+}
+
+// BackendUser is a user authenticated by a AuthBackend
+// it's kept in sync with a shadow User without a password
+type BackendUser struct {
+	// Subject never changes for the same user of the backend
+	Subject  string
+	Username string
+	Email    string
+	Name     string
+	LastName string
+
+	// nil leaves the power of the user alone
+	Power *UserPower
+}
+
+// authBackends tries the login with the backends, it's done when one
+// of them knows the user, u is the shadow user when found is true
+func (u *User) authBackends(login, password string, found bool) (string, bool, *errors.Error) {
+	if len(Config.AuthBackends) == 0 {
+		return "", false, nil
+	}
+
+	// a locked shadow user doesn't reach the backends
+	if found {
+		locked, err := u.IsLocked()
+		if err != nil {
+			return "", true, err
+		}
+
+		if locked {
+			return "", true, errors.FromCode(errors.ErrorAccountLocked)
+		}
+	}
+
+	for _, b := range Config.AuthBackends {
+		l := Logger.WithFields(log.Fields{
+			"backend": b.Name(),
+			"login":   login,
+		})
+
+		bu, gErr := b.Authenticate(login, password)
+		if gErr == ErrBackendInvalidPassword {
+			l.Debug("[User.authBackends]: Wrong password")
+			return "", true, u.backendFailed(found)
+		}
+
+		if gErr != nil {
+			l.WithError(gErr).Error("[User.authBackends]: Backend failed")
+			continue
+		}
+
+		if bu == nil {
+			continue
+		}
+
+		if err := u.syncBackendUser(b.Name(), bu); err != nil {
+			return "", true, err
+		}
+
+		l.WithField("ID", u.ID).Debug("[User.authBackends]: Authenticated")
+		if err := u.LoginSucceeded(); err != nil {
+			return "", true, err
+		}
+
+		u.AuthMethod = AMRPassword
+		token, err := u.loginToken()
+		return token, true, err
+	}
+
+	return "", false, nil
+}
+
+// backendFailed records the failure of a shadow user like a wrong local password
+func (u *User) backendFailed(found bool) *errors.Error {
+	if found {
+		lo, err := u.LoginFailed()
+		if err != nil {
+			return err
+		}
+
+		if lo != nil {
+			time.Sleep(loginDelay(lo.Failures))
+		}
+	}
+
+	return errors.FromCode(errors.ErrorUserInvalidPassword)
+}
+
+// syncBackendUser creates or refreshes the shadow user of the backend user
+func (u *User) syncBackendUser(backend string, bu *BackendUser) *errors.Error {
+	linked, err := findIdentity(backend, bu.Subject)
+	if err != nil {
+		return err
+	}
+
+	if linked == nil {
+		if bu.Email == "" {
+			return errors.FromCode(errors.ErrorNotEnoughInfo)
+		}
+
+		if err = u.createIdentity(backend, backend, bu.Subject, bu.Username, bu.Email); err != nil {
+			return err
+		}
+	} else {
+		*u = User{ID: linked.UserID}
+		found, err := u.Find()
+		if err != nil {
+			return err
+		}
+
+		if !found || u.Deleted {
+			return errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+
+		gErr := xc.Find(db.Cond{"id": linked.ID}).Update(map[string]interface{}{
+			"last_used": time.Now(),
+		})
+		if gErr != nil {
+			return errors.FromErr(gErr)
+		}
+	}
+
+	// the backend is the source of these fields
+	if bu.Email != "" {
+		u.Email = bu.Email
+	}
+
+	u.Name = bu.Name
+	u.LastName = bu.LastName
+	if bu.Power != nil {
+		u.Power = int(*bu.Power)
+	}
+
+	return u.Save()
+}
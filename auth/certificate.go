@@ -0,0 +1,301 @@
+package users
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// CertificateBinding links an identity of a client certificate to a user
+// identities are "subject:" followed by the subject dn or the
+// san type, "dns:", "email:", "uri:" or "ip:", followed by its value
+type CertificateBinding struct {
+	ID       int64      `db:"id,omitempty" json:"id,string"`
+	UserID   hide.Int64 `db:"user_id"      json:"user_id,string"`
+	Identity string     `db:"identity"     json:"identity"`
+
+	Created  time.Time `db:"created"      json:"created"`
+	LastUsed time.Time `db:"last_used"    json:"last_used"`
+}
+
+// CertificateIdentities lists the identities a certificate can be bound by
+func CertificateIdentities(cert *x509.Certificate) []string {
+	ids := []string{"subject:" + cert.Subject.String()}
+
+	for _, name := range cert.DNSNames {
+		ids = append(ids, "dns:"+name)
+	}
+
+	for _, email := range cert.EmailAddresses {
+		ids = append(ids, "email:"+email)
+	}
+
+	for _, uri := range cert.URIs {
+		ids = append(ids, "uri:"+uri.String())
+	}
+
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, "ip:"+ip.String())
+	}
+
+	return ids
+}
+
+// BindCertificate lets certificates with the identity authenticate as the user
+func (u *User) BindCertificate(identity string) *errors.Error {
+	if u.ID == 0 || !strings.Contains(identity, ":") {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	count, gErr := kc.Find(db.Cond{"identity": identity}).Count()
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	if count > 0 {
+		return errors.FromCode(errors.ErrorCertificateExists)
+	}
+
+	now := time.Now()
+	_, gErr = kc.Insert(&CertificateBinding{
+		UserID:   u.ID,
+		Identity: identity,
+		Created:  now,
+		LastUsed: now,
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.BindCertificate]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":       u.ID,
+		"identity": identity,
+	}).Info("[User.BindCertificate]: Certificate bound")
+	return nil
+}
+
+// UnbindCertificate stops accepting certificates with the identity for the user
+func (u *User) UnbindCertificate(identity string) *errors.Error {
+	r := kc.Find(db.Cond{"user_id": u.ID, "identity": identity})
+
+	count, err := r.Count()
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if count == 0 {
+		return errors.FromCode(errors.ErrorCertificateNotFound)
+	}
+
+	return errors.FromErr(r.Delete())
+}
+
+// CertificateBindings lists the certificate identities of the user
+func (u *User) CertificateBindings() ([]*CertificateBinding, *errors.Error) {
+	var list []*CertificateBinding
+
+	err := kc.Find(db.Cond{"user_id": u.ID}).OrderBy("identity").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// FindCertificate finds the user bound to one of the identities
+// of a certificate that was already verified
+// it's refused when the identities are bound to different users
+func (u *User) FindCertificate(cert *x509.Certificate) *errors.Error {
+	ids := CertificateIdentities(cert)
+
+	var list []*CertificateBinding
+	err := kc.Find(db.Cond{"identity IN": ids}).All(&list)
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if len(list) == 0 {
+		Logger.WithField("subject", ids[0]).Debug("[User.FindCertificate]: Certificate not bound")
+		return errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	// identities of the same certificate bound to different users
+	b := list[0]
+	for _, o := range list[1:] {
+		if o.UserID != b.UserID {
+			Logger.WithField("subject", ids[0]).Warn("[User.FindCertificate]: Certificate bound to more than one user")
+			return errors.FromCode(errors.ErrorInvalidCertificate)
+		}
+	}
+
+	*u = User{ID: b.UserID}
+	found, fErr := u.Find()
+	if fErr != nil {
+		return fErr
+	}
+
+	if !found || u.Deleted {
+		return errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	err = kc.Find(db.Cond{"user_id": b.UserID, "identity IN": ids}).Update(map[string]interface{}{
+		"last_used": time.Now(),
+	})
+
+	return errors.FromErr(err)
+}
+
+// fromTrustedProxy checks if the request came straight from one of Config.CertTrustedProxies
+func fromTrustedProxy(c echo.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, p := range Config.CertTrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyClientCertificate checks the certificate against Config.CertClientCAs
+func verifyClientCertificate(cert *x509.Certificate, intermediates []*x509.Certificate) bool {
+	if Config.CertClientCAs == nil {
+		return false
+	}
+
+	pool := x509.NewCertPool()
+	for _, i := range intermediates {
+		pool.AddCert(i)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         Config.CertClientCAs,
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return err == nil
+}
+
+// peerCertificate gets the verified client certificate of the request
+// from the tls connection or, for requests of a trusted proxy,
+// from the url encoded pem in Config.CertProxyHeader
+func peerCertificate(c echo.Context) (*x509.Certificate, *errors.Error) {
+	r := c.Request()
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		// verified by the server when its tls config asks for it
+		if len(r.TLS.VerifiedChains) > 0 {
+			return r.TLS.VerifiedChains[0][0], nil
+		}
+
+		cert := r.TLS.PeerCertificates[0]
+		if verifyClientCertificate(cert, r.TLS.PeerCertificates[1:]) {
+			return cert, nil
+		}
+
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	if Config.CertProxyHeader == "" {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	header := r.Header.Get(Config.CertProxyHeader)
+	if header == "" || !fromTrustedProxy(c) {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	raw, gErr := url.PathUnescape(header)
+	if gErr != nil {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	cert, gErr := x509.ParseCertificate(block.Bytes)
+	if gErr != nil {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	// the proxy verified it, it's checked again when the cas are known
+	if Config.CertClientCAs != nil && !verifyClientCertificate(cert, nil) {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.FromCode(errors.ErrorInvalidCertificate)
+	}
+
+	return cert, nil
+}
+
+// LoadCertificate authenticates the request by its client certificate
+// and stores the user in the context like LoadToken, so GetID
+// and GetPower work the same for both
+// it does nothing when there is a token in the context already
+func LoadCertificate(c echo.Context) *errors.Error {
+	if c.Get(middleware.DefaultJWTConfig.ContextKey) != nil {
+		return nil
+	}
+
+	cert, err := peerCertificate(c)
+	if err != nil {
+		return err
+	}
+
+	u := NewUser()
+	if err = u.FindCertificate(cert); err != nil {
+		return err
+	}
+
+	claims, err := u.tokenClaims(false)
+	if err != nil {
+		return err
+	}
+
+	// never signed nor sent, it only carries the claims
+	c.Set(middleware.DefaultJWTConfig.ContextKey, &jwt.Token{
+		Method: jwt.SigningMethodHS256,
+		Claims: claims,
+		Valid:  true,
+	})
+
+	Logger.WithField("ID", u.ID).Debug("[LoadCertificate]: Authenticated by certificate")
+	return nil
+}
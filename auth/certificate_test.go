@@ -0,0 +1,197 @@
+package users
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCertificate creates a certificate signed by parent
+// or a self signed ca when parent is nil
+func newTestCertificate(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return cert, key
+}
+
+// certContext creates a echo context of a request from the remote address
+func certContext(remote string) (echo.Context, *http.Request) {
+	r := httptest.NewRequest(echo.GET, "/", nil)
+	r.RemoteAddr = remote
+	return echo.New().NewContext(r, httptest.NewRecorder()), r
+}
+
+func TestCertificate(t *testing.T) {
+	cas, proxies := Config.CertClientCAs, Config.CertTrustedProxies
+	defer func() {
+		Config.CertClientCAs, Config.CertTrustedProxies = cas, proxies
+	}()
+
+	ca, caKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test CA"},
+	}, nil, nil)
+
+	cert, _ := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "billing"},
+		DNSNames:     []string{"billing.internal"},
+	}, ca, caKey)
+
+	unbound, _ := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "unknown"},
+	}, ca, caKey)
+
+	assert.Equal(t, []string{"subject:CN=billing", "dns:billing.internal"}, CertificateIdentities(cert))
+
+	u := NewUser()
+	u.Username = "Cert_User"
+	u.Email = "cert_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: identities need a type
+	err = u.BindCertificate("billing.internal")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorNotEnoughInfo, err.Code)
+
+	assert.Nil(t, u.BindCertificate("dns:billing.internal"))
+
+	// expect error: bound already
+	err = u.BindCertificate("dns:billing.internal")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCertificateExists, err.Code)
+
+	// ok: verified by the tls server
+	chain := []*x509.Certificate{cert, ca}
+	c, r := certContext("192.0.2.1:4000")
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{chain},
+	}
+	assert.Nil(t, LoadCertificate(c))
+
+	id, gErr := GetID(c)
+	assert.Nil(t, gErr)
+	assert.Equal(t, u.ID, id)
+
+	power, gErr := GetPower(c)
+	assert.Nil(t, gErr)
+	assert.Equal(t, UserPower(u.Power), power)
+	assert.Nil(t, CheckTokenVersion(c))
+
+	// expect error: not verified and no cas to verify it
+	Config.CertClientCAs = nil
+	c, r = certContext("192.0.2.1:4000")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	err = LoadCertificate(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCertificate, err.Code)
+
+	// ok: verified with the cas
+	Config.CertClientCAs = x509.NewCertPool()
+	Config.CertClientCAs.AddCert(ca)
+	assert.Nil(t, LoadCertificate(c))
+
+	// expect error: not bound
+	c, r = certContext("192.0.2.1:4000")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{unbound}}
+
+	err = LoadCertificate(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCertificate, err.Code)
+
+	// expect error: the identities are bound to different users
+	o := NewUser()
+	o.Username = "Cert_Other"
+	o.Email = "cert_other@mail.com"
+	o.Password = "password"
+	_, err = o.Create()
+	assert.Nil(t, err)
+	assert.Nil(t, o.BindCertificate("subject:CN=billing"))
+
+	c, r = certContext("192.0.2.1:4000")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	err = LoadCertificate(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCertificate, err.Code)
+
+	assert.Nil(t, o.UnbindCertificate("subject:CN=billing"))
+	assert.Nil(t, o.HardDelete())
+
+	// proxy header
+	Config.CertTrustedProxies = []string{"10.0.0.0/8"}
+	header := url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+
+	// expect error: not from a trusted proxy
+	c, r = certContext("192.0.2.1:4000")
+	r.Header.Set(Config.CertProxyHeader, header)
+
+	err = LoadCertificate(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCertificate, err.Code)
+
+	// ok
+	c, r = certContext("10.1.2.3:4000")
+	r.Header.Set(Config.CertProxyHeader, header)
+	assert.Nil(t, LoadCertificate(c))
+
+	id, gErr = GetID(c)
+	assert.Nil(t, gErr)
+	assert.Equal(t, u.ID, id)
+
+	// expect error: unbound
+	assert.Nil(t, u.UnbindCertificate("dns:billing.internal"))
+
+	c, r = certContext("10.1.2.3:4000")
+	r.Header.Set(Config.CertProxyHeader, header)
+
+	err = LoadCertificate(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCertificate, err.Code)
+
+	err = u.UnbindCertificate("dns:billing.internal")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCertificateNotFound, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+}
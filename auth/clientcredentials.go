@@ -0,0 +1,329 @@
+package users
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// ClientCredentialsGrantType is the grant_type of service clients asking a token for themselves
+const ClientCredentialsGrantType = "client_credentials"
+
+// ClientAssertionType is the client_assertion_type of private_key_jwt, rfc 7523
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// scopes of the service clients, their tokens carry them instead of a power
+const (
+	// ServiceScopeUsersRead lists and reads users
+	ServiceScopeUsersRead = "users:read"
+	// ServiceScopeUsersWrite changes, unlocks and deletes users
+	ServiceScopeUsersWrite = "users:write"
+	// ServiceScopeStats reads the monitoring stats
+	ServiceScopeStats = "stats:read"
+)
+
+// ServiceScopes are the scopes a service client can be given
+var ServiceScopes = []string{ServiceScopeUsersRead, ServiceScopeUsersWrite, ServiceScopeStats}
+
+// audience of the tokens of service clients, LoadToken refuses them
+const serviceAudience = "service"
+
+// context key of the client of a service token
+const serviceClientKey = "service_client"
+
+// clientAssertionAlgorithms can sign the assertions of private_key_jwt
+var clientAssertionAlgorithms = []string{"RS256", "ES256"}
+
+// clientAssertionMaxAge is the longest a assertion can be valid for
+const clientAssertionMaxAge = 5 * time.Minute
+
+// a assertion is only accepted once, its jti is kept until it expires
+const sqlUseClientAssertion = `INSERT INTO ` + TableClientAssertion + ` (client_id, jti, expires) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+
+// normalizeServiceScope checks the scopes and removes the repeated ones
+func normalizeServiceScope(scopes []string) (string, *errors.Error) {
+	var list []string
+	for _, s := range scopes {
+		if !containsString(ServiceScopes, s) {
+			return "", errors.FromCode(errors.ErrorInvalidScope)
+		}
+
+		if !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+
+	if len(list) == 0 {
+		return "", errors.FromCode(errors.ErrorInvalidScope)
+	}
+
+	return strings.Join(list, " "), nil
+}
+
+// parseClientKey parses the pem of the public key of a client
+func parseClientKey(pem string) (interface{}, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+
+	return jwt.ParseECPublicKeyFromPEM([]byte(pem))
+}
+
+// CreateServiceClient registers a backend service calling the api as itself
+// it authenticates with the secret, only returned here,
+// or, when the pem of a public key is given, with private_key_jwt
+func CreateServiceClient(name string, scopes []string, publicKey string) (*OAuthClient, string, *errors.Error) {
+	if name == "" {
+		return nil, "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	scope, err := normalizeServiceScope(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if publicKey != "" {
+		if _, gErr := parseClientKey(publicKey); gErr != nil {
+			return nil, "", errors.FromCode(errors.ErrorInvalidRequest)
+		}
+	}
+
+	clientID, gErr := util.RandomToken(16)
+	if gErr != nil {
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	c := &OAuthClient{
+		ClientID:  clientID,
+		Name:      name,
+		Scopes:    scope,
+		PublicKey: publicKey,
+		Created:   time.Now(),
+	}
+
+	var secret string
+	if publicKey == "" {
+		if secret, gErr = util.RandomToken(32); gErr != nil {
+			return nil, "", errors.FromErr(gErr)
+		}
+
+		c.Secret = util.HashToken(secret)
+	}
+
+	id, gErr := qc.Insert(c)
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[CreateServiceClient]: Error while inserting")
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	c.ID = id.(int64)
+
+	Logger.WithFields(log.Fields{
+		"client": clientID,
+		"name":   name,
+		"scopes": scope,
+	}).Info("[CreateServiceClient]: Client registered")
+	return c, secret, nil
+}
+
+// AuthenticateClientAssertion checks the jwt of a private_key_jwt client
+// it's signed by the key of the client, which is its issuer and subject,
+// for the token endpoint and short lived
+func AuthenticateClientAssertion(assertion string) (*OAuthClient, *errors.Error) {
+	unverified, _, gErr := new(jwt.Parser).ParseUnverified(assertion, jwt.MapClaims{})
+	if gErr != nil {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	clientID, _ := unverified.Claims.(jwt.MapClaims)["iss"].(string)
+	c, err := FindOAuthClient(clientID)
+	if err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return nil, errors.FromCode(errors.ErrorInvalidClient)
+		}
+
+		return nil, err
+	}
+
+	if c.PublicKey == "" {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	token, gErr := jwt.Parse(assertion, func(t *jwt.Token) (interface{}, error) {
+		key, err := parseClientKey(c.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		// the algorithm must fit the key
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if t.Method.Alg() == "RS256" {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if t.Method.Alg() == "ES256" {
+				return key, nil
+			}
+		}
+
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+	})
+	if gErr != nil || !token.Valid {
+		Logger.WithError(gErr).WithField("client", clientID).Debug("[AuthenticateClientAssertion]: Invalid assertion")
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	endpoint := strings.TrimSuffix(Config.OIDCIssuer, "/") + "/api/v1/oauth/token"
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Unix(int64(exp), 0).After(time.Now().Add(clientAssertionMaxAge)) {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sub), []byte(c.ClientID)) != 1 || !claims.VerifyAudience(endpoint, true) {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" || len(jti) > 255 {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	// assertions nobody can use anymore
+	now := time.Now()
+	if gErr = nc.Find(db.Cond{"expires <": now}).Delete(); gErr != nil {
+		Logger.WithError(gErr).Error("[AuthenticateClientAssertion]: Error while removing the expired assertions")
+	}
+
+	res, gErr := session.Exec(sqlUseClientAssertion, c.ClientID, jti, time.Unix(int64(exp), 0))
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	if n, gErr := res.RowsAffected(); gErr != nil || n == 0 {
+		Logger.WithField("client", clientID).Warn("[AuthenticateClientAssertion]: Assertion replayed")
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	return c, nil
+}
+
+// IssueServiceToken creates the token of the client for the scope
+// asked, space separated, or for every scope of the client when empty
+func IssueServiceToken(c *OAuthClient, scope string) (string, string, *errors.Error) {
+	if c.Scopes == "" {
+		return "", "", errors.FromCode(errors.ErrorUnauthorizedClient)
+	}
+
+	allowed := strings.Fields(c.Scopes)
+	asked := strings.Fields(scope)
+	if len(asked) == 0 {
+		asked = allowed
+	}
+
+	for _, s := range asked {
+		if !containsString(allowed, s) {
+			return "", "", errors.FromCode(errors.ErrorInvalidScope)
+		}
+	}
+
+	scope, err := normalizeServiceScope(asked)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	claims := &UserToken{
+		Scope:    scope,
+		ClientID: c.ClientID,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  serviceAudience,
+			Subject:   c.ClientID,
+			ExpiresAt: now.Add(Config.OIDCTokenTime).Unix(),
+			IssuedAt:  now.Unix(),
+			Issuer:    issuer,
+			NotBefore: now.Unix(),
+		},
+	}
+
+	s, gErr := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Config.TokenSecret)
+	if gErr != nil {
+		return "", "", errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"client": c.ClientID,
+		"scope":  scope,
+	}).Info("[IssueServiceToken]: Token issued")
+	return s, scope, nil
+}
+
+// LoadServiceToken parses the service token of the authorization header
+// and stores it in the context, it returns false for any other bearer
+// a client removed after the token was issued is refused
+func LoadServiceToken(c echo.Context) (bool, *errors.Error) {
+	bearer, gErr := jwtFromHeader(echo.HeaderAuthorization)(c)
+	if gErr != nil || IsAccessTokenSecret(bearer) {
+		return false, nil
+	}
+
+	token, gErr := parseBearer(c, bearer)
+	if gErr != nil || !token.Valid {
+		return false, nil
+	}
+
+	claims, ok := token.Claims.(*UserToken)
+	if !ok || !claims.VerifyAudience(serviceAudience, true) {
+		return false, nil
+	}
+
+	client, err := FindOAuthClient(claims.ClientID)
+	if err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return false, errors.FromCode(errors.ErrorUnauthorized)
+		}
+
+		return false, err
+	}
+
+	c.Set(middleware.DefaultJWTConfig.ContextKey, token)
+	c.Set(serviceClientKey, client)
+	return true, nil
+}
+
+// GetServiceClient gets the client of the service token of the request
+// it returns nil for the tokens of users
+func GetServiceClient(c echo.Context) *OAuthClient {
+	client, _ := c.Get(serviceClientKey).(*OAuthClient)
+	return client
+}
+
+// ServiceTokenAllows checks if the service token of the request has the scope
+// the client must still have it too
+func ServiceTokenAllows(c echo.Context, scope string) bool {
+	client := GetServiceClient(c)
+	token, ok := c.Get(middleware.DefaultJWTConfig.ContextKey).(*jwt.Token)
+	if client == nil || !ok {
+		return false
+	}
+
+	claims, ok := token.Claims.(*UserToken)
+	return ok && containsString(strings.Fields(claims.Scope), scope) &&
+		containsString(strings.Fields(client.Scopes), scope)
+}
@@ -0,0 +1,144 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCredentials(t *testing.T) {
+	// expect error: unknown scope
+	_, _, err := CreateServiceClient("billing", []string{"admin"}, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidScope, err.Code)
+
+	// expect error: not a pem
+	_, _, err = CreateServiceClient("billing", []string{ServiceScopeUsersRead}, "key")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidRequest, err.Code)
+
+	// ok: with a secret
+	client, secret, err := CreateServiceClient("billing", []string{ServiceScopeUsersRead, ServiceScopeStats}, "")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, secret)
+	assert.False(t, client.Public())
+
+	_, err = AuthenticateOAuthClient(client.ClientID, secret)
+	assert.Nil(t, err)
+
+	// expect error: scope the client doesn't have
+	_, _, err = IssueServiceToken(client, ServiceScopeUsersWrite)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidScope, err.Code)
+
+	// ok: every scope of the client
+	_, scope, err := IssueServiceToken(client, "")
+	assert.Nil(t, err)
+	assert.Equal(t, ServiceScopeUsersRead+" "+ServiceScopeStats, scope)
+
+	// ok: part of them
+	token, scope, err := IssueServiceToken(client, ServiceScopeStats)
+	assert.Nil(t, err)
+	assert.Equal(t, ServiceScopeStats, scope)
+
+	c := bearerContext(echo.GET, token)
+	ok, err := LoadServiceToken(c)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, client.ClientID, GetServiceClient(c).ClientID)
+	assert.True(t, ServiceTokenAllows(c, ServiceScopeStats))
+	assert.False(t, ServiceTokenAllows(c, ServiceScopeUsersRead))
+
+	// expect error: it isn't the token of a user
+	assert.Error(t, LoadToken(bearerContext(echo.GET, token)))
+
+	// expect error: clients of users can't use the grant
+	app, _, err := CreateOAuthClient("app", []string{"https://app.example.com/callback"}, false)
+	assert.Nil(t, err)
+
+	_, _, err = IssueServiceToken(app, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorizedClient, err.Code)
+
+	// ok: private_key_jwt
+	key, gErr := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, gErr)
+
+	der, gErr := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, gErr)
+
+	public := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	keyed, secret, err := CreateServiceClient("reports", []string{ServiceScopeUsersRead}, public)
+	assert.Nil(t, err)
+	assert.Empty(t, secret)
+	assert.False(t, keyed.Public())
+
+	jti := 0
+	assertion := func(aud string, exp time.Duration) string {
+		jti++
+		s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{
+			Id:        strconv.Itoa(jti),
+			Issuer:    keyed.ClientID,
+			Subject:   keyed.ClientID,
+			Audience:  aud,
+			ExpiresAt: time.Now().Add(exp).Unix(),
+		}).SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	endpoint := strings.TrimSuffix(Config.OIDCIssuer, "/") + "/api/v1/oauth/token"
+	signed := assertion(endpoint, time.Minute)
+	found, err := AuthenticateClientAssertion(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, keyed.ClientID, found.ClientID)
+
+	// expect error: used already
+	_, err = AuthenticateClientAssertion(signed)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// expect error: without a jti
+	unnamed, gErr := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{
+		Issuer:    keyed.ClientID,
+		Subject:   keyed.ClientID,
+		Audience:  endpoint,
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}).SignedString(key)
+	assert.NoError(t, gErr)
+
+	_, err = AuthenticateClientAssertion(unnamed)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// expect error: another audience
+	_, err = AuthenticateClientAssertion(assertion("https://other.example.com", time.Minute))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// expect error: lives too long
+	_, err = AuthenticateClientAssertion(assertion(endpoint, time.Hour))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// expect error: the token of a removed client
+	assert.Nil(t, DeleteOAuthClient(client.ClientID))
+
+	_, err = LoadServiceToken(bearerContext(echo.GET, token))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	assert.Nil(t, DeleteOAuthClient(keyed.ClientID))
+	assert.Nil(t, DeleteOAuthClient(app.ClientID))
+}
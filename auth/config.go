@@ -1,6 +1,9 @@
 package users
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"runtime"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,13 +15,230 @@ type Cfg struct {
 	TokenExpirationTime time.Duration
 	TokenSecret         []byte
 
+	// EncryptionLevel is the bcrypt cost, "authenticaTed calibrate"
+	// measures it once and the generated code sets it here
+	// HashTargetTime is how long a single hash should take
 	EncryptionLevel int
 	EncryptionKey   string
+	HashTargetTime  time.Duration
+
+	// password policy, bcrypt only uses the first 72 bytes
+	PasswordMinLength int
+	PasswordMaxLength int
+
+	// HideAccountExistence makes login and sign up give the same
+	// answers and take the same time for existing and missing users
+	HideAccountExistence bool
+
+	// failed logins
+	// after LockoutThreshold failures in LockoutWindow the account is locked
+	// for LockoutDuration, doubled by every lock until LockoutMaxDuration
+	// every failure waits LockoutDelay doubled until LockoutMaxDelay, except
+	// with HideAccountExistence where missing users would answer faster
+	// the locks are forgotten when the last one ended LockoutReset ago
+	LockoutThreshold   int
+	LockoutWindow      time.Duration
+	LockoutDuration    time.Duration
+	LockoutMaxDuration time.Duration
+	LockoutDelay       time.Duration
+	LockoutMaxDelay    time.Duration
+	LockoutReset       time.Duration
+
+	// second factor
+	// MFAIssuer is the name shown in authenticator apps
+	// MFAChallengeTime is how long the second login step can take
+	MFAIssuer        string
+	MFAChallengeTime time.Duration
+
+	// MFARequired makes users with MFARequiredPower or more
+	// add a second factor on their next login
+	MFARequired      bool
+	MFARequiredPower UserPower
+
+	// passkeys
+	// WebAuthnRPID is the domain the credentials are bound to
+	// WebAuthnOrigins are the origins allowed to use them
+	// WebAuthnTimeout is how long a ceremony can take
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+	WebAuthnTimeout time.Duration
+
+	// login links
+	// MagicLinkURL is the page that consumes the link, the token is appended
+	// MagicLinkBindBrowser makes links only work on the browser that asked for them
+	MagicLinkURL         string
+	MagicLinkTime        time.Duration
+	MagicLinkBindBrowser bool
+
+	// email codes, EmailCodeDigits goes from 6 to 8
+	// a code is removed after EmailCodeAttempts wrong tries
+	// EmailCodeResend is how long until another one can be sent
+	// EmailCodeFallback lets them replace the authenticator app on AuthMFA
+	// it's off by default, the email alone becomes enough for the second step
+	EmailCodeDigits   int
+	EmailCodeTime     time.Duration
+	EmailCodeAttempts int
+	EmailCodeResend   time.Duration
+	EmailCodeFallback bool
+
+	// sms codes, work like the email ones
+	SMSCodeTime     time.Duration
+	SMSCodeAttempts int
+	SMSCodeResend   time.Duration
+	SMSCodeFallback bool
+
+	// SMSSender sends the text messages, the default only logs them
+	SMSSender SMSSender
+
+	// TrustedDeviceTime is how long a remembered
+	// device skips the second factor
+	TrustedDeviceTime time.Duration
+
+	// device authorization grant
+	// DeviceVerificationURI is the page where users type the user code
+	// DeviceCodeInterval is how long devices wait between polls
+	DeviceVerificationURI string
+	DeviceCodeTime        time.Duration
+	DeviceCodeInterval    time.Duration
+
+	// client certificates
+	// CertClientCAs verifies certificates the tls server didn't verify
+	// CertProxyHeader has the url encoded pem sent by a proxy doing the tls,
+	// it's only read from the ips or cidrs in CertTrustedProxies
+	CertClientCAs      *x509.CertPool
+	CertProxyHeader    string
+	CertTrustedProxies []string
+
+	// AccessTokenPrefix starts the secrets of the access tokens
+	// so they can be told apart from jwts and found by secret scanners
+	AccessTokenPrefix string
+
+	// OIDCProviders are the issuers users can log in with, by name
+	// OIDCStateTime is how long a login can wait for the callback
+	OIDCProviders map[string]*OIDCProvider
+	OIDCStateTime time.Duration
+
+	// openid connect provider
+	// OIDCIssuer is the public url of authenticaTed, the iss of the id tokens
+	// OIDCSigningKey signs the id tokens, a new one is made on every start when nil
+	// OIDCConsentURL is the page of the frontend asking the user to allow a client
+	// OIDCCodeTime is how long a authorization code can wait for the token endpoint
+	// OIDCTokenTime is how long the id and access tokens given to clients last
+	OIDCIssuer     string
+	OIDCSigningKey *rsa.PrivateKey
+	OIDCConsentURL string
+	OIDCCodeTime   time.Duration
+	OIDCTokenTime  time.Duration
+
+	// ServiceClientPower is the power from which users can't be
+	// changed or removed by service clients, only by admins
+	ServiceClientPower UserPower
+
+	// SAMLProviders are the saml identity providers users can log in with, by name
+	// SAMLRequestTime is how long a login can wait for the response
+	SAMLProviders   map[string]*SAMLProvider
+	SAMLRequestTime time.Duration
+
+	// AuthBackends check the passwords of users that aren't local, in order
+	AuthBackends []AuthBackend
+
+	// LegacyAuth moves the users of the old auth service on their first login, nil disables it
+	LegacyAuth *LegacyAuth
+
+	// forward auth for proxies, GET /api/v1/auth/verify
+	// VerifyCookie has the jwt of browsers, it's read when there is no authorization header
+	// VerifyLoginURL is the login page given to browsers, the original url goes in its rd param
+	VerifyCookie   string
+	VerifyLoginURL string
+
+	// ImpersonationTime is how long the tokens of admins impersonating users last
+	ImpersonationTime time.Duration
+
+	// Mailer sends the emails, the default only logs them
+	Mailer Mailer
+
+	// bcrypt worker pool
+	// HashWorkers <= 0 uses one worker per cpu
+	// HashTimeout is how long a hash can wait in the queue
+	HashWorkers   int
+	HashQueueSize int
+	HashTimeout   time.Duration
 }
 
 var Config = &Cfg{
 	TokenExpirationTime: 7 * 24 * time.Hour, // a week
 	EncryptionLevel:     15,
+	HashTargetTime:      3 * time.Second,
+
+	PasswordMinLength: 8,
+	PasswordMaxLength: 72,
+
+	LockoutThreshold:   5,
+	LockoutWindow:      15 * time.Minute,
+	LockoutDuration:    15 * time.Minute,
+	LockoutMaxDuration: 24 * time.Hour,
+	LockoutDelay:       250 * time.Millisecond,
+	LockoutMaxDelay:    4 * time.Second,
+	LockoutReset:       7 * 24 * time.Hour,
+
+	MFAIssuer:        "authenticaTed",
+	MFAChallengeTime: 5 * time.Minute,
+	MFARequiredPower: UserPowerMod,
+
+	WebAuthnRPID:    "localhost",
+	WebAuthnRPName:  "authenticaTed",
+	WebAuthnOrigins: []string{"http://localhost"},
+	WebAuthnTimeout: 5 * time.Minute,
+
+	MagicLinkURL:  "http://localhost/login/link?token=",
+	MagicLinkTime: 15 * time.Minute,
+
+	EmailCodeDigits:   6,
+	EmailCodeTime:     10 * time.Minute,
+	EmailCodeAttempts: 5,
+	EmailCodeResend:   time.Minute,
+	EmailCodeFallback: false,
+
+	SMSCodeTime:     5 * time.Minute,
+	SMSCodeAttempts: 5,
+	SMSCodeResend:   time.Minute,
+	SMSCodeFallback: false,
+	SMSSender:       &LogSMSSender{},
+
+	TrustedDeviceTime: 30 * 24 * time.Hour, // a month
+
+	DeviceVerificationURI: "http://localhost/device",
+	DeviceCodeTime:        10 * time.Minute,
+	DeviceCodeInterval:    5 * time.Second,
+
+	CertProxyHeader: "X-Client-Cert",
+
+	AccessTokenPrefix: "atd_",
+
+	OIDCProviders: map[string]*OIDCProvider{},
+	OIDCStateTime: 10 * time.Minute,
+
+	OIDCIssuer:     "http://localhost",
+	OIDCConsentURL: "http://localhost/oauth/consent",
+	OIDCCodeTime:   time.Minute,
+	OIDCTokenTime:  time.Hour,
+
+	ServiceClientPower: UserPowerMod,
+
+	SAMLProviders:   map[string]*SAMLProvider{},
+	SAMLRequestTime: 10 * time.Minute,
+
+	VerifyCookie:   "token",
+	VerifyLoginURL: "http://localhost/login",
+
+	ImpersonationTime: 15 * time.Minute,
+
+	Mailer: &LogMailer{},
+
+	HashWorkers:   runtime.NumCPU(),
+	HashQueueSize: 32,
+	HashTimeout:   10 * time.Second,
 
 	TokenSecret: secret.TokenSecret,
 
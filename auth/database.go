@@ -14,6 +14,26 @@ const Table = `users`
 const TableBan = `user_bans`
 const TableEvents = `user_events`
 const TableActivation = `user_activation`
+const TableLockout = `user_lockouts`
+const TableTOTP = `user_totp`
+const TableRecovery = `user_recovery_codes`
+const TableWebAuthn = `user_webauthn`
+const TableWebAuthnSession = `webauthn_sessions`
+const TableMagicLink = `user_magic_links`
+const TableEmailCode = `user_email_codes`
+const TableSMSCode = `user_sms_codes`
+const TableDevice = `user_devices`
+const TableDeviceCode = `device_codes`
+const TableCertificate = `user_certificates`
+const TableAccessToken = `user_access_tokens`
+const TableIdentity = `user_identities`
+const TableOIDCState = `oidc_states`
+const TableOAuthClient = `oauth_clients`
+const TableOAuthConsent = `oauth_consents`
+const TableOAuthCode = `oauth_codes`
+const TableSAMLRequest = `saml_requests`
+const TableMigration = `user_migrations`
+const TableClientAssertion = `oauth_client_assertions`
 
 var (
 	session sqlbuilder.Database
@@ -22,6 +42,26 @@ var (
 	bc db.Collection
 	ac db.Collection
 	ec db.Collection
+	lc db.Collection
+	tc db.Collection
+	rc db.Collection
+	wc db.Collection
+	cc db.Collection
+	mc db.Collection
+	oc db.Collection
+	sc db.Collection
+	dc db.Collection
+	gc db.Collection
+	kc db.Collection
+	pc db.Collection
+	xc db.Collection
+	yc db.Collection
+	qc db.Collection
+	vc db.Collection
+	zc db.Collection
+	fc db.Collection
+	jc db.Collection
+	nc db.Collection
 
 	isTest   = false
 	settings = postgresql.ConnectionURL{
@@ -69,6 +109,84 @@ func Connect() *errors.Error {
 	ec = session.Collection(TableEvents)
 	CheckCollection(ec, TableEvents)
 
+	// failed logins
+	lc = session.Collection(TableLockout)
+	CheckCollection(lc, TableLockout)
+
+	// second factor
+	tc = session.Collection(TableTOTP)
+	CheckCollection(tc, TableTOTP)
+
+	rc = session.Collection(TableRecovery)
+	CheckCollection(rc, TableRecovery)
+
+	// passkeys
+	wc = session.Collection(TableWebAuthn)
+	CheckCollection(wc, TableWebAuthn)
+
+	cc = session.Collection(TableWebAuthnSession)
+	CheckCollection(cc, TableWebAuthnSession)
+
+	// login links
+	mc = session.Collection(TableMagicLink)
+	CheckCollection(mc, TableMagicLink)
+
+	// email codes
+	oc = session.Collection(TableEmailCode)
+	CheckCollection(oc, TableEmailCode)
+
+	// sms codes
+	sc = session.Collection(TableSMSCode)
+	CheckCollection(sc, TableSMSCode)
+
+	// trusted devices
+	dc = session.Collection(TableDevice)
+	CheckCollection(dc, TableDevice)
+
+	// device authorization grant
+	gc = session.Collection(TableDeviceCode)
+	CheckCollection(gc, TableDeviceCode)
+
+	// client certificate bindings
+	kc = session.Collection(TableCertificate)
+	CheckCollection(kc, TableCertificate)
+
+	// personal access tokens
+	pc = session.Collection(TableAccessToken)
+	CheckCollection(pc, TableAccessToken)
+
+	// external identities
+	xc = session.Collection(TableIdentity)
+	CheckCollection(xc, TableIdentity)
+
+	// oidc logins waiting for the callback
+	yc = session.Collection(TableOIDCState)
+	CheckCollection(yc, TableOIDCState)
+
+	// apps logging in through the oidc provider
+	qc = session.Collection(TableOAuthClient)
+	CheckCollection(qc, TableOAuthClient)
+
+	// scopes users allowed the apps
+	vc = session.Collection(TableOAuthConsent)
+	CheckCollection(vc, TableOAuthConsent)
+
+	// authorization codes waiting for the token endpoint
+	zc = session.Collection(TableOAuthCode)
+	CheckCollection(zc, TableOAuthCode)
+
+	// saml logins waiting for the response
+	fc = session.Collection(TableSAMLRequest)
+	CheckCollection(fc, TableSAMLRequest)
+
+	// users created from the legacy auth service
+	jc = session.Collection(TableMigration)
+	CheckCollection(jc, TableMigration)
+
+	// assertions of private_key_jwt used until they expire
+	nc = session.Collection(TableClientAssertion)
+	CheckCollection(nc, TableClientAssertion)
+
 	return nil
 }
 
@@ -0,0 +1,167 @@
+package users
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// audience of the trusted device tokens
+const deviceAudience = "device"
+
+// Device is a browser where the user passed the second factor
+// and asked to be remembered, logins from it skip the second factor
+// only the hash of its secret is stored, the secret goes in a signed cookie
+type Device struct {
+	ID     int64      `db:"id,omitempty" json:"id,string"`
+	UserID hide.Int64 `db:"user_id"      json:"user_id,string"`
+	Name   string     `db:"name"         json:"name"`
+	Secret string     `db:"secret"       json:"-"`
+
+	Created  time.Time `db:"created"      json:"created"`
+	LastUsed time.Time `db:"last_used"    json:"last_used"`
+	Expires  time.Time `db:"expires"      json:"expires"`
+}
+
+// TrustDevice remembers the browser after a second factor
+// it returns the signed token that must be kept in a cookie
+func (u *User) TrustDevice(name string) (string, *errors.Error) {
+	l := Logger.WithField("ID", u.ID)
+
+	if u.ID == 0 {
+		return "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	secret, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	if len(name) > 255 {
+		name = name[:255]
+	}
+
+	now := time.Now()
+	_, gErr = dc.Insert(&Device{
+		UserID:   u.ID,
+		Name:     name,
+		Secret:   util.HashToken(secret),
+		Created:  now,
+		LastUsed: now,
+		Expires:  now.Add(Config.TrustedDeviceTime),
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.TrustDevice]: Error while inserting")
+		return "", errors.FromErr(gErr)
+	}
+
+	l.Debug("[User.TrustDevice]: Device trusted")
+	return u.signChallenge(deviceAudience, Config.TrustedDeviceTime, secret)
+}
+
+// AuthDevice finishes the login of the challenge given by Auth with
+// the token of a trusted device instead of a second factor code
+// the token stops working after a password change or when the device is revoked
+func (u *User) AuthDevice(challenge, device string) (string, *errors.Error) {
+	l := Logger.WithField("step", "device")
+	l.Debug("[User.AuthDevice]: Authenticating user...")
+
+	if err := u.FindChallenge(challenge); err != nil {
+		return "", err
+	}
+
+	l = l.WithFields(log.Fields{
+		"ID":       u.ID,
+		"Username": u.Username,
+	})
+
+	claims, id, err := parseChallenge(device, deviceAudience)
+	if err != nil || id != u.ID || claims.Version != u.TokenVersion {
+		l.Debug("[User.AuthDevice]: Invalid device token")
+		return "", errors.FromCode(errors.ErrorInvalidDevice)
+	}
+
+	var d *Device
+	gErr := dc.Find(db.Cond{
+		"user_id": u.ID,
+		"secret":  util.HashToken(claims.Id),
+	}).One(&d)
+	if gErr == db.ErrNoMoreRows {
+		l.Debug("[User.AuthDevice]: Device revoked")
+		return "", errors.FromCode(errors.ErrorInvalidDevice)
+	}
+
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	if time.Now().After(d.Expires) {
+		return "", errors.FromCode(errors.ErrorInvalidDevice)
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	gErr = dc.Find(db.Cond{"id": d.ID}).Update(map[string]interface{}{
+		"last_used": time.Now(),
+	})
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	l.Debug("[User.AuthDevice]: Token created for user")
+	return u.IssueMFAToken()
+}
+
+// Devices lists the trusted devices of the user
+func (u *User) Devices() ([]*Device, *errors.Error) {
+	var list []*Device
+
+	err := dc.Find(db.Cond{"user_id": u.ID}).OrderBy("-last_used").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// RevokeDevice stops trusting a device of the user
+func (u *User) RevokeDevice(id int64) *errors.Error {
+	r := dc.Find(db.Cond{"id": id, "user_id": u.ID})
+
+	count, err := r.Count()
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if count == 0 {
+		return errors.FromCode(errors.ErrorDeviceNotFound)
+	}
+
+	if err = r.Delete(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":     u.ID,
+		"device": id,
+	}).Debug("[User.RevokeDevice]: Device revoked")
+	return nil
+}
+
+// RevokeDevices stops trusting every device of the user
+func (u *User) RevokeDevices() *errors.Error {
+	return errors.FromErr(dc.Find(db.Cond{"user_id": u.ID}).Delete())
+}
@@ -0,0 +1,100 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedDevice(t *testing.T) {
+	u := NewUser()
+	u.Username = "Device_User"
+	u.Email = "device_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	e, err := u.EnrollTOTP()
+	assert.Nil(t, err)
+	_, err = u.ConfirmTOTP(totpCode(t, e.Secret, 0))
+	assert.Nil(t, err)
+
+	// login asking to be remembered
+	fu := NewUser()
+	fu.Username = u.Username
+	challenge, err := fu.Auth("password")
+	assert.Nil(t, err)
+
+	_, err = fu.AuthMFA(challenge, totpCode(t, e.Secret, 1))
+	assert.Nil(t, err)
+
+	device, err := fu.TrustDevice("Firefox on Linux")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, device)
+
+	// expect error: the device token isn't a challenge
+	_, err = NewUser().AuthMFA(device, totpCode(t, e.Secret, 2))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidChallenge, err.Code)
+
+	// ok: the next login skips the code
+	fu = NewUser()
+	fu.Username = u.Username
+	challenge, err = fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAPending)
+
+	token, err := NewUser().AuthDevice(challenge, device)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	list, err := u.Devices()
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "Firefox on Linux", list[0].Name)
+
+	// expect error: only works for its own user
+	o := NewUser()
+	o.Username = "Device_Other"
+	o.Email = "device_other@mail.com"
+	o.Password = "password"
+	_, err = o.Create()
+	assert.Nil(t, err)
+
+	other, err := o.IssueChallenge()
+	assert.Nil(t, err)
+
+	_, err = NewUser().AuthDevice(other, device)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidDevice, err.Code)
+
+	// expect error: revoked
+	assert.Nil(t, u.RevokeDevice(list[0].ID))
+
+	_, err = NewUser().AuthDevice(challenge, device)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidDevice, err.Code)
+
+	err = u.RevokeDevice(list[0].ID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorDeviceNotFound, err.Code)
+
+	// expect error: a password change forgets the devices
+	device, err = u.TrustDevice("Chrome")
+	assert.Nil(t, err)
+	assert.Nil(t, u.ChangePassword("password", "new password"))
+
+	fu = NewUser()
+	fu.Username = u.Username
+	challenge, err = fu.Auth("new password")
+	assert.Nil(t, err)
+
+	_, err = NewUser().AuthDevice(challenge, device)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidDevice, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, o.HardDelete())
+}
@@ -0,0 +1,299 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// DeviceCodeGrantType is the grant_type of the token requests polling a device code
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// states of a device code
+const (
+	deviceCodePending  = "pending"
+	deviceCodeApproved = "approved"
+	deviceCodeDenied   = "denied"
+)
+
+// user codes avoid vowels and look alike characters, rfc 8628 section 6.1
+const (
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+)
+
+// how much the polling interval grows on slow_down
+const deviceCodeSlowDown = 5 * time.Second
+
+// only one poll can take the token of a approved code
+const sqlUseDeviceCode = `DELETE FROM ` + TableDeviceCode + ` WHERE id = ? AND state = '` + deviceCodeApproved + `'`
+
+// DeviceCode is a login started by a device without a keyboard
+// it's approved by a logged in user typing the user code
+// only the hashes of the codes are stored
+type DeviceCode struct {
+	ID         int64      `db:"id,omitempty"`
+	DeviceCode string     `db:"device_code"`
+	UserCode   string     `db:"user_code"`
+	ClientID   string     `db:"client_id"`
+	Scope      string     `db:"scope"`
+	UserID     hide.Int64 `db:"user_id"`
+	State      string     `db:"state"`
+
+	// approved from a session that passed a second factor
+	MFA bool `db:"mfa"`
+
+	// seconds between polls, increased by slow_down
+	Interval int       `db:"interval"`
+	LastPoll time.Time `db:"last_poll"`
+	Created  time.Time `db:"created"`
+	Expires  time.Time `db:"expires"`
+}
+
+// DeviceAuthorization is the answer to a device authorization request
+// rfc 8628 section 3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// newUserCode creates a code like WDJB-MJHT
+func newUserCode() (string, error) {
+	b, err := util.RandomBytes(userCodeLength)
+	if err != nil {
+		return "", err
+	}
+
+	code := make([]byte, 0, userCodeLength+1)
+	for i, c := range b {
+		if i == userCodeLength/2 {
+			code = append(code, '-')
+		}
+
+		// 256 isn't a multiple of 20, the small bias is fine for a short lived code
+		code = append(code, userCodeCharset[int(c)%len(userCodeCharset)])
+	}
+
+	return string(code), nil
+}
+
+// normalizeUserCode accepts codes typed without the dash or in lowercase
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// hashUserCode is how user codes are stored
+func hashUserCode(code string) string {
+	return util.HashToken(normalizeUserCode(code))
+}
+
+// NewDeviceAuthorization starts a device login for the client
+// the expired ones are removed on the way
+func NewDeviceAuthorization(clientID, scope string) (*DeviceAuthorization, *errors.Error) {
+	// only registered clients start logins
+	if _, err := FindOAuthClient(clientID); err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return nil, errors.FromCode(errors.ErrorInvalidClient)
+		}
+
+		return nil, err
+	}
+
+	deviceCode, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	userCode, gErr := newUserCode()
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	interval := int(Config.DeviceCodeInterval.Seconds())
+	now := time.Now()
+
+	// logins nobody finished
+	if gErr = gc.Find(db.Cond{"expires <": now}).Delete(); gErr != nil {
+		Logger.WithError(gErr).Error("[NewDeviceAuthorization]: Error while removing the expired codes")
+	}
+
+	_, gErr = gc.Insert(&DeviceCode{
+		DeviceCode: util.HashToken(deviceCode),
+		UserCode:   hashUserCode(userCode),
+		ClientID:   clientID,
+		Scope:      scope,
+		State:      deviceCodePending,
+		Interval:   interval,
+		LastPoll:   now,
+		Created:    now,
+		Expires:    now.Add(Config.DeviceCodeTime),
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[DeviceAuthorization]: Error while inserting")
+		return nil, errors.FromErr(gErr)
+	}
+
+	uri := Config.DeviceVerificationURI
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + sep + "user_code=" + userCode,
+		ExpiresIn:               int(Config.DeviceCodeTime.Seconds()),
+		Interval:                interval,
+	}, nil
+}
+
+// findUserCode finds the pending device code of the user code
+func findUserCode(userCode string) (*DeviceCode, *errors.Error) {
+	var d *DeviceCode
+
+	err := gc.Find(db.Cond{
+		"user_code": hashUserCode(userCode),
+		"state":     deviceCodePending,
+	}).One(&d)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorInvalidUserCode)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if time.Now().After(d.Expires) {
+		return nil, errors.FromCode(errors.ErrorInvalidUserCode)
+	}
+
+	return d, nil
+}
+
+// ApproveDeviceCode lets the device of the user code log in as the user
+// mfa tells if the session approving it passed a second factor
+func (u *User) ApproveDeviceCode(userCode string, mfa bool) *errors.Error {
+	d, err := findUserCode(userCode)
+	if err != nil {
+		return err
+	}
+
+	gErr := gc.Find(db.Cond{"id": d.ID, "state": deviceCodePending}).Update(map[string]interface{}{
+		"user_id": u.ID,
+		"state":   deviceCodeApproved,
+		"mfa":     mfa,
+	})
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":     u.ID,
+		"client": d.ClientID,
+	}).Info("[User.ApproveDeviceCode]: Device approved")
+	return nil
+}
+
+// DenyDeviceCode refuses the login of the device of the user code
+func (u *User) DenyDeviceCode(userCode string) *errors.Error {
+	d, err := findUserCode(userCode)
+	if err != nil {
+		return err
+	}
+
+	gErr := gc.Find(db.Cond{"id": d.ID}).Update(map[string]interface{}{
+		"user_id": u.ID,
+		"state":   deviceCodeDenied,
+	})
+
+	return errors.FromErr(gErr)
+}
+
+// PollDeviceCode is called by the device until the user answers
+// it returns the token once approved, the errors follow rfc 8628 section 3.5
+// ErrorAuthorizationPending, ErrorSlowDown, ErrorAccessDenied and ErrorExpiredToken
+// the code only answers the client it was issued to
+func (u *User) PollDeviceCode(clientID, deviceCode string) (string, *errors.Error) {
+	var d *DeviceCode
+
+	r := gc.Find(db.Cond{"device_code": util.HashToken(deviceCode)})
+	err := r.One(&d)
+	if err == db.ErrNoMoreRows {
+		return "", errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	if err != nil {
+		return "", errors.FromErr(err)
+	}
+
+	if d.ClientID != clientID {
+		return "", errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	now := time.Now()
+	if now.After(d.Expires) {
+		return "", errors.FromCode(errors.ErrorExpiredToken)
+	}
+
+	switch d.State {
+	case deviceCodeDenied:
+		return "", errors.FromCode(errors.ErrorAccessDenied)
+
+	case deviceCodePending:
+		// polling faster than the interval makes it longer
+		if now.Sub(d.LastPoll) < time.Duration(d.Interval)*time.Second {
+			gErr := r.Update(map[string]interface{}{
+				"interval":  d.Interval + int(deviceCodeSlowDown.Seconds()),
+				"last_poll": now,
+			})
+			if gErr != nil {
+				return "", errors.FromErr(gErr)
+			}
+
+			return "", errors.FromCode(errors.ErrorSlowDown)
+		}
+
+		if gErr := r.Update(map[string]interface{}{"last_poll": now}); gErr != nil {
+			return "", errors.FromErr(gErr)
+		}
+
+		return "", errors.FromCode(errors.ErrorAuthorizationPending)
+	}
+
+	// approved, the device code only gives one token
+	res, gErr := session.Exec(sqlUseDeviceCode, d.ID)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	if n, gErr := res.RowsAffected(); gErr != nil || n == 0 {
+		return "", errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	*u = User{ID: d.UserID}
+	found, fErr := u.Find()
+	if fErr != nil || !found {
+		return "", errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	Logger.WithField("ID", u.ID).Debug("[User.PollDeviceCode]: Token created for device")
+	if d.MFA {
+		return u.IssueMFAToken()
+	}
+
+	return u.IssueToken()
+}
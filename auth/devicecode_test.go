@@ -0,0 +1,107 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+	"upper.io/db.v2"
+)
+
+func TestDeviceCode(t *testing.T) {
+	interval := Config.DeviceCodeInterval
+	defer func() {
+		Config.DeviceCodeInterval = interval
+	}()
+
+	u := NewUser()
+	u.Username = "DeviceCode_User"
+	u.Email = "devicecode_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	client, _, err := CreateOAuthClient("tv", []string{"https://tv.example.com/callback"}, true)
+	assert.Nil(t, err)
+
+	// expect error: unknown client
+	_, err = NewDeviceAuthorization("unknown", "")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// expect error: polling before the interval
+	d, err := NewDeviceAuthorization(client.ClientID, "")
+	assert.Nil(t, err)
+	assert.Len(t, d.UserCode, userCodeLength+1)
+	assert.True(t, strings.HasSuffix(d.VerificationURIComplete, "user_code="+d.UserCode))
+
+	_, err = NewUser().PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorSlowDown, err.Code)
+
+	// no wait from here on
+	Config.DeviceCodeInterval = 0
+	d, err = NewDeviceAuthorization(client.ClientID, "")
+	assert.Nil(t, err)
+
+	_, err = NewUser().PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorAuthorizationPending, err.Code)
+
+	// expect error: unknown user code
+	err = u.ApproveDeviceCode("BCDF-GHJK", false)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidUserCode, err.Code)
+
+	// ok: typed in lowercase without the dash
+	assert.Nil(t, u.ApproveDeviceCode(strings.ToLower(strings.Replace(d.UserCode, "-", "", 1)), false))
+
+	// expect error: the code of another client
+	_, err = NewUser().PollDeviceCode("another", d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidGrant, err.Code)
+
+	fu := NewUser()
+	token, err := fu.PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: single use
+	_, err = NewUser().PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidGrant, err.Code)
+
+	// expect error: denied
+	d, err = NewDeviceAuthorization(client.ClientID, "")
+	assert.Nil(t, err)
+	assert.Nil(t, u.DenyDeviceCode(d.UserCode))
+
+	_, err = NewUser().PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorAccessDenied, err.Code)
+
+	// expect error: expired
+	d, err = NewDeviceAuthorization(client.ClientID, "")
+	assert.Nil(t, err)
+
+	gErr := gc.Find(db.Cond{"user_code": hashUserCode(d.UserCode)}).Update(map[string]interface{}{
+		"expires": time.Now().Add(-time.Minute),
+	})
+	assert.Nil(t, gErr)
+
+	err = u.ApproveDeviceCode(d.UserCode, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidUserCode, err.Code)
+
+	_, err = NewUser().PollDeviceCode(client.ClientID, d.DeviceCode)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorExpiredToken, err.Code)
+
+	assert.Nil(t, gc.Find(db.Cond{"client_id": client.ClientID}).Delete())
+	assert.Nil(t, DeleteOAuthClient(client.ClientID))
+	assert.Nil(t, u.HardDelete())
+}
@@ -0,0 +1,268 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// what a email code can be used for
+const (
+	EmailCodeLogin = "login"
+	EmailCodeMFA   = "mfa"
+)
+
+// email with the code
+const (
+	mailEmailCodeSubject = "Your login code"
+	mailEmailCodeBody    = "Your code is %s, it expires in %s.\n\nIf you didn't try to log in, change your password."
+)
+
+// EmailCode is a numeric code sent by email, only its hash is stored
+// a user has at most one for each purpose
+type EmailCode struct {
+	ID       int64      `db:"id,omitempty"`
+	UserID   hide.Int64 `db:"user_id"`
+	Purpose  string     `db:"purpose"`
+	Code     string     `db:"code"`
+	Attempts int        `db:"attempts"`
+	Sent     time.Time  `db:"sent"`
+	Expires  time.Time  `db:"expires"`
+}
+
+// emailCodeDigits keeps Config.EmailCodeDigits between 6 and 8
+func emailCodeDigits() int {
+	switch {
+	case Config.EmailCodeDigits < 6:
+		return 6
+	case Config.EmailCodeDigits > 8:
+		return 8
+	}
+
+	return Config.EmailCodeDigits
+}
+
+// getEmailCode finds the code of the purpose
+// it returns nil when there is none
+func (u *User) getEmailCode(purpose string) (*EmailCode, *errors.Error) {
+	var c *EmailCode
+
+	err := oc.Find(db.Cond{"user_id": u.ID, "purpose": purpose}).One(&c)
+	if err == db.ErrNoMoreRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return c, nil
+}
+
+// SendEmailCode emails a new code to the user replacing the last one
+// a new code can only be sent after Config.EmailCodeResend
+func (u *User) SendEmailCode(purpose string) *errors.Error {
+	l := Logger.WithFields(log.Fields{
+		"ID":      u.ID,
+		"purpose": purpose,
+	})
+
+	if u.ID == 0 || u.Email == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	last, err := u.getEmailCode(purpose)
+	if err != nil {
+		return err
+	}
+
+	if last != nil && time.Since(last.Sent) < Config.EmailCodeResend {
+		l.Debug("[User.SendEmailCode]: Asked again too soon")
+		return errors.FromCode(errors.ErrorCodeThrottled)
+	}
+
+	code, gErr := util.RandomDigits(emailCodeDigits())
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	if last != nil {
+		if gErr = oc.Find(db.Cond{"id": last.ID}).Delete(); gErr != nil {
+			return errors.FromErr(gErr)
+		}
+	}
+
+	now := time.Now()
+	_, gErr = oc.Insert(&EmailCode{
+		UserID:  u.ID,
+		Purpose: purpose,
+		Code:    util.HashToken(code),
+		Sent:    now,
+		Expires: now.Add(Config.EmailCodeTime),
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.SendEmailCode]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	sendMail(u.Email, mailEmailCodeSubject, fmt.Sprintf(mailEmailCodeBody, code, Config.EmailCodeTime))
+
+	l.Debug("[User.SendEmailCode]: Code sent")
+	return nil
+}
+
+// HasEmailCode checks if a code of the purpose is waiting to be used
+func (u *User) HasEmailCode(purpose string) (bool, *errors.Error) {
+	c, err := u.getEmailCode(purpose)
+	if err != nil || c == nil {
+		return false, err
+	}
+
+	return time.Now().Before(c.Expires) && c.Attempts < Config.EmailCodeAttempts, nil
+}
+
+// VerifyEmailCode checks the code of the purpose, it's removed
+// when it's right or after Config.EmailCodeAttempts wrong ones
+func (u *User) VerifyEmailCode(purpose, code string) *errors.Error {
+	c, err := u.getEmailCode(purpose)
+	if err != nil {
+		return err
+	}
+
+	if c == nil || time.Now().After(c.Expires) || c.Attempts >= Config.EmailCodeAttempts {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	cond := db.Cond{"id": c.ID}
+	if c.Code == util.HashToken(strings.TrimSpace(code)) {
+		return errors.FromErr(oc.Find(cond).Delete())
+	}
+
+	c.Attempts++
+	if c.Attempts >= Config.EmailCodeAttempts {
+		Logger.WithField("ID", u.ID).Debug("[User.VerifyEmailCode]: No attempts left")
+		err = errors.FromErr(oc.Find(cond).Delete())
+	} else {
+		err = errors.FromErr(oc.Find(cond).Update(map[string]interface{}{
+			"attempts": c.Attempts,
+		}))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return errors.FromCode(errors.ErrorInvalidCode)
+}
+
+// SendMFAEmailCode emails a code that works as the second
+// login step with AuthMFA, when the authenticator app is not at hand
+func (u *User) SendMFAEmailCode(challenge string) *errors.Error {
+	if !Config.EmailCodeFallback {
+		return errors.FromCode(errors.ErrorMFANotEnabled)
+	}
+
+	if err := u.FindChallenge(challenge); err != nil {
+		return err
+	}
+
+	return u.SendEmailCode(EmailCodeMFA)
+}
+
+// RequestLoginCode emails a code to log in without the password
+// to the user with the email or username
+// with Config.HideAccountExistence a missing user isn't an error
+func (u *User) RequestLoginCode() *errors.Error {
+	if u.Username == "" && u.Email == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	valid, err := u.Validate()
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return errors.FromCode(errors.ErrorUserInvalid)
+	}
+
+	found, err := u.Find()
+	if err != nil && (!Config.HideAccountExistence || err.Code != errors.ErrorUserDoesntExists) {
+		return err
+	}
+
+	if !found {
+		if Config.HideAccountExistence {
+			u.ID = 0
+			return nil
+		}
+
+		return errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	return u.SendEmailCode(EmailCodeLogin)
+}
+
+// AuthEmailCode logs in the user with the email or username using
+// the code from RequestLoginCode instead of the password
+// it returns the same as Auth, a challenge when a second factor is needed
+func (u *User) AuthEmailCode(code string) (string, *errors.Error) {
+	l := Logger.WithFields(log.Fields{
+		"Username": u.Username,
+		"Email":    u.Email,
+	})
+	l.Debug("[User.AuthEmailCode]: Authenticating user...")
+
+	if code == "" || (u.Username == "" && u.Email == "") {
+		return "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	found, err := u.Find()
+	if err != nil && err.Code != errors.ErrorUserDoesntExists {
+		return "", err
+	}
+
+	// a missing user looks like a wrong code
+	if !found {
+		return "", errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if err = u.VerifyEmailCode(EmailCodeLogin, code); err != nil {
+		l.Debug("[User.AuthEmailCode]: Wrong code")
+
+		lo, lErr := u.LoginFailed()
+		if lErr != nil {
+			return "", lErr
+		}
+
+		if lo != nil {
+			time.Sleep(loginDelay(lo.Failures))
+		}
+
+		return "", err
+	}
+
+	if err = u.LoginSucceeded(); err != nil {
+		return "", err
+	}
+
+	u.AuthMethod = AMROneTimePassword
+	return u.loginToken()
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var emailCode = regexp.MustCompile(`code is (\d+)`)
+
+// lastEmailCode gets the last code emailed to the address
+func lastEmailCode(t *testing.T, m *MemoryMailer, to string) string {
+	mail := m.Last(to)
+	if !assert.NotNil(t, mail) {
+		return ""
+	}
+
+	match := emailCode.FindStringSubmatch(mail.Body)
+	if !assert.Len(t, match, 2) {
+		return ""
+	}
+
+	return match[1]
+}
+
+func TestEmailCode(t *testing.T) {
+	mailer, resend, fallback := Config.Mailer, Config.EmailCodeResend, Config.EmailCodeFallback
+	m := &MemoryMailer{}
+	Config.Mailer = m
+	defer func() {
+		Config.Mailer = mailer
+		Config.EmailCodeResend = resend
+		Config.EmailCodeFallback = fallback
+	}()
+
+	u := NewUser()
+	u.Username = "Code_User"
+	u.Email = "code_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// passwordless
+	ru := NewUser()
+	ru.Email = u.Email
+	assert.Nil(t, ru.RequestLoginCode())
+	code := lastEmailCode(t, m, u.Email)
+	assert.Len(t, code, 6)
+
+	// expect error: asked again too soon
+	err = ru.RequestLoginCode()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCodeThrottled, err.Code)
+
+	// expect error: wrong code
+	fu := NewUser()
+	fu.Email = u.Email
+	_, err = fu.AuthEmailCode("00000000")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// ok
+	fu = NewUser()
+	fu.Email = u.Email
+	token, err := fu.AuthEmailCode(code)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: single use
+	fu = NewUser()
+	fu.Email = u.Email
+	_, err = fu.AuthEmailCode(code)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// expect error: no attempts left, the right code stops working
+	Config.EmailCodeResend = 0
+	assert.Nil(t, u.SendEmailCode(EmailCodeLogin))
+	code = lastEmailCode(t, m, u.Email)
+
+	for i := 0; i < Config.EmailCodeAttempts; i++ {
+		assert.NotNil(t, u.VerifyEmailCode(EmailCodeLogin, "00000000"))
+	}
+
+	err = u.VerifyEmailCode(EmailCodeLogin, code)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// second step after the password instead of the authenticator app
+	e, err := u.EnrollTOTP()
+	assert.Nil(t, err)
+	_, err = u.ConfirmTOTP(totpCode(t, e.Secret, 0))
+	assert.Nil(t, err)
+
+	fu = NewUser()
+	fu.Username = u.Username
+	challenge, err := fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAPending)
+
+	// expect error: the fallback is off by default
+	err = NewUser().SendMFAEmailCode(challenge)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorMFANotEnabled, err.Code)
+
+	Config.EmailCodeFallback = true
+	assert.Nil(t, NewUser().SendMFAEmailCode(challenge))
+	code = lastEmailCode(t, m, u.Email)
+
+	// ok: the authenticator app still works while the code is pending
+	token, err = NewUser().AuthMFA(challenge, totpCode(t, e.Secret, 1))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	// ok
+	token, err = NewUser().AuthMFA(challenge, code)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	assert.Nil(t, u.HardDelete())
+}
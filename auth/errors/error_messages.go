@@ -39,6 +39,55 @@ const (
 	ErrorNoPasswordToCompare
 	ErrorMissingParam
 	ErrorUnauthorized
+	ErrorTryAgain
+	ErrorPasswordTooShort
+	ErrorPasswordTooLong
+	ErrorPasswordUnchanged
+	ErrorUseChangePassword
+	ErrorTokenRevoked
+	ErrorAccountLocked
+	ErrorInvalidCode
+	ErrorInvalidChallenge
+	ErrorMFAAlreadyEnabled
+	ErrorMFANotEnabled
+	ErrorMFARequired
+	ErrorWebAuthnFailed
+	ErrorCredentialNotFound
+	ErrorInvalidMagicLink
+	ErrorCodeThrottled
+	ErrorPhoneInvalid
+	ErrorPhoneExists
+	ErrorInvalidDevice
+	ErrorDeviceNotFound
+	ErrorInvalidUserCode
+	ErrorAuthorizationPending
+	ErrorSlowDown
+	ErrorAccessDenied
+	ErrorExpiredToken
+	ErrorInvalidGrant
+	ErrorInvalidCertificate
+	ErrorCertificateExists
+	ErrorCertificateNotFound
+	ErrorInvalidScope
+	ErrorAccessTokenNotFound
+	ErrorInsufficientScope
+	ErrorUnknownProvider
+	ErrorInvalidState
+	ErrorOIDCFailed
+	ErrorIdentityExists
+	ErrorIdentityNotFound
+	ErrorLastLoginMethod
+	ErrorInvalidClient
+	ErrorInvalidRedirectURI
+	ErrorInvalidRequest
+	ErrorConsentRequired
+	ErrorClientNotFound
+	ErrorSAMLFailed
+	ErrorInvalidFilter
+	ErrorInvalidPatch
+	ErrorCannotImpersonate
+	ErrorImpersonating
+	ErrorUnauthorizedClient
 
 	// this is used to check for missing error messages
 	TotalErrorMessages
@@ -47,32 +96,130 @@ const (
 // ErrorMessages holds all error messages with support for different languages
 var ErrorMessages = map[string]map[ErrorCode]string{
 	"en": {
-		ErrorUserExists:          "The User already exists.",
-		ErrorUsernameExists:      "This username is already registered.",
-		ErrorEmailExists:         "This email is already registered.",
-		ErrorUserDoesntExists:    "This user doesn't exists.",
-		ErrorUserInvalidPassword: "The user and/or password didn't match.", // shouldn't give a clue about what is wrong
-		ErrorUserInvalidUsername: "This username is invalid.",
-		ErrorUserInvalidEmail:    "This email is invalid.",
-		ErrorUserInvalid:         "This user is invalid.",
-		ErrorNotEnoughInfo:       "There is not enough information to find a user.",
-		ErrorNoPasswordToCompare: "There is no password to compare to.",
-		ErrorMissingParam:        "A URL Param is required.",
-		ErrorUnauthorized:        "You're not authorized to access this page.",
+		ErrorUserExists:           "The User already exists.",
+		ErrorUsernameExists:       "This username is already registered.",
+		ErrorEmailExists:          "This email is already registered.",
+		ErrorUserDoesntExists:     "This user doesn't exists.",
+		ErrorUserInvalidPassword:  "The user and/or password didn't match.", // shouldn't give a clue about what is wrong
+		ErrorUserInvalidUsername:  "This username is invalid.",
+		ErrorUserInvalidEmail:     "This email is invalid.",
+		ErrorUserInvalid:          "This user is invalid.",
+		ErrorNotEnoughInfo:        "There is not enough information to find a user.",
+		ErrorNoPasswordToCompare:  "There is no password to compare to.",
+		ErrorMissingParam:         "A URL Param is required.",
+		ErrorUnauthorized:         "You're not authorized to access this page.",
+		ErrorTryAgain:             "The server is busy, please try again later.",
+		ErrorPasswordTooShort:     "This password is too short.",
+		ErrorPasswordTooLong:      "This password is too long.",
+		ErrorPasswordUnchanged:    "The new password must be different from the current one.",
+		ErrorUseChangePassword:    "The password can only be changed with the current password.",
+		ErrorTokenRevoked:         "This session has expired, please log in again.",
+		ErrorAccountLocked:        "Too many failed logins, this account is locked for a while.",
+		ErrorInvalidCode:          "This code is invalid or was already used.",
+		ErrorInvalidChallenge:     "The login expired, please start again.",
+		ErrorMFAAlreadyEnabled:    "Two-factor authentication is already enabled.",
+		ErrorMFANotEnabled:        "Two-factor authentication is not enabled.",
+		ErrorMFARequired:          "This account requires two-factor authentication, please log in again.",
+		ErrorWebAuthnFailed:       "The security key could not be verified.",
+		ErrorCredentialNotFound:   "Security key not found.",
+		ErrorInvalidMagicLink:     "This login link is invalid or has expired.",
+		ErrorCodeThrottled:        "A code was sent recently, please wait before asking for another one.",
+		ErrorPhoneInvalid:         "The phone number must be in the international format, like +5511912345678.",
+		ErrorPhoneExists:          "Phone number already in use.",
+		ErrorInvalidDevice:        "This device is not trusted anymore.",
+		ErrorDeviceNotFound:       "Device not found.",
+		ErrorInvalidUserCode:      "This code is invalid or has expired.",
+		ErrorAuthorizationPending: "The user hasn't approved the device yet.",
+		ErrorSlowDown:             "Polling too fast, wait longer between requests.",
+		ErrorAccessDenied:         "The user denied the request.",
+		ErrorExpiredToken:         "The device code has expired.",
+		ErrorInvalidGrant:         "The grant is invalid or was already used.",
+		ErrorInvalidCertificate:   "The client certificate is invalid or isn't bound to a user.",
+		ErrorCertificateExists:    "This certificate identity is already bound.",
+		ErrorCertificateNotFound:  "Certificate binding not found.",
+		ErrorInvalidScope:         "Unknown scope.",
+		ErrorAccessTokenNotFound:  "Access token not found.",
+		ErrorInsufficientScope:    "The token doesn't have the scope needed for this request.",
+		ErrorUnknownProvider:      "Unknown login provider.",
+		ErrorInvalidState:         "The login expired or was started in another browser, try again.",
+		ErrorOIDCFailed:           "The login provider refused the login, try again.",
+		ErrorIdentityExists:       "This account is already linked to a user.",
+		ErrorIdentityNotFound:     "Linked account not found.",
+		ErrorLastLoginMethod:      "This is the only way to log in, set a password before unlinking it.",
+		ErrorInvalidClient:        "The client is unknown or its credentials are wrong.",
+		ErrorInvalidRedirectURI:   "The redirect uri isn't registered for this client.",
+		ErrorInvalidRequest:       "The request is missing a parameter or has an invalid one.",
+		ErrorConsentRequired:      "The user must allow the client first.",
+		ErrorClientNotFound:       "Client not found.",
+		ErrorSAMLFailed:           "The identity provider response is invalid, try again.",
+		ErrorInvalidFilter:        "The filter is invalid or isn't supported.",
+		ErrorInvalidPatch:         "The patch operation is invalid or isn't supported.",
+		ErrorCannotImpersonate:    "Only users with less power can be impersonated.",
+		ErrorImpersonating:        "This can't be done while impersonating a user.",
+		ErrorUnauthorizedClient:   "The client isn't allowed to use this grant type.",
 	},
 	"pt-br": {
-		ErrorUserExists:          "O Usuario ja existe.",
-		ErrorUsernameExists:      "Esse usuario ja existe.",
-		ErrorEmailExists:         "Esse email ja existe.",
-		ErrorUserDoesntExists:    "Esse usuario não existe.",
-		ErrorUserInvalidPassword: "O usuario e/ou senha não conferem.", // não deve dar pistas sobre o que está errado
-		ErrorUserInvalidUsername: "Esse nome de usuario não é valido.",
-		ErrorUserInvalidEmail:    "Esse email não é valido.",
-		ErrorUserInvalid:         "Usuario invalido.",
-		ErrorNotEnoughInfo:       "Não tenho informação suficiente para encontrar um usuario.",
-		ErrorNoPasswordToCompare: "Não tenho uma senha para compara-la.",
-		ErrorMissingParam:        "Um parametro de url é obrigatorio.",
-		ErrorUnauthorized:        "Você não está autorizado a acessar essa página.",
+		ErrorUserExists:           "O Usuario ja existe.",
+		ErrorUsernameExists:       "Esse usuario ja existe.",
+		ErrorEmailExists:          "Esse email ja existe.",
+		ErrorUserDoesntExists:     "Esse usuario não existe.",
+		ErrorUserInvalidPassword:  "O usuario e/ou senha não conferem.", // não deve dar pistas sobre o que está errado
+		ErrorUserInvalidUsername:  "Esse nome de usuario não é valido.",
+		ErrorUserInvalidEmail:     "Esse email não é valido.",
+		ErrorUserInvalid:          "Usuario invalido.",
+		ErrorNotEnoughInfo:        "Não tenho informação suficiente para encontrar um usuario.",
+		ErrorNoPasswordToCompare:  "Não tenho uma senha para compara-la.",
+		ErrorMissingParam:         "Um parametro de url é obrigatorio.",
+		ErrorUnauthorized:         "Você não está autorizado a acessar essa página.",
+		ErrorTryAgain:             "O servidor está ocupado, tente novamente mais tarde.",
+		ErrorPasswordTooShort:     "Essa senha é muito curta.",
+		ErrorPasswordTooLong:      "Essa senha é muito longa.",
+		ErrorPasswordUnchanged:    "A nova senha deve ser diferente da atual.",
+		ErrorUseChangePassword:    "A senha só pode ser alterada com a senha atual.",
+		ErrorTokenRevoked:         "Essa sessão expirou, faça login novamente.",
+		ErrorAccountLocked:        "Muitas tentativas de login, essa conta está bloqueada por um tempo.",
+		ErrorInvalidCode:          "Esse código é invalido ou já foi usado.",
+		ErrorInvalidChallenge:     "O login expirou, comece novamente.",
+		ErrorMFAAlreadyEnabled:    "A autenticação em dois fatores já está ativada.",
+		ErrorMFANotEnabled:        "A autenticação em dois fatores não está ativada.",
+		ErrorMFARequired:          "Essa conta exige autenticação em dois fatores, faça login novamente.",
+		ErrorWebAuthnFailed:       "Não foi possível verificar a chave de segurança.",
+		ErrorCredentialNotFound:   "Chave de segurança não encontrada.",
+		ErrorInvalidMagicLink:     "Esse link de login é inválido ou expirou.",
+		ErrorCodeThrottled:        "Um código foi enviado recentemente, aguarde antes de pedir outro.",
+		ErrorPhoneInvalid:         "O número de telefone deve estar no formato internacional, como +5511912345678.",
+		ErrorPhoneExists:          "Número de telefone já está em uso.",
+		ErrorInvalidDevice:        "Esse dispositivo não é mais confiável.",
+		ErrorDeviceNotFound:       "Dispositivo não encontrado.",
+		ErrorInvalidUserCode:      "Esse código é inválido ou expirou.",
+		ErrorAuthorizationPending: "O usuário ainda não aprovou o dispositivo.",
+		ErrorSlowDown:             "Muitas consultas, aguarde mais entre as requisições.",
+		ErrorAccessDenied:         "O usuário negou o pedido.",
+		ErrorExpiredToken:         "O código do dispositivo expirou.",
+		ErrorInvalidGrant:         "A concessão é inválida ou já foi usada.",
+		ErrorInvalidCertificate:   "O certificado do cliente é inválido ou não está vinculado a um usuário.",
+		ErrorCertificateExists:    "Essa identidade de certificado já está vinculada.",
+		ErrorCertificateNotFound:  "Vínculo de certificado não encontrado.",
+		ErrorInvalidScope:         "Escopo desconhecido.",
+		ErrorAccessTokenNotFound:  "Token de acesso não encontrado.",
+		ErrorInsufficientScope:    "O token não tem o escopo necessário para essa requisição.",
+		ErrorUnknownProvider:      "Provedor de login desconhecido.",
+		ErrorInvalidState:         "O login expirou ou foi iniciado em outro navegador, tente novamente.",
+		ErrorOIDCFailed:           "O provedor de login recusou o login, tente novamente.",
+		ErrorIdentityExists:       "Essa conta já está vinculada a um usuário.",
+		ErrorIdentityNotFound:     "Conta vinculada não encontrada.",
+		ErrorLastLoginMethod:      "Essa é a única forma de login, defina uma senha antes de desvincular.",
+		ErrorInvalidClient:        "O cliente é desconhecido ou suas credenciais estão erradas.",
+		ErrorInvalidRedirectURI:   "Essa uri de redirecionamento não está registrada para esse cliente.",
+		ErrorInvalidRequest:       "Falta um parâmetro na requisição ou um deles é inválido.",
+		ErrorConsentRequired:      "O usuário precisa permitir o cliente antes.",
+		ErrorClientNotFound:       "Cliente não encontrado.",
+		ErrorSAMLFailed:           "A resposta do provedor de identidade é inválida, tente novamente.",
+		ErrorInvalidFilter:        "O filtro é inválido ou não é suportado.",
+		ErrorInvalidPatch:         "A operação de patch é inválida ou não é suportada.",
+		ErrorCannotImpersonate:    "Apenas usuários com menos poder podem ser personificados.",
+		ErrorImpersonating:        "Isso não pode ser feito enquanto personifica um usuário.",
+		ErrorUnauthorizedClient:   "O cliente não tem permissão para usar esse tipo de concessão.",
 	},
 }
 
@@ -0,0 +1,67 @@
+package users
+
+import (
+	"net"
+	"time"
+
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// events of the audit log
+const (
+	EventImpersonationStarted = "impersonation_started"
+	EventImpersonatedRequest  = "impersonated_request"
+)
+
+// Event is a entry of the audit log of a user
+// data is free, usually json
+type Event struct {
+	ID     int64      `db:"id,omitempty" json:"id,string"`
+	UserID hide.Int64 `db:"user_id"      json:"user_id,string"`
+	Event  string     `db:"event"        json:"event"`
+	Data   string     `db:"data"         json:"data"`
+	IP     string     `db:"ip"           json:"ip"`
+	At     time.Time  `db:"at"           json:"at"`
+}
+
+// AddEvent records the event in the audit log of the user
+// a ip that can't be parsed is recorded as 0.0.0.0
+func (u *User) AddEvent(event, data, ip string) *errors.Error {
+	if u.ID == 0 || event == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	if net.ParseIP(ip) == nil {
+		ip = net.IPv4zero.String()
+	}
+
+	_, gErr := ec.Insert(&Event{
+		UserID: u.ID,
+		Event:  event,
+		Data:   data,
+		IP:     ip,
+		At:     time.Now(),
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.AddEvent]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	return nil
+}
+
+// Events lists the audit log of the user, newest first
+func (u *User) Events() ([]*Event, *errors.Error) {
+	var list []*Event
+
+	err := ec.Find(db.Cond{"user_id": u.ID}).OrderBy("-at", "-id").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
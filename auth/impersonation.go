@@ -0,0 +1,102 @@
+package users
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// Actor is the act claim of a impersonation token
+// the subject is the public id of the admin
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Impersonate creates a token of the user for the admin, it lasts ImpersonationTime
+// only admins can do it and only to users with less power than theirs
+// mfa is kept from the token of the admin
+func (u *User) Impersonate(admin *User, mfa bool, ip string) (string, *errors.Error) {
+	l := Logger.WithFields(log.Fields{
+		"ID":    u.ID,
+		"admin": admin.ID,
+	})
+
+	if u.ID == 0 || admin.ID == 0 {
+		return "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	if UserPower(admin.Power) < UserPowerAdmin || admin.Power <= u.Power || u.Deleted {
+		l.Warn("[User.Impersonate]: Refused")
+		return "", errors.FromCode(errors.ErrorCannotImpersonate)
+	}
+
+	claims, err := u.tokenClaims(mfa)
+	if err != nil {
+		return "", err
+	}
+
+	actor := strconv.FormatInt(util.Obfuscate(admin.ID), 10)
+	claims.Act = &Actor{Subject: actor}
+	claims.ExpiresAt = time.Now().Add(Config.ImpersonationTime).Unix()
+
+	token, gErr := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Config.TokenSecret)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	data, _ := json.Marshal(map[string]string{"actor": actor})
+	if err = u.AddEvent(EventImpersonationStarted, string(data), ip); err != nil {
+		return "", err
+	}
+
+	l.Info("[User.Impersonate]: Impersonation started")
+	return token, nil
+}
+
+// GetActor gets the act claim of the token in the context
+// it returns nil when the user isn't being impersonated
+func GetActor(c echo.Context) *Actor {
+	usr, ok := c.Get(middleware.DefaultJWTConfig.ContextKey).(*jwt.Token)
+	if !ok {
+		return nil
+	}
+
+	claims, ok := usr.Claims.(*UserToken)
+	if !ok {
+		return nil
+	}
+
+	return claims.Act
+}
+
+// RecordImpersonation adds the request to the audit log of the user
+// when the token in the context is impersonating them
+func RecordImpersonation(c echo.Context) *errors.Error {
+	actor := GetActor(c)
+	if actor == nil {
+		return nil
+	}
+
+	id, gErr := GetID(c)
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	data, _ := json.Marshal(map[string]string{
+		"actor":  actor.Subject,
+		"method": c.Request().Method,
+		"path":   c.Request().URL.RequestURI(),
+	})
+
+	u := &User{ID: id}
+	return u.AddEvent(EventImpersonatedRequest, string(data), c.RealIP())
+}
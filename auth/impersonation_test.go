@@ -0,0 +1,94 @@
+package users
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	"github.com/UnnoTed/authenticaTed/util"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonate(t *testing.T) {
+	admin := NewUser()
+	admin.Username = "Support_Admin"
+	admin.Email = "support_admin@mail.com"
+	admin.Password = "password"
+	_, err := admin.Create()
+	assert.Nil(t, err)
+
+	u := NewUser()
+	u.Username = "Support_User"
+	u.Email = "support_user@mail.com"
+	u.Password = "password"
+	_, err = u.Create()
+	assert.Nil(t, err)
+
+	// expect error: not an admin
+	_, err = u.Impersonate(admin, false, "127.0.0.1")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCannotImpersonate, err.Code)
+
+	// expect error: the same power
+	admin.Power = int(UserPowerAdmin)
+	u.Power = int(UserPowerAdmin)
+	_, err = u.Impersonate(admin, false, "127.0.0.1")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCannotImpersonate, err.Code)
+
+	// ok: a short lived token of the user with the admin as actor
+	u.Power = int(UserPowerNormal)
+	token, err := u.Impersonate(admin, true, "127.0.0.1")
+	assert.Nil(t, err)
+
+	c := bearerContext(echo.GET, token)
+	assert.NoError(t, LoadToken(c))
+	assert.NoError(t, CheckTokenVersion(c))
+
+	id, gErr := GetID(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, u.ID, id)
+	assert.True(t, HasMFAClaim(c))
+
+	actor := GetActor(c)
+	assert.NotNil(t, actor)
+	assert.Equal(t, strconv.FormatInt(util.Obfuscate(admin.ID), 10), actor.Subject)
+
+	claims := c.Get("user").(*jwt.Token).Claims.(*UserToken)
+	assert.True(t, claims.ExpiresAt <= time.Now().Add(Config.ImpersonationTime).Unix())
+
+	// ok: the requests are recorded
+	assert.Nil(t, RecordImpersonation(c))
+
+	events, err := u.Events()
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventImpersonatedRequest, events[0].Event)
+	assert.Equal(t, EventImpersonationStarted, events[1].Event)
+
+	data := map[string]string{}
+	assert.NoError(t, json.Unmarshal([]byte(events[0].Data), &data))
+	assert.Equal(t, actor.Subject, data["actor"])
+	assert.Equal(t, echo.GET, data["method"])
+
+	// ok: sessions of the user aren't recorded
+	session, err := u.IssueToken()
+	assert.Nil(t, err)
+
+	c = bearerContext(echo.GET, session)
+	assert.NoError(t, LoadToken(c))
+	assert.Nil(t, GetActor(c))
+	assert.Nil(t, RecordImpersonation(c))
+
+	events, err = u.Events()
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, admin.HardDelete())
+}
@@ -36,6 +36,11 @@ type (
 		// - "header:<name>"
 		// - "query:<name>"
 		TokenLookup string `json:"token_lookup"`
+
+		// Trusted issuers whose tokens are accepted too, verified with their keys
+		// and carrying the claims of the local user of their subject.
+		// Optional.
+		TrustedIssuers []*TrustedIssuer `json:"-"`
 	}
 
 	jwtExtractor func(echo.Context) (string, error)
@@ -122,7 +127,13 @@ func JWTWithConfig(config JWTConfig) echo.MiddlewareFunc {
 	}
 }
 
+// JWTParse parses and verifies the token with the signing key of the config
+// or, for tokens of a trusted issuer, with the keys of the issuer
 func JWTParse(auth string, config JWTConfig) (*jwt.Token, error) {
+	if t := config.trustedIssuer(auth); t != nil {
+		return t.parseTrusted(auth)
+	}
+
 	token, err := jwt.ParseWithClaims(auth, &UserToken{}, func(t *jwt.Token) (interface{}, error) {
 		// Check the signing method
 		if t.Method.Alg() != config.SigningMethod {
@@ -0,0 +1,247 @@
+package users
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPBackend authenticates users of a ldap directory or active directory
+// it finds the entry of the login with a service account and binds as it
+// with the password, add it to Config.AuthBackends
+type LDAPBackend struct {
+	// ID names the directory in the identities of its users, "ldap" when empty
+	ID string
+
+	// URL is ldap://host:389 or ldaps://host:636
+	// StartTLS upgrades ldap:// connections
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+
+	// BindDN and BindPassword search the directory, anonymously when empty
+	BindDN       string
+	BindPassword string
+
+	// Filter finds the entry under BaseDN, every %s is the escaped login
+	// e.g. (&(objectClass=person)(|(uid=%s)(mail=%s)))
+	// or (&(objectClass=user)(|(sAMAccountName=%s)(userPrincipalName=%s))) in active directory
+	BaseDN string
+	Filter string
+
+	// attributes of the entry, SubjectAttribute is a id that survives renames,
+	// like entryUUID or objectGUID, the dn is used when it's empty
+	SubjectAttribute  string
+	UsernameAttribute string
+	EmailAttribute    string
+	NameAttribute     string
+	LastNameAttribute string
+
+	// the groups of the user are the dns in GroupAttribute, memberOf,
+	// and when GroupFilter is set the ones it finds under GroupBaseDN,
+	// %s is the escaped dn of the user: (&(objectClass=groupOfNames)(member=%s))
+	GroupAttribute string
+	GroupBaseDN    string
+	GroupFilter    string
+
+	// Groups gives the users of the group dns the highest of their powers
+	// or DefaultPower, the power isn't touched when Groups is empty
+	Groups       map[string]UserPower
+	DefaultPower UserPower
+}
+
+// Name identifies the directory
+func (b *LDAPBackend) Name() string {
+	if b.ID == "" {
+		return "ldap"
+	}
+
+	return b.ID
+}
+
+// dial connects to the directory and binds as the service account
+func (b *LDAPBackend) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(b.URL, ldap.DialWithTLSConfig(b.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Timeout > 0 {
+		conn.SetTimeout(b.Timeout)
+	}
+
+	if b.StartTLS {
+		if err = conn.StartTLS(b.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err = b.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// bindService binds as the service account, or anonymously without one
+func (b *LDAPBackend) bindService(conn *ldap.Conn) error {
+	if b.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+
+	return conn.Bind(b.BindDN, b.BindPassword)
+}
+
+// search runs the filter with every %s replaced by the escaped value
+func (b *LDAPBackend) search(conn *ldap.Conn, base, filter, value string, limit int, attributes []string) ([]*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(
+		base,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		limit,
+		int(b.Timeout.Seconds()),
+		false,
+		strings.Replace(filter, "%s", ldap.EscapeFilter(value), -1),
+		attributes,
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Entries, nil
+}
+
+// Authenticate finds the entry of the login and binds as it
+func (b *LDAPBackend) Authenticate(login, password string) (*BackendUser, error) {
+	if login == "" || password == "" {
+		return nil, ErrBackendInvalidPassword
+	}
+
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	groupAttribute := b.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = "memberOf"
+	}
+
+	attributes := []string{groupAttribute}
+	for _, a := range []string{b.SubjectAttribute, b.UsernameAttribute, b.EmailAttribute, b.NameAttribute, b.LastNameAttribute} {
+		if a != "" {
+			attributes = append(attributes, a)
+		}
+	}
+
+	// two results are enough to know it's ambiguous
+	entries, err := b.search(conn, b.BaseDN, b.Filter, login, 2, attributes)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(entries) == 0) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("ldap: the filter found more than one entry for %q", login)
+	}
+
+	entry := entries[0]
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrBackendInvalidPassword
+		}
+
+		return nil, err
+	}
+
+	u := &BackendUser{
+		Subject:  entry.DN,
+		Username: entry.GetAttributeValue(b.UsernameAttribute),
+		Email:    entry.GetAttributeValue(b.EmailAttribute),
+		Name:     entry.GetAttributeValue(b.NameAttribute),
+		LastName: entry.GetAttributeValue(b.LastNameAttribute),
+	}
+
+	// objectGUID is binary
+	if b.SubjectAttribute != "" {
+		raw := entry.GetRawAttributeValue(b.SubjectAttribute)
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("ldap: %q has no %s", entry.DN, b.SubjectAttribute)
+		}
+
+		u.Subject = string(raw)
+		if !utf8.Valid(raw) {
+			u.Subject = hex.EncodeToString(raw)
+		}
+	}
+
+	if len(b.Groups) > 0 {
+		groups := entry.GetAttributeValues(groupAttribute)
+
+		if b.GroupFilter != "" {
+			// the user may not be allowed to read the groups
+			if err = b.bindService(conn); err != nil {
+				return nil, err
+			}
+
+			found, err := b.search(conn, b.GroupBaseDN, b.GroupFilter, entry.DN, 0, []string{"dn"})
+			if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				return nil, err
+			}
+
+			for _, g := range found {
+				groups = append(groups, g.DN)
+			}
+		}
+
+		power := b.groupsPower(groups)
+		u.Power = &power
+	}
+
+	return u, nil
+}
+
+// groupsPower is the highest power of the groups, or DefaultPower
+func (b *LDAPBackend) groupsPower(groups []string) UserPower {
+	power, found := b.DefaultPower, false
+
+	for dn, p := range b.Groups {
+		for _, g := range groups {
+			if sameDN(dn, g) && (!found || p > power) {
+				power, found = p, true
+			}
+		}
+	}
+
+	return power
+}
+
+// sameDN compares dns ignoring case and spacing
+func sameDN(a, b string) bool {
+	da, err := ldap.ParseDN(a)
+	if err != nil {
+		return strings.EqualFold(a, b)
+	}
+
+	db, err := ldap.ParseDN(b)
+	if err != nil {
+		return strings.EqualFold(a, b)
+	}
+
+	return da.EqualFold(db)
+}
@@ -0,0 +1,302 @@
+package users
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+)
+
+// ldapTerm is a (attribute=value) of a search filter
+var ldapTerm = regexp.MustCompile(`\(([A-Za-z]+)=([^()]*)\)`)
+
+// ldapEntry is a entry of the fixture directory
+type ldapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapDirectory is a in-process directory with binds checked against
+// the entries and searches matching any of the terms of the filter
+type ldapDirectory struct {
+	mu      sync.Mutex
+	entries []*ldapEntry
+	server  *gldap.Server
+	url     string
+}
+
+func newLDAPDirectory(t *testing.T, entries ...*ldapEntry) *ldapDirectory {
+	d := &ldapDirectory{entries: entries}
+
+	s, err := gldap.NewServer()
+	assert.Nil(t, err)
+
+	mux, err := gldap.NewMux()
+	assert.Nil(t, err)
+	assert.Nil(t, mux.Bind(d.bind))
+	assert.Nil(t, mux.Search(d.search))
+	assert.Nil(t, s.Router(mux))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	go s.Run(addr)
+	for !s.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+
+	d.server = s
+	d.url = "ldap://" + addr
+	return d
+}
+
+// entry finds the entry with the dn
+func (d *ldapDirectory) entry(dn string) *ldapEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, e := range d.entries {
+		if sameDN(e.dn, dn) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (d *ldapDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+
+	if e := d.entry(m.UserName); e != nil && e.password == string(m.Password) {
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (d *ldapDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(resp)
+
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		resp.SetResultCode(gldap.ResultOperationsError)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, e := range d.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(m.BaseDN)) || !e.matches(m.Filter) {
+			continue
+		}
+
+		w.Write(r.NewSearchResponseEntry(e.dn, gldap.WithAttributes(e.attributes)))
+	}
+}
+
+// matches tells if the entry has any of the terms of the filter
+func (e *ldapEntry) matches(filter string) bool {
+	for _, term := range ldapTerm.FindAllStringSubmatch(filter, -1) {
+		for name, values := range e.attributes {
+			if !strings.EqualFold(name, term[1]) {
+				continue
+			}
+
+			for _, v := range values {
+				if strings.EqualFold(v, term[2]) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLDAPBackend(t *testing.T) {
+	const (
+		people = "ou=people,dc=example,dc=com"
+		groups = "ou=groups,dc=example,dc=com"
+	)
+
+	user := &ldapEntry{
+		dn:       "uid=ldap_user," + people,
+		password: "ldap password",
+		attributes: map[string][]string{
+			"uid":       []string{"ldap_user"},
+			"mail":      []string{"ldap_user@mail.com"},
+			"givenName": []string{"Ldap"},
+			"sn":        []string{"User"},
+			"entryUUID": []string{"4f6c8b7e-0f5a-4c1e-9c1d-2b1b6c3d9e01"},
+			"memberOf":  []string{"cn=staff," + groups},
+		},
+	}
+
+	admins := &ldapEntry{
+		dn: "cn=admins," + groups,
+		attributes: map[string][]string{
+			"member": []string{"uid=someone_else," + people},
+		},
+	}
+
+	service := &ldapEntry{
+		dn:       "cn=service,dc=example,dc=com",
+		password: "service password",
+	}
+
+	d := newLDAPDirectory(t, user, admins, service)
+	defer d.server.Stop()
+
+	backend := &LDAPBackend{
+		URL:               d.url,
+		Timeout:           5 * time.Second,
+		BindDN:            service.dn,
+		BindPassword:      service.password,
+		BaseDN:            people,
+		Filter:            "(&(objectClass=person)(|(uid=%s)(mail=%s)))",
+		SubjectAttribute:  "entryUUID",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		NameAttribute:     "givenName",
+		LastNameAttribute: "sn",
+		GroupBaseDN:       groups,
+		GroupFilter:       "(&(objectClass=groupOfNames)(member=%s))",
+		Groups: map[string]UserPower{
+			"CN=Staff, " + groups: UserPowerMod,
+			"cn=admins," + groups: UserPowerAdmin,
+		},
+		DefaultPower: UserPowerNormal,
+	}
+
+	Config.AuthBackends = []AuthBackend{backend}
+	defer func() { Config.AuthBackends = nil }()
+
+	// expect error: wrong password of a user of the directory
+	fu := NewUser()
+	fu.Username = "ldap_user"
+	_, err := fu.Auth("wrong password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserInvalidPassword, err.Code)
+
+	// ok: first login creates the shadow user with the power of its groups
+	u := NewUser()
+	u.Username = "ldap_user"
+	token, err := u.Auth(user.password)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "ldap_user", u.Username)
+	assert.Equal(t, "ldap_user@mail.com", u.Email)
+	assert.Equal(t, "Ldap", u.Name)
+	assert.Equal(t, "User", u.LastName)
+	assert.Equal(t, int(UserPowerMod), u.Power)
+	assert.True(t, u.External)
+	assert.Empty(t, u.Password)
+
+	// ok: the email logs in too, groups are refreshed on every login
+	d.mu.Lock()
+	user.attributes["memberOf"] = nil
+	admins.attributes["member"] = append(admins.attributes["member"], user.dn)
+	d.mu.Unlock()
+
+	fu = NewUser()
+	fu.Email = "ldap_user@mail.com"
+	_, err = fu.Auth(user.password)
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, fu.ID)
+	assert.Equal(t, int(UserPowerAdmin), fu.Power)
+
+	// ok: no group gives the default power
+	d.mu.Lock()
+	admins.attributes["member"] = nil
+	d.mu.Unlock()
+
+	fu = NewUser()
+	fu.Username = "ldap_user"
+	_, err = fu.Auth(user.password)
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, fu.ID)
+	assert.Equal(t, int(UserPowerNormal), fu.Power)
+
+	// expect error: unknown to the directory and to authenticaTed
+	fu = NewUser()
+	fu.Username = "nobody"
+	_, err = fu.Auth("password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserDoesntExists, err.Code)
+
+	// ok: local users with a password don't reach the directory
+	local := NewUser()
+	local.Username = "local_user"
+	local.Email = "local_user@mail.com"
+	local.Password = "password"
+	_, err = local.Create()
+	assert.Nil(t, err)
+
+	d.mu.Lock()
+	d.entries = append(d.entries, &ldapEntry{
+		dn:       "uid=local_user," + people,
+		password: "ldap password",
+		attributes: map[string][]string{
+			"uid":       []string{"local_user"},
+			"mail":      []string{"local_user@mail.com"},
+			"entryUUID": []string{"4f6c8b7e-0f5a-4c1e-9c1d-2b1b6c3d9e02"},
+		},
+	})
+	d.mu.Unlock()
+
+	fu = NewUser()
+	fu.Username = "local_user"
+	_, err = fu.Auth("ldap password")
+	assert.NotNil(t, err)
+
+	fu = NewUser()
+	fu.Username = "local_user"
+	_, err = fu.Auth("password")
+	assert.Nil(t, err)
+	assert.Equal(t, local.ID, fu.ID)
+
+	// expect error: the directory is down
+	d.server.Stop()
+
+	fu = NewUser()
+	fu.Username = "ldap_user"
+	_, err = fu.Auth(user.password)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, local.HardDelete())
+}
+
+func TestLDAPGroupsPower(t *testing.T) {
+	b := &LDAPBackend{
+		Groups: map[string]UserPower{
+			"cn=staff,ou=groups,dc=example,dc=com":  UserPowerMod,
+			"cn=admins,ou=groups,dc=example,dc=com": UserPowerAdmin,
+		},
+		DefaultPower: UserPowerNormal,
+	}
+
+	assert.Equal(t, UserPowerNormal, b.groupsPower(nil))
+	assert.Equal(t, UserPowerMod, b.groupsPower([]string{"CN=Staff, OU=Groups, DC=Example, DC=Com"}))
+	assert.Equal(t, UserPowerAdmin, b.groupsPower([]string{
+		"cn=staff,ou=groups,dc=example,dc=com",
+		"cn=admins,ou=groups,dc=example,dc=com",
+	}))
+	assert.Equal(t, "ldap", b.Name())
+}
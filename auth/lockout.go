@@ -0,0 +1,181 @@
+package users
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// Lockout holds the failed logins of a user
+// the account is locked while Until is in the future
+type Lockout struct {
+	ID     int64      `db:"id,omitempty"   json:"id,string"`
+	UserID hide.Int64 `db:"user_id"        json:"user_id,string"`
+
+	// failures since First, reset after Config.LockoutWindow
+	Failures int       `db:"failures"      json:"failures"`
+	First    time.Time `db:"first_failure" json:"first_failure"`
+	Last     time.Time `db:"last_failure"  json:"last_failure"`
+
+	// how many times it was locked, each lock is longer
+	Locks int       `db:"locks"          json:"locks"`
+	Until time.Time `db:"until"          json:"until"`
+}
+
+// IsLocked checks if the lock is still active
+func (l *Lockout) IsLocked() bool {
+	return l.Until.After(time.Now())
+}
+
+// upsert of a failed login, the failures restart when
+// the first one is older than the window
+const sqlLoginFailure = `
+INSERT INTO ` + TableLockout + ` (user_id, failures, first_failure, last_failure, locks, until)
+VALUES (?, 1, ?, ?, 0, ?)
+ON CONFLICT (user_id) DO UPDATE SET
+  failures      = CASE WHEN ` + TableLockout + `.first_failure < ? THEN 1 ELSE ` + TableLockout + `.failures + 1 END,
+  first_failure = CASE WHEN ` + TableLockout + `.first_failure < ? THEN EXCLUDED.first_failure ELSE ` + TableLockout + `.first_failure END,
+  last_failure  = EXCLUDED.last_failure
+`
+
+// GetLockout finds the failed logins of the user
+// it returns nil when there are none
+func (u *User) GetLockout() (*Lockout, *errors.Error) {
+	if u.ID == 0 {
+		return nil, errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	var lo *Lockout
+	err := lc.Find(db.Cond{"user_id": u.ID}).One(&lo)
+	if err == db.ErrNoMoreRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return lo, nil
+}
+
+// IsLocked checks if the user is locked by failed logins
+func (u *User) IsLocked() (bool, *errors.Error) {
+	lo, err := u.GetLockout()
+	if err != nil || lo == nil {
+		return false, err
+	}
+
+	return lo.IsLocked(), nil
+}
+
+// LoginFailed records a failed login and locks the account
+// when there are too many failures in the window
+func (u *User) LoginFailed() (*Lockout, *errors.Error) {
+	l := Logger.WithField("ID", u.ID)
+
+	if u.ID == 0 {
+		return nil, errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-Config.LockoutWindow)
+
+	_, gErr := session.Exec(sqlLoginFailure, u.ID, now, now, nilTime, windowStart, windowStart)
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.LoginFailed]: Error while recording the failure")
+		return nil, errors.FromErr(gErr)
+	}
+
+	lo, err := u.GetLockout()
+	if err != nil || lo == nil {
+		return nil, err
+	}
+
+	if lo.Failures < Config.LockoutThreshold || lo.IsLocked() {
+		return lo, nil
+	}
+
+	// after a quiet period the locks start short again
+	if lo.Locks > 0 && lo.Until.Before(now.Add(-Config.LockoutReset)) {
+		lo.Locks = 0
+	}
+
+	// every lock doubles the time of the last one
+	d := Config.LockoutDuration << uint(lo.Locks)
+	if d <= 0 || d > Config.LockoutMaxDuration {
+		d = Config.LockoutMaxDuration
+	}
+
+	lo.Locks++
+	lo.Failures = 0
+	lo.Until = now.Add(d)
+
+	l.WithFields(log.Fields{
+		"locks": lo.Locks,
+		"until": lo.Until,
+	}).Warn("[User.LoginFailed]: Too many failed logins, account locked")
+
+	if gErr = lc.Find(db.Cond{"id": lo.ID}).Update(lo); gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	return lo, nil
+}
+
+// LoginSucceeded forgets the failed logins
+// the number of locks is kept so the next lock is still longer
+// until Config.LockoutReset passes
+func (u *User) LoginSucceeded() *errors.Error {
+	err := lc.Find(db.Cond{"user_id": u.ID, "failures >": 0}).Update(map[string]interface{}{
+		"failures": 0,
+	})
+
+	return errors.FromErr(err)
+}
+
+// Unlock removes the lock and the failed logins of the user
+// it's used by moderators and after a password change
+func (u *User) Unlock() *errors.Error {
+	if u.ID == 0 {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	r := lc.Find(db.Cond{"user_id": u.ID})
+	if err := r.Err(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	return errors.FromErr(r.Delete())
+}
+
+// FindLocked returns every lock that is still active
+func FindLocked() ([]*Lockout, *errors.Error) {
+	var list []*Lockout
+
+	err := lc.Find(db.Cond{"until >": time.Now()}).OrderBy("-until").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// loginDelay is how long a failed login waits before answering
+// it doubles with every failure up to Config.LockoutMaxDelay
+func loginDelay(failures int) time.Duration {
+	if failures <= 1 || Config.LockoutDelay <= 0 {
+		return 0
+	}
+
+	d := Config.LockoutDelay << uint(failures-2)
+	if d <= 0 || d > Config.LockoutMaxDelay {
+		return Config.LockoutMaxDelay
+	}
+
+	return d
+}
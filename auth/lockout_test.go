@@ -0,0 +1,110 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+	"upper.io/db.v2"
+)
+
+func TestLoginDelay(t *testing.T) {
+	assert.Zero(t, loginDelay(0))
+	assert.Zero(t, loginDelay(1))
+	assert.Equal(t, Config.LockoutDelay, loginDelay(2))
+	assert.Equal(t, Config.LockoutDelay*2, loginDelay(3))
+	assert.Equal(t, Config.LockoutMaxDelay, loginDelay(100))
+}
+
+func TestLockout(t *testing.T) {
+	threshold, delay := Config.LockoutThreshold, Config.LockoutDelay
+	Config.LockoutThreshold = 3
+	Config.LockoutDelay = 0
+	defer func() {
+		Config.LockoutThreshold = threshold
+		Config.LockoutDelay = delay
+	}()
+
+	u := NewUser()
+	u.Username = "Locked_User"
+	u.Email = "locked_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// a success forgets the failures
+	fu := NewUser()
+	fu.Username = u.Username
+	_, err = fu.Auth("wrong password")
+	assert.NotNil(t, err)
+
+	_, err = fu.Auth("password")
+	assert.Nil(t, err)
+
+	lo, err := u.GetLockout()
+	assert.Nil(t, err)
+	assert.Zero(t, lo.Failures)
+
+	// too many failures
+	for i := 0; i < Config.LockoutThreshold; i++ {
+		fu = NewUser()
+		fu.Username = u.Username
+		_, err = fu.Auth("wrong password")
+		assert.NotNil(t, err)
+	}
+
+	locked, err := u.IsLocked()
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	lo, err = u.GetLockout()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, lo.Locks)
+	assert.WithinDuration(t, time.Now().Add(Config.LockoutDuration), lo.Until, time.Minute)
+
+	// expect error: the right password doesn't work while locked
+	fu = NewUser()
+	fu.Username = u.Username
+	token, err := fu.Auth("password")
+	assert.Empty(t, token)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorAccountLocked, err.Code)
+
+	// moderators can see it
+	list, err := FindLocked()
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, u.ID, list[0].UserID)
+
+	// ok: old locks are forgotten
+	gErr := lc.Find(db.Cond{"id": lo.ID}).Update(map[string]interface{}{
+		"locks": 3,
+		"until": time.Now().Add(-Config.LockoutReset - time.Hour),
+	})
+	assert.NoError(t, gErr)
+
+	for i := 0; i < Config.LockoutThreshold; i++ {
+		fu = NewUser()
+		fu.Username = u.Username
+		_, err = fu.Auth("wrong password")
+		assert.NotNil(t, err)
+	}
+
+	lo, err = u.GetLockout()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, lo.Locks)
+	assert.WithinDuration(t, time.Now().Add(Config.LockoutDuration), lo.Until, time.Minute)
+
+	// ok
+	assert.Nil(t, u.Unlock())
+
+	fu = NewUser()
+	fu.Username = u.Username
+	token, err = fu.Auth("password")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	assert.Nil(t, u.HardDelete())
+}
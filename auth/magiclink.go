@@ -0,0 +1,172 @@
+package users
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// email with the login link
+const (
+	mailMagicLinkSubject = "Your login link"
+	mailMagicLinkBody    = "Use the link below to log in, it works once and expires in %s.\n\n%s%s\n\nIf you didn't ask for it, ignore this email."
+)
+
+// MagicLink is a single use login link sent by email
+// only the hashes of the token and browser are stored
+type MagicLink struct {
+	ID     int64      `db:"id,omitempty"`
+	UserID hide.Int64 `db:"user_id"`
+	Token  string     `db:"token"`
+
+	// empty when the link works on any browser
+	Browser string    `db:"browser"`
+	Used    bool      `db:"used"`
+	Created time.Time `db:"created"`
+	Expires time.Time `db:"expires"`
+}
+
+const sqlUseMagicLink = `UPDATE ` + TableMagicLink + ` SET used = TRUE WHERE id = ? AND used = FALSE`
+
+// RequestMagicLink emails a login link to the user with the email or username
+// browser is a secret kept by the requesting browser, when given the link
+// only works with it. with Config.HideAccountExistence a missing user isn't an error
+func (u *User) RequestMagicLink(browser string) *errors.Error {
+	l := Logger.WithFields(log.Fields{
+		"Username": u.Username,
+		"Email":    u.Email,
+	})
+	l.Debug("[User.RequestMagicLink]: Creating link...")
+
+	if u.Username == "" && u.Email == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	valid, err := u.Validate()
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return errors.FromCode(errors.ErrorUserInvalid)
+	}
+
+	found, err := u.Find()
+	if err != nil && (!Config.HideAccountExistence || err.Code != errors.ErrorUserDoesntExists) {
+		return err
+	}
+
+	if !found {
+		l.Debug("[User.RequestMagicLink]: User not found")
+
+		if Config.HideAccountExistence {
+			u.ID = 0
+			return nil
+		}
+
+		return errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	token, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	link := &MagicLink{
+		UserID:  u.ID,
+		Token:   util.HashToken(token),
+		Created: time.Now(),
+		Expires: time.Now().Add(Config.MagicLinkTime),
+	}
+
+	if browser != "" {
+		link.Browser = util.HashToken(browser)
+	}
+
+	// a new link replaces the ones not used yet
+	if gErr = mc.Find(db.Cond{"user_id": u.ID, "used": false}).Delete(); gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	if _, gErr = mc.Insert(link); gErr != nil {
+		l.WithError(gErr).Error("[User.RequestMagicLink]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	sendMail(u.Email, mailMagicLinkSubject, fmt.Sprintf(mailMagicLinkBody, Config.MagicLinkTime, Config.MagicLinkURL, token))
+
+	l.WithField("ID", u.ID).Debug("[User.RequestMagicLink]: Link sent")
+	return nil
+}
+
+// ConsumeMagicLink logs in with the token from the link
+// browser must be the same given to RequestMagicLink when the link is bound
+// it returns the same as Auth, a challenge when a second factor is needed
+func (u *User) ConsumeMagicLink(token, browser string) (string, *errors.Error) {
+	l := Logger.WithField("step", "link")
+	l.Debug("[User.ConsumeMagicLink]: Authenticating user...")
+
+	if token == "" {
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	var link *MagicLink
+	err := mc.Find(db.Cond{"token": util.HashToken(token)}).One(&link)
+	if err == db.ErrNoMoreRows {
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	if err != nil {
+		return "", errors.FromErr(err)
+	}
+
+	if link.Used || time.Now().After(link.Expires) {
+		l.Debug("[User.ConsumeMagicLink]: Link used or expired")
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	// opened on another browser, it keeps working on the right one
+	if link.Browser != "" && link.Browser != util.HashToken(browser) {
+		l.Debug("[User.ConsumeMagicLink]: Link opened on another browser")
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	// only one request can use it
+	res, err := session.Exec(sqlUseMagicLink, link.ID)
+	if err != nil {
+		return "", errors.FromErr(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	*u = User{ID: link.UserID}
+	found, fErr := u.Find()
+	if fErr != nil || !found {
+		return "", errors.FromCode(errors.ErrorInvalidMagicLink)
+	}
+
+	locked, fErr := u.IsLocked()
+	if fErr != nil {
+		return "", fErr
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if fErr = u.LoginSucceeded(); fErr != nil {
+		return "", fErr
+	}
+
+	u.AuthMethod = AMROneTimePassword
+	return u.loginToken()
+}
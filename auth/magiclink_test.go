@@ -0,0 +1,96 @@
+package users
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var magicLinkToken = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// lastMagicLink gets the token of the last link emailed to the address
+func lastMagicLink(t *testing.T, m *MemoryMailer, to string) string {
+	mail := m.Last(to)
+	if !assert.NotNil(t, mail) {
+		return ""
+	}
+
+	match := magicLinkToken.FindStringSubmatch(mail.Body)
+	if !assert.Len(t, match, 2) {
+		return ""
+	}
+
+	return match[1]
+}
+
+func TestMagicLink(t *testing.T) {
+	mailer := Config.Mailer
+	m := &MemoryMailer{}
+	Config.Mailer = m
+	defer func() {
+		Config.Mailer = mailer
+	}()
+
+	u := NewUser()
+	u.Username = "Link_User"
+	u.Email = "link_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: missing user
+	missing := NewUser()
+	missing.Email = "missing_link_user@mail.com"
+	err = missing.RequestMagicLink("")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserDoesntExists, err.Code)
+
+	ru := NewUser()
+	ru.Email = u.Email
+	assert.Nil(t, ru.RequestMagicLink(""))
+	token := lastMagicLink(t, m, u.Email)
+
+	// ok
+	fu := NewUser()
+	session, err := fu.ConsumeMagicLink(token, "")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, session)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: single use
+	_, err = NewUser().ConsumeMagicLink(token, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidMagicLink, err.Code)
+
+	// bound to the browser that asked for it
+	ru = NewUser()
+	ru.Username = u.Username
+	assert.Nil(t, ru.RequestMagicLink("browser secret"))
+	token = lastMagicLink(t, m, u.Email)
+
+	// expect error: another browser
+	_, err = NewUser().ConsumeMagicLink(token, "other browser")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidMagicLink, err.Code)
+
+	// ok: the right browser still works
+	_, err = NewUser().ConsumeMagicLink(token, "browser secret")
+	assert.Nil(t, err)
+
+	// expect error: expired
+	linkTime := Config.MagicLinkTime
+	Config.MagicLinkTime = -1
+	ru = NewUser()
+	ru.Email = u.Email
+	assert.Nil(t, ru.RequestMagicLink(""))
+	Config.MagicLinkTime = linkTime
+
+	_, err = NewUser().ConsumeMagicLink(lastMagicLink(t, m, u.Email), "")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidMagicLink, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+}
@@ -0,0 +1,119 @@
+package users
+
+import (
+	"fmt"
+	"net/smtp"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// Mailer sends emails to users
+// set Config.Mailer to use a different one
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// Mail is a email sent by a Mailer
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// LogMailer only logs the emails
+// it's the default until a real mailer is set
+type LogMailer struct{}
+
+// Send logs the email, the body is only shown on debug
+// as it may have codes and links
+func (m *LogMailer) Send(to, subject, body string) error {
+	l := Logger.WithFields(log.Fields{
+		"to":      to,
+		"subject": subject,
+	})
+
+	l.Warn("[LogMailer.Send]: No mailer set, the email was not sent")
+	l.WithField("body", body).Debug("[LogMailer.Send]: Email body")
+	return nil
+}
+
+// MemoryMailer keeps the emails in memory
+// it's used for testing
+type MemoryMailer struct {
+	sync.Mutex
+	Mails []*Mail
+}
+
+// Send stores the email
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Mails = append(m.Mails, &Mail{
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	})
+
+	return nil
+}
+
+// Last returns the last email sent to the address
+func (m *MemoryMailer) Last(to string) *Mail {
+	m.Lock()
+	defer m.Unlock()
+
+	for i := len(m.Mails) - 1; i >= 0; i-- {
+		if m.Mails[i].To == to {
+			return m.Mails[i]
+		}
+	}
+
+	return nil
+}
+
+// Reset removes all stored emails
+func (m *MemoryMailer) Reset() {
+	m.Lock()
+	m.Mails = nil
+	m.Unlock()
+}
+
+// SMTPMailer sends emails with a smtp server
+type SMTPMailer struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	From string
+}
+
+// Send the email using plain auth
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	addr := m.Host + ":" + strconv.Itoa(m.Port)
+
+	var a smtp.Auth
+	if m.User != "" {
+		a = smtp.PlainAuth("", m.User, m.Pass, m.Host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.From, to, subject, body)
+	return smtp.SendMail(addr, a, m.From, []string{to}, []byte(msg))
+}
+
+// sendMail sends a email with the mailer from the config
+// errors are only logged so they don't change the response
+func sendMail(to, subject, body string) {
+	m := Config.Mailer
+	if m == nil {
+		m = &LogMailer{}
+	}
+
+	if err := m.Send(to, subject, body); err != nil {
+		Logger.WithError(err).WithField("to", to).Error("[Mail]: Error while sending email")
+	}
+}
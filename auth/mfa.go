@@ -0,0 +1,280 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// audiences of the tokens between the password and the second factor
+// the api middleware refuses them
+const (
+	challengeAudience = "mfa"
+	enrollAudience    = "mfa_enroll"
+)
+
+// ChallengeToken is given by Auth when a second factor is needed
+// it only works with AuthMFA
+type ChallengeToken struct {
+	UID     string `json:"id"`
+	Version int    `json:"ver"`
+	AMR     string `json:"amr,omitempty"` // the first factor
+	jwt.StandardClaims
+}
+
+// HasMFA checks if the user has any second factor
+func (u *User) HasMFA() (bool, *errors.Error) {
+	return u.HasTOTP()
+}
+
+// MFARequired checks if the power of the user needs a second factor
+func (u *User) MFARequired() bool {
+	return MFARequiredFor(UserPower(u.Power))
+}
+
+// MFARequiredFor checks if the power needs a second factor
+// as set by Config.MFARequired and Config.MFARequiredPower
+func MFARequiredFor(power UserPower) bool {
+	return Config.MFARequired && power >= Config.MFARequiredPower
+}
+
+// VerifySecondFactor checks a code from the authenticator app, a recovery code
+// or the code sent by SendMFAEmailCode or SendMFASMSCode while it's waiting to be used
+// every factor is tried, a pending code doesn't stop the others from working
+func (u *User) VerifySecondFactor(code string) *errors.Error {
+	if code == "" {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	if isRecoveryCode(code) {
+		return u.UseRecoveryCode(code)
+	}
+
+	err := u.VerifyTOTP(code)
+	if err == nil || (err.Code != errors.ErrorInvalidCode && err.Code != errors.ErrorMFANotEnabled) {
+		return err
+	}
+
+	if Config.EmailCodeFallback {
+		emailed, hErr := u.HasEmailCode(EmailCodeMFA)
+		if hErr != nil {
+			return hErr
+		}
+
+		if emailed {
+			if err = u.VerifyEmailCode(EmailCodeMFA, code); err == nil || err.Code != errors.ErrorInvalidCode {
+				return err
+			}
+		}
+	}
+
+	if Config.SMSCodeFallback {
+		texted, hErr := u.HasSMSCode(SMSCodeMFA)
+		if hErr != nil {
+			return hErr
+		}
+
+		if texted {
+			if _, err = u.VerifySMSCode(SMSCodeMFA, code); err == nil || err.Code != errors.ErrorInvalidCode {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+// CheckSecondFactor is VerifySecondFactor with the lockout of the logins
+// wrong codes count as failed logins and no code works while locked
+func (u *User) CheckSecondFactor(code string) *errors.Error {
+	locked, err := u.IsLocked()
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		return errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if err = u.VerifySecondFactor(code); err != nil {
+		lo, lErr := u.LoginFailed()
+		if lErr != nil {
+			return lErr
+		}
+
+		if lo != nil {
+			time.Sleep(loginDelay(lo.Failures))
+		}
+
+		return err
+	}
+
+	return u.LoginSucceeded()
+}
+
+// IssueChallenge creates the short lived token used by AuthMFA
+func (u *User) IssueChallenge() (string, *errors.Error) {
+	return u.issueChallenge(challengeAudience)
+}
+
+// IssueEnrollChallenge creates the short lived token used to add
+// a second factor on login when the user's power requires one
+func (u *User) IssueEnrollChallenge() (string, *errors.Error) {
+	return u.issueChallenge(enrollAudience)
+}
+
+func (u *User) issueChallenge(audience string) (string, *errors.Error) {
+	return u.signChallenge(audience, Config.MFAChallengeTime, "")
+}
+
+// signChallenge creates a token only accepted by parseChallenge with the audience
+func (u *User) signChallenge(audience string, expiration time.Duration, jti string) (string, *errors.Error) {
+	id, err := util.Encrypt(util.HideToString(u.ID), Config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &ChallengeToken{
+		UID:     id,
+		Version: u.TokenVersion,
+		AMR:     u.AuthMethod,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  audience,
+			ExpiresAt: now.Add(expiration).Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			Issuer:    issuer,
+			NotBefore: now.Unix(),
+		},
+	})
+
+	s, gErr := token.SignedString(Config.TokenSecret)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	return s, nil
+}
+
+// FindChallenge checks the challenge token and finds its user
+func (u *User) FindChallenge(challenge string) *errors.Error {
+	return u.findChallenge(challenge, challengeAudience)
+}
+
+// parseChallenge checks the signature, expiration and audience
+// of a challenge token and returns its claims and user id
+func parseChallenge(challenge, audience string) (*ChallengeToken, hide.Int64, *errors.Error) {
+	token, gErr := jwt.ParseWithClaims(challenge, &ChallengeToken{}, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != AlgorithmHS256 {
+			return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+		}
+
+		return Config.TokenSecret, nil
+	})
+	if gErr != nil || !token.Valid {
+		return nil, 0, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	claims := token.Claims.(*ChallengeToken)
+	if !claims.VerifyAudience(audience, true) {
+		return nil, 0, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	id, err := util.Decrypt(claims.UID, Config.EncryptionKey)
+	if err != nil {
+		return nil, 0, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	i, gErr := strconv.ParseInt(id, 10, 64)
+	if gErr != nil {
+		return nil, 0, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	return claims, hide.Int64(i), nil
+}
+
+func (u *User) findChallenge(challenge, audience string) *errors.Error {
+	claims, id, err := parseChallenge(challenge, audience)
+	if err != nil {
+		return err
+	}
+
+	*u = User{ID: id}
+	found, err := u.Find()
+	if err != nil || !found {
+		return errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	// the password changed after the challenge was given
+	if claims.Version != u.TokenVersion {
+		return errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	u.AuthMethod = claims.AMR
+	return nil
+}
+
+// AuthMFA is the second login step, it checks the code for
+// the challenge given by Auth and returns the real token
+func (u *User) AuthMFA(challenge, code string) (string, *errors.Error) {
+	l := Logger.WithField("step", "mfa")
+	l.Debug("[User.AuthMFA]: Authenticating user...")
+
+	if err := u.FindChallenge(challenge); err != nil {
+		l.WithError(err).Debug("[User.AuthMFA]: Invalid challenge")
+		return "", err
+	}
+
+	l = l.WithFields(log.Fields{
+		"ID":       u.ID,
+		"Username": u.Username,
+	})
+
+	if err := u.CheckSecondFactor(code); err != nil {
+		l.Debug("[User.AuthMFA]: Wrong code")
+		return "", err
+	}
+
+	l.Debug("[User.AuthMFA]: Token created for user")
+	return u.IssueMFAToken()
+}
+
+// EnrollTOTPWithChallenge starts adding a authenticator app
+// during a login that was forced to enroll by the power of the user
+func (u *User) EnrollTOTPWithChallenge(challenge string) (*TOTPEnrollment, *errors.Error) {
+	if err := u.findChallenge(challenge, enrollAudience); err != nil {
+		return nil, err
+	}
+
+	return u.EnrollTOTP()
+}
+
+// ConfirmTOTPWithChallenge enables the authenticator app and finishes
+// the forced enrollment login with a token and the recovery codes
+func (u *User) ConfirmTOTPWithChallenge(challenge, code string) (string, []string, *errors.Error) {
+	if err := u.findChallenge(challenge, enrollAudience); err != nil {
+		return "", nil, err
+	}
+
+	codes, err := u.ConfirmTOTP(code)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := u.IssueMFAToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	Logger.WithField("ID", u.ID).Debug("[User.ConfirmTOTPWithChallenge]: Enrolled on login")
+	return token, codes, nil
+}
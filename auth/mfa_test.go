@@ -0,0 +1,191 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	"github.com/UnnoTed/authenticaTed/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// totpCode returns the code of the app for a time step
+// steps moves it from the current one
+func totpCode(t *testing.T, secret string, steps int64) string {
+	code, err := util.HOTP(secret, util.TOTPCounter(time.Now())+steps)
+	assert.NoError(t, err)
+	return code
+}
+
+func TestMFA(t *testing.T) {
+	u := NewUser()
+	u.Username = "MFA_User"
+	u.Email = "mfa_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: not enabled yet
+	_, err = u.ConfirmTOTP("123456")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorMFANotEnabled, err.Code)
+
+	e, err := u.EnrollTOTP()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, e.Secret)
+	assert.Contains(t, e.URI, "otpauth://totp/")
+	assert.Contains(t, e.QR, "data:image/png;base64,")
+
+	// an unconfirmed app isn't used on logins
+	mfa, err := u.HasMFA()
+	assert.Nil(t, err)
+	assert.False(t, mfa)
+
+	// expect error: wrong code
+	_, err = u.ConfirmTOTP("000000")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// ok
+	codes, err := u.ConfirmTOTP(totpCode(t, e.Secret, 0))
+	assert.Nil(t, err)
+	assert.Len(t, codes, recoveryCodes)
+
+	// expect error: already enabled
+	_, err = u.EnrollTOTP()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorMFAAlreadyEnabled, err.Code)
+
+	// the password only gives a challenge
+	fu := NewUser()
+	fu.Username = u.Username
+	challenge, err := fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAPending)
+	assert.NotEmpty(t, challenge)
+
+	// expect error: the code used to confirm can't be used again
+	fu = NewUser()
+	token, err := fu.AuthMFA(challenge, totpCode(t, e.Secret, 0))
+	assert.Empty(t, token)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// expect error: invalid challenge
+	_, err = fu.AuthMFA("not a challenge", totpCode(t, e.Secret, 1))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidChallenge, err.Code)
+
+	// ok: next time step
+	token, err = fu.AuthMFA(challenge, totpCode(t, e.Secret, 1))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// ok: recovery code, typed without dashes
+	token, err = fu.AuthMFA(challenge, normalizeRecoveryCode(codes[0]))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	// expect error: recovery codes only work once
+	_, err = fu.AuthMFA(challenge, codes[0])
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// expect error: wrong codes count as failed logins
+	err = u.DisableTOTP("000000")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// the reused recovery code was the first one
+	lo, err := u.GetLockout()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lo.Failures)
+
+	// ok
+	assert.Nil(t, u.DisableTOTP(codes[1]))
+
+	fu = NewUser()
+	fu.Username = u.Username
+	token, err = fu.Auth("password")
+	assert.Nil(t, err)
+	assert.False(t, fu.MFAPending)
+	assert.NotEmpty(t, token)
+
+	assert.Nil(t, u.HardDelete())
+}
+
+func TestMFAPolicy(t *testing.T) {
+	required := Config.MFARequired
+	Config.MFARequired = true
+	defer func() {
+		Config.MFARequired = required
+	}()
+
+	u := NewUser()
+	u.Username = "MFA_Mod"
+	u.Email = "mfa_mod@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// below the required power the password is enough
+	assert.False(t, u.MFARequired())
+	fu := NewUser()
+	fu.Username = u.Username
+	token, err := fu.Auth("password")
+	assert.Nil(t, err)
+	assert.False(t, fu.MFAEnrollmentRequired)
+	assert.NotEmpty(t, token)
+
+	u.Power = int(Config.MFARequiredPower)
+	assert.Nil(t, u.Save())
+	assert.True(t, u.MFARequired())
+
+	// the password only gives a enrollment challenge
+	fu = NewUser()
+	fu.Username = u.Username
+	challenge, err := fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAEnrollmentRequired)
+	assert.False(t, fu.MFAPending)
+
+	// expect error: it isn't a second factor challenge
+	_, err = NewUser().AuthMFA(challenge, "123456")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidChallenge, err.Code)
+
+	// expect error: a second factor challenge can't enroll
+	mfaChallenge, err := u.IssueChallenge()
+	assert.Nil(t, err)
+	_, err = NewUser().EnrollTOTPWithChallenge(mfaChallenge)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidChallenge, err.Code)
+
+	// ok
+	e, err := NewUser().EnrollTOTPWithChallenge(challenge)
+	assert.Nil(t, err)
+
+	token, codes, err := NewUser().ConfirmTOTPWithChallenge(challenge, totpCode(t, e.Secret, 0))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Len(t, codes, recoveryCodes)
+
+	// the token went through a second factor
+	config := DefaultJWTConfig
+	config.SigningKey = Config.TokenSecret
+	jt, gErr := JWTParse(token, config)
+	assert.NoError(t, gErr)
+	assert.True(t, jt.Claims.(*UserToken).MFA)
+
+	// the next login asks for the code
+	fu = NewUser()
+	fu.Username = u.Username
+	_, err = fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAPending)
+	assert.False(t, fu.MFAEnrollmentRequired)
+
+	assert.Nil(t, u.HardDelete())
+}
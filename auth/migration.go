@@ -0,0 +1,214 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// LegacyAuth is the old authentication service users are moved from
+// User.Auth asks it about logins that aren't local users, the ones it
+// verifies are created here with the password they logged in with
+//
+// it receives a POST with {"login": "...", "password": "..."}
+// and answers 200 with the user, 401, 403 or 404 when it's refused:
+// {"id": "...", "username": "...", "email": "...", "name": "...", "last_name": "..."}
+type LegacyAuth struct {
+	// counters since the start, at the top for 64bit alignment
+	verified int64
+	refused  int64
+	failed   int64
+
+	URL string
+
+	// Token is sent as the bearer of the requests when set
+	Token string
+
+	// Timeout of the requests, 10 seconds when zero
+	Timeout time.Duration
+
+	// Users is how many users the legacy service has, it's only used
+	// for the remaining users of the stats
+	Users int64
+}
+
+// legacyUser is the answer of the legacy service
+type legacyUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	LastName string `json:"last_name"`
+}
+
+// Migration marks a user created from the legacy service
+type Migration struct {
+	ID       int64      `db:"id,omitempty" json:"id,string"`
+	UserID   hide.Int64 `db:"user_id"      json:"user_id,string"`
+	LegacyID string     `db:"legacy_id"    json:"legacy_id"`
+	Created  time.Time  `db:"created"      json:"created"`
+}
+
+// MigrationStats is a snapshot of the migration used for monitoring
+// Remaining is -1 when LegacyAuth.Users isn't set
+type MigrationStats struct {
+	Migrated  int64 `json:"migrated"`
+	Remaining int64 `json:"remaining"`
+	Verified  int64 `json:"verified"`
+	Refused   int64 `json:"refused"`
+	Failed    int64 `json:"failed"`
+}
+
+// verify asks the legacy service about the credentials
+// a refused login returns nil and no error
+func (a *LegacyAuth) verify(login, password string) (*legacyUser, error) {
+	body, err := json.Marshal(map[string]string{
+		"login":    login,
+		"password": password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if a.Token != "" {
+		req.Header.Set("Authorization", bearer+" "+a.Token)
+	}
+
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	res, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("legacy auth answered %s", res.Status)
+	}
+
+	lu := &legacyUser{}
+	if err = json.NewDecoder(res.Body).Decode(lu); err != nil {
+		return nil, err
+	}
+
+	return lu, nil
+}
+
+// migrateLegacy logs in a user that isn't local with the legacy service
+// it's done when the service verified the credentials or failed
+func (u *User) migrateLegacy(login, password string) (string, bool, *errors.Error) {
+	a := Config.LegacyAuth
+	if a == nil {
+		return "", false, nil
+	}
+
+	l := Logger.WithField("login", login)
+
+	lu, gErr := a.verify(login, password)
+	if gErr != nil {
+		atomic.AddInt64(&a.failed, 1)
+		l.WithError(gErr).Error("[User.migrateLegacy]: Legacy auth failed")
+		return "", true, errors.FromCode(errors.ErrorTryAgain)
+	}
+
+	if lu == nil {
+		atomic.AddInt64(&a.refused, 1)
+		l.Debug("[User.migrateLegacy]: Refused by the legacy auth")
+		return "", false, nil
+	}
+
+	atomic.AddInt64(&a.verified, 1)
+
+	email := lu.Email
+	if email == "" && strings.Contains(login, "@") {
+		email = login
+	}
+
+	err := u.createNamed(User{
+		Email:     email,
+		Password:  password,
+		Name:      lu.Name,
+		LastName:  lu.LastName,
+		Activated: true, // they were using the legacy service
+	}, lu.Username)
+	if err != nil {
+		l.WithError(err).Error("[User.migrateLegacy]: Error while creating the user")
+		return "", true, err
+	}
+
+	_, gErr = jc.Insert(&Migration{
+		UserID:   u.ID,
+		LegacyID: lu.ID,
+		Created:  time.Now(),
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.migrateLegacy]: Error while inserting")
+		return "", true, errors.FromErr(gErr)
+	}
+
+	l.WithFields(log.Fields{
+		"ID":     u.ID,
+		"legacy": lu.ID,
+	}).Info("[User.migrateLegacy]: User migrated")
+
+	if err := u.LoginSucceeded(); err != nil {
+		return "", true, err
+	}
+
+	u.AuthMethod = AMRPassword
+	token, err := u.loginToken()
+	return token, true, err
+}
+
+// GetMigrationStats counts the users moved from the legacy service
+func GetMigrationStats() (MigrationStats, *errors.Error) {
+	s := MigrationStats{Remaining: -1}
+
+	migrated, gErr := jc.Find().Count()
+	if gErr != nil {
+		return s, errors.FromErr(gErr)
+	}
+
+	s.Migrated = int64(migrated)
+
+	a := Config.LegacyAuth
+	if a == nil {
+		return s, nil
+	}
+
+	s.Verified = atomic.LoadInt64(&a.verified)
+	s.Refused = atomic.LoadInt64(&a.refused)
+	s.Failed = atomic.LoadInt64(&a.failed)
+
+	if a.Users > 0 {
+		s.Remaining = a.Users - s.Migrated
+		if s.Remaining < 0 {
+			s.Remaining = 0
+		}
+	}
+
+	return s, nil
+}
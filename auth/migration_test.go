@@ -0,0 +1,137 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegacyMigration(t *testing.T) {
+	var calls, down int64
+
+	// the legacy service knows one user
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+
+		if atomic.LoadInt64(&down) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer legacy secret" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		if body["login"] == "legacy_long@mail.com" && body["password"] == "old password" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"id":       "43",
+				"username": "legacy_user_with_a_long_name",
+				"email":    "legacy_long@mail.com",
+			})
+			return
+		}
+
+		if body["login"] != "legacy_user" && body["login"] != "legacy_user@mail.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if body["password"] != "old password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":       "42",
+			"username": "legacy_user",
+			"email":    "legacy_user@mail.com",
+		})
+	}))
+	defer legacy.Close()
+
+	Config.LegacyAuth = &LegacyAuth{
+		URL:   legacy.URL,
+		Token: "legacy secret",
+		Users: 10,
+	}
+	defer func() { Config.LegacyAuth = nil }()
+
+	before, err := GetMigrationStats()
+	assert.Nil(t, err)
+
+	// expect error: unknown to both
+	fu := NewUser()
+	fu.Username = "nobody"
+	_, err = fu.Auth("old password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserDoesntExists, err.Code)
+
+	// expect error: wrong password
+	fu = NewUser()
+	fu.Username = "legacy_user"
+	_, err = fu.Auth("wrong password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserDoesntExists, err.Code)
+
+	// expect error: the legacy service is down
+	atomic.StoreInt64(&down, 1)
+	fu = NewUser()
+	fu.Username = "legacy_user"
+	_, err = fu.Auth("old password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorTryAgain, err.Code)
+	atomic.StoreInt64(&down, 0)
+
+	// ok: the user is created with its password hashed
+	u := NewUser()
+	u.Email = "legacy_user@mail.com"
+	token, err := u.Auth("old password")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "legacy_user", u.Username)
+	assert.NotEqual(t, "old password", u.Password)
+	assert.True(t, u.Activated)
+
+	stats, err := GetMigrationStats()
+	assert.Nil(t, err)
+	assert.Equal(t, before.Migrated+1, stats.Migrated)
+	assert.Equal(t, 10-stats.Migrated, stats.Remaining)
+	assert.Equal(t, int64(1), stats.Verified)
+	assert.Equal(t, int64(2), stats.Refused)
+	assert.Equal(t, int64(1), stats.Failed)
+
+	// ok: the next login doesn't reach the legacy service
+	n := atomic.LoadInt64(&calls)
+
+	fu = NewUser()
+	fu.Username = "legacy_user"
+	_, err = fu.Auth("old password")
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, fu.ID)
+
+	fu = NewUser()
+	fu.Username = "legacy_user"
+	_, err = fu.Auth("wrong password")
+	assert.NotNil(t, err)
+	assert.Equal(t, n, atomic.LoadInt64(&calls))
+
+	// ok: a long username is cut like the ones of external users
+	long := NewUser()
+	long.Email = "legacy_long@mail.com"
+	_, err = long.Auth("old password")
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy_user_with_a", long.Username)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, long.HardDelete())
+}
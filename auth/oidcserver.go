@@ -0,0 +1,709 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"github.com/dgrijalva/jwt-go"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// AuthorizationCodeGrantType is the grant_type exchanging a code from the authorize endpoint
+const AuthorizationCodeGrantType = "authorization_code"
+
+// audience of the access tokens given to clients, only accepted by UserInfo
+const oidcAccessAudience = "oidc"
+
+// scopes a client can ask for, openid is required
+var oidcScopes = []string{"openid", "profile", "email", "phone"}
+
+const sqlUseAuthorizationCode = `DELETE FROM ` + TableOAuthCode + ` WHERE id = ?`
+
+var (
+	// generated when Config.OIDCSigningKey isn't set
+	oidcKeyOnce      sync.Once
+	oidcEphemeralKey *rsa.PrivateKey
+)
+
+// OAuthClient is a app registered to log its users in through authenticaTed
+// public clients, like single page and mobile apps, have no secret
+// only the hash of the secret is stored
+type OAuthClient struct {
+	ID       int64  `db:"id,omitempty" json:"-"`
+	ClientID string `db:"client_id"    json:"client_id"`
+	Secret   string `db:"secret"       json:"-"`
+	Name     string `db:"name"         json:"name"`
+
+	// one per line, they must match exactly
+	RedirectURIs string `db:"redirect_uris" json:"-"`
+
+	// service clients, see CreateServiceClient
+	// the scopes they can get, space separated, and the pem of private_key_jwt
+	Scopes    string `db:"scopes"     json:"scopes,omitempty"`
+	PublicKey string `db:"public_key" json:"public_key,omitempty"`
+
+	Created time.Time `db:"created" json:"created"`
+
+	// filled from RedirectURIs
+	RedirectURIList []string `db:"-" json:"redirect_uris"`
+}
+
+// Public checks if the client has no secret nor key
+func (c *OAuthClient) Public() bool {
+	return c.Secret == "" && c.PublicKey == ""
+}
+
+// AllowsRedirect checks if the uri is one of the registered ones
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, r := range strings.Split(c.RedirectURIs, "\n") {
+		if r != "" && r == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Consent is the permission a user gave a client to the scopes
+type Consent struct {
+	ID       int64      `db:"id,omitempty" json:"-"`
+	UserID   hide.Int64 `db:"user_id"      json:"user_id,string"`
+	ClientID string     `db:"client_id"    json:"client_id"`
+	Scope    string     `db:"scope"        json:"scope"`
+	Created  time.Time  `db:"created"      json:"created"`
+}
+
+// AuthorizationCode is given to the client through the redirect uri
+// and exchanged once for the tokens, only its hash is stored
+type AuthorizationCode struct {
+	ID          int64      `db:"id,omitempty"`
+	Code        string     `db:"code"`
+	ClientID    string     `db:"client_id"`
+	UserID      hide.Int64 `db:"user_id"`
+	RedirectURI string     `db:"redirect_uri"`
+	Scope       string     `db:"scope"`
+	Nonce       string     `db:"nonce"`
+	Challenge   string     `db:"challenge"` // pkce, S256
+	AMR         string     `db:"amr"`       // comma separated, of the session
+	Expires     time.Time  `db:"expires"`
+}
+
+// AuthorizeRequest are the parameters of the authorize endpoint
+type AuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// OIDCTokens is the answer of the token endpoint for a authorization code
+type OIDCTokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// oidcKey is the key signing the id tokens and its id
+func oidcKey() (*rsa.PrivateKey, string) {
+	key := Config.OIDCSigningKey
+	if key == nil {
+		oidcKeyOnce.Do(func() {
+			Logger.Warn("[oidcKey]: No OIDCSigningKey set, id tokens are signed by a key that changes on restart")
+
+			var err error
+			if oidcEphemeralKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+				Logger.WithError(err).Error("[oidcKey]: Error while generating a key")
+			}
+		})
+
+		key = oidcEphemeralKey
+	}
+
+	// the first bytes of the hash of the modulus
+	sum := sha256.Sum256(key.N.Bytes())
+	return key, base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// OIDCDiscovery is the document served at /.well-known/openid-configuration
+func OIDCDiscovery() map[string]interface{} {
+	issuer := strings.TrimSuffix(Config.OIDCIssuer, "/")
+
+	return map[string]interface{}{
+		"issuer":                                           issuer,
+		"authorization_endpoint":                           issuer + "/api/v1/oauth/authorize",
+		"token_endpoint":                                   issuer + "/api/v1/oauth/token",
+		"userinfo_endpoint":                                issuer + "/api/v1/oauth/userinfo",
+		"jwks_uri":                                         issuer + "/api/v1/oauth/jwks",
+		"response_types_supported":                         []string{"code"},
+		"grant_types_supported":                            []string{AuthorizationCodeGrantType, DeviceCodeGrantType, ClientCredentialsGrantType},
+		"subject_types_supported":                          []string{"public"},
+		"id_token_signing_alg_values_supported":            []string{"RS256"},
+		"scopes_supported":                                 oidcScopes,
+		"token_endpoint_auth_methods_supported":            []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+		"token_endpoint_auth_signing_alg_values_supported": clientAssertionAlgorithms,
+		"code_challenge_methods_supported":                 []string{"S256"},
+		"claims_supported": []string{
+			"sub", "name", "preferred_username", "email", "email_verified", "phone_number", "phone_number_verified",
+		},
+	}
+}
+
+// JWKS is the public key set of the id tokens
+func JWKS() map[string]interface{} {
+	key, kid := oidcKey()
+
+	return map[string]interface{}{
+		"keys": []map[string]string{
+			map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// CreateOAuthClient registers a app with its redirect uris
+// the secret, empty for public clients, is only returned here
+func CreateOAuthClient(name string, redirectURIs []string, public bool) (*OAuthClient, string, *errors.Error) {
+	if name == "" || len(redirectURIs) == 0 {
+		return nil, "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	for _, r := range redirectURIs {
+		u, err := url.Parse(r)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, "", errors.FromCode(errors.ErrorInvalidRedirectURI)
+		}
+	}
+
+	clientID, gErr := util.RandomToken(16)
+	if gErr != nil {
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	var secret string
+	if !public {
+		if secret, gErr = util.RandomToken(32); gErr != nil {
+			return nil, "", errors.FromErr(gErr)
+		}
+	}
+
+	c := &OAuthClient{
+		ClientID:     clientID,
+		Name:         name,
+		RedirectURIs: strings.Join(redirectURIs, "\n"),
+		Created:      time.Now(),
+	}
+
+	if secret != "" {
+		c.Secret = util.HashToken(secret)
+	}
+
+	id, gErr := qc.Insert(c)
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[CreateOAuthClient]: Error while inserting")
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	c.ID = id.(int64)
+	c.RedirectURIList = redirectURIs
+
+	Logger.WithFields(log.Fields{
+		"client": clientID,
+		"name":   name,
+	}).Info("[CreateOAuthClient]: Client registered")
+	return c, secret, nil
+}
+
+// FindOAuthClient finds the client of the id
+func FindOAuthClient(clientID string) (*OAuthClient, *errors.Error) {
+	var c *OAuthClient
+
+	err := qc.Find(db.Cond{"client_id": clientID}).One(&c)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorClientNotFound)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	c.RedirectURIList = strings.Split(c.RedirectURIs, "\n")
+	return c, nil
+}
+
+// OAuthClients lists the registered clients
+func OAuthClients() ([]*OAuthClient, *errors.Error) {
+	var list []*OAuthClient
+
+	if err := qc.Find().OrderBy("name").All(&list); err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	for _, c := range list {
+		c.RedirectURIList = strings.Split(c.RedirectURIs, "\n")
+	}
+
+	return list, nil
+}
+
+// DeleteOAuthClient removes a client with its consents and codes
+func DeleteOAuthClient(clientID string) *errors.Error {
+	if _, err := FindOAuthClient(clientID); err != nil {
+		return err
+	}
+
+	cond := db.Cond{"client_id": clientID}
+	for _, c := range []db.Collection{zc, vc, qc} {
+		if err := c.Find(cond).Delete(); err != nil {
+			return errors.FromErr(err)
+		}
+	}
+
+	Logger.WithField("client", clientID).Info("[DeleteOAuthClient]: Client removed")
+	return nil
+}
+
+// AuthenticateOAuthClient checks the credentials sent to the token endpoint
+// public clients only send their id
+func AuthenticateOAuthClient(clientID, secret string) (*OAuthClient, *errors.Error) {
+	c, err := FindOAuthClient(clientID)
+	if err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return nil, errors.FromCode(errors.ErrorInvalidClient)
+		}
+
+		return nil, err
+	}
+
+	if c.Public() {
+		if secret != "" {
+			return nil, errors.FromCode(errors.ErrorInvalidClient)
+		}
+
+		return c, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Secret), []byte(util.HashToken(secret))) != 1 {
+		return nil, errors.FromCode(errors.ErrorInvalidClient)
+	}
+
+	return c, nil
+}
+
+// normalizeOIDCScope checks the scopes and removes the repeated ones
+func normalizeOIDCScope(scope string) (string, *errors.Error) {
+	var list []string
+	for _, s := range strings.Fields(scope) {
+		if !containsString(oidcScopes, s) {
+			return "", errors.FromCode(errors.ErrorInvalidScope)
+		}
+
+		if !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+
+	if !containsString(list, "openid") {
+		return "", errors.FromCode(errors.ErrorInvalidScope)
+	}
+
+	return strings.Join(list, " "), nil
+}
+
+// containsString checks if the list has the string
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks the request against its client
+// errors about the client or redirect uri must not be sent to the redirect uri
+func (r *AuthorizeRequest) Validate() (*OAuthClient, *errors.Error) {
+	c, err := FindOAuthClient(r.ClientID)
+	if err != nil {
+		if err.Code == errors.ErrorClientNotFound {
+			return nil, errors.FromCode(errors.ErrorInvalidClient)
+		}
+
+		return nil, err
+	}
+
+	if !c.AllowsRedirect(r.RedirectURI) {
+		return nil, errors.FromCode(errors.ErrorInvalidRedirectURI)
+	}
+
+	if r.ResponseType != "code" || r.CodeChallenge == "" || r.CodeChallengeMethod != "S256" {
+		return c, errors.FromCode(errors.ErrorInvalidRequest)
+	}
+
+	scope, err := normalizeOIDCScope(r.Scope)
+	if err != nil {
+		return c, err
+	}
+
+	r.Scope = scope
+	return c, nil
+}
+
+// Redirect builds the uri the browser goes back to with the query values
+func (r *AuthorizeRequest) Redirect(values url.Values) string {
+	if r.State != "" {
+		values.Set("state", r.State)
+	}
+
+	sep := "?"
+	if strings.Contains(r.RedirectURI, "?") {
+		sep = "&"
+	}
+
+	return r.RedirectURI + sep + values.Encode()
+}
+
+// HasConsent checks if the user already allowed the client every scope
+func (u *User) HasConsent(clientID, scope string) (bool, *errors.Error) {
+	var c *Consent
+
+	err := vc.Find(db.Cond{"user_id": u.ID, "client_id": clientID}).One(&c)
+	if err == db.ErrNoMoreRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.FromErr(err)
+	}
+
+	granted := strings.Fields(c.Scope)
+	for _, s := range strings.Fields(scope) {
+		if !containsString(granted, s) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// GrantConsent allows the client the scopes, adding to the ones allowed before
+func (u *User) GrantConsent(clientID, scope string) *errors.Error {
+	var c *Consent
+
+	r := vc.Find(db.Cond{"user_id": u.ID, "client_id": clientID})
+	err := r.One(&c)
+	if err == db.ErrNoMoreRows {
+		_, err = vc.Insert(&Consent{
+			UserID:   u.ID,
+			ClientID: clientID,
+			Scope:    scope,
+			Created:  time.Now(),
+		})
+
+		return errors.FromErr(err)
+	}
+
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	granted := strings.Fields(c.Scope)
+	for _, s := range strings.Fields(scope) {
+		if !containsString(granted, s) {
+			granted = append(granted, s)
+		}
+	}
+
+	return errors.FromErr(r.Update(map[string]interface{}{
+		"scope": strings.Join(granted, " "),
+	}))
+}
+
+// Consents lists the clients the user allowed
+func (u *User) Consents() ([]*Consent, *errors.Error) {
+	var list []*Consent
+
+	err := vc.Find(db.Cond{"user_id": u.ID}).OrderBy("created").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// RevokeConsent removes the permission given to the client
+// the client has to ask again on the next login
+func (u *User) RevokeConsent(clientID string) *errors.Error {
+	r := vc.Find(db.Cond{"user_id": u.ID, "client_id": clientID})
+
+	count, err := r.Count()
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if count == 0 {
+		return errors.FromCode(errors.ErrorClientNotFound)
+	}
+
+	return errors.FromErr(r.Delete())
+}
+
+// IssueAuthorizationCode creates the code the client exchanges for the tokens
+// the request must be validated and consented to first
+// amr are the authentication methods of the session of the user
+func (u *User) IssueAuthorizationCode(r *AuthorizeRequest, amr []string) (string, *errors.Error) {
+	code, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	_, gErr = zc.Insert(&AuthorizationCode{
+		Code:        util.HashToken(code),
+		ClientID:    r.ClientID,
+		UserID:      u.ID,
+		RedirectURI: r.RedirectURI,
+		Scope:       r.Scope,
+		Nonce:       r.Nonce,
+		Challenge:   r.CodeChallenge,
+		AMR:         strings.Join(amr, ","),
+		Expires:     time.Now().Add(Config.OIDCCodeTime),
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.IssueAuthorizationCode]: Error while inserting")
+		return "", errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":     u.ID,
+		"client": r.ClientID,
+	}).Debug("[User.IssueAuthorizationCode]: Code issued")
+	return code, nil
+}
+
+// ExchangeAuthorizationCode gives the tokens of the code to the client that got it
+// the pkce verifier and redirect uri must match the authorize request
+func ExchangeAuthorizationCode(c *OAuthClient, code, redirectURI, verifier string) (*OIDCTokens, *errors.Error) {
+	var ac *AuthorizationCode
+
+	gErr := zc.Find(db.Cond{"code": util.HashToken(code)}).One(&ac)
+	if gErr == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	// only one request can use it
+	res, gErr := session.Exec(sqlUseAuthorizationCode, ac.ID)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	if ac.ClientID != c.ClientID || ac.RedirectURI != redirectURI || time.Now().After(ac.Expires) {
+		return nil, errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	if verifier == "" || pkceChallenge(verifier) != ac.Challenge {
+		return nil, errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	u := NewUser()
+	u.ID = ac.UserID
+
+	found, fErr := u.Find()
+	if fErr != nil {
+		return nil, fErr
+	}
+
+	if !found || u.Deleted {
+		return nil, errors.FromCode(errors.ErrorInvalidGrant)
+	}
+
+	access, err := u.issueOIDCAccessToken(c.ClientID, ac.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := u.issueIDToken(c.ClientID, ac.Scope, ac.Nonce, ac.AMR)
+	if err != nil {
+		return nil, err
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":     u.ID,
+		"client": c.ClientID,
+	}).Info("[ExchangeAuthorizationCode]: Tokens issued")
+
+	return &OIDCTokens{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(Config.OIDCTokenTime.Seconds()),
+		IDToken:     id,
+		Scope:       ac.Scope,
+	}, nil
+}
+
+// issueOIDCAccessToken creates the token the client sends to UserInfo
+// its audience keeps it from being used as a session
+func (u *User) issueOIDCAccessToken(clientID, scope string) (string, *errors.Error) {
+	claims, err := u.tokenClaims(false)
+	if err != nil {
+		return "", err
+	}
+
+	claims.Scope = scope
+	claims.ClientID = clientID
+	claims.Audience = oidcAccessAudience
+	claims.ExpiresAt = time.Now().Add(Config.OIDCTokenTime).Unix()
+
+	s, gErr := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Config.TokenSecret)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	return s, nil
+}
+
+// oidcClaims builds the claims of the user allowed by the scope
+func (u *User) oidcClaims(scope string) jwt.MapClaims {
+	// the same id the api shows
+	claims := jwt.MapClaims{
+		"sub": strconv.FormatInt(util.Obfuscate(u.ID), 10),
+	}
+
+	scopes := strings.Fields(scope)
+	if containsString(scopes, "profile") {
+		claims["name"] = strings.TrimSpace(u.Name + " " + u.LastName)
+		claims["preferred_username"] = u.Username
+	}
+
+	if containsString(scopes, "email") {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.Activated
+	}
+
+	if containsString(scopes, "phone") && u.Phone != "" {
+		claims["phone_number"] = u.Phone
+		claims["phone_number_verified"] = true // only verified numbers are saved
+	}
+
+	return claims
+}
+
+// issueIDToken creates the signed id token of the user for the client
+// amr is left out when the session didn't say how the user logged in
+func (u *User) issueIDToken(clientID, scope, nonce, amr string) (string, *errors.Error) {
+	now := time.Now()
+
+	claims := u.oidcClaims(scope)
+	claims["iss"] = strings.TrimSuffix(Config.OIDCIssuer, "/")
+	claims["aud"] = clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(Config.OIDCTokenTime).Unix()
+
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	// authentication methods, rfc 8176
+	if amr != "" {
+		claims["amr"] = strings.Split(amr, ",")
+	}
+
+	key, kid := oidcKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	s, gErr := token.SignedString(key)
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	return s, nil
+}
+
+// UserInfo gives the claims allowed to the client of the access token
+func UserInfo(accessToken string) (map[string]interface{}, *errors.Error) {
+	token, gErr := jwt.ParseWithClaims(accessToken, &UserToken{}, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != AlgorithmHS256 {
+			return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+		}
+
+		return Config.TokenSecret, nil
+	})
+	if gErr != nil || !token.Valid {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	claims := token.Claims.(*UserToken)
+	if !claims.VerifyAudience(oidcAccessAudience, true) {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	id, err := util.Decrypt(claims.UID, Config.EncryptionKey)
+	if err != nil {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	i, gErr := strconv.ParseInt(id, 10, 64)
+	if gErr != nil {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	u := NewUser()
+	u.ID = hide.Int64(i)
+
+	found, err := u.Find()
+	if err != nil {
+		return nil, err
+	}
+
+	// revoked by a password change or a revoked consent
+	if !found || u.Deleted || claims.Version != u.TokenVersion {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	consent, err := u.HasConsent(claims.ClientID, claims.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if !consent {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	return u.oidcClaims(claims.Scope), nil
+}
@@ -0,0 +1,183 @@
+package users
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	"github.com/UnnoTed/authenticaTed/util"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// jwksKey reads the first key of the jwks back into a public key
+func jwksKey(t *testing.T) (*rsa.PublicKey, string) {
+	k := JWKS()["keys"].([]map[string]string)[0]
+
+	n, err := base64.RawURLEncoding.DecodeString(k["n"])
+	assert.Nil(t, err)
+
+	e, err := base64.RawURLEncoding.DecodeString(k["e"])
+	assert.Nil(t, err)
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, k["kid"]
+}
+
+func TestOIDCServer(t *testing.T) {
+	u := NewUser()
+	u.Username = "Provider_User"
+	u.Email = "provider_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: relative redirect uri
+	_, _, err = CreateOAuthClient("app", []string{"/callback"}, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidRedirectURI, err.Code)
+
+	// ok
+	client, secret, err := CreateOAuthClient("app", []string{"https://app.example.com/callback"}, false)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, secret)
+	assert.False(t, client.Public())
+
+	// expect error: wrong secret
+	_, err = AuthenticateOAuthClient(client.ClientID, "wrong")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidClient, err.Code)
+
+	// ok
+	_, err = AuthenticateOAuthClient(client.ClientID, secret)
+	assert.Nil(t, err)
+
+	verifier := "a-verifier-long-enough-for-pkce-0123456789"
+	r := &AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            client.ClientID,
+		RedirectURI:         "https://app.example.com/other",
+		Scope:               "openid email profile email",
+		State:               "state",
+		Nonce:               "nonce",
+		CodeChallenge:       pkceChallenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	// expect error: unregistered redirect uri
+	_, err = r.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidRedirectURI, err.Code)
+
+	// expect error: plain pkce
+	r.RedirectURI = "https://app.example.com/callback"
+	r.CodeChallengeMethod = "plain"
+	_, err = r.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidRequest, err.Code)
+
+	// expect error: openid is required
+	r.CodeChallengeMethod = "S256"
+	r.Scope = "email"
+	_, err = r.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidScope, err.Code)
+
+	// ok
+	r.Scope = "openid email profile email"
+	_, err = r.Validate()
+	assert.Nil(t, err)
+	assert.Equal(t, "openid email profile", r.Scope)
+
+	consent, err := u.HasConsent(client.ClientID, r.Scope)
+	assert.Nil(t, err)
+	assert.False(t, consent)
+
+	assert.Nil(t, u.GrantConsent(client.ClientID, r.Scope))
+
+	consent, err = u.HasConsent(client.ClientID, "openid email")
+	assert.Nil(t, err)
+	assert.True(t, consent)
+
+	code, err := u.IssueAuthorizationCode(r, nil)
+	assert.Nil(t, err)
+
+	// expect error: wrong verifier, the code is gone after any attempt
+	_, err = ExchangeAuthorizationCode(client, code, r.RedirectURI, "wrong")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidGrant, err.Code)
+
+	_, err = ExchangeAuthorizationCode(client, code, r.RedirectURI, verifier)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidGrant, err.Code)
+
+	// ok: the methods of the session that consented
+	code, err = u.IssueAuthorizationCode(r, []string{AMRHardwareKey, AMRMultipleFactors})
+	assert.Nil(t, err)
+
+	tokens, err := ExchangeAuthorizationCode(client, code, r.RedirectURI, verifier)
+	assert.Nil(t, err)
+	assert.Equal(t, "openid email profile", tokens.Scope)
+
+	// expect error: single use
+	_, err = ExchangeAuthorizationCode(client, code, r.RedirectURI, verifier)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidGrant, err.Code)
+
+	// the id token is verified by the published key
+	key, kid := jwksKey(t)
+	id, gErr := jwt.Parse(tokens.IDToken, func(t *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	assert.Nil(t, gErr)
+	assert.True(t, id.Valid)
+	assert.Equal(t, kid, id.Header["kid"])
+
+	claims := id.Claims.(jwt.MapClaims)
+	assert.Equal(t, strconv.FormatInt(util.Obfuscate(u.ID), 10), claims["sub"])
+	assert.Equal(t, client.ClientID, claims["aud"])
+	assert.Equal(t, "nonce", claims["nonce"])
+	assert.Equal(t, "provider_user@mail.com", claims["email"])
+	assert.Equal(t, "provider_user", claims["preferred_username"])
+	assert.Equal(t, []interface{}{AMRHardwareKey, AMRMultipleFactors}, claims["amr"])
+
+	// expect error: the access token isn't a session
+	c := bearerContext("GET", tokens.AccessToken)
+	assert.NotNil(t, LoadToken(c))
+
+	// ok
+	info, err := UserInfo(tokens.AccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, claims["sub"], info["sub"])
+	assert.Equal(t, "provider_user@mail.com", info["email"])
+	assert.Nil(t, info["phone_number"])
+
+	// expect error: revoked consent
+	assert.Nil(t, u.RevokeConsent(client.ClientID))
+
+	_, err = UserInfo(tokens.AccessToken)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	// expect error: a session token
+	token, err := u.IssueToken()
+	assert.Nil(t, err)
+
+	_, err = UserInfo(token)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	assert.Nil(t, DeleteOAuthClient(client.ClientID))
+
+	_, err = FindOAuthClient(client.ClientID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorClientNotFound, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+}
@@ -0,0 +1,120 @@
+package users
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// CheckPasswordPolicy checks a plaintext password against
+// the limits from the config before it is hashed
+func CheckPasswordPolicy(password string) *errors.Error {
+	if len(password) < Config.PasswordMinLength {
+		return errors.FromCode(errors.ErrorPasswordTooShort)
+	}
+
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > Config.PasswordMaxLength {
+		return errors.FromCode(errors.ErrorPasswordTooLong)
+	}
+
+	return nil
+}
+
+// ChangePassword replaces the user's password after checking the current one
+// all tokens issued before the change stop working, a u.Find() is required before using it
+func (u *User) ChangePassword(current, password string) *errors.Error {
+	l := Logger.WithFields(log.Fields{
+		"ID":       u.ID,
+		"Username": u.Username,
+	})
+	l.Debug("[User.ChangePassword]: Changing password...")
+
+	if u.ID == 0 || current == "" || password == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	// guessing the current password here counts as failed logins
+	locked, err := u.IsLocked()
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		return errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	// the current password must match
+	err = u.ComparePassword(current)
+	if err != nil {
+		if err.Code == errors.ErrorTryAgain {
+			return err
+		}
+
+		l.Debug("[User.ChangePassword]: Wrong current password")
+		if _, err = u.LoginFailed(); err != nil {
+			return err
+		}
+
+		return errors.FromCode(errors.ErrorUserInvalidPassword)
+	}
+
+	if current == password {
+		return errors.FromCode(errors.ErrorPasswordUnchanged)
+	}
+
+	if err = u.SetPassword(password); err != nil {
+		return err
+	}
+
+	l.Debug("[User.ChangePassword]: Password changed")
+	return nil
+}
+
+// SetPassword replaces the user's password without the current one
+// like ChangePassword, the tokens issued before it stop working
+func (u *User) SetPassword(password string) *errors.Error {
+	l := Logger.WithField("ID", u.ID)
+
+	if u.ID == 0 || password == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	err := CheckPasswordPolicy(password)
+	if err != nil {
+		l.WithError(err).Debug("[User.SetPassword]: Password refused by the policy")
+		return err
+	}
+
+	// hash a copy so the user keeps the old hash when anything fails
+	nu := *u
+	nu.Password = password
+	if err = nu.Hash(); err != nil {
+		return err
+	}
+
+	nu.TokenVersion++
+
+	// only the password and token version are touched
+	gErr := uc.Find(db.Cond{"id": u.ID}).Update(map[string]interface{}{
+		"password":      nu.Password,
+		"token_version": nu.TokenVersion,
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.SetPassword]: Error while saving the password")
+		return errors.FromErr(gErr)
+	}
+
+	u.Password = nu.Password
+	u.TokenVersion = nu.TokenVersion
+
+	// a new password also lifts a lock from failed logins
+	if err = u.Unlock(); err != nil {
+		return err
+	}
+
+	l.Debug("[User.SetPassword]: Password set")
+	return nil
+}
@@ -0,0 +1,79 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	assert.Nil(t, CheckPasswordPolicy("password"))
+
+	// expect error: too short
+	err := CheckPasswordPolicy("pass")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPasswordTooShort, err.Code)
+
+	// expect error: too long
+	long := make([]byte, Config.PasswordMaxLength+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+
+	err = CheckPasswordPolicy(string(long))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPasswordTooLong, err.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	u := NewUser()
+	u.Username = "Password_Changer"
+	u.Email = "password_changer@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// expect error: wrong current password
+	err = u.ChangePassword("wrong", "new password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserInvalidPassword, err.Code)
+
+	// expect error: same password
+	err = u.ChangePassword("password", "password")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPasswordUnchanged, err.Code)
+
+	// expect error: policy
+	err = u.ChangePassword("password", "new")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPasswordTooShort, err.Code)
+
+	// ok
+	err = u.ChangePassword("password", "new password")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, u.TokenVersion)
+
+	// check the database
+	found := NewUser()
+	found.ID = u.ID
+	ok, err := found.Find()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, found.TokenVersion)
+	assert.Nil(t, found.ComparePassword("new password"))
+
+	// Save never touches the password or the token version
+	found.Password = "plaintext"
+	found.TokenVersion = 0
+	assert.Nil(t, found.Save())
+
+	ok, err = found.Find()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, found.TokenVersion)
+	assert.Nil(t, found.ComparePassword("new password"))
+
+	assert.Nil(t, u.HardDelete())
+}
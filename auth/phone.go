@@ -0,0 +1,339 @@
+package users
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// what a sms code can be used for
+const (
+	SMSCodeVerify = "verify"
+	SMSCodeLogin  = "login"
+	SMSCodeMFA    = "mfa"
+)
+
+// digits of the sms codes
+const smsCodeDigits = 6
+
+const smsCodeBody = "Your %s code is %s, it expires in %s."
+
+// e.164: a plus, the country code and up to 15 digits
+var phoneFormat = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// SMSCode is a numeric code sent to a phone, only its hash is stored
+// a user has at most one for each purpose
+type SMSCode struct {
+	ID      int64      `db:"id,omitempty"`
+	UserID  hide.Int64 `db:"user_id"`
+	Purpose string     `db:"purpose"`
+
+	// number the code was sent to, it's the new one while verifying
+	Phone    string    `db:"phone"`
+	Code     string    `db:"code"`
+	Attempts int       `db:"attempts"`
+	Sent     time.Time `db:"sent"`
+	Expires  time.Time `db:"expires"`
+}
+
+// NormalizePhone removes the spaces, dashes, dots and parentheses
+// people type and checks the number is in the E.164 format
+func NormalizePhone(phone string) (string, *errors.Error) {
+	phone = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(phone)
+
+	if !phoneFormat.MatchString(phone) {
+		return "", errors.FromCode(errors.ErrorPhoneInvalid)
+	}
+
+	return phone, nil
+}
+
+// getSMSCode finds the code of the purpose
+// it returns nil when there is none
+func (u *User) getSMSCode(purpose string) (*SMSCode, *errors.Error) {
+	var c *SMSCode
+
+	err := sc.Find(db.Cond{"user_id": u.ID, "purpose": purpose}).One(&c)
+	if err == db.ErrNoMoreRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return c, nil
+}
+
+// SendSMSCode texts a new code to the phone replacing the last one of the purpose
+// a new code can only be sent after Config.SMSCodeResend
+func (u *User) SendSMSCode(purpose, phone string) *errors.Error {
+	l := Logger.WithFields(log.Fields{
+		"ID":      u.ID,
+		"purpose": purpose,
+	})
+
+	if u.ID == 0 || phone == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	last, err := u.getSMSCode(purpose)
+	if err != nil {
+		return err
+	}
+
+	if last != nil && time.Since(last.Sent) < Config.SMSCodeResend {
+		l.Debug("[User.SendSMSCode]: Asked again too soon")
+		return errors.FromCode(errors.ErrorCodeThrottled)
+	}
+
+	code, gErr := util.RandomDigits(smsCodeDigits)
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	if last != nil {
+		if gErr = sc.Find(db.Cond{"id": last.ID}).Delete(); gErr != nil {
+			return errors.FromErr(gErr)
+		}
+	}
+
+	now := time.Now()
+	_, gErr = sc.Insert(&SMSCode{
+		UserID:  u.ID,
+		Purpose: purpose,
+		Phone:   phone,
+		Code:    util.HashToken(code),
+		Sent:    now,
+		Expires: now.Add(Config.SMSCodeTime),
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.SendSMSCode]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	sendSMS(phone, fmt.Sprintf(smsCodeBody, Config.MFAIssuer, code, Config.SMSCodeTime))
+
+	l.Debug("[User.SendSMSCode]: Code sent")
+	return nil
+}
+
+// HasSMSCode checks if a code of the purpose is waiting to be used
+func (u *User) HasSMSCode(purpose string) (bool, *errors.Error) {
+	c, err := u.getSMSCode(purpose)
+	if err != nil || c == nil {
+		return false, err
+	}
+
+	return time.Now().Before(c.Expires) && c.Attempts < Config.SMSCodeAttempts, nil
+}
+
+// VerifySMSCode checks the code of the purpose and returns the number it was sent to
+// the code is removed when it's right or after Config.SMSCodeAttempts wrong ones
+func (u *User) VerifySMSCode(purpose, code string) (string, *errors.Error) {
+	c, err := u.getSMSCode(purpose)
+	if err != nil {
+		return "", err
+	}
+
+	if c == nil || time.Now().After(c.Expires) || c.Attempts >= Config.SMSCodeAttempts {
+		return "", errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	cond := db.Cond{"id": c.ID}
+	if c.Code == util.HashToken(strings.TrimSpace(code)) {
+		return c.Phone, errors.FromErr(sc.Find(cond).Delete())
+	}
+
+	c.Attempts++
+	if c.Attempts >= Config.SMSCodeAttempts {
+		Logger.WithField("ID", u.ID).Debug("[User.VerifySMSCode]: No attempts left")
+		err = errors.FromErr(sc.Find(cond).Delete())
+	} else {
+		err = errors.FromErr(sc.Find(cond).Update(map[string]interface{}{
+			"attempts": c.Attempts,
+		}))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "", errors.FromCode(errors.ErrorInvalidCode)
+}
+
+// SetPhone starts changing the phone of the user, a code is texted to
+// the new number and it's only saved after VerifyPhone
+func (u *User) SetPhone(phone string) *errors.Error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+
+	if phone == u.Phone {
+		return errors.FromCode(errors.ErrorPhoneExists)
+	}
+
+	// only verified numbers are saved, they must be unique
+	exists, err := u.ExistsWithCond(db.Cond{"phone": phone})
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return errors.FromCode(errors.ErrorPhoneExists)
+	}
+
+	return u.SendSMSCode(SMSCodeVerify, phone)
+}
+
+// VerifyPhone saves the number given to SetPhone with the code texted to it
+func (u *User) VerifyPhone(code string) *errors.Error {
+	phone, err := u.VerifySMSCode(SMSCodeVerify, code)
+	if err != nil {
+		return err
+	}
+
+	// another user verified it first
+	exists, err := u.ExistsWithCond(db.Cond{"phone": phone})
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return errors.FromCode(errors.ErrorPhoneExists)
+	}
+
+	gErr := uc.Find(db.Cond{"id": u.ID}).Update(map[string]interface{}{
+		"phone": phone,
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.VerifyPhone]: Error while saving the phone")
+		return errors.FromErr(gErr)
+	}
+
+	u.Phone = phone
+
+	Logger.WithField("ID", u.ID).Debug("[User.VerifyPhone]: Phone verified")
+	return nil
+}
+
+// RemovePhone removes the phone of the user
+func (u *User) RemovePhone() *errors.Error {
+	gErr := uc.Find(db.Cond{"id": u.ID}).Update(map[string]interface{}{
+		"phone": "",
+	})
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	u.Phone = ""
+	return nil
+}
+
+// SendMFASMSCode texts a code that works as the second login
+// step with AuthMFA, when the authenticator app is not at hand
+func (u *User) SendMFASMSCode(challenge string) *errors.Error {
+	if !Config.SMSCodeFallback {
+		return errors.FromCode(errors.ErrorMFANotEnabled)
+	}
+
+	if err := u.FindChallenge(challenge); err != nil {
+		return err
+	}
+
+	if u.Phone == "" {
+		return errors.FromCode(errors.ErrorMFANotEnabled)
+	}
+
+	return u.SendSMSCode(SMSCodeMFA, u.Phone)
+}
+
+// RequestSMSLoginCode texts a code to log in without the password
+// to the user with the verified phone
+// with Config.HideAccountExistence a missing user isn't an error
+func (u *User) RequestSMSLoginCode(phone string) *errors.Error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+
+	found, err := u.FindWithCond(db.Cond{"phone": phone})
+	if err != nil && (!Config.HideAccountExistence || err.Code != errors.ErrorUserDoesntExists) {
+		return err
+	}
+
+	if !found {
+		if Config.HideAccountExistence {
+			u.ID = 0
+			return nil
+		}
+
+		return errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	return u.SendSMSCode(SMSCodeLogin, u.Phone)
+}
+
+// AuthSMSCode logs in the user of the phone using the code
+// from RequestSMSLoginCode instead of the password
+// it returns the same as Auth, a challenge when a second factor is needed
+func (u *User) AuthSMSCode(phone, code string) (string, *errors.Error) {
+	l := Logger.WithField("step", "sms")
+	l.Debug("[User.AuthSMSCode]: Authenticating user...")
+
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return "", err
+	}
+
+	found, err := u.FindWithCond(db.Cond{"phone": phone})
+	if err != nil && err.Code != errors.ErrorUserDoesntExists {
+		return "", err
+	}
+
+	// a missing user looks like a wrong code
+	if !found {
+		return "", errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if _, err = u.VerifySMSCode(SMSCodeLogin, code); err != nil {
+		l.WithField("ID", u.ID).Debug("[User.AuthSMSCode]: Wrong code")
+
+		lo, lErr := u.LoginFailed()
+		if lErr != nil {
+			return "", lErr
+		}
+
+		if lo != nil {
+			time.Sleep(loginDelay(lo.Failures))
+		}
+
+		return "", err
+	}
+
+	if err = u.LoginSucceeded(); err != nil {
+		return "", err
+	}
+
+	u.AuthMethod = AMRSMS
+	return u.loginToken()
+}
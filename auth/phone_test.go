@@ -0,0 +1,155 @@
+package users
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var smsCode = regexp.MustCompile(`code is (\d+)`)
+
+// lastSMSCode gets the last code texted to the number
+func lastSMSCode(t *testing.T, s *MemorySMSSender, to string) string {
+	sms := s.Last(to)
+	if !assert.NotNil(t, sms) {
+		return ""
+	}
+
+	match := smsCode.FindStringSubmatch(sms.Body)
+	if !assert.Len(t, match, 2) {
+		return ""
+	}
+
+	return match[1]
+}
+
+func TestNormalizePhone(t *testing.T) {
+	phone, err := NormalizePhone("+55 (11) 91234-5678")
+	assert.Nil(t, err)
+	assert.Equal(t, "+5511912345678", phone)
+
+	for _, p := range []string{"", "11912345678", "+0511912345678", "+55 11 9123 4567 8901 23", "+55abc"} {
+		_, err = NormalizePhone(p)
+		assert.NotNil(t, err, p)
+		assert.Equal(t, errors.ErrorPhoneInvalid, err.Code, p)
+	}
+}
+
+func TestPhone(t *testing.T) {
+	sender, resend := Config.SMSSender, Config.SMSCodeResend
+	email, sms := Config.EmailCodeFallback, Config.SMSCodeFallback
+	s := &MemorySMSSender{}
+	Config.SMSSender = s
+	defer func() {
+		Config.SMSSender = sender
+		Config.SMSCodeResend = resend
+		Config.EmailCodeFallback, Config.SMSCodeFallback = email, sms
+	}()
+
+	const phone = "+5511912345678"
+
+	u := NewUser()
+	u.Username = "Phone_User"
+	u.Email = "phone_user@mail.com"
+	u.Password = "password"
+	u.Phone = phone
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	// not verified yet
+	assert.Empty(t, u.Phone)
+
+	// expect error: format
+	err = u.SetPhone("12345")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPhoneInvalid, err.Code)
+
+	assert.Nil(t, u.SetPhone("+55 11 91234-5678"))
+
+	// expect error: wrong code
+	err = u.VerifyPhone("000000")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// ok
+	assert.Nil(t, u.VerifyPhone(lastSMSCode(t, s, phone)))
+	assert.Equal(t, phone, u.Phone)
+
+	fu := NewUser()
+	fu.ID = u.ID
+	_, err = fu.Find()
+	assert.Nil(t, err)
+	assert.Equal(t, phone, fu.Phone)
+
+	// expect error: unique
+	o := NewUser()
+	o.Username = "Phone_Other"
+	o.Email = "phone_other@mail.com"
+	o.Password = "password"
+	_, err = o.Create()
+	assert.Nil(t, err)
+
+	err = o.SetPhone(phone)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorPhoneExists, err.Code)
+
+	// login with a code
+	assert.Nil(t, NewUser().RequestSMSLoginCode(phone))
+
+	fu = NewUser()
+	token, err := fu.AuthSMSCode(phone, lastSMSCode(t, s, phone))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: single use
+	_, err = NewUser().AuthSMSCode(phone, lastSMSCode(t, s, phone))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidCode, err.Code)
+
+	// users without a phone are found too
+	fo := NewUser()
+	fo.ID = o.ID
+	found, err := fo.Find()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Empty(t, fo.Phone)
+
+	// ok: a texted code while a emailed one is pending
+	Config.SMSCodeResend = 0
+	Config.EmailCodeFallback, Config.SMSCodeFallback = true, true
+	e, err := u.EnrollTOTP()
+	assert.Nil(t, err)
+	_, err = u.ConfirmTOTP(totpCode(t, e.Secret, 0))
+	assert.Nil(t, err)
+
+	fu = NewUser()
+	fu.Username = u.Username
+	challenge, err := fu.Auth("password")
+	assert.Nil(t, err)
+	assert.True(t, fu.MFAPending)
+
+	assert.Nil(t, NewUser().SendMFAEmailCode(challenge))
+	assert.Nil(t, NewUser().SendMFASMSCode(challenge))
+
+	token, err = NewUser().AuthMFA(challenge, lastSMSCode(t, s, phone))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	// ok: the number is free again
+	assert.Nil(t, u.RemovePhone())
+	assert.Nil(t, o.SetPhone(phone))
+
+	fu = NewUser()
+	fu.ID = u.ID
+	found, err = fu.Find()
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Empty(t, fu.Phone)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, o.HardDelete())
+}
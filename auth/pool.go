@@ -0,0 +1,195 @@
+package users
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// states of a job inside the hash pool
+const (
+	jobQueued int32 = iota
+	jobStarted
+	jobAbandoned
+)
+
+// hashJob is a bcrypt operation waiting for a worker
+type hashJob struct {
+	state int32
+	work  func()
+	done  chan struct{}
+}
+
+// HashStats is a snapshot of the hash pool used for monitoring
+type HashStats struct {
+	Workers  int   `json:"workers"`
+	Queued   int   `json:"queued"`
+	Capacity int   `json:"capacity"`
+	Running  int64 `json:"running"`
+	Rejected int64 `json:"rejected"`
+}
+
+// hashPool runs bcrypt on a fixed number of goroutines
+// so a few concurrent logins can't pin every core
+type hashPool struct {
+	// keep the atomic counters at the top for 64bit alignment
+	running  int64
+	rejected int64
+
+	jobs    chan *hashJob
+	workers int
+	timeout time.Duration
+}
+
+var (
+	pool     *hashPool
+	poolOnce sync.Once
+)
+
+// getHashPool starts the pool with the values from the config
+// the first time it is used
+func getHashPool() *hashPool {
+	poolOnce.Do(func() {
+		pool = newHashPool(Config.HashWorkers, Config.HashQueueSize, Config.HashTimeout)
+	})
+
+	return pool
+}
+
+// newHashPool starts the workers of a new pool
+// workers <= 0 uses one worker per cpu
+func newHashPool(workers, queue int, timeout time.Duration) *hashPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	if queue < 0 {
+		queue = 0
+	}
+
+	p := &hashPool{
+		jobs:    make(chan *hashJob, queue),
+		workers: workers,
+		timeout: timeout,
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// work runs the queued jobs until the pool is gone
+func (p *hashPool) work() {
+	for j := range p.jobs {
+		// the caller gave up waiting, there is nobody to answer
+		if !atomic.CompareAndSwapInt32(&j.state, jobQueued, jobStarted) {
+			continue
+		}
+
+		atomic.AddInt64(&p.running, 1)
+		j.work()
+		atomic.AddInt64(&p.running, -1)
+
+		close(j.done)
+	}
+}
+
+// Do queues f and waits until a worker runs it
+// it returns ErrorTryAgain when the queue is full or when
+// no worker picked the job before the timeout
+func (p *hashPool) Do(f func()) *errors.Error {
+	j := &hashJob{
+		work: f,
+		done: make(chan struct{}),
+	}
+
+	// never block when the queue is full
+	select {
+	case p.jobs <- j:
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		Logger.WithField("queued", len(p.jobs)).Warn("[HashPool.Do]: Queue is full")
+		return errors.FromCode(errors.ErrorTryAgain)
+	}
+
+	if p.timeout <= 0 {
+		<-j.done
+		return nil
+	}
+
+	t := time.NewTimer(p.timeout)
+	defer t.Stop()
+
+	select {
+	case <-j.done:
+		return nil
+
+	case <-t.C:
+		// a worker already started it, so it is worth waiting
+		if !atomic.CompareAndSwapInt32(&j.state, jobQueued, jobAbandoned) {
+			<-j.done
+			return nil
+		}
+
+		atomic.AddInt64(&p.rejected, 1)
+		Logger.WithField("timeout", p.timeout).Warn("[HashPool.Do]: Timed out waiting for a worker")
+		return errors.FromCode(errors.ErrorTryAgain)
+	}
+}
+
+// Stats returns the current state of the pool
+func (p *hashPool) Stats() HashStats {
+	return HashStats{
+		Workers:  p.workers,
+		Queued:   len(p.jobs),
+		Capacity: cap(p.jobs),
+		Running:  atomic.LoadInt64(&p.running),
+		Rejected: atomic.LoadInt64(&p.rejected),
+	}
+}
+
+// GetHashStats returns the state of the bcrypt worker pool
+// the queue depth is the "Queued" field
+func GetHashStats() HashStats {
+	return getHashPool().Stats()
+}
+
+// generateHash hashes a password using the worker pool
+func generateHash(password []byte, cost int) ([]byte, *errors.Error) {
+	var (
+		hash []byte
+		err  error
+	)
+
+	pErr := getHashPool().Do(func() {
+		hash, err = bcrypt.GenerateFromPassword(password, cost)
+	})
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	return hash, errors.FromErr(err)
+}
+
+// compareHash compares a bcrypt hash with a password using the worker pool
+// a nil error means they are equal
+func compareHash(hash, password []byte) *errors.Error {
+	var err error
+
+	pErr := getHashPool().Do(func() {
+		err = bcrypt.CompareHashAndPassword(hash, password)
+	})
+	if pErr != nil {
+		return pErr
+	}
+
+	return errors.FromErr(err)
+}
@@ -0,0 +1,87 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPool(t *testing.T) {
+	p := newHashPool(2, 4, time.Second)
+
+	ran := false
+	err := p.Do(func() {
+		ran = true
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, 2, p.Stats().Workers)
+	assert.Equal(t, 4, p.Stats().Capacity)
+}
+
+func TestHashPoolSaturated(t *testing.T) {
+	p := newHashPool(1, 1, time.Second)
+
+	// keep the only worker busy
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go p.Do(func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	// fill the queue
+	go p.Do(func() {})
+	for p.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// expect error: queue is full
+	err := p.Do(func() {})
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorTryAgain, err.Code)
+	assert.Equal(t, 1, p.Stats().Queued)
+	assert.Equal(t, int64(1), p.Stats().Rejected)
+
+	close(block)
+}
+
+func TestHashPoolTimeout(t *testing.T) {
+	p := newHashPool(1, 1, 10*time.Millisecond)
+
+	// keep the only worker busy
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go p.Do(func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	// expect error: nobody picked the job in time
+	ran := false
+	err := p.Do(func() {
+		ran = true
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorTryAgain, err.Code)
+
+	// the abandoned job must not run
+	close(block)
+	assert.Nil(t, p.Do(func() {}))
+	assert.False(t, ran)
+}
+
+func TestGenerateAndCompareHash(t *testing.T) {
+	h, err := generateHash([]byte("password"), Config.EncryptionLevel)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, h)
+
+	assert.Nil(t, compareHash(h, []byte("password")))
+	assert.NotNil(t, compareHash(h, []byte("err")))
+}
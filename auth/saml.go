@@ -0,0 +1,418 @@
+package users
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// SAMLBindingRedirect and SAMLBindingPost send the AuthnRequest to the identity provider
+const (
+	SAMLBindingRedirect = "redirect"
+	SAMLBindingPost     = "post"
+)
+
+// SAMLProvider is a saml 2.0 identity provider users can log in with
+// authenticaTed is the service provider, keyed by name in Config.SAMLProviders
+type SAMLProvider struct {
+	// IDPMetadata is the xml metadata of the identity provider
+	IDPMetadata []byte
+
+	// MetadataURL is /api/v1/users/auth/saml/:provider/metadata
+	// ACSURL is /api/v1/users/auth/saml/:provider/acs
+	// EntityID defaults to the MetadataURL
+	EntityID    string
+	MetadataURL string
+	ACSURL      string
+
+	// Certificate and Key sign the requests and decrypt encrypted assertions
+	// requests are sent unsigned without them
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+
+	// Binding sends the AuthnRequest with a redirect, the default, or a form post
+	Binding string
+
+	// Attributes are the names, or friendly names, of the assertion
+	// attributes filling the fields of new users
+	Attributes SAMLAttributes
+
+	// PowerAttribute, when set, gives users the highest power of its values
+	// found in Powers on every login, or DefaultPower without a match
+	PowerAttribute string
+	Powers         map[string]UserPower
+	DefaultPower   UserPower
+
+	// built on the first use
+	mu sync.Mutex
+	sp *saml.ServiceProvider
+}
+
+// SAMLAttributes maps the assertion attributes to User fields
+// the NameID identifies the user, the email is required to create one
+// empty ones use the ldap names: uid, mail, givenName and sn
+type SAMLAttributes struct {
+	Username string
+	Email    string
+	Name     string
+	LastName string
+}
+
+// withDefaults fills the empty names
+func (a SAMLAttributes) withDefaults() SAMLAttributes {
+	if a.Username == "" {
+		a.Username = "uid"
+	}
+
+	if a.Email == "" {
+		a.Email = "mail"
+	}
+
+	if a.Name == "" {
+		a.Name = "givenName"
+	}
+
+	if a.LastName == "" {
+		a.LastName = "sn"
+	}
+
+	return a
+}
+
+// SAMLRequest is a login waiting for the identity provider's response
+// only the hash of the relay state is stored, it's used once
+type SAMLRequest struct {
+	ID         int64     `db:"id,omitempty"`
+	RelayState string    `db:"relay_state"`
+	Provider   string    `db:"provider"`
+	RequestID  string    `db:"request_id"`
+	Expires    time.Time `db:"expires"`
+}
+
+// SAMLStart is how the browser is sent to the identity provider
+// URL is set for the redirect binding and Form, a html page posting itself, for the post binding
+type SAMLStart struct {
+	URL  string
+	Form []byte
+}
+
+// serviceProvider builds the service provider of the config once
+func (p *SAMLProvider) serviceProvider() (*saml.ServiceProvider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sp != nil {
+		return p.sp, nil
+	}
+
+	idp := &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(p.IDPMetadata, idp); err != nil {
+		return nil, err
+	}
+
+	metadataURL, err := url.Parse(p.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	acsURL, err := url.Parse(p.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          p.EntityID,
+		Key:               p.Key,
+		Certificate:       p.Certificate,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idp,
+		AuthnNameIDFormat: saml.PersistentNameIDFormat,
+	}
+
+	if p.Key != nil && p.Certificate != nil {
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+
+	p.sp = sp
+	return sp, nil
+}
+
+// getSAMLProvider finds a provider of Config.SAMLProviders
+func getSAMLProvider(name string) (*SAMLProvider, *saml.ServiceProvider, *errors.Error) {
+	p, ok := Config.SAMLProviders[name]
+	if !ok || p == nil {
+		return nil, nil, errors.FromCode(errors.ErrorUnknownProvider)
+	}
+
+	sp, err := p.serviceProvider()
+	if err != nil {
+		Logger.WithError(err).WithField("provider", name).Error("[getSAMLProvider]: Invalid provider config")
+		return nil, nil, errors.FromCode(errors.ErrorSAMLFailed)
+	}
+
+	return p, sp, nil
+}
+
+// SAMLMetadata is the service provider metadata given to the identity provider
+func SAMLMetadata(provider string) ([]byte, *errors.Error) {
+	_, sp, err := getSAMLProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, gErr := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	return append([]byte(xml.Header), buf...), nil
+}
+
+// BeginSAML starts a login with the identity provider
+// the relay state sent along keeps track of the request
+func BeginSAML(provider string) (*SAMLStart, *errors.Error) {
+	p, sp, err := getSAMLProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	binding := saml.HTTPRedirectBinding
+	if p.Binding == SAMLBindingPost {
+		binding = saml.HTTPPostBinding
+	}
+
+	req, gErr := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(binding), binding, saml.HTTPPostBinding)
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[BeginSAML]: Error while making the request")
+		return nil, errors.FromCode(errors.ErrorSAMLFailed)
+	}
+
+	relayState, gErr := util.RandomToken(32)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	_, gErr = fc.Insert(&SAMLRequest{
+		RelayState: util.HashToken(relayState),
+		Provider:   provider,
+		RequestID:  req.ID,
+		Expires:    time.Now().Add(Config.SAMLRequestTime),
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[BeginSAML]: Error while inserting")
+		return nil, errors.FromErr(gErr)
+	}
+
+	if binding == saml.HTTPPostBinding {
+		return &SAMLStart{Form: req.Post(relayState)}, nil
+	}
+
+	u, gErr := req.Redirect(relayState, sp)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	return &SAMLStart{URL: u.String()}, nil
+}
+
+// takeSAMLRequest finds and removes the request of the relay state
+func takeSAMLRequest(provider, relayState string) (*SAMLRequest, *errors.Error) {
+	var s *SAMLRequest
+
+	r := fc.Find(db.Cond{"relay_state": util.HashToken(relayState)})
+	err := r.One(&s)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorInvalidState)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if err = r.Delete(); err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if s.Provider != provider || time.Now().After(s.Expires) {
+		return nil, errors.FromCode(errors.ErrorInvalidState)
+	}
+
+	return s, nil
+}
+
+// samlAttribute is the first value of the attribute with the name or friendly name
+func samlAttribute(a *saml.Assertion, name string) string {
+	values := samlAttributeValues(a, name)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// samlAttributeValues are the values of the attribute with the name or friendly name
+func samlAttributeValues(a *saml.Assertion, name string) []string {
+	var values []string
+	if name == "" {
+		return values
+	}
+
+	for _, s := range a.AttributeStatements {
+		for _, attr := range s.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+
+			for _, v := range attr.Values {
+				values = append(values, strings.TrimSpace(v.Value))
+			}
+		}
+	}
+
+	return values
+}
+
+// samlPower is the power the assertion gives, false without a PowerAttribute
+func (p *SAMLProvider) samlPower(a *saml.Assertion) (UserPower, bool) {
+	if p.PowerAttribute == "" {
+		return 0, false
+	}
+
+	power, found := p.DefaultPower, false
+	for _, v := range samlAttributeValues(a, p.PowerAttribute) {
+		if up, ok := p.Powers[v]; ok && (!found || up > power) {
+			power, found = up, true
+		}
+	}
+
+	return power, true
+}
+
+// CompleteSAML handles the response posted by the identity provider
+// to the assertion consumer service, it returns the same as Auth
+// and creates the user on its first login
+func (u *User) CompleteSAML(provider string, r *http.Request) (string, *errors.Error) {
+	l := Logger.WithField("provider", provider)
+	l.Debug("[User.CompleteSAML]: Authenticating user...")
+
+	p, sp, err := getSAMLProvider(provider)
+	if err != nil {
+		return "", err
+	}
+
+	if gErr := r.ParseForm(); gErr != nil {
+		return "", errors.FromCode(errors.ErrorSAMLFailed)
+	}
+
+	s, err := takeSAMLRequest(provider, r.PostForm.Get("RelayState"))
+	if err != nil {
+		return "", err
+	}
+
+	// checks the signature, audience, destination, times and InResponseTo
+	a, gErr := sp.ParseResponse(r, []string{s.RequestID})
+	if gErr != nil {
+		if ir, ok := gErr.(*saml.InvalidResponseError); ok {
+			gErr = ir.PrivateErr
+		}
+
+		l.WithError(gErr).Debug("[User.CompleteSAML]: Invalid response")
+		return "", errors.FromCode(errors.ErrorSAMLFailed)
+	}
+
+	if a.Subject == nil || a.Subject.NameID == nil || a.Subject.NameID.Value == "" {
+		l.Debug("[User.CompleteSAML]: No NameID")
+		return "", errors.FromCode(errors.ErrorSAMLFailed)
+	}
+
+	names := p.Attributes.withDefaults()
+	issuer, subject := sp.IDPMetadata.EntityID, a.Subject.NameID.Value
+	email := samlAttribute(a, names.Email)
+
+	linked, err := findIdentity(issuer, subject)
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	if linked != nil {
+		*u = User{ID: linked.UserID}
+		found, fErr := u.Find()
+		if fErr != nil {
+			return "", fErr
+		}
+
+		if !found || u.Deleted {
+			return "", errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+
+		gErr := xc.Find(db.Cond{"id": linked.ID}).Update(map[string]interface{}{
+			"last_used": time.Now(),
+		})
+		if gErr != nil {
+			return "", errors.FromErr(gErr)
+		}
+	} else {
+		// an existing account isn't merged by email, like the oidc logins
+		if email == "" {
+			l.Debug("[User.CompleteSAML]: No email to create the user")
+			return "", errors.FromCode(errors.ErrorNotEnoughInfo)
+		}
+
+		if err = u.createIdentity(provider, issuer, subject, samlAttribute(a, names.Username), email); err != nil {
+			return "", err
+		}
+
+		u.Name = samlAttribute(a, names.Name)
+		u.LastName = samlAttribute(a, names.LastName)
+		changed = true
+	}
+
+	// the identity provider decides the power
+	if power, ok := p.samlPower(a); ok && int(power) != u.Power {
+		l.WithFields(log.Fields{
+			"ID":    u.ID,
+			"power": power,
+		}).Info("[User.CompleteSAML]: Power set by the identity provider")
+
+		u.Power = int(power)
+		changed = true
+	}
+
+	if changed {
+		if err = u.Save(); err != nil {
+			return "", err
+		}
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if err = u.LoginSucceeded(); err != nil {
+		return "", err
+	}
+
+	u.AuthMethod = AMRFederated
+	return u.loginToken()
+}
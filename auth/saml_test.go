@@ -0,0 +1,212 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSigned creates a key and its self signed certificate
+func selfSigned(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return key, cert
+}
+
+// samlIdP is a local identity provider signing with a self signed certificate
+type samlIdP struct {
+	*saml.IdentityProvider
+	sp *saml.EntityDescriptor
+}
+
+func newSAMLIdP(t *testing.T) *samlIdP {
+	key, cert := selfSigned(t, "idp.example.com")
+
+	return &samlIdP{IdentityProvider: &saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: url.URL{Scheme: "https", Host: "idp.example.com", Path: "/metadata"},
+		SSOURL:      url.URL{Scheme: "https", Host: "idp.example.com", Path: "/sso"},
+	}}
+}
+
+// GetServiceProvider gives the metadata of authenticaTed to the identity provider
+func (i *samlIdP) GetServiceProvider(r *http.Request, id string) (*saml.EntityDescriptor, error) {
+	return i.sp, nil
+}
+
+// metadata is the xml given to authenticaTed
+func (i *samlIdP) metadata(t *testing.T) []byte {
+	buf, err := xml.Marshal(i.Metadata())
+	assert.Nil(t, err)
+	return buf
+}
+
+// login answers the redirect of BeginSAML with a signed response for the
+// subject and returns the request the browser would post to the acs
+func (i *samlIdP) login(t *testing.T, provider string, start *SAMLStart, subject string, attrs map[string][]string) *http.Request {
+	buf, err := SAMLMetadata(provider)
+	assert.Nil(t, err)
+
+	i.sp = &saml.EntityDescriptor{}
+	assert.Nil(t, xml.Unmarshal(buf, i.sp))
+	i.ServiceProviderProvider = i
+
+	req, gErr := saml.NewIdpAuthnRequest(i.IdentityProvider, httptest.NewRequest("GET", start.URL, nil))
+	assert.Nil(t, gErr)
+	assert.Nil(t, req.Validate())
+
+	session := &saml.Session{
+		NameID:       subject,
+		NameIDFormat: string(saml.PersistentNameIDFormat),
+		CreateTime:   time.Now(),
+	}
+
+	for name, values := range attrs {
+		a := saml.Attribute{Name: name}
+		for _, v := range values {
+			a.Values = append(a.Values, saml.AttributeValue{Type: "xs:string", Value: v})
+		}
+
+		session.CustomAttributes = append(session.CustomAttributes, a)
+	}
+
+	assert.Nil(t, saml.DefaultAssertionMaker{}.MakeAssertion(req, session))
+
+	form, gErr := req.PostBinding()
+	assert.Nil(t, gErr)
+
+	body := url.Values{
+		"SAMLResponse": []string{form.SAMLResponse},
+		"RelayState":   []string{form.RelayState},
+	}
+
+	r := httptest.NewRequest("POST", form.URL, strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := newSAMLIdP(t)
+	key, cert := selfSigned(t, "localhost")
+
+	Config.SAMLProviders["fixture"] = &SAMLProvider{
+		IDPMetadata:    idp.metadata(t),
+		MetadataURL:    "http://localhost/api/v1/users/auth/saml/fixture/metadata",
+		ACSURL:         "http://localhost/api/v1/users/auth/saml/fixture/acs",
+		Certificate:    cert,
+		Key:            key,
+		PowerAttribute: "groups",
+		Powers: map[string]UserPower{
+			"staff":  UserPowerMod,
+			"admins": UserPowerAdmin,
+		},
+		DefaultPower: UserPowerNormal,
+	}
+	defer delete(Config.SAMLProviders, "fixture")
+
+	// expect error: unknown provider
+	_, err := BeginSAML("nope")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnknownProvider, err.Code)
+
+	// ok: metadata
+	buf, err := SAMLMetadata("fixture")
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), "http://localhost/api/v1/users/auth/saml/fixture/acs")
+
+	// ok: first login creates the user
+	start, err := BeginSAML("fixture")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(start.URL, "https://idp.example.com/sso?"))
+
+	attrs := map[string][]string{
+		"uid":       []string{"saml.user"},
+		"mail":      []string{"saml_user@mail.com"},
+		"givenName": []string{"Saml"},
+		"groups":    []string{"everyone", "staff"},
+	}
+
+	r := idp.login(t, "fixture", start, "subject-1", attrs)
+
+	u := NewUser()
+	token, err := u.CompleteSAML("fixture", r)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "saml_user", u.Username)
+	assert.Equal(t, "saml_user@mail.com", u.Email)
+	assert.Equal(t, "Saml", u.Name)
+	assert.Equal(t, int(UserPowerMod), u.Power)
+	assert.Empty(t, u.Password)
+
+	// expect error: the relay state is used once
+	_, err = NewUser().CompleteSAML("fixture", idp.login(t, "fixture", start, "subject-1", attrs))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidState, err.Code)
+
+	// ok: the next login finds the same user and updates the power
+	start, err = BeginSAML("fixture")
+	assert.Nil(t, err)
+
+	attrs["groups"] = []string{"everyone"}
+	fu := NewUser()
+	_, err = fu.CompleteSAML("fixture", idp.login(t, "fixture", start, "subject-1", attrs))
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, fu.ID)
+	assert.Equal(t, int(UserPowerNormal), fu.Power)
+
+	// expect error: signed by another identity provider
+	start, err = BeginSAML("fixture")
+	assert.Nil(t, err)
+
+	other := newSAMLIdP(t)
+	_, err = NewUser().CompleteSAML("fixture", other.login(t, "fixture", start, "subject-1", attrs))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorSAMLFailed, err.Code)
+
+	// expect error: no email to create a user with
+	start, err = BeginSAML("fixture")
+	assert.Nil(t, err)
+
+	_, err = NewUser().CompleteSAML("fixture", idp.login(t, "fixture", start, "subject-2", map[string][]string{}))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorNotEnoughInfo, err.Code)
+
+	// ok: post binding
+	Config.SAMLProviders["fixture"].Binding = SAMLBindingPost
+
+	start, err = BeginSAML("fixture")
+	assert.Nil(t, err)
+	assert.Empty(t, start.URL)
+	assert.Contains(t, string(start.Form), `name="SAMLRequest"`)
+
+	assert.Nil(t, u.HardDelete())
+}
@@ -1,5 +1,7 @@
 package users
 
+import "strings"
+
 // Schema is the database schema for users
 // it runs everytime the application starts
 var Schema = []string{`
@@ -11,11 +13,13 @@ CREATE TABLE IF NOT EXISTS ` + Table + ` (
 
   password     TEXT NOT NULL,
   email        VARCHAR(255) NOT NULL,
+  phone        VARCHAR(16) NOT NULL DEFAULT '', -- e.164, verified, unique when set
 
   deleted      BOOLEAN NOT NULL DEFAULT FALSE,
   activated    BOOLEAN NOT NULL DEFAULT FALSE,
 
   power        INTEGER NOT NULL DEFAULT 0,
+  token_version INTEGER NOT NULL DEFAULT 0, -- increased on password changes
 
   created      TIMESTAMP NOT NULL,
   seen         TIMESTAMP
@@ -45,10 +49,265 @@ CREATE TABLE IF NOT EXISTS ` + TableEvents + ` (
   ip        INET NOT NULL,
   at        TIMESTAMP NOT NULL
 );
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableLockout + ` (
+  id            SERIAL UNIQUE PRIMARY KEY,
+  user_id       INTEGER NOT NULL UNIQUE,
+  failures      INTEGER NOT NULL DEFAULT 0,
+  first_failure TIMESTAMP NOT NULL,
+  last_failure  TIMESTAMP NOT NULL,
+  locks         INTEGER NOT NULL DEFAULT 0,
+  until         TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableTOTP + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  secret    TEXT NOT NULL, -- encrypted
+  confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+  counter   BIGINT NOT NULL DEFAULT 0,
+  created   TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableRecovery + ` (
+  id      SERIAL UNIQUE PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  code    VARCHAR(64) NOT NULL, -- sha256
+  used    BOOLEAN NOT NULL DEFAULT FALSE
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableWebAuthn + ` (
+  id              SERIAL UNIQUE PRIMARY KEY,
+  user_id         INTEGER NOT NULL,
+  name            VARCHAR(255) NOT NULL DEFAULT '',
+  credential_id   VARCHAR(1024) NOT NULL UNIQUE, -- base64url
+  public_key      BYTEA NOT NULL, -- cose
+  sign_count      BIGINT NOT NULL DEFAULT 0,
+  transports      VARCHAR(255) NOT NULL DEFAULT '',
+  backup_eligible BOOLEAN NOT NULL DEFAULT FALSE,
+  backup_state    BOOLEAN NOT NULL DEFAULT FALSE,
+  created         TIMESTAMP NOT NULL,
+  last_used       TIMESTAMP NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableWebAuthnSession + ` (
+  id      SERIAL UNIQUE PRIMARY KEY,
+  token   VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  user_id INTEGER NOT NULL DEFAULT 0, -- 0 on passkey logins
+  data    TEXT NOT NULL,
+  expires TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableMagicLink + ` (
+  id      SERIAL UNIQUE PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  token   VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  browser VARCHAR(64) NOT NULL DEFAULT '', -- sha256
+  used    BOOLEAN NOT NULL DEFAULT FALSE,
+  created TIMESTAMP NOT NULL,
+  expires TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableEmailCode + ` (
+  id       SERIAL UNIQUE PRIMARY KEY,
+  user_id  INTEGER NOT NULL,
+  purpose  VARCHAR(16) NOT NULL,
+  code     VARCHAR(64) NOT NULL, -- sha256
+  attempts INTEGER NOT NULL DEFAULT 0,
+  sent     TIMESTAMP NOT NULL,
+  expires  TIMESTAMP NOT NULL,
+  UNIQUE (user_id, purpose)
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableSMSCode + ` (
+  id       SERIAL UNIQUE PRIMARY KEY,
+  user_id  INTEGER NOT NULL,
+  purpose  VARCHAR(16) NOT NULL,
+  phone    VARCHAR(16) NOT NULL,
+  code     VARCHAR(64) NOT NULL, -- sha256
+  attempts INTEGER NOT NULL DEFAULT 0,
+  sent     TIMESTAMP NOT NULL,
+  expires  TIMESTAMP NOT NULL,
+  UNIQUE (user_id, purpose)
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableDevice + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  name      VARCHAR(255) NOT NULL DEFAULT '',
+  secret    VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  created   TIMESTAMP NOT NULL,
+  last_used TIMESTAMP NOT NULL,
+  expires   TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableDeviceCode + ` (
+  id          SERIAL UNIQUE PRIMARY KEY,
+  device_code VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  user_code   VARCHAR(64) NOT NULL, -- sha256
+  client_id   VARCHAR(255) NOT NULL DEFAULT '',
+  scope       TEXT NOT NULL DEFAULT '',
+  user_id     INTEGER NOT NULL DEFAULT 0, -- set when approved
+  state       VARCHAR(16) NOT NULL,
+  mfa         BOOLEAN NOT NULL DEFAULT FALSE,
+  interval    INTEGER NOT NULL,
+  last_poll   TIMESTAMP NOT NULL,
+  created     TIMESTAMP NOT NULL,
+  expires     TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableCertificate + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  identity  VARCHAR(512) NOT NULL UNIQUE, -- subject dn or san
+  created   TIMESTAMP NOT NULL,
+  last_used TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableAccessToken + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  name      VARCHAR(255) NOT NULL,
+  hint      VARCHAR(32) NOT NULL,
+  secret    VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  scopes    VARCHAR(255) NOT NULL,
+  mfa       BOOLEAN NOT NULL DEFAULT FALSE,
+  power     INTEGER NOT NULL DEFAULT 0,
+  created   TIMESTAMP NOT NULL,
+  expires   TIMESTAMP NOT NULL, -- zero never expires
+  last_used TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableIdentity + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  provider  VARCHAR(64) NOT NULL,
+  issuer    VARCHAR(255) NOT NULL,
+  subject   VARCHAR(255) NOT NULL,
+  email     VARCHAR(255) NOT NULL DEFAULT '',
+  created   TIMESTAMP NOT NULL,
+  last_used TIMESTAMP NOT NULL,
+  UNIQUE (issuer, subject)
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableOIDCState + ` (
+  id       SERIAL UNIQUE PRIMARY KEY,
+  state    VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  provider VARCHAR(64) NOT NULL,
+  nonce    VARCHAR(64) NOT NULL,
+  verifier VARCHAR(64) NOT NULL, -- pkce
+  user_id  INTEGER NOT NULL DEFAULT 0, -- set when linking
+  expires  TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableOAuthClient + ` (
+  id            SERIAL UNIQUE PRIMARY KEY,
+  client_id     VARCHAR(64) NOT NULL UNIQUE,
+  secret        VARCHAR(64) NOT NULL DEFAULT '', -- sha256, empty for public clients
+  name          VARCHAR(255) NOT NULL,
+  redirect_uris TEXT NOT NULL, -- one per line
+  scopes        TEXT NOT NULL DEFAULT '', -- client credentials, space separated
+  public_key    TEXT NOT NULL DEFAULT '', -- pem, private_key_jwt
+  created       TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableOAuthConsent + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL,
+  client_id VARCHAR(64) NOT NULL,
+  scope     VARCHAR(255) NOT NULL,
+  created   TIMESTAMP NOT NULL,
+  UNIQUE (user_id, client_id)
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableOAuthCode + ` (
+  id           SERIAL UNIQUE PRIMARY KEY,
+  code         VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  client_id    VARCHAR(64) NOT NULL,
+  user_id      INTEGER NOT NULL,
+  redirect_uri TEXT NOT NULL,
+  scope        VARCHAR(255) NOT NULL,
+  nonce        VARCHAR(255) NOT NULL DEFAULT '',
+  challenge    VARCHAR(64) NOT NULL, -- pkce
+  amr          VARCHAR(64) NOT NULL DEFAULT '',
+  expires      TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableSAMLRequest + ` (
+  id          SERIAL UNIQUE PRIMARY KEY,
+  relay_state VARCHAR(64) NOT NULL UNIQUE, -- sha256
+  provider    VARCHAR(64) NOT NULL,
+  request_id  VARCHAR(64) NOT NULL,
+  expires     TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableMigration + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  user_id   INTEGER NOT NULL UNIQUE,
+  legacy_id VARCHAR(255) NOT NULL DEFAULT '',
+  created   TIMESTAMP NOT NULL
+);
+`, `
+CREATE TABLE IF NOT EXISTS ` + TableClientAssertion + ` (
+  id        SERIAL UNIQUE PRIMARY KEY,
+  client_id VARCHAR(64) NOT NULL,
+  jti       VARCHAR(255) NOT NULL,
+  expires   TIMESTAMP NOT NULL,
+  UNIQUE (client_id, jti)
+);
+`, `
+-- columns added to existing tables, the tables above only have them when new
+ALTER TABLE ` + Table + ` ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+`, `
+-- phones were nullable and unique, users without one are now ''
+ALTER TABLE ` + Table + ` ADD COLUMN IF NOT EXISTS phone VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE ` + Table + ` DROP CONSTRAINT IF EXISTS ` + Table + `_phone_key;
+UPDATE ` + Table + ` SET phone = '' WHERE phone IS NULL;
+ALTER TABLE ` + Table + ` ALTER COLUMN phone SET DEFAULT '', ALTER COLUMN phone SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS ` + Table + `_phone ON ` + Table + ` (phone) WHERE phone <> '';
+`, `
+-- access tokens keep the second factor and power of the session that created them
+ALTER TABLE ` + TableAccessToken + ` ADD COLUMN IF NOT EXISTS mfa BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE ` + TableAccessToken + ` ADD COLUMN IF NOT EXISTS power INTEGER NOT NULL DEFAULT 0;
+`, `
+-- authorization codes keep how the user logged in instead of only the second factor
+ALTER TABLE ` + TableOAuthCode + ` ADD COLUMN IF NOT EXISTS amr VARCHAR(64) NOT NULL DEFAULT '';
+`, `
+-- clients of the oidc provider created before the client credentials grant
+ALTER TABLE ` + TableOAuthClient + ` ADD COLUMN IF NOT EXISTS scopes TEXT NOT NULL DEFAULT '';
+ALTER TABLE ` + TableOAuthClient + ` ADD COLUMN IF NOT EXISTS public_key TEXT NOT NULL DEFAULT '';
 `}
 
 // SchemaTest is the database schema for testing the users table
 // it runs before tests starts
 var SchemaTest = []string{
-	`TRUNCATE ` + Table + `, ` + TableActivation + `, ` + TableBan + `, ` + TableEvents + ` CASCADE;`,
+	`TRUNCATE ` + strings.Join(Tables, `, `) + ` CASCADE;`,
+}
+
+// Tables is every table created by the schema
+var Tables = []string{
+	Table,
+	TableActivation,
+	TableBan,
+	TableEvents,
+	TableLockout,
+	TableTOTP,
+	TableRecovery,
+	TableWebAuthn,
+	TableWebAuthnSession,
+	TableMagicLink,
+	TableEmailCode,
+	TableSMSCode,
+	TableDevice,
+	TableDeviceCode,
+	TableCertificate,
+	TableAccessToken,
+	TableIdentity,
+	TableOIDCState,
+	TableOAuthClient,
+	TableOAuthConsent,
+	TableOAuthCode,
+	TableSAMLRequest,
+	TableMigration,
+	TableClientAssertion,
 }
@@ -0,0 +1,755 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// schemas of the scim 2.0 messages, rfc 7643 and 7644
+const (
+	SCIMUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// SCIMMaxResults is the most users a page of SCIMUsers has
+const SCIMMaxResults = 100
+
+// SCIMUser is a User as a scim resource
+// active is Activated and not Deleted, the password is only written
+type SCIMUser struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Name     *SCIMName   `json:"name,omitempty"`
+	Emails   []SCIMEmail `json:"emails,omitempty"`
+	Active   *bool       `json:"active,omitempty"`
+	Password string      `json:"password,omitempty"`
+	Meta     *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMName is the name of a SCIMUser
+type SCIMName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMEmail is a email of a SCIMUser, users have only one
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMeta describes the resource, Version is its weak etag
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+// SCIMList is a page of resources
+type SCIMList struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    []*SCIMUser `json:"Resources"`
+}
+
+// SCIMPatch is the body of a PATCH
+type SCIMPatch struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation is a add, replace or remove of the attribute of
+// the path, or of the attributes of the value without a path
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimID is the public id of the user, the same of the json
+func scimID(id hide.Int64) string {
+	return strconv.FormatInt(util.Obfuscate(id), 10)
+}
+
+// primaryEmail is the primary email of the resource or its first one
+func (s *SCIMUser) primaryEmail() string {
+	for _, e := range s.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+
+	if len(s.Emails) > 0 {
+		return s.Emails[0].Value
+	}
+
+	return ""
+}
+
+// SCIM converts the user to a scim resource
+func (u *User) SCIM() *SCIMUser {
+	active := u.Activated && !u.Deleted
+	s := &SCIMUser{
+		Schemas:  []string{SCIMUserSchema},
+		ID:       scimID(u.ID),
+		UserName: u.Username,
+		Active:   &active,
+	}
+
+	if u.Name != "" || u.LastName != "" {
+		s.Name = &SCIMName{GivenName: u.Name, FamilyName: u.LastName}
+	}
+
+	if u.Email != "" {
+		s.Emails = []SCIMEmail{SCIMEmail{Value: u.Email, Type: "work", Primary: true}}
+	}
+
+	// the version changes with any attribute
+	buf, _ := json.Marshal(s)
+	sum := sha256.Sum256(buf)
+
+	s.Meta = &SCIMMeta{
+		ResourceType: "User",
+		Created:      u.Created,
+		Location:     strings.TrimSuffix(Config.OIDCIssuer, "/") + "/scim/v2/Users/" + s.ID,
+		Version:      `W/"` + hex.EncodeToString(sum[:8]) + `"`,
+	}
+
+	return s
+}
+
+// FindSCIMUser finds the user of the scim id for a token of the power
+// users with the same power or more are refused, like in Impersonate
+func FindSCIMUser(id string, power UserPower) (*User, *errors.Error) {
+	i, gErr := strconv.ParseInt(id, 10, 64)
+	if gErr != nil {
+		return nil, errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	u := NewUser()
+	u.ID = util.Deobfuscate(i)
+
+	found, err := u.Find()
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	if UserPower(u.Power) >= power {
+		return nil, errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	return u, nil
+}
+
+// SCIMUsers lists the users matching the filter, the start index is 1 based
+// a negative count uses SCIMMaxResults, zero only counts them
+// only users with less power than the token's are listed
+func SCIMUsers(filter string, startIndex, count int, power UserPower) (*SCIMList, *errors.Error) {
+	var cond db.Compound = db.Cond{"power <": int(power)}
+	if strings.TrimSpace(filter) != "" {
+		c, err := parseSCIMFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		cond = db.And(cond, c)
+	}
+
+	if startIndex < 1 {
+		startIndex = 1
+	}
+
+	if count < 0 || count > SCIMMaxResults {
+		count = SCIMMaxResults
+	}
+
+	res := uc.Find(cond)
+	total, gErr := res.Count()
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	list := &SCIMList{
+		Schemas:      []string{SCIMListSchema},
+		TotalResults: int(total),
+		StartIndex:   startIndex,
+		Resources:    []*SCIMUser{},
+	}
+
+	if count == 0 {
+		return list, nil
+	}
+
+	var users []*User
+	gErr = res.OrderBy("id").Offset(startIndex - 1).Limit(count).All(&users)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	for _, u := range users {
+		list.Resources = append(list.Resources, u.SCIM())
+	}
+
+	list.ItemsPerPage = len(list.Resources)
+	return list, nil
+}
+
+// CreateSCIMUser creates the user of the resource
+// users provisioned without a password log in with a external provider
+func CreateSCIMUser(s *SCIMUser) (*User, *errors.Error) {
+	u := &User{
+		Username:  s.UserName,
+		Email:     s.primaryEmail(),
+		Password:  s.Password,
+		Activated: true, // provisioned by the organization
+		External:  s.Password == "",
+	}
+
+	if s.Name != nil {
+		u.Name = s.Name.GivenName
+		u.LastName = s.Name.FamilyName
+	}
+
+	if s.Active != nil && !*s.Active {
+		u.Activated = false
+		u.Deleted = true
+	}
+
+	if _, err := u.Create(); err != nil {
+		return nil, err
+	}
+
+	Logger.WithField("ID", u.ID).Info("[CreateSCIMUser]: User provisioned")
+	return u, nil
+}
+
+// ReplaceSCIM replaces the attributes of the user with the ones of the resource
+// an active missing from the resource is true, a missing password is kept
+func (u *User) ReplaceSCIM(s *SCIMUser) *errors.Error {
+	email := s.primaryEmail()
+	if s.UserName == "" || email == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	// unique columns
+	for field, value := range map[string]string{"username": s.UserName, "email": email} {
+		exists, err := u.ExistsWithCond(db.Cond{field: value, "id <>": u.ID})
+		if err != nil {
+			return err
+		}
+
+		if exists && field == "username" {
+			return errors.FromCode(errors.ErrorUsernameExists)
+		}
+
+		if exists {
+			return errors.FromCode(errors.ErrorEmailExists)
+		}
+	}
+
+	nu := *u
+	nu.Username = s.UserName
+	nu.Email = email
+	nu.Name, nu.LastName = "", ""
+	if s.Name != nil {
+		nu.Name = s.Name.GivenName
+		nu.LastName = s.Name.FamilyName
+	}
+
+	active := s.Active == nil || *s.Active
+	nu.Activated = active
+	nu.Deleted = !active
+
+	valid, err := nu.Validate()
+	if err != nil {
+		return errors.Mask(err, errors.ErrorUserInvalid)
+	}
+
+	if !valid {
+		return errors.FromCode(errors.ErrorUserInvalid)
+	}
+
+	if err = nu.Save(); err != nil {
+		return err
+	}
+
+	*u = nu
+	if s.Password != "" {
+		if err = u.SetPassword(s.Password); err != nil {
+			return err
+		}
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":     u.ID,
+		"active": active,
+	}).Info("[User.ReplaceSCIM]: User updated")
+	return nil
+}
+
+// PatchSCIM applies the operations to the resource of the user and saves it
+func (u *User) PatchSCIM(ops []SCIMPatchOperation) *errors.Error {
+	if len(ops) == 0 {
+		return errors.FromCode(errors.ErrorInvalidPatch)
+	}
+
+	s := u.SCIM()
+	for _, op := range ops {
+		if err := s.patch(op); err != nil {
+			return err
+		}
+	}
+
+	return u.ReplaceSCIM(s)
+}
+
+// patch applies one operation to the resource
+func (s *SCIMUser) patch(op SCIMPatchOperation) *errors.Error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return errors.FromCode(errors.ErrorInvalidPatch)
+	}
+
+	path := scimAttribute(op.Path)
+	if path == "" {
+		if kind == "remove" {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		// the value has the attributes
+		values := map[string]json.RawMessage{}
+		if json.Unmarshal(op.Value, &values) != nil {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		for name, value := range values {
+			if scimAttribute(name) == "schemas" {
+				continue
+			}
+
+			if err := s.patch(SCIMPatchOperation{Op: kind, Path: name, Value: value}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// a user has one email, the filters of emails are ignored
+	if strings.HasPrefix(path, "emails[") {
+		if i := strings.Index(path, "]"); i > 0 {
+			path = "emails" + path[i+1:]
+		}
+	}
+
+	if kind == "remove" {
+		switch path {
+		case "name":
+			s.Name = nil
+		case "name.givenname", "name.familyname":
+			s.patchName(path, "")
+		default:
+			// the username, email and active are required
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		return nil
+	}
+
+	switch path {
+	case "username", "password", "name.givenname", "name.familyname", "emails.value":
+		var v string
+		if json.Unmarshal(op.Value, &v) != nil {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		switch path {
+		case "username":
+			s.UserName = v
+		case "password":
+			s.Password = v
+		case "emails.value":
+			s.Emails = []SCIMEmail{SCIMEmail{Value: v, Primary: true}}
+		default:
+			s.patchName(path, v)
+		}
+
+	case "name":
+		var n SCIMName
+		if json.Unmarshal(op.Value, &n) != nil {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		s.Name = &n
+
+	case "emails":
+		var emails []SCIMEmail
+		if json.Unmarshal(op.Value, &emails) != nil || len(emails) == 0 {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		s.Emails = emails
+
+	case "active":
+		// some clients send it as a string
+		var v interface{}
+		if json.Unmarshal(op.Value, &v) != nil {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		active, ok := v.(bool)
+		if str, isString := v.(string); isString {
+			b, gErr := strconv.ParseBool(strings.ToLower(str))
+			active, ok = b, gErr == nil
+		}
+
+		if !ok {
+			return errors.FromCode(errors.ErrorInvalidPatch)
+		}
+
+		s.Active = &active
+
+	default:
+		return errors.FromCode(errors.ErrorInvalidPatch)
+	}
+
+	return nil
+}
+
+// patchName sets a part of the name
+func (s *SCIMUser) patchName(path, v string) {
+	if s.Name == nil {
+		s.Name = &SCIMName{}
+	}
+
+	if path == "name.givenname" {
+		s.Name.GivenName = v
+	} else {
+		s.Name.FamilyName = v
+	}
+}
+
+// scimAttribute is the lower case attribute path without the schema
+func scimAttribute(path string) string {
+	path = strings.ToLower(strings.TrimSpace(path))
+	return strings.TrimPrefix(path, strings.ToLower(SCIMUserSchema)+":")
+}
+
+// scimColumns are the columns of the filterable attributes
+var scimColumns = map[string]string{
+	"id":              "id",
+	"username":        "username",
+	"emails":          "email",
+	"emails.value":    "email",
+	"name.givenname":  "name",
+	"name.familyname": "last_name",
+	"meta.created":    "created",
+}
+
+// scimOperators are the sql operators of the comparisons
+var scimOperators = map[string]string{
+	"eq": "",
+	"ne": " <>",
+	"gt": " >",
+	"ge": " >=",
+	"lt": " <",
+	"le": " <=",
+	"co": " LIKE",
+	"sw": " LIKE",
+	"ew": " LIKE",
+}
+
+// scimNegated are the operators of the negated comparisons
+var scimNegated = map[string]string{
+	"eq": "ne",
+	"ne": "eq",
+	"gt": "le",
+	"ge": "lt",
+	"lt": "ge",
+	"le": "gt",
+}
+
+// scimFilter parses the filter of a list, rfc 7644 3.4.2.2
+// it supports and, or, not, parentheses and the operators
+// of scimOperators and pr with the attributes of scimColumns and active
+// a not is moved down to the comparisons, so the condition has none
+type scimFilter struct {
+	tokens []string
+	pos    int
+}
+
+// parseSCIMFilter converts the filter to a condition of the users table
+func parseSCIMFilter(filter string) (db.Compound, *errors.Error) {
+	tokens, ok := scimTokens(filter)
+	if !ok {
+		return nil, errors.FromCode(errors.ErrorInvalidFilter)
+	}
+
+	f := &scimFilter{tokens: tokens}
+	cond, err := f.or(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.pos != len(f.tokens) {
+		return nil, errors.FromCode(errors.ErrorInvalidFilter)
+	}
+
+	return cond, nil
+}
+
+// scimTokens splits the filter in words, parentheses and quoted strings
+func scimTokens(filter string) ([]string, bool) {
+	var tokens []string
+	r := []rune(filter)
+
+	for i := 0; i < len(r); {
+		switch {
+		case unicode.IsSpace(r[i]):
+			i++
+
+		case r[i] == '(' || r[i] == ')':
+			tokens = append(tokens, string(r[i]))
+			i++
+
+		case r[i] == '"':
+			// kept quoted, json unquotes it
+			j := i + 1
+			for ; j < len(r) && r[j] != '"'; j++ {
+				if r[j] == '\\' {
+					j++
+				}
+			}
+
+			if j >= len(r) {
+				return nil, false
+			}
+
+			tokens = append(tokens, string(r[i:j+1]))
+			i = j + 1
+
+		default:
+			j := i
+			for j < len(r) && !unicode.IsSpace(r[j]) && r[j] != '(' && r[j] != ')' {
+				j++
+			}
+
+			tokens = append(tokens, string(r[i:j]))
+			i = j
+		}
+	}
+
+	return tokens, len(tokens) > 0
+}
+
+// next returns the next token, empty at the end
+func (f *scimFilter) next() string {
+	if f.pos >= len(f.tokens) {
+		return ""
+	}
+
+	t := f.tokens[f.pos]
+	f.pos++
+	return t
+}
+
+// peek is the lower case next token without consuming it
+func (f *scimFilter) peek() string {
+	if f.pos >= len(f.tokens) {
+		return ""
+	}
+
+	return strings.ToLower(f.tokens[f.pos])
+}
+
+// scimJoin combines the conditions, negated ones swap and and or
+func scimJoin(and, not bool, a, b db.Compound) db.Compound {
+	if and != not {
+		return db.And(a, b)
+	}
+
+	return db.Or(a, b)
+}
+
+func (f *scimFilter) or(not bool) (db.Compound, *errors.Error) {
+	cond, err := f.and(not)
+	if err != nil {
+		return nil, err
+	}
+
+	for f.peek() == "or" {
+		f.pos++
+
+		right, err := f.and(not)
+		if err != nil {
+			return nil, err
+		}
+
+		cond = scimJoin(false, not, cond, right)
+	}
+
+	return cond, nil
+}
+
+func (f *scimFilter) and(not bool) (db.Compound, *errors.Error) {
+	cond, err := f.term(not)
+	if err != nil {
+		return nil, err
+	}
+
+	for f.peek() == "and" {
+		f.pos++
+
+		right, err := f.term(not)
+		if err != nil {
+			return nil, err
+		}
+
+		cond = scimJoin(true, not, cond, right)
+	}
+
+	return cond, nil
+}
+
+func (f *scimFilter) term(not bool) (db.Compound, *errors.Error) {
+	switch f.peek() {
+	case "not":
+		f.pos++
+		if f.peek() != "(" {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		return f.term(!not)
+
+	case "(":
+		f.pos++
+		cond, err := f.or(not)
+		if err != nil {
+			return nil, err
+		}
+
+		if f.next() != ")" {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		return cond, nil
+	}
+
+	return f.comparison(not)
+}
+
+// comparison is a attribute, a operator and a value
+func (f *scimFilter) comparison(not bool) (db.Compound, *errors.Error) {
+	attribute := scimAttribute(f.next())
+	op := strings.ToLower(f.next())
+
+	if op == "pr" {
+		if attribute == "active" {
+			if not {
+				return db.Cond{"id": 0}, nil
+			}
+
+			return db.Cond{}, nil
+		}
+
+		column, ok := scimColumns[attribute]
+		if !ok {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		if not {
+			return db.Cond{column: ""}, nil
+		}
+
+		return db.Cond{column + " <>": ""}, nil
+	}
+
+	var value interface{}
+	if json.Unmarshal([]byte(f.next()), &value) != nil {
+		return nil, errors.FromCode(errors.ErrorInvalidFilter)
+	}
+
+	if attribute == "active" {
+		active, ok := value.(bool)
+		if !ok || (op != "eq" && op != "ne") {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		if (op == "eq") == (active != not) {
+			return db.Cond{"activated": true, "deleted": false}, nil
+		}
+
+		return db.Or(db.Cond{"activated": false}, db.Cond{"deleted": true}), nil
+	}
+
+	column, ok := scimColumns[attribute]
+	sqlOp, known := scimOperators[op]
+	str, isString := value.(string)
+	if !ok || !known || !isString {
+		return nil, errors.FromCode(errors.ErrorInvalidFilter)
+	}
+
+	if not {
+		if negated, ok := scimNegated[op]; ok {
+			sqlOp = scimOperators[negated]
+		} else {
+			sqlOp = " NOT LIKE"
+		}
+	}
+
+	switch attribute {
+	case "id":
+		i, gErr := strconv.ParseInt(str, 10, 64)
+		if gErr != nil || (op != "eq" && op != "ne") {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		return db.Cond{column + sqlOp: util.Deobfuscate(i)}, nil
+
+	case "meta.created":
+		t, gErr := time.Parse(time.RFC3339, str)
+		if gErr != nil || strings.HasSuffix(sqlOp, "LIKE") {
+			return nil, errors.FromCode(errors.ErrorInvalidFilter)
+		}
+
+		return db.Cond{column + sqlOp: t}, nil
+	}
+
+	// like patterns match the characters themselves
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(str)
+	switch op {
+	case "co":
+		return db.Cond{column + sqlOp: "%" + escaped + "%"}, nil
+	case "sw":
+		return db.Cond{column + sqlOp: escaped + "%"}, nil
+	case "ew":
+		return db.Cond{column + sqlOp: "%" + escaped}, nil
+	}
+
+	return db.Cond{column + sqlOp: str}, nil
+}
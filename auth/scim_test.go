@@ -0,0 +1,175 @@
+package users
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCIMFilter(t *testing.T) {
+	valid := []string{
+		`userName eq "scim_user"`,
+		`UserName Eq "scim_user"`,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "scim"`,
+		`emails.value co "@mail.com" and active eq true`,
+		`(name.givenName ew "n" or name.familyName pr) and not (active eq false)`,
+		`not (userName eq "scim_user" or emails co "@mail.com")`,
+		`meta.created gt "2016-12-27T20:21:22Z"`,
+		`userName eq "quote \" inside"`,
+	}
+
+	for _, f := range valid {
+		_, err := parseSCIMFilter(f)
+		assert.Nil(t, err, f)
+	}
+
+	invalid := []string{
+		`userName`,
+		`userName eq`,
+		`userName eq scim_user`,
+		`password eq "password"`,
+		`userName xx "scim_user"`,
+		`(userName eq "scim_user"`,
+		`userName eq "scim_user" and`,
+		`userName eq "unterminated`,
+		`active co true`,
+		`id eq "not a number"`,
+		`not userName eq "scim_user"`,
+	}
+
+	for _, f := range invalid {
+		_, err := parseSCIMFilter(f)
+		assert.NotNil(t, err, f)
+		assert.Equal(t, errors.ErrorInvalidFilter, err.Code, f)
+	}
+}
+
+func TestSCIMUser(t *testing.T) {
+	// expect error: only admins can create provisioning tokens
+	admin := NewUser()
+	admin.Username = "SCIM_Admin"
+	admin.Email = "scim_admin@mail.com"
+	admin.Password = "password"
+	_, err := admin.Create()
+	assert.Nil(t, err)
+
+	_, _, err = admin.CreateAccessToken("idp", []string{ScopeSCIM}, 0, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidScope, err.Code)
+
+	// ok: scim alone doesn't include read
+	admin.Power = int(UserPowerAdmin)
+	assert.Nil(t, admin.Save())
+
+	at, _, err := admin.CreateAccessToken("idp", []string{ScopeSCIM}, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ScopeSCIM, at.Scopes)
+
+	// ok: provisioned without a password
+	active := true
+	u, err := CreateSCIMUser(&SCIMUser{
+		UserName: "scim_user",
+		Name:     &SCIMName{GivenName: "Scim", FamilyName: "User"},
+		Emails:   []SCIMEmail{SCIMEmail{Value: "scim_user@mail.com", Primary: true}},
+		Active:   &active,
+	})
+	assert.Nil(t, err)
+	assert.True(t, u.Activated)
+	assert.Empty(t, u.Password)
+
+	s := u.SCIM()
+	assert.Equal(t, "scim_user", s.UserName)
+	assert.Equal(t, "scim_user@mail.com", s.Emails[0].Value)
+	assert.True(t, *s.Active)
+
+	found, err := FindSCIMUser(s.ID, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, found.ID)
+	assert.Equal(t, s.Meta.Version, found.SCIM().Meta.Version)
+
+	// expect error: unknown id
+	_, err = FindSCIMUser("123", UserPowerAdmin)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUserDoesntExists, err.Code)
+
+	// expect error: the token's own power
+	_, err = FindSCIMUser(admin.SCIM().ID, UserPowerAdmin)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnauthorized, err.Code)
+
+	// ok: filtered
+	list, err := SCIMUsers(`userName eq "scim_user" and active eq true`, 1, -1, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, list.TotalResults)
+	assert.Equal(t, s.ID, list.Resources[0].ID)
+
+	list, err = SCIMUsers(`emails co "scim_" and active eq false`, 1, -1, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, list.TotalResults)
+
+	// ok: paginated
+	list, err = SCIMUsers(`emails co "scim_"`, 1, 1, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, list.TotalResults)
+	assert.Equal(t, 1, list.ItemsPerPage)
+
+	second, err := SCIMUsers(`emails co "scim_"`, 2, 1, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, second.ItemsPerPage)
+	assert.NotEqual(t, list.Resources[0].ID, second.Resources[0].ID)
+
+	list, err = SCIMUsers(`emails co "scim_"`, 1, 0, UserPowerAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, list.TotalResults)
+	assert.Empty(t, list.Resources)
+
+	// expect error: the username is taken
+	replaced := u.SCIM()
+	replaced.UserName = admin.Username
+	err = u.ReplaceSCIM(replaced)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUsernameExists, err.Code)
+
+	// ok: deactivated by patch, the version changes
+	err = u.PatchSCIM([]SCIMPatchOperation{
+		SCIMPatchOperation{Op: "Replace", Path: "active", Value: json.RawMessage(`"False"`)},
+	})
+	assert.Nil(t, err)
+	assert.True(t, u.Deleted)
+	assert.False(t, u.Activated)
+	assert.NotEqual(t, s.Meta.Version, u.SCIM().Meta.Version)
+
+	// ok: without a path, with a filtered email
+	err = u.PatchSCIM([]SCIMPatchOperation{
+		SCIMPatchOperation{Op: "replace", Value: json.RawMessage(`{"active": true, "name": {"givenName": "Changed"}}`)},
+		SCIMPatchOperation{Op: "replace", Path: `emails[type eq "work"].value`, Value: json.RawMessage(`"scim_changed@mail.com"`)},
+		SCIMPatchOperation{Op: "add", Path: "password", Value: json.RawMessage(`"new password"`)},
+	})
+	assert.Nil(t, err)
+	assert.True(t, u.Activated)
+	assert.False(t, u.Deleted)
+	assert.Equal(t, "Changed", u.Name)
+	assert.Empty(t, u.LastName)
+	assert.Equal(t, "scim_changed@mail.com", u.Email)
+	assert.Nil(t, u.ComparePassword("new password"))
+
+	// expect error: the username can't be removed
+	err = u.PatchSCIM([]SCIMPatchOperation{
+		SCIMPatchOperation{Op: "remove", Path: "userName"},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidPatch, err.Code)
+
+	// expect error: unknown operation
+	err = u.PatchSCIM([]SCIMPatchOperation{
+		SCIMPatchOperation{Op: "move", Path: "userName"},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidPatch, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, admin.HardDelete())
+}
@@ -1,36 +1,18 @@
 package users
 
 import (
-	"fmt"
 	"math/big"
-	"testing"
+	"time"
 
 	"github.com/UnnoTed/authenticaTed/errors"
 	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/c2h5oh/hide"
-	"github.com/dustin/go-humanize"
-	"golang.org/x/crypto/bcrypt"
 )
 
-const (
-	minimumRounds = 14
-
-	// seconds * (1s in nanosecond)
-	ns            = 1000000000
-	maxTime int64 = 3 * ns
-)
-
-type result struct {
-	rounds int
-	time   int64
-}
-
 var (
-	p  = []byte("123456")
-	cr = minimumRounds
-
 	primes = []uint64{
 		1199456261,
 		8432571981118615261,
@@ -40,56 +22,14 @@ var (
 	}
 )
 
-func benchmarkRoundTime(b *testing.B) {
-	var err error
-
-	b.ResetTimer()
-	for i := 0; i < 1; i++ {
-		_, err = bcrypt.GenerateFromPassword(p, cr)
-	}
-	b.StopTimer()
-
-	if err != nil {
-		panic(err)
-	}
-}
-
+// Setup prepares the id obfuscation and checks in the background
+// if the bcrypt cost from the config still fits this machine
+// the cost is chosen once with "authenticaTed calibrate"
 func Setup() *errors.Error {
-	Logger.Info("[PASSWORD HASH ROUNDS]: Starting...")
-
-	var (
-		results []*result
-		b       testing.BenchmarkResult
-		t       int64
-	)
-
-	for {
-		b = testing.Benchmark(benchmarkRoundTime)
-		t = b.NsPerOp()
-
-		if t >= maxTime {
-			break
-		} else {
-			Logger.WithFields(log.Fields{
-				"Rounds": cr,
-				"Time":   humanize.Comma(t),
-			}).Info("[PASSWORD HASH ROUNDS]: Not enough to ", maxTime/ns, " seconds")
-
-			r := &result{
-				rounds: cr,
-				time:   t,
-			}
-			results = append(results, r)
-			cr++
-		}
+	if !isTest {
+		go checkEncryptionLevel()
 	}
 
-	Logger.WithFields(log.Fields{
-		"Rounds": cr,
-		"Time":   t / ns,
-	}).Info("[PASSWORD HASH ROUNDS]: Done, round choosen is ", cr-1)
-	log.Println(fmt.Sprintf("ROUND[%v] TIME[%v]", cr, t))
-
 	var err error
 	handleErr := func(f func(*big.Int) error, i *big.Int) {
 		if err == nil {
@@ -115,3 +55,36 @@ func Setup() *errors.Error {
 
 	return errors.FromErr(err)
 }
+
+// checkEncryptionLevel hashes once with the configured cost
+// and warns when it is far from Config.HashTargetTime
+func checkEncryptionLevel() {
+	l := Logger.WithField("Rounds", Config.EncryptionLevel)
+	l.Debug("[PASSWORD HASH ROUNDS]: Checking...")
+
+	var t time.Duration
+	err := getHashPool().Do(func() {
+		var err error
+		t, err = util.MeasureCost(Config.EncryptionLevel)
+		if err != nil {
+			l.WithError(err).Error("[PASSWORD HASH ROUNDS]: Error while measuring")
+		}
+	})
+	if err != nil || t == 0 {
+		return
+	}
+
+	l = l.WithFields(log.Fields{
+		"Time":   t,
+		"Target": Config.HashTargetTime,
+	})
+
+	// each round doubles the time, so anything outside
+	// half/double of the target is at least one round off
+	if t < Config.HashTargetTime/2 || t > Config.HashTargetTime*2 {
+		l.Warn(`[PASSWORD HASH ROUNDS]: Cost is far from the target on this machine, run "authenticaTed calibrate"`)
+		return
+	}
+
+	l.Info("[PASSWORD HASH ROUNDS]: Cost is fine")
+}
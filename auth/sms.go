@@ -0,0 +1,87 @@
+package users
+
+import (
+	"sync"
+
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// SMSSender sends text messages to phone numbers in the E.164 format
+// set Config.SMSSender to use a provider
+type SMSSender interface {
+	Send(to, body string) error
+}
+
+// SMS is a message sent by a SMSSender
+type SMS struct {
+	To   string
+	Body string
+}
+
+// LogSMSSender prints the messages on the console
+// it's the default until a real sender is set
+type LogSMSSender struct{}
+
+// Send logs the message, the body is only shown on debug
+// as it has codes
+func (s *LogSMSSender) Send(to, body string) error {
+	l := Logger.WithField("to", to)
+
+	l.Warn("[LogSMSSender.Send]: No sms sender set, the message was not sent")
+	l.WithField("body", body).Debug("[LogSMSSender.Send]: Message body")
+	return nil
+}
+
+// MemorySMSSender keeps the messages in memory
+// it's used for testing
+type MemorySMSSender struct {
+	sync.Mutex
+	Messages []*SMS
+}
+
+// Send stores the message
+func (s *MemorySMSSender) Send(to, body string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.Messages = append(s.Messages, &SMS{
+		To:   to,
+		Body: body,
+	})
+
+	return nil
+}
+
+// Last returns the last message sent to the number
+func (s *MemorySMSSender) Last(to string) *SMS {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		if s.Messages[i].To == to {
+			return s.Messages[i]
+		}
+	}
+
+	return nil
+}
+
+// Reset removes all stored messages
+func (s *MemorySMSSender) Reset() {
+	s.Lock()
+	s.Messages = nil
+	s.Unlock()
+}
+
+// sendSMS sends a message with the sender from the config
+// errors are only logged so they don't change the response
+func sendSMS(to, body string) {
+	s := Config.SMSSender
+	if s == nil {
+		s = &LogSMSSender{}
+	}
+
+	if err := s.Send(to, body); err != nil {
+		Logger.WithError(err).WithField("to", to).Error("[SMS]: Error while sending message")
+	}
+}
@@ -0,0 +1,493 @@
+package users
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// how long the discovery and token requests can take
+const oidcTimeout = 10 * time.Second
+
+// characters usernames can't have, see the User struct
+var usernameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// OIDCProvider is a openid connect issuer users can log in with
+// they're set in authenticaTed.yml under "oidc", keyed by name
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// the callback, /api/v1/users/auth/oidc/:provider/callback
+	RedirectURL string
+
+	// openid is always asked for
+	Scopes []string
+
+	// discovered on the first use
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// discover fetches the configuration of the issuer once
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	p.provider = provider
+	return provider, nil
+}
+
+// oauth2 builds the client config of the provider
+func (p *OIDCProvider) oauth2(provider *oidc.Provider) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID}
+	for _, s := range p.Scopes {
+		if s != oidc.ScopeOpenID {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// OIDCState is a login or link waiting for the provider's callback
+// only the hash of the state is stored, it's used once
+type OIDCState struct {
+	ID       int64  `db:"id,omitempty"`
+	State    string `db:"state"`
+	Provider string `db:"provider"`
+	Nonce    string `db:"nonce"`
+	Verifier string `db:"verifier"` // pkce
+
+	// the user linking the identity, zero to log in
+	UserID  hide.Int64 `db:"user_id"`
+	Expires time.Time  `db:"expires"`
+}
+
+// Identity is a account of a external provider linked to a user
+type Identity struct {
+	ID       int64      `db:"id,omitempty" json:"id,string"`
+	UserID   hide.Int64 `db:"user_id"      json:"user_id,string"`
+	Provider string     `db:"provider"     json:"provider"`
+	Issuer   string     `db:"issuer"       json:"issuer"`
+	Subject  string     `db:"subject"      json:"subject"`
+	Email    string     `db:"email"        json:"email"`
+
+	Created  time.Time `db:"created"      json:"created"`
+	LastUsed time.Time `db:"last_used"    json:"last_used"`
+}
+
+// oidcClaims are the id token claims used to create users
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// getOIDCProvider finds a provider of Config.OIDCProviders
+func getOIDCProvider(name string) (*OIDCProvider, *errors.Error) {
+	p, ok := Config.OIDCProviders[name]
+	if !ok || p == nil {
+		return nil, errors.FromCode(errors.ErrorUnknownProvider)
+	}
+
+	return p, nil
+}
+
+// pkceChallenge is the S256 code challenge of the verifier, rfc 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// BeginOIDC starts a login with the provider, or links it to the user when
+// its id is set, it returns the state, that should be kept in a cookie,
+// and the url of the provider to redirect the browser to
+func (u *User) BeginOIDC(provider string) (string, string, *errors.Error) {
+	p, err := getOIDCProvider(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+
+	op, gErr := p.discover(ctx)
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.BeginOIDC]: Discovery failed")
+		return "", "", errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	var random [3]string
+	for i := range random {
+		if random[i], gErr = util.RandomToken(32); gErr != nil {
+			return "", "", errors.FromErr(gErr)
+		}
+	}
+
+	state, nonce, verifier := random[0], random[1], random[2]
+
+	_, gErr = yc.Insert(&OIDCState{
+		State:    util.HashToken(state),
+		Provider: provider,
+		Nonce:    nonce,
+		Verifier: verifier,
+		UserID:   u.ID,
+		Expires:  time.Now().Add(Config.OIDCStateTime),
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.BeginOIDC]: Error while inserting")
+		return "", "", errors.FromErr(gErr)
+	}
+
+	url := p.oauth2(op).AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+
+	return state, url, nil
+}
+
+// takeOIDCState finds and removes the state of the callback
+func takeOIDCState(provider, state string) (*OIDCState, *errors.Error) {
+	var s *OIDCState
+
+	r := yc.Find(db.Cond{"state": util.HashToken(state)})
+	err := r.One(&s)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorInvalidState)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if err = r.Delete(); err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if s.Provider != provider || time.Now().After(s.Expires) {
+		return nil, errors.FromCode(errors.ErrorInvalidState)
+	}
+
+	return s, nil
+}
+
+// exchangeOIDC trades the code for the verified id token of the state
+func exchangeOIDC(p *OIDCProvider, s *OIDCState, code string) (*oidc.IDToken, *errors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+
+	op, err := p.discover(ctx)
+	if err != nil {
+		Logger.WithError(err).Error("[exchangeOIDC]: Discovery failed")
+		return nil, errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	token, err := p.oauth2(op).Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", s.Verifier))
+	if err != nil {
+		Logger.WithError(err).Debug("[exchangeOIDC]: Code exchange failed")
+		return nil, errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		Logger.Debug("[exchangeOIDC]: No id token")
+		return nil, errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	id, err := op.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(ctx, raw)
+	if err != nil {
+		Logger.WithError(err).Debug("[exchangeOIDC]: Invalid id token")
+		return nil, errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	if id.Nonce != s.Nonce {
+		Logger.Debug("[exchangeOIDC]: Wrong nonce")
+		return nil, errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	return id, nil
+}
+
+// findIdentity finds the link of the issuer and subject, nil when there is none
+func findIdentity(issuer, subject string) (*Identity, *errors.Error) {
+	var i *Identity
+
+	err := xc.Find(db.Cond{"issuer": issuer, "subject": subject}).One(&i)
+	if err == db.ErrNoMoreRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return i, nil
+}
+
+// CompleteOIDC finishes BeginOIDC with the state and code of the callback
+// a link adds the identity to the user of the state and returns no token
+// a login returns the same as Auth, creating the user on its first login
+func (u *User) CompleteOIDC(provider, state, code string) (string, *errors.Error) {
+	l := Logger.WithField("provider", provider)
+	l.Debug("[User.CompleteOIDC]: Authenticating user...")
+
+	p, err := getOIDCProvider(provider)
+	if err != nil {
+		return "", err
+	}
+
+	s, err := takeOIDCState(provider, state)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := exchangeOIDC(p, s, code)
+	if err != nil {
+		return "", err
+	}
+
+	var claims oidcClaims
+	if gErr := id.Claims(&claims); gErr != nil {
+		return "", errors.FromCode(errors.ErrorOIDCFailed)
+	}
+
+	linked, err := findIdentity(id.Issuer, id.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	// linking from a session
+	if s.UserID != 0 {
+		if linked != nil {
+			return "", errors.FromCode(errors.ErrorIdentityExists)
+		}
+
+		*u = User{ID: s.UserID}
+		if found, fErr := u.Find(); fErr != nil || !found {
+			return "", errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+
+		return "", u.addIdentity(provider, id.Issuer, id.Subject, claims.Email)
+	}
+
+	if linked != nil {
+		*u = User{ID: linked.UserID}
+		found, fErr := u.Find()
+		if fErr != nil {
+			return "", fErr
+		}
+
+		if !found || u.Deleted {
+			return "", errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+
+		gErr := xc.Find(db.Cond{"id": linked.ID}).Update(map[string]interface{}{
+			"last_used": time.Now(),
+		})
+		if gErr != nil {
+			return "", errors.FromErr(gErr)
+		}
+	} else {
+		// an existing account must log in and link it, emails aren't trusted to merge accounts
+		if claims.Email == "" || !claims.EmailVerified {
+			l.Debug("[User.CompleteOIDC]: No verified email to create the user")
+			return "", errors.FromCode(errors.ErrorNotEnoughInfo)
+		}
+
+		if err = u.createIdentity(provider, id.Issuer, id.Subject, claims.PreferredUsername, claims.Email); err != nil {
+			return "", err
+		}
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	if err = u.LoginSucceeded(); err != nil {
+		return "", err
+	}
+
+	u.AuthMethod = AMRFederated
+	return u.loginToken()
+}
+
+// createExternal creates a user without a password for a external identity
+func (u *User) createExternal(username, email string) *errors.Error {
+	return u.createNamed(User{
+		Email:     email,
+		Activated: true, // verified by the provider
+		External:  true,
+	}, username)
+}
+
+// createNamed creates the user with a username made from the given one
+// or the email, with a number at the end when it's taken
+func (u *User) createNamed(user User, username string) *errors.Error {
+	if username == "" {
+		username = strings.SplitN(user.Email, "@", 2)[0]
+	}
+
+	base := usernameInvalid.ReplaceAllString(username, "_")
+	if len(base) > 18 {
+		base = base[:18]
+	}
+
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	username = base
+	for i := 0; i < 5; i++ {
+		*u = user
+		u.Username = username
+
+		_, err := u.Create()
+		if err == nil || err.Code != errors.ErrorUsernameExists {
+			return err
+		}
+
+		suffix, gErr := util.RandomDigits(6)
+		if gErr != nil {
+			return errors.FromErr(gErr)
+		}
+
+		username = base + "_" + suffix
+	}
+
+	return errors.FromCode(errors.ErrorUsernameExists)
+}
+
+// createIdentity creates the user of a new external identity and links it
+// the user is removed again when the link fails, like when a concurrent
+// login of the same subject linked it first, so no user is left without a way to log in
+func (u *User) createIdentity(provider, issuer, subject, username, email string) *errors.Error {
+	if err := u.createExternal(username, email); err != nil {
+		return err
+	}
+
+	err := u.addIdentity(provider, issuer, subject, email)
+	if err == nil {
+		return nil
+	}
+
+	if dErr := u.HardDelete(); dErr != nil {
+		Logger.WithError(dErr).WithField("ID", u.ID).Error("[User.createIdentity]: Error while removing the user")
+	}
+
+	return err
+}
+
+// addIdentity links the verified subject of the issuer to the user
+func (u *User) addIdentity(provider, issuer, subject, email string) *errors.Error {
+	now := time.Now()
+	_, gErr := xc.Insert(&Identity{
+		UserID:   u.ID,
+		Provider: provider,
+		Issuer:   issuer,
+		Subject:  subject,
+		Email:    email,
+		Created:  now,
+		LastUsed: now,
+	})
+	if gErr != nil {
+		Logger.WithError(gErr).Error("[User.addIdentity]: Error while inserting")
+		return errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":       u.ID,
+		"provider": provider,
+	}).Info("[User.addIdentity]: Identity linked")
+	return nil
+}
+
+// Identities lists the external identities linked to the user
+func (u *User) Identities() ([]*Identity, *errors.Error) {
+	var list []*Identity
+
+	err := xc.Find(db.Cond{"user_id": u.ID}).OrderBy("created").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// UnlinkIdentity removes a external identity of the user
+// the last one of a user without a password can't be removed
+func (u *User) UnlinkIdentity(id int64) *errors.Error {
+	list, err := u.Identities()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, i := range list {
+		found = found || i.ID == id
+	}
+
+	if !found {
+		return errors.FromCode(errors.ErrorIdentityNotFound)
+	}
+
+	if len(list) == 1 {
+		user := User{ID: u.ID}
+		if _, err = user.Find(); err != nil {
+			return err
+		}
+
+		if user.Password == "" {
+			return errors.FromCode(errors.ErrorLastLoginMethod)
+		}
+	}
+
+	gErr := xc.Find(db.Cond{"id": id, "user_id": u.ID}).Delete()
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	Logger.WithFields(log.Fields{
+		"ID":       u.ID,
+		"identity": id,
+	}).Info("[User.UnlinkIdentity]: Identity unlinked")
+	return nil
+}
@@ -0,0 +1,266 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// oidcGrant is what the stand-in remembers of an authorization
+type oidcGrant struct {
+	nonce     string
+	challenge string
+	subject   string
+	email     string
+}
+
+// oidcStandIn is a minimal openid connect issuer with
+// discovery, jwks and a token endpoint checking pkce
+type oidcStandIn struct {
+	*httptest.Server
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]*oidcGrant
+}
+
+func newOIDCStandIn(t *testing.T) *oidcStandIn {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	s := &oidcStandIn{key: key, codes: map[string]*oidcGrant{}}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{map[string]string{
+				"kty": "RSA",
+				"kid": "stand-in",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.mu.Lock()
+		g, ok := s.codes[r.Form.Get("code")]
+		delete(s.codes, r.Form.Get("code"))
+		s.mu.Unlock()
+
+		if !ok || pkceChallenge(r.Form.Get("code_verifier")) != g.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		now := time.Now()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            s.URL,
+			"sub":            g.subject,
+			"aud":            "client",
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Minute).Unix(),
+			"nonce":          g.nonce,
+			"email":          g.email,
+			"email_verified": true,
+		})
+		token.Header["kid"] = "stand-in"
+
+		id, err := token.SignedString(key)
+		assert.Nil(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "stand-in",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     id,
+		})
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// authorize logs the subject in at the stand-in and returns the code
+// the browser would bring back to the callback
+func (s *oidcStandIn) authorize(t *testing.T, authURL, subject, email string) string {
+	u, err := url.Parse(authURL)
+	assert.Nil(t, err)
+
+	q := u.Query()
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Contains(t, q.Get("scope"), "openid")
+
+	code := subject + "-" + q.Get("state")[:8]
+
+	s.mu.Lock()
+	s.codes[code] = &oidcGrant{
+		nonce:     q.Get("nonce"),
+		challenge: q.Get("code_challenge"),
+		subject:   subject,
+		email:     email,
+	}
+	s.mu.Unlock()
+
+	return code
+}
+
+func TestSocialLogin(t *testing.T) {
+	s := newOIDCStandIn(t)
+	defer s.Close()
+
+	Config.OIDCProviders["stand-in"] = &OIDCProvider{
+		Issuer:       s.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/api/v1/users/auth/oidc/stand-in/callback",
+		Scopes:       []string{"email"},
+	}
+	defer delete(Config.OIDCProviders, "stand-in")
+
+	// expect error: unknown provider
+	_, _, err := NewUser().BeginOIDC("nope")
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorUnknownProvider, err.Code)
+
+	// ok: first login creates the user
+	state, authURL, err := NewUser().BeginOIDC("stand-in")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(authURL, s.URL+"/authorize"))
+
+	code := s.authorize(t, authURL, "subject-1", "social_user@mail.com")
+
+	u := NewUser()
+	token, err := u.CompleteOIDC("stand-in", state, code)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "social_user", u.Username)
+	assert.Empty(t, u.Password)
+
+	// expect error: single use state
+	_, err = NewUser().CompleteOIDC("stand-in", state, code)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidState, err.Code)
+
+	// expect error: no password to log in with
+	fu := NewUser()
+	fu.Username = u.Username
+	_, err = fu.Auth("password")
+	assert.NotNil(t, err)
+
+	// ok: the next login finds the same user
+	state, authURL, err = NewUser().BeginOIDC("stand-in")
+	assert.Nil(t, err)
+
+	fu = NewUser()
+	_, err = fu.CompleteOIDC("stand-in", state, s.authorize(t, authURL, "subject-1", "social_user@mail.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: wrong pkce verifier
+	state, authURL, err = NewUser().BeginOIDC("stand-in")
+	assert.Nil(t, err)
+
+	code = s.authorize(t, authURL, "subject-1", "social_user@mail.com")
+	s.codes[code].challenge = pkceChallenge("wrong")
+
+	_, err = NewUser().CompleteOIDC("stand-in", state, code)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorOIDCFailed, err.Code)
+
+	// expect error: the only way to log in
+	list, err := u.Identities()
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	err = u.UnlinkIdentity(list[0].ID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorLastLoginMethod, err.Code)
+
+	// linking from a session
+	l := NewUser()
+	l.Username = "Social_Local"
+	l.Email = "social_local@mail.com"
+	l.Password = "password"
+	_, err = l.Create()
+	assert.Nil(t, err)
+
+	// expect error: linked to another user
+	state, authURL, err = l.BeginOIDC("stand-in")
+	assert.Nil(t, err)
+
+	_, err = NewUser().CompleteOIDC("stand-in", state, s.authorize(t, authURL, "subject-1", "social_user@mail.com"))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorIdentityExists, err.Code)
+
+	// ok
+	state, authURL, err = l.BeginOIDC("stand-in")
+	assert.Nil(t, err)
+
+	fu = NewUser()
+	token, err = fu.CompleteOIDC("stand-in", state, s.authorize(t, authURL, "subject-2", "other@mail.com"))
+	assert.Nil(t, err)
+	assert.Empty(t, token)
+	assert.Equal(t, l.ID, fu.ID)
+
+	list, err = l.Identities()
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "subject-2", list[0].Subject)
+
+	// ok: it has a password
+	assert.Nil(t, l.UnlinkIdentity(list[0].ID))
+
+	err = l.UnlinkIdentity(list[0].ID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorIdentityNotFound, err.Code)
+
+	// expect error: the subject was linked meanwhile, no user is left behind
+	assert.Nil(t, u.addIdentity("stand-in", "https://raced.example.com", "subject-3", ""))
+
+	o := NewUser()
+	err = o.createIdentity("stand-in", "https://raced.example.com", "subject-3", "raced_user", "raced_user@mail.com")
+	assert.NotNil(t, err)
+
+	o = NewUser()
+	o.Username = "raced_user"
+	found, err := o.Find()
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, l.HardDelete())
+}
@@ -0,0 +1,97 @@
+package users
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// emails sent by Register when Config.HideAccountExistence is on
+const (
+	mailRegisteredSubject = "Welcome"
+	mailRegisteredBody    = "Your account %s was created."
+
+	mailEmailTakenSubject = "Sign up attempt"
+	mailEmailTakenBody    = "Someone tried to create an account with this email, you already have one. If it was you, log in or reset your password instead."
+
+	mailUsernameTakenSubject = "Sign up attempt"
+	mailUsernameTakenBody    = "Someone tried to create an account with your username %s. If it wasn't you, you can ignore this email."
+)
+
+var (
+	// hashed once and compared against when a user
+	// doesn't exist so it takes as long as a real login
+	dummyHash []byte
+	dummyOnce sync.Once
+)
+
+// dummyCompare spends the same time as a password comparison
+// it always returns ErrorUserInvalidPassword unless the pool is busy
+func dummyCompare(password string) *errors.Error {
+	dummyOnce.Do(func() {
+		var err error
+		dummyHash, err = bcrypt.GenerateFromPassword([]byte("authenticaTed dummy password"), Config.EncryptionLevel)
+		if err != nil {
+			Logger.WithError(err).Error("[User.dummyCompare]: Error while hashing the dummy password")
+		}
+	})
+
+	if err := compareHash(dummyHash, []byte(password)); err != nil && err.Code == errors.ErrorTryAgain {
+		return err
+	}
+
+	return errors.FromCode(errors.ErrorUserInvalidPassword)
+}
+
+// Register creates the user like Create but when Config.HideAccountExistence
+// is on it never tells if the username or email is taken, an email is sent instead
+// in that mode a nil error doesn't mean a user was created
+func (u *User) Register() *errors.Error {
+	_, err := u.Create()
+	if !Config.HideAccountExistence {
+		return err
+	}
+
+	if err == nil {
+		sendMail(u.Email, mailRegisteredSubject, fmt.Sprintf(mailRegisteredBody, u.Username))
+		return nil
+	}
+
+	switch err.Code {
+	case errors.ErrorEmailExists:
+		// the owner of the email is told about the attempt
+		Logger.Debug("[User.Register]: Email exists, emailing the owner")
+		sendMail(u.Email, mailEmailTakenSubject, mailEmailTakenBody)
+
+	case errors.ErrorUsernameExists:
+		// the owner of the username is told, never the given address
+		Logger.Debug("[User.Register]: Username exists, emailing the owner")
+		owner := NewUser()
+		owner.Username = u.Username
+
+		found, fErr := owner.Find()
+		if fErr != nil {
+			return fErr
+		}
+
+		if found {
+			sendMail(owner.Email, mailUsernameTakenSubject, fmt.Sprintf(mailUsernameTakenBody, owner.Username))
+		}
+
+	default:
+		return err
+	}
+
+	// hash the password anyway so it takes as long as creating a user
+	p := *u
+	if hErr := p.Hash(); hErr != nil && hErr.Code == errors.ErrorTryAgain {
+		return hErr
+	}
+
+	u.ID = 0
+	return nil
+}
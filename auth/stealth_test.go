@@ -0,0 +1,111 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHideAccountExistenceAuth(t *testing.T) {
+	Config.HideAccountExistence = true
+	defer func() {
+		Config.HideAccountExistence = false
+	}()
+
+	u := NewUser()
+	u.Username = "Stealthy_User"
+	u.Email = "stealthy_user@mail.com"
+	u.Password = "password"
+	err := u.Register()
+	assert.Nil(t, err)
+
+	// wrong password
+	wrong := NewUser()
+	wrong.Username = u.Username
+	token, wrongErr := wrong.Auth("wrong password")
+	assert.Empty(t, token)
+	assert.NotNil(t, wrongErr)
+	assert.Equal(t, errors.ErrorUserInvalidPassword, wrongErr.Code)
+
+	// missing user
+	missing := NewUser()
+	missing.Username = "Missing_User"
+	token, missingErr := missing.Auth("wrong password")
+	assert.Empty(t, token)
+	assert.NotNil(t, missingErr)
+
+	// both answers must be the same
+	assert.Equal(t, wrongErr, missingErr)
+	assert.Equal(t, wrongErr.JSON(), missingErr.JSON())
+
+	// same thing with emails
+	wrong = NewUser()
+	wrong.Email = u.Email
+	_, wrongErr = wrong.Auth("wrong password")
+
+	missing = NewUser()
+	missing.Email = "missing_user@mail.com"
+	_, missingErr = missing.Auth("wrong password")
+	assert.Equal(t, wrongErr, missingErr)
+
+	// ok
+	ok := NewUser()
+	ok.Username = u.Username
+	token, err = ok.Auth("password")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	assert.Nil(t, u.HardDelete())
+}
+
+func TestHideAccountExistenceRegister(t *testing.T) {
+	m := &MemoryMailer{}
+	Config.Mailer = m
+	Config.HideAccountExistence = true
+	defer func() {
+		Config.Mailer = &LogMailer{}
+		Config.HideAccountExistence = false
+	}()
+
+	// new user
+	u := NewUser()
+	u.Username = "Registered_User"
+	u.Email = "registered_user@mail.com"
+	u.Password = "password"
+	newErr := u.Register()
+	assert.Nil(t, newErr)
+	assert.Equal(t, mailRegisteredSubject, m.Last(u.Email).Subject)
+
+	// existing email, the owner gets an email
+	taken := NewUser()
+	taken.Username = "Other_User"
+	taken.Email = u.Email
+	taken.Password = "password"
+	takenErr := taken.Register()
+	assert.Equal(t, newErr, takenErr)
+	assert.Zero(t, taken.ID)
+	assert.Equal(t, mailEmailTakenBody, m.Last(u.Email).Body)
+
+	// existing username, the owner gets an email, the given address nothing
+	m.Reset()
+	taken = NewUser()
+	taken.Username = u.Username
+	taken.Email = "other_user@mail.com"
+	taken.Password = "password"
+	takenErr = taken.Register()
+	assert.Equal(t, newErr, takenErr)
+	assert.Zero(t, taken.ID)
+	assert.Nil(t, m.Last(taken.Email))
+	assert.Equal(t, fmt.Sprintf(mailUsernameTakenBody, u.Username), m.Last(u.Email).Body)
+
+	// the normal mode still tells what is wrong
+	Config.HideAccountExistence = false
+	takenErr = taken.Register()
+	assert.NotNil(t, takenErr)
+	assert.Equal(t, errors.ErrorUsernameExists, takenErr.Code)
+
+	assert.Nil(t, u.HardDelete())
+}
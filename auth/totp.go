@@ -0,0 +1,308 @@
+package users
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/hide"
+	"github.com/skip2/go-qrcode"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// how many recovery codes a user gets
+const recoveryCodes = 10
+
+// only one request can use a time step or a recovery code
+const (
+	sqlUseTOTPCounter  = `UPDATE ` + TableTOTP + ` SET counter = ? WHERE id = ? AND counter < ?`
+	sqlUseRecoveryCode = `UPDATE ` + TableRecovery + ` SET used = TRUE WHERE id = ? AND used = FALSE`
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the authenticator app of a user
+// it only works after being confirmed with a code
+type TOTP struct {
+	ID     int64      `db:"id,omitempty" json:"-"`
+	UserID hide.Int64 `db:"user_id"      json:"user_id,string"`
+
+	// encrypted with Config.EncryptionKey
+	Secret    string `db:"secret"       json:"-"`
+	Confirmed bool   `db:"confirmed"    json:"confirmed"`
+
+	// last time step used, a code can't be used twice
+	Counter int64     `db:"counter"      json:"-"`
+	Created time.Time `db:"created"      json:"created"`
+}
+
+// TOTPEnrollment is shown to the user once
+// so it can be added to a authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+
+	// png image as a data uri
+	QR string `json:"qr"`
+}
+
+// RecoveryCode is a single use code for when
+// the authenticator app is lost, only its hash is stored
+type RecoveryCode struct {
+	ID     int64      `db:"id,omitempty"`
+	UserID hide.Int64 `db:"user_id"`
+	Code   string     `db:"code"`
+	Used   bool       `db:"used"`
+}
+
+// getTOTP finds the authenticator of the user
+// it returns nil when there is none
+func (u *User) getTOTP(confirmed bool) (*TOTP, *errors.Error) {
+	var t *TOTP
+
+	err := tc.Find(db.Cond{"user_id": u.ID, "confirmed": confirmed}).One(&t)
+	if err == db.ErrNoMoreRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return t, nil
+}
+
+// HasTOTP checks if the user confirmed a authenticator app
+func (u *User) HasTOTP() (bool, *errors.Error) {
+	t, err := u.getTOTP(true)
+	return t != nil, err
+}
+
+// EnrollTOTP creates a new secret for a authenticator app
+// it must be confirmed with ConfirmTOTP before it is used
+func (u *User) EnrollTOTP() (*TOTPEnrollment, *errors.Error) {
+	l := Logger.WithField("ID", u.ID)
+	l.Debug("[User.EnrollTOTP]: Enrolling...")
+
+	if u.ID == 0 {
+		return nil, errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	enabled, err := u.HasTOTP()
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		return nil, errors.FromCode(errors.ErrorMFAAlreadyEnabled)
+	}
+
+	secret, gErr := util.NewTOTPSecret()
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	encrypted, err := util.Encrypt(secret, Config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new enrollment replaces the unconfirmed one
+	r := tc.Find(db.Cond{"user_id": u.ID, "confirmed": false})
+	if gErr = r.Delete(); gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	_, gErr = tc.Insert(&TOTP{
+		UserID:  u.ID,
+		Secret:  encrypted,
+		Created: time.Now(),
+	})
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.EnrollTOTP]: Error while inserting")
+		return nil, errors.FromErr(gErr)
+	}
+
+	e := &TOTPEnrollment{
+		Secret: secret,
+		URI:    util.TOTPURI(Config.MFAIssuer, u.Username, secret),
+	}
+
+	png, gErr := qrcode.Encode(e.URI, qrcode.Medium, 256)
+	if gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	e.QR = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+
+	l.Debug("[User.EnrollTOTP]: Waiting for confirmation")
+	return e, nil
+}
+
+// ConfirmTOTP enables the authenticator app with its first code
+// the recovery codes are returned and never shown again
+func (u *User) ConfirmTOTP(code string) ([]string, *errors.Error) {
+	t, err := u.getTOTP(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, errors.FromCode(errors.ErrorMFANotEnabled)
+	}
+
+	if err = u.checkTOTP(t, code); err != nil {
+		return nil, err
+	}
+
+	t.Confirmed = true
+	if gErr := tc.Find(db.Cond{"id": t.ID}).Update(t); gErr != nil {
+		return nil, errors.FromErr(gErr)
+	}
+
+	Logger.WithField("ID", u.ID).Debug("[User.ConfirmTOTP]: Authenticator enabled")
+	return u.GenerateRecoveryCodes()
+}
+
+// VerifyTOTP checks a code from the authenticator app
+func (u *User) VerifyTOTP(code string) *errors.Error {
+	t, err := u.getTOTP(true)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return errors.FromCode(errors.ErrorMFANotEnabled)
+	}
+
+	return u.checkTOTP(t, code)
+}
+
+// checkTOTP validates the code and saves its time step
+func (u *User) checkTOTP(t *TOTP, code string) *errors.Error {
+	secret, err := util.Decrypt(t.Secret, Config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	counter, ok, gErr := util.ValidateTOTP(secret, strings.TrimSpace(code), time.Now(), 1)
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	// codes can't be used twice
+	if !ok || counter <= t.Counter {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	res, gErr := session.Exec(sqlUseTOTPCounter, counter, t.ID, counter)
+	if gErr != nil {
+		return errors.FromErr(gErr)
+	}
+
+	if n, gErr := res.RowsAffected(); gErr != nil || n == 0 {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	t.Counter = counter
+	return nil
+}
+
+// DisableTOTP removes the authenticator app and the recovery codes
+// a valid second factor code is required, wrong ones count as failed logins
+func (u *User) DisableTOTP(code string) *errors.Error {
+	if err := u.CheckSecondFactor(code); err != nil {
+		return err
+	}
+
+	cond := db.Cond{"user_id": u.ID}
+	if err := tc.Find(cond).Delete(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	if err := rc.Find(cond).Delete(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	Logger.WithField("ID", u.ID).Debug("[User.DisableTOTP]: Authenticator disabled")
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the user
+func (u *User) GenerateRecoveryCodes() ([]string, *errors.Error) {
+	if err := rc.Find(db.Cond{"user_id": u.ID}).Delete(); err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	codes := make([]string, recoveryCodes)
+	for i := range codes {
+		b, err := util.RandomBytes(10)
+		if err != nil {
+			return nil, errors.FromErr(err)
+		}
+
+		// xxxx-xxxx-xxxx-xxxx
+		c := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i] = c[0:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:16]
+
+		_, err = rc.Insert(&RecoveryCode{
+			UserID: u.ID,
+			Code:   util.HashToken(normalizeRecoveryCode(codes[i])),
+		})
+		if err != nil {
+			return nil, errors.FromErr(err)
+		}
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode checks and burns a recovery code
+func (u *User) UseRecoveryCode(code string) *errors.Error {
+	var c *RecoveryCode
+
+	cond := db.Cond{
+		"user_id": u.ID,
+		"code":    util.HashToken(normalizeRecoveryCode(code)),
+		"used":    false,
+	}
+
+	err := rc.Find(cond).One(&c)
+	if err == db.ErrNoMoreRows {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	res, err := session.Exec(sqlUseRecoveryCode, c.ID)
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.FromCode(errors.ErrorInvalidCode)
+	}
+
+	c.Used = true
+
+	Logger.WithField("ID", u.ID).Info("[User.UseRecoveryCode]: Recovery code used")
+	return nil
+}
+
+// normalizeRecoveryCode accepts codes typed without dashes or in uppercase
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// isRecoveryCode tells recovery codes apart from the numeric ones
+func isRecoveryCode(code string) bool {
+	return len(normalizeRecoveryCode(code)) == 16
+}
@@ -0,0 +1,398 @@
+package users
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc"
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+)
+
+// TrustedIssuer is a external identity provider whose jwts are accepted
+// like the ones of authenticaTed, set in DefaultJWTConfig.TrustedIssuers
+// its subjects are mapped to local users, so GetID and GetPower work the same
+type TrustedIssuer struct {
+	// Name identifies the issuer in the identities of its users
+	Name string
+
+	// Issuer is the iss claim of its tokens
+	Issuer string
+
+	// Audience must be in the aud claim, it's required:
+	// without it the tokens the issuer gives to any other service are accepted
+	Audience string
+
+	// JWKSURL is fetched to verify the tokens, again for unknown kids
+	// Keys are used without it, keyed by kid, "" matches any:
+	// *rsa.PublicKey, *ecdsa.PublicKey or []byte for HS256
+	JWKSURL string
+	Keys    map[string]interface{}
+
+	// Algorithms the tokens can be signed with, RS256 when empty
+	Algorithms []string
+
+	// Claims maps the claims of the tokens to User fields
+	Claims TrustedClaims
+
+	// Powers gives the users the highest power of the values of
+	// Claims.Power, or DefaultPower without a match
+	Powers       map[string]UserPower
+	DefaultPower UserPower
+
+	// MFAValues are the acr values of logins with a second factor,
+	// tokens with mfa in the amr claim always count as one
+	MFAValues []string
+
+	// AutoProvision creates users for unknown subjects,
+	// otherwise an admin links them first with LinkTrustedSubject
+	AutoProvision bool
+
+	// built on the first use
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+}
+
+// TrustedClaims are the names of the claims of a TrustedIssuer
+// empty ones use the openid connect names, Power is only used when set
+type TrustedClaims struct {
+	Subject  string
+	Username string
+	Email    string
+	Name     string
+	LastName string
+	Power    string
+}
+
+// withDefaults fills the empty names
+func (c TrustedClaims) withDefaults() TrustedClaims {
+	if c.Subject == "" {
+		c.Subject = "sub"
+	}
+
+	if c.Username == "" {
+		c.Username = "preferred_username"
+	}
+
+	if c.Email == "" {
+		c.Email = "email"
+	}
+
+	if c.Name == "" {
+		c.Name = "given_name"
+	}
+
+	if c.LastName == "" {
+		c.LastName = "family_name"
+	}
+
+	return c
+}
+
+// staticKeySet verifies the tokens with the Keys of a TrustedIssuer
+type staticKeySet map[string]interface{}
+
+// VerifySignature checks the signature and returns the payload
+func (s staticKeySet) VerifySignature(ctx context.Context, raw string) ([]byte, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, goerrors.New("malformed jwt")
+	}
+
+	var p jwt.Parser
+	p.SkipClaimsValidation = true // done by the verifier
+
+	_, err := p.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := s[kid]; ok {
+			return key, nil
+		}
+
+		if key, ok := s[""]; ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.DecodeSegment(parts[1])
+}
+
+// getVerifier builds the verifier of the issuer once
+func (t *TrustedIssuer) getVerifier() *oidc.IDTokenVerifier {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.verifier != nil {
+		return t.verifier
+	}
+
+	var keys oidc.KeySet = staticKeySet(t.Keys)
+	if t.JWKSURL != "" {
+		ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcTimeout})
+		keys = oidc.NewRemoteKeySet(ctx, t.JWKSURL)
+	}
+
+	algorithms := t.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{oidc.RS256}
+	}
+
+	t.verifier = oidc.NewVerifier(t.Issuer, keys, &oidc.Config{
+		ClientID:             t.Audience,
+		SupportedSigningAlgs: algorithms,
+	})
+
+	return t.verifier
+}
+
+// trustedIssuer finds the issuer of the unverified token in the config
+func (config JWTConfig) trustedIssuer(raw string) *TrustedIssuer {
+	if len(config.TrustedIssuers) == 0 {
+		return nil
+	}
+
+	var claims jwt.StandardClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(raw, &claims); err != nil {
+		return nil
+	}
+
+	for _, t := range config.TrustedIssuers {
+		if t == nil || t.Issuer == "" || t.Issuer != claims.Issuer {
+			continue
+		}
+
+		if t.Audience == "" {
+			Logger.WithField("issuer", t.Issuer).Warn("[JWTConfig.trustedIssuer]: Issuer without an audience, its tokens are refused")
+			return nil
+		}
+
+		return t
+	}
+
+	return nil
+}
+
+// claimString is the claim as a string, the first one of a list
+func claimString(claims map[string]interface{}, name string) string {
+	values := claimStrings(claims, name)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// claimStrings are the values of a string or list claim
+func claimStrings(claims map[string]interface{}, name string) []string {
+	var values []string
+
+	switch v := claims[name].(type) {
+	case string:
+		values = append(values, v)
+
+	case []interface{}:
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return values
+}
+
+// claimsPower is the power the claims give, false without a Claims.Power
+func (t *TrustedIssuer) claimsPower(claims map[string]interface{}) (UserPower, bool) {
+	if t.Claims.Power == "" {
+		return 0, false
+	}
+
+	power, found := t.DefaultPower, false
+	for _, v := range claimStrings(claims, t.Claims.Power) {
+		if up, ok := t.Powers[v]; ok && (!found || up > power) {
+			power, found = up, true
+		}
+	}
+
+	return power, true
+}
+
+// claimsMFA checks if the issuer says the user passed a second factor
+func (t *TrustedIssuer) claimsMFA(claims map[string]interface{}) bool {
+	if containsString(claimStrings(claims, "amr"), AMRMultipleFactors) {
+		return true
+	}
+
+	acr := claimString(claims, "acr")
+	return acr != "" && containsString(t.MFAValues, acr)
+}
+
+// parseTrusted verifies a token of the issuer and returns it with the
+// claims of its local user, as if authenticaTed had issued it
+func (t *TrustedIssuer) parseTrusted(raw string) (*jwt.Token, error) {
+	l := Logger.WithField("issuer", t.Issuer)
+
+	idt, gErr := t.getVerifier().Verify(context.Background(), raw)
+	if gErr != nil {
+		l.WithError(gErr).Debug("[TrustedIssuer.parseTrusted]: Invalid token")
+		return nil, gErr
+	}
+
+	claims := map[string]interface{}{}
+	if gErr = idt.Claims(&claims); gErr != nil {
+		return nil, gErr
+	}
+
+	// the header was checked by the verifier
+	unverified, _, gErr := new(jwt.Parser).ParseUnverified(raw, &jwt.StandardClaims{})
+	if gErr != nil {
+		return nil, gErr
+	}
+
+	u := NewUser()
+	if err := u.syncTrustedUser(t, claims); err != nil {
+		l.WithError(err).Debug("[TrustedIssuer.parseTrusted]: No local user")
+		return nil, err
+	}
+
+	// the second factor, if any, was checked by the issuer
+	u.AuthMethod = AMRFederated
+	userClaims, err := u.tokenClaims(t.claimsMFA(claims))
+	if err != nil {
+		return nil, err
+	}
+
+	// it isn't valid for longer than the original
+	userClaims.ExpiresAt = idt.Expiry.Unix()
+
+	return &jwt.Token{
+		Raw:    raw,
+		Method: unverified.Method,
+		Header: unverified.Header,
+		Claims: userClaims,
+		Valid:  true,
+	}, nil
+}
+
+// syncTrustedUser finds the local user of the subject of the claims,
+// creating it when the issuer provisions them, and updates its power
+func (u *User) syncTrustedUser(t *TrustedIssuer, claims map[string]interface{}) *errors.Error {
+	names := t.Claims.withDefaults()
+
+	subject := claimString(claims, names.Subject)
+	if subject == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	linked, err := findIdentity(t.Issuer, subject)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	if linked != nil {
+		*u = User{ID: linked.UserID}
+		found, fErr := u.Find()
+		if fErr != nil {
+			return fErr
+		}
+
+		if !found || u.Deleted {
+			return errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+	} else {
+		if !t.AutoProvision {
+			return errors.FromCode(errors.ErrorIdentityNotFound)
+		}
+
+		email := claimString(claims, names.Email)
+		if email == "" {
+			return errors.FromCode(errors.ErrorNotEnoughInfo)
+		}
+
+		if err = u.createIdentity(t.Name, t.Issuer, subject, claimString(claims, names.Username), email); err != nil {
+			return err
+		}
+
+		u.Name = claimString(claims, names.Name)
+		u.LastName = claimString(claims, names.LastName)
+		changed = true
+	}
+
+	// the issuer decides the power
+	if power, ok := t.claimsPower(claims); ok && int(power) != u.Power {
+		Logger.WithFields(log.Fields{
+			"ID":    u.ID,
+			"power": power,
+		}).Info("[User.syncTrustedUser]: Power set by the issuer")
+
+		u.Power = int(power)
+		changed = true
+	}
+
+	if changed {
+		return u.Save()
+	}
+
+	return nil
+}
+
+// LinkTrustedSubject links the subject of a trusted issuer to the user
+// so its tokens authenticate as the user, for issuers without AutoProvision
+// admin is who links it, it must have more power than the user
+func (u *User) LinkTrustedSubject(admin *User, issuer, subject string) *errors.Error {
+	if issuer == "" || subject == "" {
+		return errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	var t *TrustedIssuer
+	for _, ti := range DefaultJWTConfig.TrustedIssuers {
+		if ti != nil && ti.Issuer == issuer {
+			t = ti
+		}
+	}
+
+	if t == nil {
+		return errors.FromCode(errors.ErrorUnknownProvider)
+	}
+
+	linked, err := findIdentity(issuer, subject)
+	if err != nil {
+		return err
+	}
+
+	if linked != nil {
+		return errors.FromCode(errors.ErrorIdentityExists)
+	}
+
+	found, err := u.Find()
+	if err != nil {
+		return err
+	}
+
+	if !found || u.Deleted {
+		return errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
+	// the same rule of impersonation, the tokens of the issuer act as the user
+	if UserPower(admin.Power) < UserPowerAdmin || admin.Power <= u.Power {
+		Logger.WithFields(log.Fields{
+			"ID":    u.ID,
+			"admin": admin.ID,
+		}).Warn("[User.LinkTrustedSubject]: Refused")
+		return errors.FromCode(errors.ErrorUnauthorized)
+	}
+
+	return u.addIdentity(t.Name, issuer, subject, "")
+}
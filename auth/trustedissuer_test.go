@@ -0,0 +1,229 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// partnerToken signs the claims like a external issuer
+func partnerToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return s
+}
+
+func TestTrustedIssuer(t *testing.T) {
+	// the partner publishes the jwks of authenticaTed's own key
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKS())
+	}))
+	defer jwks.Close()
+
+	partnerKey, kid := oidcKey()
+	staticKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	DefaultJWTConfig.TrustedIssuers = []*TrustedIssuer{
+		&TrustedIssuer{
+			Name:          "partner",
+			Issuer:        "https://partner.example.com",
+			Audience:      "authenticaTed",
+			JWKSURL:       jwks.URL,
+			Claims:        TrustedClaims{Power: "roles"},
+			Powers:        map[string]UserPower{"staff": UserPowerMod},
+			DefaultPower:  UserPowerNormal,
+			MFAValues:     []string{"phr"},
+			AutoProvision: true,
+		},
+		&TrustedIssuer{
+			Name:     "static",
+			Issuer:   "https://static.example.com",
+			Audience: "authenticaTed",
+			Keys:     map[string]interface{}{"": &staticKey.PublicKey},
+			Claims:   TrustedClaims{Subject: "oid"},
+		},
+	}
+	defer func() { DefaultJWTConfig.TrustedIssuers = nil }()
+
+	claims := jwt.MapClaims{
+		"iss":                "https://partner.example.com",
+		"sub":                "partner-subject",
+		"aud":                "authenticaTed",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"email":              "partner_user@mail.com",
+		"preferred_username": "partner_user",
+		"roles":              []string{"everyone", "staff"},
+	}
+
+	// ok: the first token creates the user
+	c := bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.NoError(t, LoadToken(c))
+	assert.NoError(t, CheckTokenVersion(c))
+
+	linked, err := findIdentity("https://partner.example.com", "partner-subject")
+	assert.Nil(t, err)
+	assert.NotNil(t, linked)
+
+	id, gErr := GetID(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, linked.UserID, id)
+
+	power, gErr := GetPower(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, UserPowerMod, power)
+
+	provisioned := NewUser()
+	provisioned.ID = id
+	_, err = provisioned.Find()
+	assert.Nil(t, err)
+	assert.Equal(t, "partner_user", provisioned.Username)
+	assert.Equal(t, "partner_user@mail.com", provisioned.Email)
+
+	// ok: the next token finds the same user and updates the power
+	claims["roles"] = []string{"everyone"}
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.NoError(t, LoadToken(c))
+
+	id, gErr = GetID(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, provisioned.ID, id)
+
+	power, gErr = GetPower(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, UserPowerNormal, power)
+
+	// ok: no second factor by default
+	assert.False(t, HasMFAClaim(c))
+
+	// ok: the issuer says the user passed a second factor
+	claims["amr"] = []string{"pwd", "mfa"}
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.NoError(t, LoadToken(c))
+	assert.True(t, HasMFAClaim(c))
+	delete(claims, "amr")
+
+	claims["acr"] = "phr"
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.NoError(t, LoadToken(c))
+	assert.True(t, HasMFAClaim(c))
+	delete(claims, "acr")
+
+	// ok: parsed once when checked for a service token first
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	service, sErr := LoadServiceToken(c)
+	assert.Nil(t, sErr)
+	assert.False(t, service)
+
+	parsed := c.Get(parsedBearerKey).(*parsedBearer).token
+	assert.NoError(t, LoadToken(c))
+	assert.True(t, parsed == c.Get(DefaultJWTConfig.ContextKey))
+
+	// expect error: another audience
+	claims["aud"] = "another service"
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.Error(t, LoadToken(c))
+	claims["aud"] = "authenticaTed"
+
+	// expect error: expired
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, partnerKey, kid, claims))
+	assert.Error(t, LoadToken(c))
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+
+	// expect error: signed by another key
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, staticKey, kid, claims))
+	assert.Error(t, LoadToken(c))
+
+	// expect error: algorithm that isn't allowed, signed with the token secret
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodHS256, Config.TokenSecret, "", claims))
+	assert.Error(t, LoadToken(c))
+
+	// expect error: the subject isn't linked to a user
+	static := jwt.MapClaims{
+		"iss": "https://static.example.com",
+		"aud": "authenticaTed",
+		"oid": "static-subject",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, staticKey, "", static))
+	assert.Error(t, LoadToken(c))
+
+	// expect error: unknown issuer
+	u := NewUser()
+	u.Username = "Trusted_User"
+	u.Email = "trusted_user@mail.com"
+	u.Password = "password"
+	_, err = u.Create()
+	assert.Nil(t, err)
+
+	admin := NewUser()
+	admin.Username = "Trusted_Admin"
+	admin.Email = "trusted_admin@mail.com"
+	admin.Password = "password"
+	_, err = admin.Create()
+	assert.Nil(t, err)
+
+	admin.Power = int(UserPowerAdmin)
+	assert.Nil(t, admin.Save())
+
+	lErr := u.LinkTrustedSubject(admin, "https://unknown.example.com", "static-subject")
+	assert.NotNil(t, lErr)
+	assert.Equal(t, errors.ErrorUnknownProvider, lErr.Code)
+
+	// expect error: not linked by an admin
+	lErr = u.LinkTrustedSubject(u, "https://static.example.com", "static-subject")
+	assert.NotNil(t, lErr)
+	assert.Equal(t, errors.ErrorUnauthorized, lErr.Code)
+
+	// expect error: a user with as much power as the admin
+	lErr = admin.LinkTrustedSubject(admin, "https://static.example.com", "static-subject")
+	assert.NotNil(t, lErr)
+	assert.Equal(t, errors.ErrorUnauthorized, lErr.Code)
+
+	// ok: linked by an admin
+	assert.Nil(t, u.LinkTrustedSubject(admin, "https://static.example.com", "static-subject"))
+
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, staticKey, "", static))
+	assert.NoError(t, LoadToken(c))
+	assert.NoError(t, CheckTokenVersion(c))
+
+	id, gErr = GetID(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, u.ID, id)
+
+	power, gErr = GetPower(c)
+	assert.NoError(t, gErr)
+	assert.Equal(t, UserPower(u.Power), power)
+
+	// expect error: the issuer has no audience
+	DefaultJWTConfig.TrustedIssuers[1].Audience = ""
+	c = bearerContext(echo.GET, partnerToken(t, jwt.SigningMethodRS256, staticKey, "", static))
+	assert.Error(t, LoadToken(c))
+	DefaultJWTConfig.TrustedIssuers[1].Audience = "authenticaTed"
+
+	// expect error: linked already
+	lErr = provisioned.LinkTrustedSubject(admin, "https://static.example.com", "static-subject")
+	assert.NotNil(t, lErr)
+	assert.Equal(t, errors.ErrorIdentityExists, lErr.Code)
+
+	assert.Nil(t, u.HardDelete())
+	assert.Nil(t, admin.HardDelete())
+	assert.Nil(t, provisioned.HardDelete())
+}
@@ -2,14 +2,16 @@ package users
 
 import (
 	"encoding/json"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/asaskevich/govalidator"
 	"github.com/c2h5oh/hide"
 	jwt "github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/ungerik/go-dry"
 	"upper.io/db.v2"
 
 	"github.com/UnnoTed/authenticaTed/errors"
@@ -30,9 +32,15 @@ type User struct {
 	Password string `db:"password"   json:"password,omitempty" valid:"optional,length(3|255)"`
 	Email    string `db:"email"      json:"email"              valid:"optional,length(6|255),email"`
 
+	// e.164, only set by VerifyPhone so it's always verified
+	Phone string `db:"phone,omitempty" json:"phone,omitempty"`
+
 	Token string `db:"-"             json:"token"` // jwt
 	Power int    `db:"power"         json:"power"`
 
+	// increased on password changes to revoke old tokens
+	TokenVersion int `db:"token_version" json:"-"`
+
 	Deleted bool      `db:"deleted"  json:"deleted"`
 	Created time.Time `db:"created"  json:"created"`
 	Seen    time.Time `db:"seen"     json:"seen"`
@@ -45,6 +53,19 @@ type User struct {
 	// when this is set to false
 	Activated bool `db:"activated"   json:"activated"`
 
+	// set by Auth when the login needs a second factor
+	// or when it must add one before logging in
+	MFAPending            bool `db:"-" json:"mfa_pending,omitempty"`
+	MFAEnrollmentRequired bool `db:"-" json:"mfa_enrollment_required,omitempty"`
+
+	// set by the login to the first factor it used, it goes
+	// into the amr claim of the token and of the challenge
+	AuthMethod string `db:"-" json:"-"`
+
+	// set before Create for users of a external identity provider
+	// they can be created without a password and can't use one to log in
+	External bool `db:"-" json:"-"`
+
 	// other structs
 	Banned     *Ban        `db:"-"   json:"banned"`
 	Activation *Activation `db:"-"   json:"activation"`
@@ -121,8 +142,10 @@ func (u *User) ExistsWithCond(cond db.Cond) (bool, *errors.Error) {
 }
 
 // Create validates and check if a user exists before inserting into the db
+// the password is only optional for External users
 func (u *User) Create() (hide.Int64, *errors.Error) {
-	if u.Username == "" || u.Email == "" || u.Password == "" {
+	passwordless := u.External && u.Password == ""
+	if u.Username == "" || u.Email == "" || (u.Password == "" && !passwordless) {
 		Logger.WithField("User", u).Error("[User.Create]: Not enough info!")
 		return 0, errors.FromCode(errors.ErrorNotEnoughInfo)
 	}
@@ -166,17 +189,22 @@ func (u *User) Create() (hide.Int64, *errors.Error) {
 		}
 	}
 
-	// hash the password
-	err = u.Hash()
-	if err != nil {
-		Logger.WithError(err).Error("[User.Create]: error while hashing password")
-		return 0, err
+	// hash the password, an empty one never matches
+	if !passwordless {
+		err = u.Hash()
+		if err != nil {
+			Logger.WithError(err).Error("[User.Create]: error while hashing password")
+			return 0, err
+		}
 	}
 
 	// default values
 	Logger.WithField("username", u.Username).Debug("[User.Create]: Setting default values for user")
 	u.Created = time.Now()
 
+	// the phone is only set after being verified
+	u.Phone = ""
+
 	// insert into the database
 	Logger.WithField("username", u.Username).Debug("[User.Create]: Inserting user into the database")
 	id, gErr := uc.Insert(u)
@@ -220,11 +248,11 @@ func (u *User) Hash() *errors.Error {
 		return errors.FromCode(errors.ErrorUserInvalidPassword)
 	}
 
-	// encrypt the password using bcrypt
-	p, err := bcrypt.GenerateFromPassword([]byte(u.Password), Config.EncryptionLevel)
+	// encrypt the password using bcrypt on the hash pool
+	p, err := generateHash([]byte(u.Password), Config.EncryptionLevel)
 	if err != nil {
 		Logger.WithError(err).Error("[User.Encrypt]: error during encryption")
-		return errors.FromErr(err)
+		return err
 	}
 
 	// writes the encrypTed password into the user struct
@@ -258,9 +286,11 @@ func (u *User) Save() *errors.Error {
 }
 
 // SaveWithCond updates the user's data on the db with conditions
+// the password and token version are never touched, use ChangePassword for them
+// the phone is only changed by VerifyPhone and RemovePhone
 func (u *User) SaveWithCond(cond db.Cond) *errors.Error {
 	Logger.WithField("cond", cond).Debug("[User.SaveWithCond]: Saving user...")
-	err := uc.Find(cond).Update(u)
+	err := uc.Find(cond).Update(u.columns("id", "password", "token_version", "phone"))
 
 	if err != nil {
 		Logger.WithError(err).Error("[User.SaveWithCond]: Error while saving the user")
@@ -271,6 +301,26 @@ func (u *User) SaveWithCond(cond db.Cond) *errors.Error {
 	return nil
 }
 
+// columns returns the user's db columns and values
+// without the given columns
+func (u *User) columns(exclude ...string) map[string]interface{} {
+	columns := map[string]interface{}{}
+
+	v := reflect.ValueOf(u).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("db"), ",")[0]
+		if name == "" || name == "-" || dry.StringListContains(exclude, name) {
+			continue
+		}
+
+		columns[name] = v.Field(i).Interface()
+	}
+
+	return columns
+}
+
 // IsBanned checks if a ban expired
 // then removes the ban state and save to the database
 func (u *User) IsBanned() (bool, *errors.Error) {
@@ -396,6 +446,23 @@ func (u *User) HardDelete() *errors.Error {
 	err = del(bc, cond) // user bans
 	err = del(ac, cond) // user activation
 	err = del(ec, cond) // user events
+	err = del(lc, cond) // failed logins
+	err = del(tc, cond) // authenticator app
+	err = del(rc, cond) // recovery codes
+	err = del(wc, cond) // passkeys
+	err = del(cc, cond) // passkey ceremonies
+	err = del(mc, cond) // login links
+	err = del(oc, cond) // email codes
+	err = del(sc, cond) // sms codes
+	err = del(dc, cond) // trusted devices
+	err = del(gc, cond) // device codes
+	err = del(kc, cond) // certificate bindings
+	err = del(pc, cond) // access tokens
+	err = del(xc, cond) // external identities
+	err = del(yc, cond) // oidc links in progress
+	err = del(vc, cond) // consents given to oauth clients
+	err = del(zc, cond) // authorization codes
+	err = del(jc, cond) // legacy migration
 
 	return err
 }
@@ -434,6 +501,10 @@ func (u *User) Find() (bool, *errors.Error) {
 	} else if u.Email != "" {
 		Logger.Debug("[User.Find]: found Email, trying FindWithCond(email)")
 		return u.FindWithCond(db.Cond{"email": u.Email})
+
+	} else if u.Phone != "" {
+		Logger.Debug("[User.Find]: found Phone, trying FindWithCond(phone)")
+		return u.FindWithCond(db.Cond{"phone": u.Phone})
 	}
 
 	Logger.Warn("[User.Find]: No info found")
@@ -450,6 +521,11 @@ func (u *User) FindWithCond(cond db.Cond) (bool, *errors.Error) {
 
 	// find user on db and insert into the struct
 	err := uc.Find(cond).One(&user)
+	if err == db.ErrNoMoreRows {
+		l.Debug("[User.FindWithCond]: User not found")
+		return false, errors.FromCode(errors.ErrorUserDoesntExists)
+	}
+
 	if err != nil {
 		l.WithError(err).Error()
 		return false, errors.FromErr(err)
@@ -512,18 +588,22 @@ func (u *User) ComparePassword(password string) *errors.Error {
 		return errors.FromCode(errors.ErrorNoPasswordToCompare)
 	}
 
-	// compare the password
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	// compare the password on the hash pool
+	err := compareHash([]byte(u.Password), []byte(password))
 	if err == nil {
 		l.Debug("[User.ComparePassword]: Passwords are equal")
 	} else {
 		l.Debug("[User.ComparePassword]: Wrong password")
 	}
 
-	return errors.FromErr(err)
+	return err
 }
 
 // Auth authenticates a user and return a jwt token
+// when the user has a second factor it's the first step of the login,
+// u.MFAPending is set and the token is a challenge for AuthMFA
+// when the user's power requires one it doesn't have, u.MFAEnrollmentRequired
+// is set and the token is a challenge for EnrollTOTPWithChallenge
 func (u *User) Auth(password string) (string, *errors.Error) {
 	l := Logger.WithFields(log.Fields{
 		"ID":       u.ID,
@@ -555,62 +635,226 @@ func (u *User) Auth(password string) (string, *errors.Error) {
 		return "", errors.FromCode(errors.ErrorUserInvalid)
 	}
 
+	login := u.Username
+	if login == "" {
+		login = u.Email
+	}
+
 	// tries to find the user with the username or email
 	found, err := u.Find()
-	if err != nil {
+	notFound := err != nil && err.Code == errors.ErrorUserDoesntExists
+	if err != nil && !notFound {
+		l.Debug("[User.Auth]: Error while finding user")
+		return "", err
+	}
+
+	// users of the backends have no local password
+	if !found || u.Password == "" {
+		token, done, bErr := u.authBackends(login, password, found)
+		if done {
+			return token, bErr
+		}
+	}
+
+	// users of the legacy service are moved here on their first login
+	if notFound {
+		token, done, mErr := u.migrateLegacy(login, password)
+		if done {
+			return token, mErr
+		}
+	}
+
+	if notFound && !Config.HideAccountExistence {
 		l.Debug("[User.Auth]: Error while finding user")
 		return "", err
 	}
 
 	if !found {
 		l.Debug("[User.Auth]: User not found")
+
+		// takes as long as a wrong password and gives the same error
+		if Config.HideAccountExistence {
+			return "", dummyCompare(password)
+		}
+
 		return "", errors.FromCode(errors.ErrorUserDoesntExists)
 	}
 
+	// too many failed logins
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		l.Debug("[User.Auth]: User is locked")
+
+		if Config.HideAccountExistence {
+			return "", dummyCompare(password)
+		}
+
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
 	// check if the password given is equal
 	err = u.ComparePassword(password)
 	if err != nil {
+		if err.Code == errors.ErrorTryAgain {
+			return "", err
+		}
+
+		// record the failure and slow down the next ones
+		lo, lErr := u.LoginFailed()
+		if lErr != nil {
+			return "", lErr
+		}
+
+		// missing users can't be slowed down the same way
+		if lo != nil && !Config.HideAccountExistence {
+			time.Sleep(loginDelay(lo.Failures))
+		}
+
+		if Config.HideAccountExistence {
+			return "", errors.FromCode(errors.ErrorUserInvalidPassword)
+		}
+
 		return "", err
 	}
 
-	// obfuscate the user id
-	obfuscatedID, gErr := u.ID.MarshalJSON()
-	if gErr != nil {
-		l.WithError(gErr).Error("[User.Auth]: Can't obfuscate user id")
-		return "", errors.FromErr(gErr)
+	if err = u.LoginSucceeded(); err != nil {
+		return "", err
 	}
 
-	// encrypt the obfuscaTed user id
-	id, err := util.Encrypt(string(obfuscatedID), Config.EncryptionKey)
+	u.AuthMethod = AMRPassword
+	return u.loginToken()
+}
+
+// authentication methods of the amr claim, rfc 8176
+const (
+	// AMRPassword is a password, local or of a backend
+	AMRPassword = "pwd"
+	// AMROneTimePassword is a emailed code or magic link
+	AMROneTimePassword = "otp"
+	// AMRSMS is a texted code
+	AMRSMS = "sms"
+	// AMRHardwareKey is a passkey
+	AMRHardwareKey = "hwk"
+	// AMRFederated is a login done by another identity provider, not in the rfc
+	AMRFederated = "fed"
+	// AMRMultipleFactors is added after a second factor
+	AMRMultipleFactors = "mfa"
+)
+
+// loginToken is given after the first factor, it's a challenge when
+// the user has a second factor or must add one, a session token otherwise
+// u.AuthMethod, one of the AMR constants, goes into its amr
+func (u *User) loginToken() (string, *errors.Error) {
+	l := Logger.WithFields(log.Fields{
+		"ID":       u.ID,
+		"Username": u.Username,
+	})
+
+	// the second step is done by AuthMFA with the challenge
+	mfa, err := u.HasMFA()
 	if err != nil {
 		return "", err
 	}
 
-	// encrypt the user's power
-	power, err := util.Encrypt(strconv.Itoa(u.Power), Config.EncryptionKey)
+	if mfa {
+		l.Debug("[User.loginToken]: Second factor required, challenge created for user")
+		u.MFAPending = true
+		return u.IssueChallenge()
+	}
+
+	// the power of the user needs a second factor it doesn't have yet
+	if u.MFARequired() {
+		l.Debug("[User.loginToken]: Second factor enrollment required, challenge created for user")
+		u.MFAEnrollmentRequired = true
+		return u.IssueEnrollChallenge()
+	}
+
+	// create the jwt token
+	tokenString, err := u.IssueToken()
 	if err != nil {
+		l.WithError(err).Error("[User.loginToken]: Can't create jwt token")
 		return "", err
 	}
 
-	// Create a new token object, specifying signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"id":    id,
-		"power": power,
-		"nbf":   time.Now().Unix(),
-		"exp":   time.Now().Add(Config.TokenExpirationTime).Unix(),
-	})
+	l.Debug("[User.loginToken]: Token created for user")
+	return tokenString, nil
+}
+
+// IssueToken creates a signed jwt with the encrypted id and power
+// of the user and the current token version
+func (u *User) IssueToken() (string, *errors.Error) {
+	return u.issueToken(false)
+}
+
+// IssueMFAToken is the same as IssueToken for a login
+// that was confirmed with a second factor
+func (u *User) IssueMFAToken() (string, *errors.Error) {
+	return u.issueToken(true)
+}
+
+func (u *User) issueToken(mfa bool) (string, *errors.Error) {
+	claims, err := u.tokenClaims(mfa)
+	if err != nil {
+		return "", err
+	}
+
+	// create a new token object, specifying signing method and the claims
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	// sign and get the complete encoded token as a string using the secret
 	tokenString, gErr := token.SignedString(Config.TokenSecret)
 	if gErr != nil {
-		l.WithError(gErr).Error("[User.Auth]: Can't sign jwt token")
 		return "", errors.FromErr(gErr)
 	}
 
-	l.Debug("[User.Auth]: Token created for user")
 	return tokenString, nil
 }
 
+// tokenClaims creates the claims of a session of the user
+func (u *User) tokenClaims(mfa bool) (*UserToken, *errors.Error) {
+	// encrypt the user id
+	id, err := util.Encrypt(util.HideToString(u.ID), Config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt the user's power
+	power, err := util.Encrypt(strconv.Itoa(u.Power), Config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// authentication methods, rfc 8176
+	var amr []string
+	if u.AuthMethod != "" {
+		amr = append(amr, u.AuthMethod)
+	}
+
+	if mfa {
+		amr = append(amr, AMRMultipleFactors)
+	}
+
+	now := time.Now()
+	return &UserToken{
+		UID:     id,
+		Power:   power,
+		Version: u.TokenVersion,
+		MFA:     mfa,
+		AMR:     amr,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.Add(Config.TokenExpirationTime).Unix(),
+			Id:        id,
+			IssuedAt:  now.Unix(),
+			Issuer:    issuer,
+			NotBefore: now.Unix(),
+		},
+	}, nil
+}
+
 // SetIDFromString parses a user id from a string and insert it
 // into the user
 func (u *User) SetIDFromString(id string) *errors.Error {
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 
+	authErrors "github.com/UnnoTed/authenticaTed/errors"
 	"github.com/UnnoTed/authenticaTed/util"
 
 	"github.com/c2h5oh/hide"
@@ -20,69 +21,147 @@ const (
 
 // UserToken holds a user id inside a jwt
 type UserToken struct {
-	UID   string `json:"id,string"`
-	Power string `json:"power"`
+	UID     string `json:"id,string"`
+	Power   string `json:"power"`
+	Version int    `json:"ver"`
+	MFA     bool   `json:"mfa,omitempty"`
+
+	// how the user logged in, rfc 8176
+	AMR []string `json:"amr,omitempty"`
+
+	// tokens given to oauth clients
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// the admin impersonating the user, rfc 8693
+	Act *Actor `json:"act,omitempty"`
 	jwt.StandardClaims
 }
 
-// CreateToken creates a jwt token with a ID
-func CreateToken(hID interface{}, power string, encrypt bool) (string, error) {
-	var id string
+// WillTokenExpire checks if a token will expire
+// the current range is 5-30 minutes
+func WillTokenExpire(expAt int64) bool {
+	exp := time.Unix(expAt, 0)
+	almostNow := time.Now().Add(5 * time.Minute)
+	later := time.Now().Add(30 * time.Minute)
+
+	// after 5min and before 30min
+	return exp.After(almostNow) && exp.Before(later)
+}
+
+// context key of the parsed bearer of the request
+const parsedBearerKey = "parsed_bearer"
 
-	switch hID.(type) {
-	case hide.Int64:
-		id = strconv.FormatInt(int64(hID.(hide.Int64)), 10)
-	case string:
-		id = hID.(string)
-	case int64:
-		id = strconv.FormatInt(hID.(int64), 10)
+// parsedBearer is the result of parsing the bearer
+type parsedBearer struct {
+	token *jwt.Token
+	err   error
+}
+
+// parseBearer parses the jwt once per request, tokens of trusted issuers
+// provision their users when parsed, LoadServiceToken and LoadToken share it
+func parseBearer(c echo.Context, bearer string) (*jwt.Token, error) {
+	if p, ok := c.Get(parsedBearerKey).(*parsedBearer); ok {
+		return p.token, p.err
 	}
 
-	var (
-		encryptedID = id
-		err         error
-	)
+	config := DefaultJWTConfig
+	config.SigningKey = Config.TokenSecret
 
-	if encrypt {
-		// encrypt the user's ID
-		encryptedID, err = util.Encrypt(id, Config.EncryptionKey)
-		if err != nil {
-			return "", err
-		}
+	token, err := JWTParse(bearer, config)
+	c.Set(parsedBearerKey, &parsedBearer{token: token, err: err})
+	return token, err
+}
+
+// LoadToken parses the jwt from the authorization header
+// and stores it in the context for GetID and GetPower
+// it does nothing when there is a token in the context already
+func LoadToken(c echo.Context) error {
+	if c.Get(middleware.DefaultJWTConfig.ContextKey) != nil {
+		return nil
+	}
+
+	auth, err := jwtFromHeader(echo.HeaderAuthorization)(c)
+	if err != nil {
+		return err
 	}
 
-	// create a new token object, specifying signing method and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		&UserToken{
-			encryptedID,
-			power,
-			jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(Config.TokenExpirationTime).Unix(),
-				Id:        encryptedID,
-				IssuedAt:  time.Now().Unix(),
-				Issuer:    issuer,
-				NotBefore: time.Now().Unix(),
-			},
-		})
-
-	// sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString(Config.TokenSecret)
+	token, err := parseBearer(c, auth)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if !token.Valid {
+		return errors.New("Invalid token")
 	}
 
-	return tokenString, err
+	// challenges from the first login step aren't sessions
+	if token.Claims.(*UserToken).Audience != "" {
+		return errors.New("Invalid token audience")
+	}
+
+	c.Set(DefaultJWTConfig.ContextKey, token)
+	return nil
 }
 
-// WillTokenExpire checks if a token will expire
-// the current range is 5-30 minutes
-func WillTokenExpire(expAt int64) bool {
-	exp := time.Unix(expAt, 0)
-	almostNow := time.Now().Add(5 * time.Minute)
-	later := time.Now().Add(30 * time.Minute)
+// CheckTokenVersion compares the version inside the token with the user's
+// tokens issued before a password change are refused
+func CheckTokenVersion(c echo.Context) error {
+	usr, ok := c.Get(middleware.DefaultJWTConfig.ContextKey).(*jwt.Token)
+	if !ok {
+		return errors.New("There is no token")
+	}
 
-	// after 5min and before 30min
-	return exp.After(almostNow) && exp.Before(later)
+	claims, ok := usr.Claims.(*UserToken)
+	if !ok {
+		return errors.New("Not able to find token")
+	}
+
+	id, err := GetID(c)
+	if err != nil {
+		return err
+	}
+
+	u := NewUser()
+	u.ID = id
+
+	found, fErr := u.Find()
+	if fErr != nil {
+		return fErr
+	}
+
+	if !found || claims.Version != u.TokenVersion {
+		return authErrors.FromCode(authErrors.ErrorTokenRevoked)
+	}
+
+	return nil
+}
+
+// HasMFAClaim checks if the token in the context
+// was issued after a second factor
+func HasMFAClaim(c echo.Context) bool {
+	usr, ok := c.Get(middleware.DefaultJWTConfig.ContextKey).(*jwt.Token)
+	if !ok {
+		return false
+	}
+
+	claims, ok := usr.Claims.(*UserToken)
+	return ok && claims.MFA
+}
+
+// GetAMR gets the authentication methods of the token in the context
+func GetAMR(c echo.Context) []string {
+	usr, ok := c.Get(middleware.DefaultJWTConfig.ContextKey).(*jwt.Token)
+	if !ok {
+		return nil
+	}
+
+	claims, ok := usr.Claims.(*UserToken)
+	if !ok {
+		return nil
+	}
+
+	return claims.AMR
 }
 
 // GetPower gets the user's power from the jwt and decrypts it
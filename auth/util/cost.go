@@ -0,0 +1,54 @@
+package util
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinimumCost is the lowest bcrypt cost chosen by Calibrate
+// it is used even when it takes longer than the target
+const MinimumCost = 14
+
+var costPassword = []byte("123456")
+
+// MeasureCost returns how long a single bcrypt hash
+// takes on this machine with the given cost
+func MeasureCost(cost int) (time.Duration, error) {
+	start := time.Now()
+
+	_, err := bcrypt.GenerateFromPassword(costPassword, cost)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+// Calibrate finds the highest bcrypt cost that hashes
+// faster than the target, every extra round doubles the time
+func Calibrate(target time.Duration) (int, time.Duration, error) {
+	cost := MinimumCost
+
+	took, err := MeasureCost(cost)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for cost < bcrypt.MaxCost {
+		next, err := MeasureCost(cost + 1)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// the next round is too slow
+		if next >= target {
+			break
+		}
+
+		cost++
+		took = next
+	}
+
+	return cost, took, nil
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+)
+
+// RandomBytes reads n bytes from crypto/rand
+// use it for anything that protects an account
+func RandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// RandomToken returns a url safe string with n random bytes
+func RandomToken(n int) (string, error) {
+	b, err := RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// RandomDigits returns a numeric code with n digits
+// leading zeros are kept
+func RandomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		d, err := crand.Int(crand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+
+		b[i] = byte('0' + d.Int64())
+	}
+
+	return string(b), nil
+}
+
+// HashToken returns the sha256 of a random token in hex
+// tokens are stored this way, bcrypt isn't needed for random data
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
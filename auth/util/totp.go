@@ -0,0 +1,98 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP settings from RFC 6238 that authenticator apps expect
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret with 160 bits
+func NewTOTPSecret() (string, error) {
+	b, err := RandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+
+	return b32.EncodeToString(b), nil
+}
+
+// TOTPCounter returns the time step of t
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// HOTP returns the code of a counter as in RFC 4226
+func HOTP(secret string, counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	bin := (uint32(sum[offset])&0x7f)<<24 |
+		uint32(sum[offset+1])<<16 |
+		uint32(sum[offset+2])<<8 |
+		uint32(sum[offset+3])
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, bin%mod), nil
+}
+
+// ValidateTOTP checks the code against the time steps around t
+// it returns the matched counter so the code can't be used again
+func ValidateTOTP(secret, code string, t time.Time, skew int64) (int64, bool, error) {
+	now := TOTPCounter(t)
+
+	for i := -skew; i <= skew; i++ {
+		c, err := HOTP(secret, now+i)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return now + i, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// TOTPURI builds the otpauth uri that authenticator apps read from a qr code
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(TOTPDigits))
+	v.Set("period", strconv.Itoa(TOTPPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// "12345678901234567890" from the RFC 6238 test vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, code := range vectors {
+		c, err := HOTP(rfcSecret, TOTPCounter(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, code, c)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	now := time.Now()
+	code, err := HOTP(secret, TOTPCounter(now.Add(-TOTPPeriod*time.Second)))
+	assert.NoError(t, err)
+
+	// ok: one step behind
+	counter, ok, err := ValidateTOTP(secret, code, now, 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, TOTPCounter(now)-1, counter)
+
+	// expect error: out of the window
+	_, ok, err = ValidateTOTP(secret, code, now, 0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("authenticaTed", "gopher", rfcSecret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/authenticaTed:gopher?"))
+	assert.Contains(t, uri, "secret="+rfcSecret)
+	assert.Contains(t, uri, "issuer=authenticaTed")
+}
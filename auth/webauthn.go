@@ -0,0 +1,470 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/c2h5oh/hide"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"upper.io/db.v2"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+	. "github.com/UnnoTed/authenticaTed/logger"
+	"github.com/UnnoTed/authenticaTed/util"
+)
+
+// WebAuthnCredential is a passkey or security key of a user
+type WebAuthnCredential struct {
+	ID     int64      `db:"id,omitempty"    json:"-"`
+	UserID hide.Int64 `db:"user_id"         json:"user_id,string"`
+	Name   string     `db:"name"            json:"name"`
+
+	// base64url of the raw id given by the authenticator
+	CredentialID string `db:"credential_id"   json:"credential_id"`
+	PublicKey    []byte `db:"public_key"      json:"-"`
+
+	// the authenticator increments it on every login
+	// a smaller one means the credential was cloned
+	SignCount  int64  `db:"sign_count"      json:"sign_count"`
+	Transports string `db:"transports"      json:"transports"`
+
+	// synced passkeys are backup eligible
+	BackupEligible bool `db:"backup_eligible" json:"backup_eligible"`
+	BackupState    bool `db:"backup_state"    json:"backup_state"`
+
+	Created  time.Time  `db:"created"         json:"created"`
+	LastUsed *time.Time `db:"last_used"       json:"last_used"`
+}
+
+// WebAuthnSession holds the challenge of a ceremony
+// until the browser answers, it only works once
+type WebAuthnSession struct {
+	ID      int64      `db:"id,omitempty"`
+	Token   string     `db:"token"`
+	UserID  hide.Int64 `db:"user_id"`
+	Data    string     `db:"data"`
+	Expires time.Time  `db:"expires"`
+}
+
+// only one request can finish a ceremony
+const sqlUseWebAuthnSession = `DELETE FROM ` + TableWebAuthnSession + ` WHERE id = ?`
+
+// webAuthnUser is the user as seen by the webauthn library
+type webAuthnUser struct {
+	*User
+	credentials []webauthn.Credential
+}
+
+// WebAuthnID is the user handle stored in passkeys
+// the hidden id is used so the real one isn't exposed
+func (w *webAuthnUser) WebAuthnID() []byte {
+	return []byte(util.HideToString(w.ID))
+}
+
+func (w *webAuthnUser) WebAuthnName() string {
+	return w.Username
+}
+
+func (w *webAuthnUser) WebAuthnDisplayName() string {
+	return w.Username
+}
+
+func (w *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (w *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return w.credentials
+}
+
+// credential converts it to the type used by the webauthn library
+func (c *WebAuthnCredential) credential() (webauthn.Credential, error) {
+	id, err := base64.RawURLEncoding.DecodeString(c.CredentialID)
+	if err != nil {
+		return webauthn.Credential{}, err
+	}
+
+	var transports []protocol.AuthenticatorTransport
+	for _, t := range strings.Split(c.Transports, ",") {
+		if t != "" {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+	}
+
+	return webauthn.Credential{
+		ID:        id,
+		PublicKey: c.PublicKey,
+		Transport: transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			SignCount: uint32(c.SignCount),
+		},
+	}, nil
+}
+
+// newWebAuthn creates the relying party from the config
+func newWebAuthn() (*webauthn.WebAuthn, *errors.Error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          Config.WebAuthnRPID,
+		RPDisplayName: Config.WebAuthnRPName,
+		RPOrigins:     Config.WebAuthnOrigins,
+	})
+	if err != nil {
+		Logger.WithError(err).Error("[WebAuthn]: Invalid config")
+		return nil, errors.FromErr(err)
+	}
+
+	return w, nil
+}
+
+// webAuthnUser loads the credentials of the user for the webauthn library
+func (u *User) webAuthnUser() (*webAuthnUser, *errors.Error) {
+	list, err := u.WebAuthnCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &webAuthnUser{User: u}
+	for _, c := range list {
+		cred, gErr := c.credential()
+		if gErr != nil {
+			return nil, errors.FromErr(gErr)
+		}
+
+		w.credentials = append(w.credentials, cred)
+	}
+
+	return w, nil
+}
+
+// saveWebAuthnSession stores the ceremony and returns
+// the token the browser sends back with its answer
+// the expired ones are removed on the way
+func saveWebAuthnSession(userID hide.Int64, data *webauthn.SessionData) (string, *errors.Error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.FromErr(err)
+	}
+
+	token, err := util.RandomToken(32)
+	if err != nil {
+		return "", errors.FromErr(err)
+	}
+
+	// ceremonies the browser never finished
+	if err = cc.Find(db.Cond{"expires <": time.Now()}).Delete(); err != nil {
+		Logger.WithError(err).Error("[WebAuthn]: Error while removing the expired sessions")
+	}
+
+	_, err = cc.Insert(&WebAuthnSession{
+		Token:   util.HashToken(token),
+		UserID:  userID,
+		Data:    string(b),
+		Expires: time.Now().Add(Config.WebAuthnTimeout),
+	})
+	if err != nil {
+		Logger.WithError(err).Error("[WebAuthn]: Error while inserting the session")
+		return "", errors.FromErr(err)
+	}
+
+	return token, nil
+}
+
+// takeWebAuthnSession finds and removes the ceremony of the token
+func takeWebAuthnSession(token string, userID hide.Int64) (*webauthn.SessionData, *errors.Error) {
+	var s *WebAuthnSession
+
+	err := cc.Find(db.Cond{"token": util.HashToken(token), "user_id": userID}).One(&s)
+	if err == db.ErrNoMoreRows {
+		return nil, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	// single use
+	res, err := session.Exec(sqlUseWebAuthnSession, s.ID)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	if time.Now().After(s.Expires) {
+		return nil, errors.FromCode(errors.ErrorInvalidChallenge)
+	}
+
+	data := new(webauthn.SessionData)
+	if err = json.Unmarshal([]byte(s.Data), data); err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return data, nil
+}
+
+// WebAuthnCredentials lists the passkeys of the user
+func (u *User) WebAuthnCredentials() ([]*WebAuthnCredential, *errors.Error) {
+	var list []*WebAuthnCredential
+
+	err := wc.Find(db.Cond{"user_id": u.ID}).OrderBy("id").All(&list)
+	if err != nil {
+		return nil, errors.FromErr(err)
+	}
+
+	return list, nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of the user
+func (u *User) DeleteWebAuthnCredential(credentialID string) *errors.Error {
+	r := wc.Find(db.Cond{"user_id": u.ID, "credential_id": credentialID})
+
+	exists, err := r.Count()
+	if err != nil {
+		return errors.FromErr(err)
+	}
+
+	if exists == 0 {
+		return errors.FromCode(errors.ErrorCredentialNotFound)
+	}
+
+	if err = r.Delete(); err != nil {
+		return errors.FromErr(err)
+	}
+
+	Logger.WithField("ID", u.ID).Debug("[User.DeleteWebAuthnCredential]: Passkey removed")
+	return nil
+}
+
+// BeginWebAuthnRegistration starts adding a passkey
+// it returns the options for navigator.credentials.create
+// and the session token for FinishWebAuthnRegistration
+func (u *User) BeginWebAuthnRegistration() (*protocol.CredentialCreation, string, *errors.Error) {
+	if u.ID == 0 {
+		return nil, "", errors.FromCode(errors.ErrorNotEnoughInfo)
+	}
+
+	w, err := newWebAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	wu, err := u.webAuthnUser()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// discoverable so it can log in without a username
+	// and the same authenticator can't be added twice
+	var exclude []protocol.CredentialDescriptor
+	for _, c := range wu.credentials {
+		exclude = append(exclude, c.Descriptor())
+	}
+
+	options, data, gErr := w.BeginRegistration(wu,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclude),
+	)
+	if gErr != nil {
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	token, err := saveWebAuthnSession(u.ID, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, token, nil
+}
+
+// FinishWebAuthnRegistration checks the answer of the authenticator
+// and stores the new passkey, body is the json of the PublicKeyCredential
+func (u *User) FinishWebAuthnRegistration(session, name string, body io.Reader) (*WebAuthnCredential, *errors.Error) {
+	l := Logger.WithField("ID", u.ID)
+
+	data, err := takeWebAuthnSession(session, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newWebAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	wu, err := u.webAuthnUser()
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, gErr := protocol.ParseCredentialCreationResponseBody(body)
+	if gErr != nil {
+		l.WithError(gErr).Debug("[User.FinishWebAuthnRegistration]: Invalid response")
+		return nil, errors.FromCode(errors.ErrorWebAuthnFailed)
+	}
+
+	cred, gErr := w.CreateCredential(wu, *data, parsed)
+	if gErr != nil {
+		l.WithError(gErr).Debug("[User.FinishWebAuthnRegistration]: Verification failed")
+		return nil, errors.FromCode(errors.ErrorWebAuthnFailed)
+	}
+
+	var transports []string
+	for _, t := range cred.Transport {
+		transports = append(transports, string(t))
+	}
+
+	c := &WebAuthnCredential{
+		UserID:         u.ID,
+		Name:           name,
+		CredentialID:   base64.RawURLEncoding.EncodeToString(cred.ID),
+		PublicKey:      cred.PublicKey,
+		SignCount:      int64(cred.Authenticator.SignCount),
+		Transports:     strings.Join(transports, ","),
+		BackupEligible: cred.Flags.BackupEligible,
+		BackupState:    cred.Flags.BackupState,
+		Created:        time.Now(),
+	}
+
+	id, gErr := wc.Insert(c)
+	if gErr != nil {
+		l.WithError(gErr).Error("[User.FinishWebAuthnRegistration]: Error while inserting")
+		return nil, errors.FromErr(gErr)
+	}
+
+	c.ID = id.(int64)
+
+	l.Debug("[User.FinishWebAuthnRegistration]: Passkey added")
+	return c, nil
+}
+
+// BeginWebAuthnLogin starts a passkey login without a username
+// it returns the options for navigator.credentials.get
+// and the session token for FinishWebAuthnLogin
+func BeginWebAuthnLogin() (*protocol.CredentialAssertion, string, *errors.Error) {
+	w, err := newWebAuthn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	options, data, gErr := w.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if gErr != nil {
+		return nil, "", errors.FromErr(gErr)
+	}
+
+	token, err := saveWebAuthnSession(0, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, token, nil
+}
+
+// FinishWebAuthnLogin checks the answer of the authenticator, finds
+// the user of the passkey and returns its token, body is the json
+// of the PublicKeyCredential. the passkey verifies the user so
+// the token counts as a second factor
+func (u *User) FinishWebAuthnLogin(session string, body io.Reader) (string, *errors.Error) {
+	l := Logger.WithField("step", "webauthn")
+	l.Debug("[User.FinishWebAuthnLogin]: Authenticating user...")
+
+	data, err := takeWebAuthnSession(session, 0)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := newWebAuthn()
+	if err != nil {
+		return "", err
+	}
+
+	parsed, gErr := protocol.ParseCredentialRequestResponseBody(body)
+	if gErr != nil {
+		l.WithError(gErr).Debug("[User.FinishWebAuthnLogin]: Invalid response")
+		return "", errors.FromCode(errors.ErrorWebAuthnFailed)
+	}
+
+	var stored *WebAuthnCredential
+
+	// finds the passkey and checks it belongs to the user handle
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		err := wc.Find(db.Cond{
+			"credential_id": base64.RawURLEncoding.EncodeToString(rawID),
+		}).One(&stored)
+		if err != nil {
+			return nil, err
+		}
+
+		if util.HideToString(stored.UserID) != string(userHandle) {
+			return nil, errors.FromCode(errors.ErrorCredentialNotFound)
+		}
+
+		*u = User{ID: stored.UserID}
+		found, fErr := u.Find()
+		if fErr != nil {
+			return nil, fErr
+		}
+
+		if !found {
+			return nil, errors.FromCode(errors.ErrorUserDoesntExists)
+		}
+
+		wu, fErr := u.webAuthnUser()
+		if fErr != nil {
+			return nil, fErr
+		}
+
+		return wu, nil
+	}
+
+	cred, gErr := w.ValidateDiscoverableLogin(handler, *data, parsed)
+	if gErr != nil {
+		l.WithError(gErr).Debug("[User.FinishWebAuthnLogin]: Verification failed")
+		return "", errors.FromCode(errors.ErrorWebAuthnFailed)
+	}
+
+	l = l.WithFields(log.Fields{
+		"ID":       u.ID,
+		"Username": u.Username,
+	})
+
+	if cred.Authenticator.CloneWarning {
+		l.Warn("[User.FinishWebAuthnLogin]: Sign count went back, the passkey may be cloned")
+		return "", errors.FromCode(errors.ErrorWebAuthnFailed)
+	}
+
+	locked, err := u.IsLocked()
+	if err != nil {
+		return "", err
+	}
+
+	if locked {
+		return "", errors.FromCode(errors.ErrorAccountLocked)
+	}
+
+	now := time.Now()
+	gErr = wc.Find(db.Cond{"id": stored.ID}).Update(map[string]interface{}{
+		"sign_count":   int64(cred.Authenticator.SignCount),
+		"backup_state": cred.Flags.BackupState,
+		"last_used":    now,
+	})
+	if gErr != nil {
+		return "", errors.FromErr(gErr)
+	}
+
+	l.WithField("credential", stored.ID).Debug("[User.FinishWebAuthnLogin]: Token created for user")
+	u.AuthMethod = AMRHardwareKey
+	return u.IssueMFAToken()
+}
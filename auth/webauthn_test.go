@@ -0,0 +1,213 @@
+package users
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+
+	"github.com/UnnoTed/authenticaTed/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// softAuthenticator is a passkey in memory, it answers
+// the ceremonies like a browser with a platform authenticator
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	count      uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	assert.NoError(t, err)
+
+	return &softAuthenticator{key: key, id: id}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// clientData is the json the browser signs
+func (a *softAuthenticator) clientData(typ string, challenge protocol.URLEncodedBase64) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":      typ,
+		"challenge": challenge.String(),
+		"origin":    Config.WebAuthnOrigins[0],
+	})
+
+	return b
+}
+
+// authData is rp id hash, flags and the sign count
+// followed by the credential when attested is set
+func (a *softAuthenticator) authData(t *testing.T, attested bool) []byte {
+	rp := sha256.Sum256([]byte(Config.WebAuthnRPID))
+	a.count++
+
+	// user present and verified
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+
+	buf := bytes.NewBuffer(rp[:])
+	buf.WriteByte(flags)
+	binary.Write(buf, binary.BigEndian, a.count)
+
+	if attested {
+		// cose ec2 p-256 key
+		key, err := cbor.Marshal(map[int]interface{}{
+			1:  2,
+			3:  -7,
+			-1: 1,
+			-2: a.key.X.FillBytes(make([]byte, 32)),
+			-3: a.key.Y.FillBytes(make([]byte, 32)),
+		})
+		assert.NoError(t, err)
+
+		buf.Write(make([]byte, 16)) // aaguid
+		binary.Write(buf, binary.BigEndian, uint16(len(a.id)))
+		buf.Write(a.id)
+		buf.Write(key)
+	}
+
+	return buf.Bytes()
+}
+
+// create answers navigator.credentials.create
+func (a *softAuthenticator) create(t *testing.T, options *protocol.CredentialCreation, userHandle []byte) *bytes.Reader {
+	a.userHandle = userHandle
+
+	object, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(t, true),
+	})
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", options.Response.Challenge)),
+			"attestationObject": b64(object),
+			"transports":        []string{"internal"},
+		},
+	})
+	assert.NoError(t, err)
+
+	return bytes.NewReader(b)
+}
+
+// get answers navigator.credentials.get
+func (a *softAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion) *bytes.Reader {
+	data := a.authData(t, false)
+	client := a.clientData("webauthn.get", options.Response.Challenge)
+
+	hash := sha256.Sum256(client)
+	signed := sha256.Sum256(append(append([]byte{}, data...), hash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(client),
+			"authenticatorData": b64(data),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	assert.NoError(t, err)
+
+	return bytes.NewReader(b)
+}
+
+func TestWebAuthn(t *testing.T) {
+	u := NewUser()
+	u.Username = "Passkey_User"
+	u.Email = "passkey_user@mail.com"
+	u.Password = "password"
+	_, err := u.Create()
+	assert.Nil(t, err)
+
+	a := newSoftAuthenticator(t)
+	wu := &webAuthnUser{User: u}
+
+	// registration
+	options, session, err := u.BeginWebAuthnRegistration()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, session)
+
+	cred, err := u.FinishWebAuthnRegistration(session, "laptop", a.create(t, options, wu.WebAuthnID()))
+	assert.Nil(t, err)
+	assert.Equal(t, b64(a.id), cred.CredentialID)
+	assert.Equal(t, "internal", cred.Transports)
+
+	// expect error: a session only works once
+	_, err = u.FinishWebAuthnRegistration(session, "laptop", a.create(t, options, wu.WebAuthnID()))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorInvalidChallenge, err.Code)
+
+	list, err := u.WebAuthnCredentials()
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	// discoverable login
+	login, session, err := BeginWebAuthnLogin()
+	assert.Nil(t, err)
+
+	fu := NewUser()
+	token, err := fu.FinishWebAuthnLogin(session, a.get(t, login))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, u.ID, fu.ID)
+
+	// expect error: a cloned passkey has an older sign count
+	login, session, err = BeginWebAuthnLogin()
+	assert.Nil(t, err)
+
+	a.count = 0
+	_, err = NewUser().FinishWebAuthnLogin(session, a.get(t, login))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorWebAuthnFailed, err.Code)
+
+	// expect error: signed by another key
+	login, session, err = BeginWebAuthnLogin()
+	assert.Nil(t, err)
+
+	other := newSoftAuthenticator(t)
+	other.id, other.userHandle, other.count = a.id, a.userHandle, 100
+	_, err = NewUser().FinishWebAuthnLogin(session, other.get(t, login))
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorWebAuthnFailed, err.Code)
+
+	// ok
+	assert.Nil(t, u.DeleteWebAuthnCredential(cred.CredentialID))
+
+	// expect error: already removed
+	err = u.DeleteWebAuthnCredential(cred.CredentialID)
+	assert.NotNil(t, err)
+	assert.Equal(t, errors.ErrorCredentialNotFound, err.Code)
+
+	assert.Nil(t, u.HardDelete())
+}
@@ -0,0 +1,75 @@
+package generator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/UnnoTed/authenticaTed/auth/util"
+)
+
+// DefaultHashTime is how long a single bcrypt hash should take
+const DefaultHashTime = 3 * time.Second
+
+const calibrationFile = `package {{.Package}}
+
+// the bcrypt cost measured by "authenticaTed calibrate"
+// run it again when the server hardware changes
+func init() {
+	Config.EncryptionLevel = {{.EncryptionLevel}}{{if .HashTargetTime}}
+	Config.HashTargetTime = {{printf "%d" .HashTargetTime}} // {{.HashTargetTime}}{{end}}
+}
+`
+
+// Calibrate measures the bcrypt cost for the current hardware
+// and writes it into the config file with the target
+// so the check on boot compares against the same time
+func Calibrate(target time.Duration) error {
+	c, err := NewConfig()
+	if err != nil {
+		return err
+	}
+
+	if target <= 0 {
+		target = DefaultHashTime
+	}
+
+	log.Println("Measuring bcrypt, target:", target)
+	cost, took, err := util.Calibrate(target)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Cost chosen is %d, a hash takes %v", cost, took)
+	if err = c.SetValue("encryption_level", strconv.Itoa(cost)); err != nil {
+		return err
+	}
+
+	return c.SetValue("hash_target", strconv.Quote(target.String()))
+}
+
+// InsertCalibration writes the calibrated bcrypt cost
+// into the generated package, nothing is written without one
+func InsertCalibration(path string, i Information) error {
+	if i.EncryptionLevel <= 0 {
+		log.Println(`Warning: no bcrypt cost found, run "authenticaTed calibrate"`)
+		return nil
+	}
+
+	tmpl, err := template.New("calibration.go").Parse(calibrationFile)
+	if err != nil {
+		return err
+	}
+
+	buff := bytes.NewBufferString("// generated by authenticaTed " + version + " at " + time.Now().String() + "\n\n")
+	err = tmpl.Execute(buff, i)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(path, "calibration.go"), buff.Bytes(), 0644)
+}
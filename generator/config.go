@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strings"
 
 	"github.com/ungerik/go-dry"
 	"gopkg.in/yaml.v1"
@@ -24,6 +25,14 @@ type Config struct {
 
 	Logging bool
 	Fmt     bool
+
+	// bcrypt cost written by "authenticaTed calibrate"
+	EncryptionLevel int `yaml:"encryption_level"`
+	// how long a hash took when it was calibrated, e.g. "3s"
+	HashTarget string `yaml:"hash_target"`
+
+	// social login providers by name
+	OIDC map[string]*OIDCConfig `yaml:"oidc"`
 }
 
 // NewConfig creates and load a new config
@@ -77,3 +86,41 @@ func (c *Config) Load() error {
 
 	return nil
 }
+
+// SetValue replaces a top level key in the config file
+// keeping the comments, it appends the key when missing
+func (c *Config) SetValue(key, value string) error {
+	filePath, found := c.Find()
+	if !found {
+		return errors.New("Error: authenticaTed config file not found.")
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	line := key + ": " + value
+	lines := strings.Split(string(data), "\n")
+	replaced := false
+
+	for i, l := range lines {
+		if strings.HasPrefix(l, key+":") {
+			lines[i] = line
+			replaced = true
+			break
+		}
+	}
+
+	if !replaced {
+		// keep the trailing new line at the end
+		if len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines[len(lines)-1] = line
+			lines = append(lines, "")
+		} else {
+			lines = append(lines, line)
+		}
+	}
+
+	return ioutil.WriteFile(filePath, []byte(strings.Join(lines, "\n")), 0644)
+}
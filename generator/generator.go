@@ -32,6 +32,9 @@ type Information struct {
 	DestinationPackage string
 	Logging            bool
 	Debug              bool
+	EncryptionLevel    int
+	HashTargetTime     time.Duration
+	OIDC               map[string]*OIDCConfig
 
 	Fields []*Field
 }
@@ -114,6 +117,14 @@ func Generate(list *Skeleton) error {
 		return err
 	}
 
+	// the target the cost was calibrated for
+	var target time.Duration
+	if c.HashTarget != "" {
+		if target, err = time.ParseDuration(c.HashTarget); err != nil {
+			return err
+		}
+	}
+
 	// get info to inject into the go templates
 	i := Information{
 		Activation: false,
@@ -123,6 +134,10 @@ func Generate(list *Skeleton) error {
 		Primes:     primes,
 		Logging:    c.Logging,
 		Debug:      c.Debug,
+
+		EncryptionLevel: c.EncryptionLevel,
+		HashTargetTime:  target,
+		OIDC:            c.OIDC,
 		// SecretPackage: "github.com/UnnoTed/secret",
 	}
 
@@ -240,6 +255,16 @@ func Generate(list *Skeleton) error {
 		return err
 	}
 
+	// bcrypt cost from "authenticaTed calibrate"
+	if err = InsertCalibration(wd, i); err != nil {
+		return err
+	}
+
+	// social login providers
+	if err = InsertOIDC(wd, i); err != nil {
+		return err
+	}
+
 	return nil
 }
 
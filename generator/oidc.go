@@ -0,0 +1,59 @@
+package generator
+
+import (
+	"bytes"
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// OIDCConfig is a openid connect provider in the config file
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+const oidcFile = `package {{.Package}}
+
+// the openid connect providers of the config file
+func init() {
+{{range $name, $p := .OIDC}}	Config.OIDCProviders[{{printf "%q" $name}}] = &OIDCProvider{
+		Issuer:       {{printf "%q" $p.Issuer}},
+		ClientID:     {{printf "%q" $p.ClientID}},
+		ClientSecret: {{printf "%q" $p.ClientSecret}},
+		RedirectURL:  {{printf "%q" $p.RedirectURL}},
+		Scopes:       {{printf "%#v" $p.Scopes}},
+	}
+{{end}}}
+`
+
+// InsertOIDC writes the openid connect providers
+// into the generated package, nothing is written without one
+func InsertOIDC(path string, i Information) error {
+	if len(i.OIDC) == 0 {
+		return nil
+	}
+
+	tmpl, err := template.New("oidc.go").Parse(oidcFile)
+	if err != nil {
+		return err
+	}
+
+	buff := bytes.NewBufferString("// generated by authenticaTed " + version + " at " + time.Now().String() + "\n\n")
+	err = tmpl.Execute(buff, i)
+	if err != nil {
+		return err
+	}
+
+	src, err := format.Source(buff.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(path, "oidc.go"), src, 0644)
+}
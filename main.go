@@ -22,5 +22,28 @@ func main() {
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "calibrate",
+			Usage: "measures bcrypt on this machine and writes the cost into the config",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "target",
+					Value: generator.DefaultHashTime,
+					Usage: "how long a single hash should take",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				log.Println("Calibrating...")
+				err := generator.Calibrate(c.Duration("target"))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				return nil
+			},
+		},
+	}
+
 	app.Run(os.Args)
 }